@@ -7,21 +7,47 @@ import (
 	"io"
 )
 
+// readAnythingButSpecial parses an anything-but object in a Pattern. The value can be a string or number, an
+// array of them, or an object containing one of the prefix, suffix, equals-ignore-case, or wildcard patterns,
+// in which case the pattern matches any value that the contained pattern doesn't.
 func readAnythingButSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
 	t, err := pb.jd.Token()
 	if err != nil {
 		return
 	}
 	pathVals = valsIn
-	fieldCount := 0
-	delim, ok := t.(json.Delim)
-	if (!ok) || delim != '[' {
-		err = errors.New("value for anything-but must be an array")
+	val := typedVal{vType: anythingButType}
+	switch tt := t.(type) {
+	case string:
+		val.list = append(val.list, []byte(`"`+tt+`"`))
+	case json.Number:
+		val.list = appendAnythingButNumber(val.list, tt)
+	case json.Delim:
+		switch tt {
+		case '[':
+			val.list, err = readAnythingButList(pb)
+		case '{':
+			val.negated, err = readAnythingButPattern(pb)
+		default:
+			err = fmt.Errorf("spurious %c in anything-but", tt)
+		}
+	default:
+		err = errors.New("value for anything-but must be a string, number, array, or object")
+	}
+	if err != nil {
 		return
 	}
-	done := false
-	val := typedVal{vType: anythingButType}
-	for !done {
+	pathVals = append(pathVals, val)
+
+	// this has to be a '}' or you're going to get an err from the tokenizer, so no point looking at the value
+	_, err = pb.jd.Token()
+	return
+}
+
+// readAnythingButList reads the strings and numbers in an anything-but array, the '[' having been consumed
+func readAnythingButList(pb *patternBuild) (list [][]byte, err error) {
+	for {
+		var t json.Token
 		t, err = pb.jd.Token()
 		if errors.Is(err, io.EOF) {
 			err = errors.New("anything-but list truncated")
@@ -31,31 +57,64 @@ func readAnythingButSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typ
 		}
 		switch tt := t.(type) {
 		case json.Delim:
-			if tt == ']' {
-				done = true
-			} else {
+			if tt != ']' {
 				err = fmt.Errorf("spurious %c in anything-but list", tt)
+				return
+			}
+			if len(list) == 0 {
+				err = errors.New("empty list in 'anything-but' pattern")
 			}
+			return
 		case string:
-			fieldCount++
-			val.list = append(val.list, []byte(`"`+tt+`"`))
+			list = append(list, []byte(`"`+tt+`"`))
+		case json.Number:
+			list = appendAnythingButNumber(list, tt)
 		default:
 			err = errors.New("malformed anything-but list")
-			done = true
+			return
 		}
 	}
+}
+
+// appendAnythingButNumber adds both the number as written and its canonical form, since depending on the
+// Flattener and the other patterns, a number in an event may be matched in either form, see numbers.go
+func appendAnythingButNumber(list [][]byte, number json.Number) [][]byte {
+	list = append(list, []byte(number.String()))
+	canonical, err := canonicalNumber([]byte(number.String()))
+	if err == nil {
+		list = append(list, canonical)
+	}
+	return list
+}
+
+// readAnythingButPattern reads the pattern in an anything-but object, the '{' having been consumed. The
+// readers for the pattern types consume the closing '}'.
+func readAnythingButPattern(pb *patternBuild) (*typedVal, error) {
+	t, err := pb.jd.Token()
 	if err != nil {
-		return
+		return nil, err
 	}
-	if fieldCount == 0 {
-		err = errors.New("empty list in 'anything-but' pattern")
-		return
+	patternType, ok := t.(string)
+	if !ok {
+		return nil, errors.New("empty object in anything-but")
 	}
-	pathVals = append(pathVals, val)
-
-	// this has to be a '}' or you're going to get an err from the tokenizer, so no point looking at the value
-	_, err = pb.jd.Token()
-	return
+	var vals []typedVal
+	switch patternType {
+	case "prefix":
+		vals, err = readPrefixSpecial(pb, nil)
+	case "suffix":
+		vals, err = readSuffixSpecial(pb, nil)
+	case "equals-ignore-case":
+		vals, err = readEqualsIgnoreCaseSpecial(pb, nil)
+	case "wildcard":
+		vals, err = readWildcardSpecial(pb, nil)
+	default:
+		err = errors.New("unsupported in anything-but: " + patternType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &vals[0], nil
 }
 
 // makeMultiAnythingButAutomaton exists to handle constructs such as
@@ -116,3 +175,66 @@ func oneMultiAnythingButStep(vals [][]byte, index int, nextField *fieldMatcher)
 	table.pack(&u)
 	return table
 }
+
+// makeAnythingButPatternAutomaton handles anything-but wrapped around another pattern, as in
+//
+// {"x": [ {"anything-but": {"prefix": "a"} } ] }
+//
+// by building the DFA for the other pattern and complementing it. As in EventBridge, only strings are matched,
+// so the complement has to start with '"', just as the other pattern does.
+func makeAnythingButPatternAutomaton(negated *typedVal, useThisTransition *fieldMatcher) (*smallTable[*dfaStep], *fieldMatcher) {
+	var nextField *fieldMatcher
+	if useThisTransition != nil {
+		nextField = useThisTransition
+	} else {
+		nextField = newFieldMatcher()
+	}
+	var dfa *smallTable[*dfaStep]
+	if negated.vType == wildcardType || negated.vType == regexpType {
+		nfa, _ := makeNfaAutomaton(*negated, []byte(negated.val))
+		dfa = nfa2Dfa(nfa)
+	} else {
+		dfa, _ = makeAutomaton(*negated, []byte(negated.val))
+	}
+	success := &dfaStep{table: newSmallTable[*dfaStep](), fieldTransitions: []*fieldMatcher{nextField}}
+	complement := unpackTable(complementTable(dfa, success, make(map[*dfaStep]*dfaStep)))
+	var stringsOnly unpackedTable[*dfaStep]
+	stringsOnly['"'] = complement['"']
+	table := newSmallTable[*dfaStep]()
+	table.pack(&stringsOnly)
+	return table, nextField
+}
+
+// complementTable returns a table which, for any value, arrives at success if and only if table doesn't match
+// the value. A DFA matches when it arrives at a step with field transitions, which can happen before the end of
+// the value, for example with a prefix. So, the complement has no step where the original matches, and
+// arrives at success wherever the original has nowhere to go, or when the value ends without a match.
+func complementTable(table *smallTable[*dfaStep], success *dfaStep, memo map[*dfaStep]*dfaStep) *smallTable[*dfaStep] {
+	original := unpackTable(table)
+	var u unpackedTable[*dfaStep]
+	for utf8Byte, next := range original {
+		switch {
+		case next == nil:
+			u[utf8Byte] = success
+		case len(next.fieldTransitions) > 0:
+			// no-op, the original matches
+		case utf8Byte == int(valueTerminator):
+			u[utf8Byte] = success
+		default:
+			u[utf8Byte] = complementStep(next, success, memo)
+		}
+	}
+	complement := newSmallTable[*dfaStep]()
+	complement.pack(&u)
+	return complement
+}
+
+func complementStep(step *dfaStep, success *dfaStep, memo map[*dfaStep]*dfaStep) *dfaStep {
+	if complement, ok := memo[step]; ok {
+		return complement
+	}
+	complement := &dfaStep{}
+	memo[step] = complement
+	complement.table = complementTable(step.table, success, memo)
+	return complement
+}
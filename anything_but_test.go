@@ -111,10 +111,17 @@ func TestParseAnythingButPattern(t *testing.T) {
 	goods := []string{
 		`{"a": [ {"anything-but": [ "foo" ] } ] }`,
 		`{"a": [ {"anything-but": [ "bif", "x", "y", "a;sldkfjas;lkdfjs" ] } ] }`,
+		`{"a": [ {"anything-but": "foo" } ] }`,
+		`{"a": [ {"anything-but": 1 } ] }`,
+		`{"a": [ {"anything-but": [ 404, 500, "x" ] } ] }`,
+		`{"a": [ {"anything-but": {"prefix": "foo"} } ] }`,
+		`{"a": [ {"anything-but": {"suffix": "foo"} } ] }`,
+		`{"a": [ {"anything-but": {"equals-ignore-case": "foo"} } ] }`,
+		`{"a": [ {"anything-but": {"wildcard": "f*o"} } ] }`,
 	}
 	bads := []string{
 		`{"a": [ {"anything-but": x } ] }`,
-		`{"a": [ {"anything-but": 1 } ] }`,
+		`{"a": [ {"anything-but": true } ] }`,
 		`{"a": [ {"anything-but": [ "a"`,
 		`{"a": [ {"anything-but": [ x ] } ] }`,
 		`{"a": [ {"anything-but": [ {"z": 1} ] } ] }`,
@@ -122,26 +129,177 @@ func TestParseAnythingButPattern(t *testing.T) {
 		`{"a": [ {"anything-but": [ "foo" ] x`,
 		`{"a": [ {"anything-but": [ "foo" ] ] ] }`,
 		`{"a": [ {"anything-but": {"x":1} } ] }`,
-		`{"a": [ {"anything-but": "foo" } ] }`,
+		`{"a": [ {"anything-but": {} } ] }`,
+		`{"a": [ {"anything-but": {"exists": true} } ] }`,
+		`{"a": [ {"anything-but": {"prefix": 3} } ] }`,
+		`{"a": [ {"anything-but": {"wildcard": "a**"} } ] }`,
+		`{"a": [ {"anything-but": {"prefix": "a" ] } ] }`,
 		`{"a": [ 2, {"anything-but": [ "foo" ] } ] }`,
 		`{"a": [ {"anything-but": [ "foo" ] }, 2 ] }`,
 		`{"a": [ {"anything-but": [ ] } ] }`,
 	}
 
 	for i, good := range goods {
-		fields, err := patternFromJSON([]byte(good))
+		alternatives, err := patternsFromJSON([]byte(good))
 		if err != nil {
 			t.Errorf("parse anything-but i=%d: "+err.Error(), i)
 		}
+		fields := alternatives[0]
 		if len(fields[0].vals) != 1 {
 			t.Errorf("wanted11 fields got %d", len(fields))
 		}
 	}
 
 	for _, bad := range bads {
-		_, err := patternFromJSON([]byte(bad))
+		_, err := patternsFromJSON([]byte(bad))
 		if err == nil {
 			t.Errorf(`accepted anything-but "%s"`, bad)
 		}
 	}
 }
+
+func TestAnythingButNumbers(t *testing.T) {
+	for _, canonicalize := range []bool{false, true} {
+		q, _ := New(WithNumberCanonicalization(canonicalize))
+		err := q.AddPattern("notError", `{"status": [ {"anything-but": [ 404, 500 ] } ] }`)
+		if err != nil {
+			t.Error("add: " + err.Error())
+		}
+		err = q.AddPattern("not200", `{"status": [ {"anything-but": 200 } ] }`)
+		if err != nil {
+			t.Error("add: " + err.Error())
+		}
+		// a numeric pattern means the matcher looks at canonical forms too
+		err = q.AddPattern("big", `{"status": [ {"numeric": [ ">=", 400 ] } ] }`)
+		if err != nil {
+			t.Error("add: " + err.Error())
+		}
+		wanted := map[string][]X{
+			`{"status": 200}`:   {"notError"},
+			`{"status": 404}`:   {"not200", "big"},
+			`{"status": 500}`:   {"not200", "big"},
+			`{"status": 403}`:   {"notError", "not200", "big"},
+			`{"status": "404"}`: {"notError", "not200"},
+		}
+		for event, want := range wanted {
+			matches, err := q.MatchesForEvent([]byte(event))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != len(want) {
+				t.Errorf("canonicalize=%v %s: wanted %v got %v", canonicalize, event, want, matches)
+				continue
+			}
+			for _, w := range want {
+				if !containsX(matches, w) {
+					t.Errorf("canonicalize=%v %s: missing %v in %v", canonicalize, event, w, matches)
+				}
+			}
+		}
+	}
+	q, _ := New(WithNumberCanonicalization(true))
+	_ = q.AddPattern("not404", `{"status": [ {"anything-but": 404 } ] }`)
+	matches, _ := q.MatchesForEvent([]byte(`{"status": 4.04e2}`))
+	if len(matches) != 0 {
+		t.Errorf("4.04e2 matched %v", matches)
+	}
+}
+
+func TestAnythingButPatterns(t *testing.T) {
+	type abTest struct {
+		pattern string
+		matches []string
+		misses  []string
+	}
+	tests := []abTest{
+		{
+			pattern: `{"prefix": "test-"}`,
+			matches: []string{"prod-1", "test", "tes", "", "Test-1", "xtest-1"},
+			misses:  []string{"test-", "test-1"},
+		},
+		{
+			pattern: `{"prefix": ""}`,
+			misses:  []string{"", "a"},
+		},
+		{
+			pattern: `{"suffix": ".png"}`,
+			matches: []string{"a.jpg", "png", "a.pngx", ""},
+			misses:  []string{".png", "a.png", "a.png.png"},
+		},
+		{
+			pattern: `{"equals-ignore-case": "Alice"}`,
+			matches: []string{"Bob", "Alic", "Alicex", "xalice"},
+			misses:  []string{"alice", "ALICE", "aLiCe"},
+		},
+		{
+			pattern: `{"wildcard": "*.example.com"}`,
+			matches: []string{"example.com", "a.example.org", "a.example.com.au"},
+			misses:  []string{".example.com", "www.example.com", "a.b.example.com"},
+		},
+	}
+	for _, test := range tests {
+		q, _ := New()
+		pattern := `{"x": [ {"anything-but": ` + test.pattern + `} ] }`
+		err := q.AddPattern("AB", pattern)
+		if err != nil {
+			t.Errorf("add %s: %s", pattern, err.Error())
+			continue
+		}
+		for _, m := range test.matches {
+			matches, _ := q.MatchesForEvent([]byte(`{"x": "` + m + `"}`))
+			if len(matches) != 1 {
+				t.Errorf("%s should match %s", pattern, m)
+			}
+		}
+		for _, m := range test.misses {
+			matches, _ := q.MatchesForEvent([]byte(`{"x": "` + m + `"}`))
+			if len(matches) != 0 {
+				t.Errorf("%s should not match %s", pattern, m)
+			}
+		}
+		// only strings are matched, even though the contained patterns don't match anything else either
+		for _, value := range []string{"3", "-1.5e3", "true", "false", "null"} {
+			matches, _ := q.MatchesForEvent([]byte(`{"x": ` + value + `}`))
+			if len(matches) != 0 {
+				t.Errorf("%s should not match %s", pattern, value)
+			}
+		}
+	}
+}
+
+func TestAnythingButPatternMerging(t *testing.T) {
+	q, _ := New()
+	patterns := map[X]string{
+		"notTest": `{"x": [ {"anything-but": {"prefix": "test-"} } ] }`,
+		"test":    `{"x": [ {"prefix": "test-"} ] }`,
+		"exact":   `{"x": [ "test-1" ] }`,
+		"notPng":  `{"x": [ {"anything-but": {"suffix": ".png"} } ] }`,
+	}
+	for x, p := range patterns {
+		err := q.AddPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"x": "test-1"}`:     {"test", "exact", "notPng"},
+		`{"x": "test-1.png"}`: {"test"},
+		`{"x": "prod.png"}`:   {"notTest"},
+		`{"x": "prod"}`:       {"notTest", "notPng"},
+	}
+	for event, want := range wanted {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package quamina
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// This file reads the JSON form of an Avro schema, as described in the Avro specification, into the tree of
+// avroSchema nodes that flattenAvro uses to decode records. Logical types are decoded as their underlying
+// types, and defaults, aliases, and doc strings aren't needed, since the schema is the writer's.
+
+type avroType int
+
+const (
+	avroNull avroType = iota
+	avroBoolean
+	avroInt
+	avroLong
+	avroFloat
+	avroDouble
+	avroBytes
+	avroString
+	avroRecord
+	avroEnum
+	avroArray
+	avroMap
+	avroFixed
+	avroUnion
+)
+
+var avroPrimitives = map[string]avroType{
+	"null":    avroNull,
+	"boolean": avroBoolean,
+	"int":     avroInt,
+	"long":    avroLong,
+	"float":   avroFloat,
+	"double":  avroDouble,
+	"bytes":   avroBytes,
+	"string":  avroString,
+}
+
+type avroSchema struct {
+	typ      avroType
+	name     string        // full name, for records, enums, and fixed
+	fields   []*avroField  // for records
+	symbols  [][]byte      // for enums, the quoted symbols
+	items    *avroSchema   // for arrays
+	values   *avroSchema   // for maps
+	size     int           // for fixed
+	branches []*avroSchema // for unions
+}
+
+type avroField struct {
+	name   []byte
+	schema *avroSchema
+}
+
+// avroSchemaParser keeps track of the named types, which can be referred to by name once they've been defined
+type avroSchemaParser struct {
+	named map[string]*avroSchema
+}
+
+// parseAvroSchema reads a schema, whose top level has to be a record since events are objects
+func parseAvroSchema(schemaJSON []byte) (*avroSchema, error) {
+	var schemaVal any
+	if err := json.Unmarshal(schemaJSON, &schemaVal); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %w", err)
+	}
+	p := &avroSchemaParser{named: make(map[string]*avroSchema)}
+	schema, err := p.parse(schemaVal, "")
+	if err != nil {
+		return nil, err
+	}
+	if schema.typ != avroRecord {
+		return nil, errors.New("top level of Avro schema must be a record")
+	}
+	if err = p.checkRecursion(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// checkRecursion makes sure that every record has values that end. A record may contain itself, but only
+// through a union with another branch, an array, or a map, which can stop the recursion; otherwise no value
+// could be written, and decoding would recurse until the stack overflowed. The records that can end are found
+// by starting with none and adding those whose fields can end, until there are no more.
+func (p *avroSchemaParser) checkRecursion() error {
+	ends := make(map[*avroSchema]bool)
+	for added := true; added; {
+		added = false
+		for _, schema := range p.named {
+			if schema.typ == avroRecord && !ends[schema] && avroRecordEnds(schema, ends) {
+				ends[schema] = true
+				added = true
+			}
+		}
+	}
+	names := make([]string, 0, len(p.named))
+	for name, schema := range p.named {
+		if schema.typ == avroRecord && !ends[schema] {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Errorf("record %s in Avro schema contains itself with no way out", names[0])
+	}
+	return nil
+}
+
+func avroRecordEnds(record *avroSchema, ends map[*avroSchema]bool) bool {
+	for _, field := range record.fields {
+		if !avroValueEnds(field.schema, ends) {
+			return false
+		}
+	}
+	return true
+}
+
+// avroValueEnds says whether a value of the schema can end, given the records known to be able to
+func avroValueEnds(schema *avroSchema, ends map[*avroSchema]bool) bool {
+	switch schema.typ {
+	case avroRecord:
+		return ends[schema]
+	case avroUnion:
+		for _, branch := range schema.branches {
+			if avroValueEnds(branch, ends) {
+				return true
+			}
+		}
+		return false
+	default:
+		// including arrays and maps, which can be empty
+		return true
+	}
+}
+
+func (p *avroSchemaParser) parse(schemaVal any, namespace string) (*avroSchema, error) {
+	switch v := schemaVal.(type) {
+	case string:
+		if typ, ok := avroPrimitives[v]; ok {
+			return &avroSchema{typ: typ}, nil
+		}
+		return p.lookup(v, namespace)
+	case []any:
+		return p.parseUnion(v, namespace)
+	case map[string]any:
+		return p.parseComplex(v, namespace)
+	default:
+		return nil, fmt.Errorf("invalid Avro schema %v", schemaVal)
+	}
+}
+
+// lookup finds a named type, which may be given by its full name or by its name relative to the namespace
+func (p *avroSchemaParser) lookup(name string, namespace string) (*avroSchema, error) {
+	if !strings.Contains(name, ".") && namespace != "" {
+		if schema, ok := p.named[namespace+"."+name]; ok {
+			return schema, nil
+		}
+	}
+	if schema, ok := p.named[name]; ok {
+		return schema, nil
+	}
+	return nil, fmt.Errorf("unknown Avro type %s", name)
+}
+
+func (p *avroSchemaParser) parseUnion(branchVals []any, namespace string) (*avroSchema, error) {
+	schema := &avroSchema{typ: avroUnion}
+	for _, branchVal := range branchVals {
+		branch, err := p.parse(branchVal, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if branch.typ == avroUnion {
+			return nil, errors.New("unions in Avro schema may not contain unions")
+		}
+		schema.branches = append(schema.branches, branch)
+	}
+	if len(schema.branches) == 0 {
+		return nil, errors.New("empty Avro union")
+	}
+	return schema, nil
+}
+
+func (p *avroSchemaParser) parseComplex(v map[string]any, namespace string) (*avroSchema, error) {
+	typeVal, ok := v["type"]
+	if !ok {
+		return nil, errors.New("object in Avro schema has no type")
+	}
+	typeName, ok := typeVal.(string)
+	if !ok {
+		// e.g. {"type": {"type": "array", "items": "int"}}
+		return p.parse(typeVal, namespace)
+	}
+
+	switch typeName {
+	case "record", "error":
+		schema := &avroSchema{typ: avroRecord}
+		if err := p.define(schema, v, &namespace); err != nil {
+			return nil, err
+		}
+		fieldVals, ok := v["fields"].([]any)
+		if !ok {
+			return nil, fmt.Errorf("record %s in Avro schema has no fields", schema.name)
+		}
+		for _, fieldVal := range fieldVals {
+			fieldObj, ok := fieldVal.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid field in Avro record %s", schema.name)
+			}
+			name, ok := fieldObj["name"].(string)
+			if !ok {
+				return nil, fmt.Errorf("field without name in Avro record %s", schema.name)
+			}
+			fieldType, ok := fieldObj["type"]
+			if !ok {
+				return nil, fmt.Errorf("field %s in Avro record %s has no type", name, schema.name)
+			}
+			fieldSchema, err := p.parse(fieldType, namespace)
+			if err != nil {
+				return nil, err
+			}
+			schema.fields = append(schema.fields, &avroField{name: []byte(name), schema: fieldSchema})
+		}
+		return schema, nil
+
+	case "enum":
+		schema := &avroSchema{typ: avroEnum}
+		if err := p.define(schema, v, &namespace); err != nil {
+			return nil, err
+		}
+		symbolVals, ok := v["symbols"].([]any)
+		if !ok {
+			return nil, fmt.Errorf("enum %s in Avro schema has no symbols", schema.name)
+		}
+		for _, symbolVal := range symbolVals {
+			symbol, ok := symbolVal.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid symbol in Avro enum %s", schema.name)
+			}
+			schema.symbols = append(schema.symbols, quoted([]byte(symbol)))
+		}
+		return schema, nil
+
+	case "fixed":
+		schema := &avroSchema{typ: avroFixed}
+		if err := p.define(schema, v, &namespace); err != nil {
+			return nil, err
+		}
+		size, ok := v["size"].(float64)
+		if !ok || size < 0 || size != float64(int(size)) {
+			return nil, fmt.Errorf("fixed %s in Avro schema needs a size", schema.name)
+		}
+		schema.size = int(size)
+		return schema, nil
+
+	case "array":
+		itemsVal, ok := v["items"]
+		if !ok {
+			return nil, errors.New("array in Avro schema has no items")
+		}
+		items, err := p.parse(itemsVal, namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: avroArray, items: items}, nil
+
+	case "map":
+		valuesVal, ok := v["values"]
+		if !ok {
+			return nil, errors.New("map in Avro schema has no values")
+		}
+		values, err := p.parse(valuesVal, namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: avroMap, values: values}, nil
+
+	default:
+		// primitives, perhaps with a logicalType, and references to named types
+		return p.parse(typeName, namespace)
+	}
+}
+
+// define gives a record, enum, or fixed its full name and makes it available to later references, including
+// those inside itself. The namespace is updated to the type's own, which its fields are in.
+func (p *avroSchemaParser) define(schema *avroSchema, v map[string]any, namespace *string) error {
+	name, ok := v["name"].(string)
+	if !ok || name == "" {
+		return errors.New("named type in Avro schema has no name")
+	}
+	if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+		*namespace = ns
+	}
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		*namespace = name[:dot]
+	} else if *namespace != "" {
+		name = *namespace + "." + name
+	}
+	if _, ok := p.named[name]; ok {
+		return fmt.Errorf("type %s defined more than once in Avro schema", name)
+	}
+	schema.name = name
+	p.named[name] = schema
+	return nil
+}
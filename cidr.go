@@ -0,0 +1,272 @@
+package quamina
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// readCidrSpecial parses a cidr object in a Pattern. The value is a string giving an IPv4 or IPv6 address prefix
+// in the usual notation, e.g. "10.0.0.0/8" or "2001:db8::/32". Host bits beyond the prefix length must be zero,
+// because otherwise it's not clear what the pattern author meant.
+func readCidrSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
+	t, err := pb.jd.Token()
+	if err != nil {
+		return
+	}
+	pathVals = valsIn
+	cidrString, ok := t.(string)
+	if !ok {
+		err = errors.New("value for 'cidr' must be a string")
+		return
+	}
+	prefix, err := netip.ParsePrefix(cidrString)
+	if err != nil {
+		err = errors.New("invalid 'cidr' value: " + err.Error())
+		return
+	}
+	if prefix != prefix.Masked() {
+		err = errors.New("'cidr' value " + cidrString + " has bits set beyond the prefix length")
+		return
+	}
+
+	pathVals = append(pathVals, typedVal{vType: cidrType, val: `"` + cidrString + `"`, ipPrefix: &prefix})
+
+	// has to be } or tokenizer will throw error
+	_, err = pb.jd.Token()
+	return
+}
+
+// cidrBuilder makes the NFA for a cidr pattern, which is then turned into a DFA. The NFA is much easier to
+// build, because there are lots of ways to write the same address: IPv6 hex digits can be in either case and
+// have leading zeroes, and a "::" can stand in for any run of zero groups, which means that you can't know
+// which group you're looking at until you've seen the whole address.
+type cidrBuilder struct {
+	lister *listMaker
+}
+
+// makeCidrAutomaton builds a DFA matching the quoted textual forms of all the addresses in the prefix. IPv4
+// prefixes match dotted-quad addresses, without leading zeroes since those are sometimes read as octal. IPv6
+// prefixes match addresses in the RFC 4291 forms, including "::" compression and a dotted-quad final 32 bits.
+func makeCidrAutomaton(prefix *netip.Prefix, useThisTransition *fieldMatcher) (*smallTable[*dfaStep], *fieldMatcher) {
+	var nextField *fieldMatcher
+	if useThisTransition != nil {
+		nextField = useThisTransition
+	} else {
+		nextField = newFieldMatcher()
+	}
+	b := &cidrBuilder{lister: newListMaker()}
+
+	first := newNfaStep()
+	closingQuote := newNfaStep()
+	afterQuote := newNfaStep()
+	closingQuote.table.addByteStep('"', b.lister.getList(afterQuote))
+	lastStep := &nfaStep{table: newSmallTable[*nfaStepList](), fieldTransitions: []*fieldMatcher{nextField}}
+	afterQuote.table.addByteStep(valueTerminator, b.lister.getList(lastStep))
+
+	addr := prefix.Addr().AsSlice()
+	if prefix.Addr().Is4() {
+		start := newNfaStep()
+		first.table.addByteStep('"', b.lister.getList(start))
+		b.ipv4(start, closingQuote, addr, prefix.Bits())
+	} else {
+		b.ipv6(first, closingQuote, addr, prefix.Bits())
+	}
+	return nfa2Dfa(first.table), nextField
+}
+
+// ipv4 builds the steps from start to end for a dotted quad whose 32 bits are the last 4 bytes of addr and
+// whose first prefixBits bits must match those of addr.
+func (b *cidrBuilder) ipv4(start, end *nfaStep, addr []byte, prefixBits int) {
+	step := start
+	for i := 0; i < 4; i++ {
+		lo, hi := fieldRange(addr, prefixBits, i*8, 8)
+		octetEnd := newNfaStep()
+		b.number(step, octetEnd, lo, hi, 10, 3)
+		if i < 3 {
+			step = newNfaStep()
+			octetEnd.table.addByteStep('.', b.lister.getList(step))
+		} else {
+			octetEnd.epsilon = append(octetEnd.epsilon, end)
+		}
+	}
+}
+
+// ipv6 builds the steps for an IPv6 address, starting with the opening quote, and ending at end. There are two
+// steps for the start of each group, depending on whether a "::" has been seen, since there can only be one.
+// After a "::" which stands for groups i through j-1, the address either ends or carries on at group j.
+func (b *cidrBuilder) ipv6(first, end *nfaStep, addr []byte, prefixBits int) {
+	var groupStarts, compressedGroupStarts [8]*nfaStep
+	for i := 0; i < 8; i++ {
+		groupStarts[i] = newNfaStep()
+		compressedGroupStarts[i] = newNfaStep()
+	}
+
+	// zeroesOK[i] says whether group i is allowed to be zero, i.e. whether it may be elided by a "::"
+	var zeroesOK [8]bool
+	for i := 0; i < 8; i++ {
+		lo, _ := fieldRange(addr, prefixBits, i*16, 16)
+		zeroesOK[i] = lo == 0
+	}
+	compressions := make([]*nfaStep, 8)
+	for i := 0; i < 8; i++ {
+		if !zeroesOK[i] {
+			continue
+		}
+		compressions[i] = newNfaStep()
+		for j := i + 1; j <= 8 && zeroesOK[j-1]; j++ {
+			if j == 8 {
+				compressions[i].epsilon = append(compressions[i].epsilon, end)
+			} else {
+				compressions[i].epsilon = append(compressions[i].epsilon, compressedGroupStarts[j])
+			}
+		}
+	}
+
+	// the opening quote might be followed by the first group or by "::"
+	afterQuote := []*nfaStep{groupStarts[0]}
+	if compressions[0] != nil {
+		colon1 := newNfaStep()
+		colon2 := newNfaStep()
+		colon1.table.addByteStep(':', b.lister.getList(colon2))
+		colon2.table.addByteStep(':', b.lister.getList(compressions[0]))
+		afterQuote = append(afterQuote, colon1)
+	}
+	first.table.addByteStep('"', b.lister.getList(afterQuote...))
+
+	for i := 0; i < 8; i++ {
+		lo, hi := fieldRange(addr, prefixBits, i*16, 16)
+		for _, compressed := range []bool{false, true} {
+			groupStart := groupStarts[i]
+			if compressed {
+				groupStart = compressedGroupStarts[i]
+			}
+			groupEnd := newNfaStep()
+			b.number(groupStart, groupEnd, lo, hi, 16, 4)
+
+			// the last 32 bits may be written as a dotted quad
+			if i == 6 {
+				b.ipv4(groupStart, end, addr[12:], prefixBits-96)
+			}
+
+			if i == 7 {
+				groupEnd.epsilon = append(groupEnd.epsilon, end)
+				continue
+			}
+			if compressed {
+				groupEnd.table.addByteStep(':', b.lister.getList(compressedGroupStarts[i+1]))
+				continue
+			}
+			afterColon := []*nfaStep{groupStarts[i+1]}
+			if compressions[i+1] != nil {
+				secondColon := newNfaStep()
+				secondColon.table.addByteStep(':', b.lister.getList(compressions[i+1]))
+				afterColon = append(afterColon, secondColon)
+			}
+			groupEnd.table.addByteStep(':', b.lister.getList(afterColon...))
+		}
+	}
+}
+
+// fieldRange returns the lowest and highest values that the width-bit field starting at offset bits into addr
+// can have, if the first prefixBits bits of an address have to match addr.
+func fieldRange(addr []byte, prefixBits int, offset int, width int) (lo, hi int) {
+	value := 0
+	for i := offset / 8; i < (offset+width)/8; i++ {
+		value = value<<8 | int(addr[i])
+	}
+	fixedBits := prefixBits - offset
+	if fixedBits < 0 {
+		fixedBits = 0
+	} else if fixedBits > width {
+		fixedBits = width
+	}
+	freeMask := 1<<(width-fixedBits) - 1
+	lo = value &^ freeMask
+	hi = lo | freeMask
+	return
+}
+
+// number adds steps from start to end which match a number between lo and hi, written with at most maxDigits
+// digits. Decimal numbers can't have leading zeroes, hex numbers can, and can use either case. There's a
+// separate path for each possible number of digits.
+func (b *cidrBuilder) number(start, end *nfaStep, lo, hi int, base int, maxDigits int) {
+	smallest := 0
+	largest := base - 1
+	for digits := 1; digits <= maxDigits; digits++ {
+		if base == 10 && digits > 1 {
+			smallest = largest + 1
+		}
+		if digits > 1 {
+			largest = largest*base + base - 1
+		}
+		rangeLo, rangeHi := lo, hi
+		if rangeLo < smallest {
+			rangeLo = smallest
+		}
+		if rangeHi > largest {
+			rangeHi = largest
+		}
+		if rangeLo > rangeHi {
+			continue
+		}
+		loDigits := digitsOf(rangeLo, base, digits)
+		hiDigits := digitsOf(rangeHi, base, digits)
+		memo := make(map[[3]int]*nfaStep)
+		start.epsilon = append(start.epsilon, b.digitSteps(loDigits, hiDigits, 0, true, true, base, end, memo))
+	}
+}
+
+// digitSteps returns a step matching digits from position index on, given that the digits so far are equal to
+// those in loDigits and/or hiDigits if tightLo and/or tightHi are set. This is the usual way of matching a
+// range of fixed-length numbers: only the digits on the edges of the range need to be looked at carefully.
+func (b *cidrBuilder) digitSteps(loDigits, hiDigits []int, index int, tightLo, tightHi bool, base int, end *nfaStep, memo map[[3]int]*nfaStep) *nfaStep {
+	if index == len(loDigits) {
+		return end
+	}
+	key := [3]int{index, 0, 0}
+	if tightLo {
+		key[1] = 1
+	}
+	if tightHi {
+		key[2] = 1
+	}
+	if step, ok := memo[key]; ok {
+		return step
+	}
+
+	step := newNfaStep()
+	memo[key] = step
+	low, high := 0, base-1
+	if tightLo {
+		low = loDigits[index]
+	}
+	if tightHi {
+		high = hiDigits[index]
+	}
+	unpacked := unpackTable(step.table)
+	for digit := low; digit <= high; digit++ {
+		next := b.digitSteps(loDigits, hiDigits, index+1, tightLo && digit == low, tightHi && digit == high, base, end, memo)
+		list := b.lister.getList(next)
+		for _, ch := range digitBytes(digit) {
+			unpacked[ch] = list
+		}
+	}
+	step.table.pack(unpacked)
+	return step
+}
+
+func digitsOf(value int, base int, count int) []int {
+	digits := make([]int, count)
+	for i := count - 1; i >= 0; i-- {
+		digits[i] = value % base
+		value /= base
+	}
+	return digits
+}
+
+func digitBytes(digit int) []byte {
+	if digit < 10 {
+		return []byte{byte('0' + digit)}
+	}
+	return []byte{byte('a' + digit - 10), byte('A' + digit - 10)}
+}
@@ -0,0 +1,227 @@
+package quamina
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestReadCidrSpecial(t *testing.T) {
+	goods := []string{
+		`{"x": [ {"cidr": "10.0.0.0/8"} ] }`,
+		`{"x": [ {"cidr": "192.168.1.7/32"} ] }`,
+		`{"x": [ {"cidr": "0.0.0.0/0"} ] }`,
+		`{"x": [ {"cidr": "2001:db8::/32"} ] }`,
+		`{"x": [ {"cidr": "::/0"} ] }`,
+		`{"x": [ {"cidr": "::ffff:10.0.0.0/104"} ] }`,
+	}
+	for _, good := range goods {
+		alternatives, err := patternsFromJSON([]byte(good))
+		if err != nil {
+			t.Errorf("parse %s: %s", good, err.Error())
+			continue
+		}
+		fields := alternatives[0]
+		if fields[0].vals[0].vType != cidrType || fields[0].vals[0].ipPrefix == nil {
+			t.Errorf("%s: not a cidr", good)
+		}
+	}
+	bads := []string{
+		`{"x": [ {"cidr": 10} ] }`,
+		`{"x": [ {"cidr": "10.0.0.0"} ] }`,
+		`{"x": [ {"cidr": "10.0.0.1/8"} ] }`,
+		`{"x": [ {"cidr": "10.0.0.0/33"} ] }`,
+		`{"x": [ {"cidr": "10.0.0/8"} ] }`,
+		`{"x": [ {"cidr": "2001:db8::1/32"} ] }`,
+		`{"x": [ {"cidr": "fe80::%eth0/64"} ] }`,
+		`{"x": [ {"cidr": "10.0.0.0/8" ] }`,
+	}
+	for _, bad := range bads {
+		_, err := patternsFromJSON([]byte(bad))
+		if err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestCidrMatching(t *testing.T) {
+	type cidrTest struct {
+		cidr    string
+		matches []string
+		misses  []string
+	}
+	tests := []cidrTest{
+		{
+			cidr:    "10.0.0.0/8",
+			matches: []string{"10.0.0.0", "10.255.255.255", "10.1.22.133"},
+			misses:  []string{"11.0.0.0", "1.0.0.0", "100.0.0.1", "010.0.0.1", "10.0.0", "10.0.0.256", "10.0.0.1.", "::ffff:10.0.0.1"},
+		},
+		{
+			cidr:    "192.168.100.0/22",
+			matches: []string{"192.168.100.0", "192.168.103.255", "192.168.101.9"},
+			misses:  []string{"192.168.99.255", "192.168.104.0", "192.168.1.0"},
+		},
+		{
+			cidr:    "172.16.5.4/32",
+			matches: []string{"172.16.5.4"},
+			misses:  []string{"172.16.5.40", "172.16.5.5", "172.16.5.04"},
+		},
+		{
+			cidr:    "0.0.0.0/0",
+			matches: []string{"0.0.0.0", "255.255.255.255", "8.8.4.4"},
+			misses:  []string{"256.0.0.0", "1.2.3", "::1", ""},
+		},
+		{
+			cidr: "2001:db8::/32",
+			matches: []string{"2001:db8::", "2001:db8::1", "2001:DB8:0:0:0:0:0:1", "2001:0db8:ffff:ffff:ffff:ffff:ffff:ffff",
+				"2001:db8:1::2:3", "2001:db8::1.2.3.4"},
+			misses: []string{"2001:db9::", "2001::db8", "2001:db8", "2001:db8:::1", "2001:db8::1::2", "2001:00db8::1",
+				"2001:db8:0:0:0:0:0:0:1", "2001:db8:0:0:0:0:1", "2001:db8::g"},
+		},
+		{
+			cidr:    "::/0",
+			matches: []string{"::", "::1", "1::", "1:2:3:4:5:6:7:8", "1:2:3:4:5:6:1.2.3.4", "::ffff:1.2.3.4", "1::2:3:4:5:6:7"},
+			misses:  []string{":", ":::", "1:2:3:4:5:6:7", "1:2:3:4:5:6:7:8:9", "1.2.3.4", "1:2:3:4:5:6:7:1.2.3.4", "::1.2.3"},
+		},
+		{
+			cidr:    "::1/128",
+			matches: []string{"::1", "0:0:0:0:0:0:0:1", "0000::0001", "::0:1"},
+			misses:  []string{"::", "::2", "1::", "::0.0.0.1x"},
+		},
+		{
+			cidr:    "::ffff:10.0.0.0/104",
+			matches: []string{"::ffff:10.0.0.1", "::FFFF:a00:1", "0:0:0:0:0:ffff:10.255.1.2"},
+			misses:  []string{"::ffff:11.0.0.1", "10.0.0.1", "::10.0.0.1"},
+		},
+		{
+			cidr:    "fe80::/10",
+			matches: []string{"fe80::1", "febf:1::", "FE9A::abcd"},
+			misses:  []string{"fec0::1", "fe7f::", "::fe80"},
+		},
+	}
+	for _, test := range tests {
+		q, _ := New()
+		pattern := fmt.Sprintf(`{"x": [ {"cidr": %q} ] }`, test.cidr)
+		err := q.AddPattern("C", pattern)
+		if err != nil {
+			t.Errorf("add %s: %s", pattern, err.Error())
+			continue
+		}
+		for _, m := range test.matches {
+			matches, err := q.MatchesForEvent([]byte(fmt.Sprintf(`{"x": %q}`, m)))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 1 {
+				t.Errorf("%s should match %s", test.cidr, m)
+			}
+		}
+		for _, m := range test.misses {
+			matches, err := q.MatchesForEvent([]byte(fmt.Sprintf(`{"x": %q}`, m)))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 0 {
+				t.Errorf("%s should not match %s", test.cidr, m)
+			}
+		}
+	}
+}
+
+// TestCidrRandomized checks the automata against netip.Prefix.Contains, for random prefixes and addresses near
+// them, with the IPv6 addresses written in several different ways.
+func TestCidrRandomized(t *testing.T) {
+	//nolint:gosec
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		var raw []byte
+		if i%2 == 0 {
+			raw = make([]byte, 4)
+		} else {
+			raw = make([]byte, 16)
+		}
+		r.Read(raw)
+		addr, _ := netip.AddrFromSlice(raw)
+		prefix, _ := addr.Prefix(r.Intn(len(raw)*8 + 1))
+		automaton, wanted := makeCidrAutomaton(&prefix, nil)
+
+		for j := 0; j < 20; j++ {
+			// flip a random bit so that some addresses are just inside the prefix and some just outside
+			candidate := make([]byte, len(raw))
+			copy(candidate, raw)
+			if j > 0 {
+				bit := r.Intn(len(raw) * 8)
+				candidate[bit/8] ^= 0x80 >> (bit % 8)
+			}
+			candidateAddr, _ := netip.AddrFromSlice(candidate)
+			for _, text := range addressForms(candidateAddr) {
+				trans := transitionDfa(automaton, []byte(`"`+text+`"`), nil)
+				matched := len(trans) == 1 && trans[0] == wanted
+				if matched != prefix.Contains(candidateAddr) {
+					t.Errorf("%s on %s: got %v", prefix, text, matched)
+				}
+			}
+		}
+	}
+}
+
+func addressForms(addr netip.Addr) []string {
+	if addr.Is4() {
+		return []string{addr.String()}
+	}
+	b := addr.As16()
+	var groups []string
+	for i := 0; i < 16; i += 2 {
+		groups = append(groups, fmt.Sprintf("%04x", int(b[i])<<8|int(b[i+1])))
+	}
+	dotted := fmt.Sprintf("%s:%d.%d.%d.%d", strings.Join(groups[:6], ":"), b[12], b[13], b[14], b[15])
+	return []string{
+		addr.String(),
+		strings.ToUpper(addr.String()),
+		strings.Join(groups, ":"),
+		dotted,
+	}
+}
+
+func TestCidrWithOtherPatterns(t *testing.T) {
+	q, _ := New()
+	patterns := map[X]string{
+		"ten":    `{"ip": [ {"cidr": "10.0.0.0/8"} ] }`,
+		"ten1":   `{"ip": [ {"cidr": "10.1.0.0/16"} ] }`,
+		"exact":  `{"ip": [ "10.1.2.3" ] }`,
+		"prefix": `{"ip": [ {"prefix": "10.1."} ] }`,
+		"v6":     `{"ip": [ {"cidr": "2001:db8::/32"} ] }`,
+	}
+	for x, p := range patterns {
+		err := q.AddPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"ip": "10.1.2.3"}`:      {"ten", "ten1", "exact", "prefix"},
+		`{"ip": "10.2.2.3"}`:      {"ten"},
+		`{"ip": "10.1.300.1"}`:    {"prefix"},
+		`{"ip": "2001:db8::1"}`:   {"v6"},
+		`{"ip": "2001:db80::1"}`:  {},
+		`{"ip": "192.168.0.1"}`:   {},
+		`{"ip": ["10.1.0.0", 3]}`: {"ten", "ten1", "prefix"},
+	}
+	for event, want := range wanted {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
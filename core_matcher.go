@@ -21,9 +21,11 @@ import (
 // However, any number of goroutines may in parallel be executing matchesForFields while the addPattern
 // update is in progress. The updateable atomic.Value allows the addPattern thread to change the maps and
 // slices in the structure atomically with atomic.Load() while matchesForFields threads are reading them.
+// If canonicalizeNumbers is set, number values in patterns are compiled to match their canonical forms.
 type coreMatcher struct {
-	updateable atomic.Value // always holds a *coreFields
-	lock       sync.Mutex
+	updateable          atomic.Value // always holds a *coreFields
+	lock                sync.Mutex
+	canonicalizeNumbers bool
 }
 
 // coreFields groups the updateable fields in coreMatcher.
@@ -52,13 +54,18 @@ func (m *coreMatcher) fields() *coreFields {
 // addPattern - the patternBytes is a JSON text which must be an object. The X is what the matcher returns to indicate
 // that the provided pattern has been matched. In many applications it might be a string which is the pattern's name.
 func (m *coreMatcher) addPattern(x X, patternJSON string) error {
-	patternFields, err := patternFromJSON([]byte(patternJSON))
+	alternatives, err := patternsFromJSON([]byte(patternJSON))
 	if err != nil {
 		return err
 	}
+	for _, patternFields := range alternatives {
+		if m.canonicalizeNumbers {
+			canonicalizeNumberVals(patternFields)
+		}
 
-	// sort the pattern fields lexically
-	sort.Slice(patternFields, func(i, j int) bool { return patternFields[i].path < patternFields[j].path })
+		// sort the pattern fields lexically
+		sort.Slice(patternFields, func(i, j int) bool { return patternFields[i].path < patternFields[j].path })
+	}
 
 	// only one thread can be updating at a time
 	m.lock.Lock()
@@ -70,40 +77,47 @@ func (m *coreMatcher) addPattern(x X, patternJSON string) error {
 	freshStart.segmentsTree = currentFields.segmentsTree.copy()
 	freshStart.state = currentFields.state
 
-	// Add paths to the segments tree index.
-	for _, field := range patternFields {
-		freshStart.segmentsTree.add(field.path)
-	}
-
-	// now we add each of the name/value pairs in fields slice to the automaton, starting with the start state -
-	// the addTransition for a field returns a list of the fieldMatchers transitioned to for that name/val
-	// combo.
-	states := []*fieldMatcher{currentFields.state}
-	for _, field := range patternFields {
-		var nextStates []*fieldMatcher
-
-		// separate handling for field exists:true/false and regular field name/val matches. Since the exists
-		// true/false are only allowed one value, we can test vals[0] to figure out which type
-		for _, state := range states {
-			var ns []*fieldMatcher
-			switch field.vals[0].vType {
-			case existsTrueType:
-				ns = state.addExists(true, field)
-			case existsFalseType:
-				ns = state.addExists(false, field)
-			default:
-				ns = state.addTransition(field)
+	// a pattern with "$or" in it expands into alternatives, each of which is added just like a pattern without,
+	// leading to the same x. Since matches are reported as a set, x is only reported once.
+	for _, patternFields := range alternatives {
+		// Add paths to the segments tree index.
+		for _, field := range patternFields {
+			freshStart.segmentsTree.add(field.path)
+			if field.vals[0].vType == existsTrueType || field.vals[0].vType == existsFalseType {
+				freshStart.segmentsTree.addPresence(field.path)
 			}
+		}
 
-			nextStates = append(nextStates, ns...)
+		// now we add each of the name/value pairs in fields slice to the automaton, starting with the start state -
+		// the addTransition for a field returns a list of the fieldMatchers transitioned to for that name/val
+		// combo.
+		states := []*fieldMatcher{currentFields.state}
+		for _, field := range patternFields {
+			var nextStates []*fieldMatcher
+
+			// separate handling for field exists:true/false and regular field name/val matches. Since the exists
+			// true/false are only allowed one value, we can test vals[0] to figure out which type
+			for _, state := range states {
+				var ns []*fieldMatcher
+				switch field.vals[0].vType {
+				case existsTrueType:
+					ns = state.addExists(true, field)
+				case existsFalseType:
+					ns = state.addExists(false, field)
+				default:
+					ns = state.addTransition(field)
+				}
+
+				nextStates = append(nextStates, ns...)
+			}
+			states = nextStates
 		}
-		states = nextStates
-	}
 
-	// we've processed all the name/val combos in fields, "states" now holds the set of terminal states arrived at
-	//  by matching each field in the pattern, so update the matches value to indicate this.
-	for _, endState := range states {
-		endState.addMatch(x)
+		// we've processed all the name/val combos in fields, "states" now holds the set of terminal states arrived at
+		//  by matching each field in the pattern, so update the matches value to indicate this.
+		for _, endState := range states {
+			endState.addMatch(x)
+		}
 	}
 	m.updateable.Store(freshStart)
 
@@ -270,3 +270,91 @@ func TestSimpleaddPattern(t *testing.T) {
 		t.Error("No trans from start on 'a'")
 	}
 }
+
+func TestOrMatching(t *testing.T) {
+	m := newCoreMatcher()
+	patterns := map[X]string{
+		"http": `{"source": ["http"], "$or": [ {"status": [ {"numeric": [">=", 500]} ]}, {"error": [ {"exists": true} ]} ] }`,
+		"user": `{"$or": [ {"user": {"name": ["root"]}}, {"user": {"id": [0]}} ] }`,
+	}
+	for x, p := range patterns {
+		err := m.addPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"source": "http", "status": 503}`:                      {"http"},
+		`{"source": "http", "status": 404}`:                      {},
+		`{"source": "http", "status": 200, "error": "x"}`:        {"http"},
+		`{"source": "http", "status": 503, "error": "x"}`:        {"http"},
+		`{"source": "ftp", "status": 503}`:                       {},
+		`{"user": {"name": "root", "id": 0}}`:                    {"user"},
+		`{"user": {"name": "alice", "id": 0}}`:                   {"user"},
+		`{"user": {"name": "alice", "id": 1}}`:                   {},
+		`{"source": "http", "status": 500, "user": {"id": 0}}`:   {"http", "user"},
+		`{"source": "http", "status": 500, "user": {"id": 0.5}}`: {"http"},
+	}
+	for event, want := range wanted {
+		matches, err := m.matchesForJSONEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
+
+func TestExistsOnObjectsAndArrays(t *testing.T) {
+	m := newCoreMatcher()
+	patterns := map[X]string{
+		"errorExists":    `{"detail": {"error": [ {"exists": true} ] } }`,
+		"errorNotExists": `{"detail": {"error": [ {"exists": false} ] } }`,
+		"errorCode":      `{"detail": {"error": {"code": [ 500 ] } } }`,
+		"tagsExist":      `{"tags": [ {"exists": true} ] }`,
+		"notString":      `{"detail": {"error": [ {"anything-but": "none"} ] } }`,
+	}
+	for x, p := range patterns {
+		err := m.addPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"detail": {"error": {"code": 500}}}`:                 {"errorExists", "errorCode"},
+		`{"detail": {"error": {"code": 404}}}`:                 {"errorExists"},
+		`{"detail": {"error": {}}}`:                            {"errorExists"},
+		`{"detail": {"error": []}}`:                            {"errorNotExists"},
+		`{"detail": {"error": [{"code": 500}]}}`:               {"errorExists", "errorCode"},
+		`{"detail": {"error": "oops"}}`:                        {"errorExists", "notString"},
+		`{"detail": {"error": "none"}}`:                        {"errorExists"},
+		`{"detail": {"warning": {"code": 500}}}`:               {"errorNotExists"},
+		`{"detail": {}}`:                                       {"errorNotExists"},
+		`{"tags": {"a": 1}}`:                                   {"errorNotExists", "tagsExist"},
+		`{"tags": [], "detail": {"error": {"x": 1}}}`:          {"errorExists"},
+		`{"tags": [[1]], "x": 1}`:                              {"errorNotExists", "tagsExist"},
+		`{"list": [{"detail": {"error": {}}}], "tags": false}`: {"errorNotExists", "tagsExist"},
+	}
+	for event, want := range wanted {
+		matches, err := m.matchesForJSONEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
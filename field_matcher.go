@@ -120,21 +120,6 @@ func (m *fieldMatcher) addTransition(field *patternField) []*fieldMatcher {
 	var nextFieldMatchers []*fieldMatcher
 	for _, val := range field.vals {
 		nextFieldMatchers = append(nextFieldMatchers, vm.addTransition(val))
-
-		// if the val is a number, let's add a transition on the canonicalized number
-		// TODO: Only do this if asked
-		/*
-			if val.vType == numberType {
-				c, err := canonicalize([]byte(val.val))
-				if err == nil {
-					number := typedVal{
-						vType: literalType,
-						val:   c,
-					}
-					nextFieldMatchers = append(nextFieldMatchers, vm.addTransition(number))
-				}
-			}
-		*/
 	}
 	m.update(freshStart)
 	return nextFieldMatchers
@@ -151,5 +136,10 @@ func (m *fieldMatcher) transitionOn(field *Field) []*fieldMatcher {
 		return nil
 	}
 
+	// a presence marker for an object or array only matches "exists" patterns, which aren't in the valueMatcher
+	if field.Val == nil {
+		return nil
+	}
+
 	return valMatcher.transitionOn(field.Val)
 }
@@ -0,0 +1,455 @@
+package quamina
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileState is a LivePatternsState that keeps the live patterns in memory, as the default one does, but also
+// records them in files in a directory, so that they survive restarts; pass it to WithPatternStorage. Each Add
+// and Delete appends a record to a write-ahead log, and when the log has grown long enough, all the live patterns
+// are written to a snapshot and the log is emptied. NewFileState reads the snapshot and then the log. A record
+// that was only partly written when the process stopped, at the end of the log, is discarded, along with any
+// zeros or garbage after it; damage that's followed by good records is reported as an error.
+//
+// Since X values have to be written to files, only strings can be stored.
+type FileState struct {
+	live     *memState
+	dir      string
+	lock     sync.Mutex // held while writing
+	wal      *os.File
+	size     int64 // of the log
+	count    int   // records in the log
+	patterns int   // live patterns, which is how many records a snapshot holds
+	err      error // once writing has failed in a way that can't be undone, all writes fail
+
+	syncInterval        time.Duration
+	compactionThreshold int
+	dirty               bool // there are records in the log that haven't been synced
+	stop                chan struct{}
+	stopped             sync.WaitGroup
+
+	buf []byte
+}
+
+// FileStateOption is an interface type used in NewFileState to pass in options
+type FileStateOption func(s *FileState) error
+
+const (
+	fileStateSnapshot = "patterns.snapshot"
+	fileStateLog      = "patterns.wal"
+
+	// each record has a header with the length of its payload, a CRC-32C checksum of the payload, and one of
+	// those two; the payload is the operation, the length of the X, the X, and for adds, the pattern
+	fileStateHeaderSize = 12
+	fileStateAdd        = 1
+	fileStateDelete     = 2
+
+	defaultCompactionThreshold = 10000
+)
+
+var fileStateTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WithSyncInterval says how often the log is synced to storage with fsync. If the interval is zero, which is the
+// default, every Add and Delete waits until its record has been synced, so it's not lost even if the system
+// crashes; this is slow. If it's positive, the log is synced in the background at that interval, so a crash can
+// lose the changes made in the last interval. If it's negative, syncing is left to the operating system.
+func WithSyncInterval(d time.Duration) FileStateOption {
+	return func(s *FileState) error {
+		s.syncInterval = d
+		return nil
+	}
+}
+
+// WithCompactionThreshold sets how many records the log has to contain before it's compacted, as long as there
+// are also at least as many records as live patterns. The default is 10,000.
+func WithCompactionThreshold(records int) FileStateOption {
+	return func(s *FileState) error {
+		if records < 1 {
+			return errors.New("compaction threshold must be positive")
+		}
+		s.compactionThreshold = records
+		return nil
+	}
+}
+
+// NewFileState returns a FileState that keeps its files in dir, which is created if necessary, and contains the
+// patterns recorded there. Only one FileState at a time should use a directory.
+func NewFileState(dir string, opts ...FileStateOption) (*FileState, error) {
+	s := &FileState{live: newMemState(), dir: dir, compactionThreshold: defaultCompactionThreshold}
+	for _, option := range opts {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := os.Open(filepath.Join(dir, fileStateSnapshot))
+	if err == nil {
+		// snapshots are written to a temporary file and renamed, so unlike the log, one can't be torn
+		var info os.FileInfo
+		var size int64
+		if info, err = snapshot.Stat(); err == nil {
+			if size, _, err = s.replay(snapshot); err == nil && size != info.Size() {
+				err = fmt.Errorf("bad record at offset %d", size)
+			}
+		}
+		_ = snapshot.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fileStateSnapshot, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	s.wal, err = os.OpenFile(filepath.Join(dir, fileStateLog), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.size, s.count, err = s.replay(s.wal)
+	if err == nil {
+		// discard a partly-written record, if there is one, and append after the last good one
+		if err = s.wal.Truncate(s.size); err == nil {
+			_, err = s.wal.Seek(s.size, io.SeekStart)
+		}
+	}
+	if err != nil {
+		_ = s.wal.Close()
+		return nil, fmt.Errorf("%s: %w", fileStateLog, err)
+	}
+
+	if s.syncInterval > 0 {
+		s.stop = make(chan struct{})
+		s.stopped.Add(1)
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+// replay applies the records in a file to the live patterns, returning the size of the part of the file that
+// holds complete records, and how many there are
+func (s *FileState) replay(f *os.File) (int64, int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReaderSize(f, 64*1024)
+	var header [fileStateHeaderSize]byte
+	var size int64
+	count := 0
+	for {
+		// a record that was being written when the process stopped can only be the last one, and it may
+		// be incomplete, or complete but with garbage in it
+		if size+fileStateHeaderSize > info.Size() {
+			return size, count, nil
+		}
+		if _, err = io.ReadFull(reader, header[:]); err != nil {
+			return 0, 0, err
+		}
+		if crc32.Checksum(header[:8], fileStateTable) != binary.LittleEndian.Uint32(header[8:]) {
+			// if the process stopped while extending the file, what's left may be zeros or garbage, so
+			// this is only damage if there are good records after it
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				return 0, 0, err
+			}
+			if containsRecord(append(header[1:], rest...)) {
+				return 0, 0, fmt.Errorf("checksum mismatch in header of record at offset %d", size)
+			}
+			return size, count, nil
+		}
+		// the length can be trusted, so a record that runs past the end of the file is the last one
+		length := int64(binary.LittleEndian.Uint32(header[:4]))
+		end := size + fileStateHeaderSize + length
+		if end > info.Size() {
+			return size, count, nil
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return 0, 0, err
+		}
+		if crc32.Checksum(payload, fileStateTable) != binary.LittleEndian.Uint32(header[4:]) {
+			if end == info.Size() {
+				return size, count, nil
+			}
+			return 0, 0, fmt.Errorf("checksum mismatch in record at offset %d", size)
+		}
+		if err = s.apply(payload); err != nil {
+			return 0, 0, fmt.Errorf("record at offset %d: %w", size, err)
+		}
+		size = end
+		count++
+	}
+}
+
+// containsRecord checks whether there's a complete record with good checksums anywhere in data
+func containsRecord(data []byte) bool {
+	for i := 0; i+fileStateHeaderSize <= len(data); i++ {
+		header := data[i : i+fileStateHeaderSize]
+		if crc32.Checksum(header[:8], fileStateTable) != binary.LittleEndian.Uint32(header[8:]) {
+			continue
+		}
+		end := uint64(i) + fileStateHeaderSize + uint64(binary.LittleEndian.Uint32(header[:4]))
+		if end > uint64(len(data)) {
+			continue
+		}
+		payload := data[i+fileStateHeaderSize : end]
+		if crc32.Checksum(payload, fileStateTable) == binary.LittleEndian.Uint32(header[4:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies a record's payload to the live patterns
+func (s *FileState) apply(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("empty record")
+	}
+	xLength, n := binary.Uvarint(payload[1:])
+	if n <= 0 || xLength > uint64(len(payload)-1-n) {
+		return errors.New("bad X length")
+	}
+	x := string(payload[1+n : 1+n+int(xLength)])
+	switch payload[0] {
+	case fileStateAdd:
+		if s.live.add(x, string(payload[1+n+int(xLength):])) {
+			s.patterns++
+		}
+		return nil
+	case fileStateDelete:
+		deleted, err := s.live.Delete(x)
+		s.patterns -= deleted
+		return err
+	default:
+		return fmt.Errorf("unknown operation %d", payload[0])
+	}
+}
+
+// Add implements LivePatternsState
+func (s *FileState) Add(x X, pattern string) error {
+	name, ok := x.(string)
+	if !ok {
+		return fmt.Errorf("only X values that are strings can be stored in a FileState, not %T", x)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.write(fileStateAdd, name, pattern); err != nil {
+		return err
+	}
+	if s.live.add(name, pattern) {
+		s.patterns++
+	}
+	s.maybeCompact()
+	return nil
+}
+
+// Delete implements LivePatternsState
+func (s *FileState) Delete(x X) (int, error) {
+	name, ok := x.(string)
+	if !ok {
+		return 0, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if have, _ := s.live.Contains(name); !have {
+		return 0, nil
+	}
+	if err := s.write(fileStateDelete, name, ""); err != nil {
+		return 0, err
+	}
+	n, _ := s.live.Delete(name)
+	s.patterns -= n
+	s.maybeCompact()
+	return n, nil
+}
+
+// Iterate implements LivePatternsState
+func (s *FileState) Iterate(f func(x X, pattern string) error) error {
+	return s.live.Iterate(f)
+}
+
+// Contains implements LivePatternsState
+func (s *FileState) Contains(x X) (bool, error) {
+	return s.live.Contains(x)
+}
+
+// write appends a record to the log. If that fails, the log is truncated to remove whatever part of the record
+// was written, so the record has no effect.
+func (s *FileState) write(op byte, x string, pattern string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.buf = s.appendRecord(s.buf[:0], op, x, pattern)
+	if _, err := s.wal.Write(s.buf); err != nil {
+		s.undoWrite()
+		return err
+	}
+	if s.syncInterval == 0 {
+		if err := s.wal.Sync(); err != nil {
+			s.undoWrite()
+			return err
+		}
+	}
+	s.size += int64(len(s.buf))
+	s.count++
+	s.dirty = s.syncInterval != 0
+	return nil
+}
+
+func (s *FileState) undoWrite() {
+	if err := s.wal.Truncate(s.size); err != nil {
+		s.err = fmt.Errorf("log can't be repaired after failed write: %w", err)
+		return
+	}
+	if _, err := s.wal.Seek(s.size, io.SeekStart); err != nil {
+		s.err = fmt.Errorf("log can't be repaired after failed write: %w", err)
+	}
+}
+
+func (s *FileState) appendRecord(buf []byte, op byte, x string, pattern string) []byte {
+	var header [fileStateHeaderSize]byte
+	var xLength [binary.MaxVarintLen64]byte
+	start := len(buf)
+	buf = append(buf, header[:]...)
+	buf = append(buf, op)
+	buf = append(buf, xLength[:binary.PutUvarint(xLength[:], uint64(len(x)))]...)
+	buf = append(buf, x...)
+	buf = append(buf, pattern...)
+	payload := buf[start+fileStateHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, fileStateTable))
+	binary.LittleEndian.PutUint32(buf[start+8:], crc32.Checksum(buf[start:start+8], fileStateTable))
+	return buf
+}
+
+// maybeCompact compacts the log if it's grown past the threshold and is longer than a snapshot would be. The
+// change that caused this has already been recorded, so if compaction fails, that's not its problem; the log
+// just keeps growing until a compaction succeeds, and if the log is left unusable, the next change fails.
+func (s *FileState) maybeCompact() {
+	if s.count < s.compactionThreshold || s.count < s.patterns {
+		return
+	}
+	_ = s.compactWhileLocked()
+}
+
+// Compact writes all the live patterns to a new snapshot and empties the log.
+func (s *FileState) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.compactWhileLocked()
+}
+
+func (s *FileState) compactWhileLocked() error {
+	if s.err != nil {
+		return s.err
+	}
+	tmpName := filepath.Join(s.dir, fileStateSnapshot+".tmp")
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(tmp, 64*1024)
+	err = s.live.Iterate(func(x X, pattern string) error {
+		s.buf = s.appendRecord(s.buf[:0], fileStateAdd, x.(string), pattern)
+		_, err := writer.Write(s.buf)
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(s.dir, fileStateSnapshot))
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	// make the rename durable; this isn't possible everywhere, e.g. on Windows, hence no error
+	if dir, err := os.Open(s.dir); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+
+	// if the process stops before the log is emptied, replaying it over the new snapshot does no harm, since
+	// the snapshot already reflects it and replaying changes that have been applied doesn't alter the result
+	if err = s.wal.Truncate(0); err == nil {
+		_, err = s.wal.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.err = fmt.Errorf("log can't be emptied after compaction: %w", err)
+		return s.err
+	}
+	s.size = 0
+	s.count = 0
+	return s.wal.Sync()
+}
+
+// Sync syncs the log to storage, for use when WithSyncInterval isn't zero.
+func (s *FileState) Sync() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.syncWhileLocked()
+}
+
+func (s *FileState) syncWhileLocked() error {
+	if !s.dirty || s.wal == nil {
+		return nil
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *FileState) syncPeriodically() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = s.Sync()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the log. The FileState can't be changed after that.
+func (s *FileState) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		s.stopped.Wait()
+		s.stop = nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	err := s.syncWhileLocked()
+	if closeErr := s.wal.Close(); err == nil {
+		err = closeErr
+	}
+	s.wal = nil
+	s.err = errors.New("the FileState is closed")
+	return err
+}
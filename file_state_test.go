@@ -0,0 +1,279 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fileStateContents lists a FileState's patterns as sorted "x=pattern" strings
+func fileStateContents(t *testing.T, s *FileState) string {
+	t.Helper()
+	var got []string
+	err := s.Iterate(func(x X, pattern string) error {
+		got = append(got, fmt.Sprintf("%s=%s", x, pattern))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	return strings.Join(got, " ")
+}
+
+func openFileState(t *testing.T, dir string, opts ...FileStateOption) *FileState {
+	t.Helper()
+	s, err := NewFileState(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFileStateRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileState(t, dir)
+	for _, p := range []struct{ x, pattern string }{{"a", "1"}, {"b", "2"}, {"a", "3"}, {"c", "4"}} {
+		if err := s.Add(p.x, p.pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := s.Delete("b"); err != nil || n != 1 {
+		t.Fatalf("delete: %d, %v", n, err)
+	}
+	if n, err := s.Delete("nope"); err != nil || n != 0 {
+		t.Fatalf("delete: %d, %v", n, err)
+	}
+	if err := s.Add(1, "x"); err == nil {
+		t.Error("accepted a non-string X")
+	}
+	wanted := "a=1 a=3 c=4"
+	if got := fileStateContents(t, s); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("d", "5"); err == nil {
+		t.Error("accepted Add after Close")
+	}
+
+	s = openFileState(t, dir)
+	if got := fileStateContents(t, s); got != wanted {
+		t.Errorf("after reopening, wanted %s got %s", wanted, got)
+	}
+	if have, _ := s.Contains("a"); !have {
+		t.Error("lost a")
+	}
+	_ = s.Close()
+}
+
+func TestFileStateTornTail(t *testing.T) {
+	for _, damage := range []string{"partial", "garbage"} {
+		dir := t.TempDir()
+		s := openFileState(t, dir)
+		_ = s.Add("a", "1")
+		_ = s.Add("b", "2")
+		_ = s.Close()
+
+		// damage the last record as if the process had stopped while writing it
+		logName := filepath.Join(dir, fileStateLog)
+		log, err := os.ReadFile(logName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if damage == "partial" {
+			log = log[:len(log)-1]
+		} else {
+			log[len(log)-1] ^= 0xff
+		}
+		if err = os.WriteFile(logName, log, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		s = openFileState(t, dir)
+		if got := fileStateContents(t, s); got != "a=1" {
+			t.Errorf("%s: got %s", damage, got)
+		}
+		_ = s.Add("c", "3")
+		_ = s.Close()
+		s = openFileState(t, dir)
+		if got := fileStateContents(t, s); got != "a=1 c=3" {
+			t.Errorf("%s, after adding: got %s", damage, got)
+		}
+		_ = s.Close()
+	}
+
+	// nor do zeros or garbage that a crash left after the last record when the log was being extended
+	for _, tail := range [][]byte{make([]byte, 64), bytes.Repeat([]byte{0xa5, 0x3c, 0x0f}, 30)} {
+		dir := t.TempDir()
+		s := openFileState(t, dir)
+		_ = s.Add("a", "1")
+		_ = s.Add("b", "2")
+		_ = s.Close()
+		logName := filepath.Join(dir, fileStateLog)
+		log, _ := os.ReadFile(logName)
+		_ = os.WriteFile(logName, append(log, tail...), 0o644)
+
+		s = openFileState(t, dir)
+		if got := fileStateContents(t, s); got != "a=1 b=2" {
+			t.Errorf("tail %x: got %s", tail[:3], got)
+		}
+		_ = s.Add("c", "3")
+		_ = s.Close()
+		s = openFileState(t, dir)
+		if got := fileStateContents(t, s); got != "a=1 b=2 c=3" {
+			t.Errorf("tail %x, after adding: got %s", tail[:3], got)
+		}
+		_ = s.Close()
+	}
+
+	// damage anywhere but at the end isn't tolerated
+	dir := t.TempDir()
+	s := openFileState(t, dir)
+	_ = s.Add("a", "1")
+	_ = s.Add("b", "2")
+	_ = s.Close()
+	logName := filepath.Join(dir, fileStateLog)
+	log, _ := os.ReadFile(logName)
+	log[fileStateHeaderSize+1] ^= 0xff
+	_ = os.WriteFile(logName, log, 0o644)
+	if _, err := NewFileState(dir); err == nil {
+		t.Error("accepted damaged log")
+	}
+
+	// nor is a damaged length, even one that makes a record seem to run past the end of the log
+	dir = t.TempDir()
+	s = openFileState(t, dir)
+	_ = s.Add("a", "1")
+	_ = s.Add("b", "2")
+	_ = s.Add("c", "3")
+	_ = s.Close()
+	logName = filepath.Join(dir, fileStateLog)
+	log, _ = os.ReadFile(logName)
+	second := fileStateHeaderSize + int(binary.LittleEndian.Uint32(log))
+	binary.LittleEndian.PutUint32(log[second:], uint32(len(log)))
+	_ = os.WriteFile(logName, log, 0o644)
+	if _, err := NewFileState(dir); err == nil {
+		t.Error("accepted damaged length")
+	}
+	if after, _ := os.ReadFile(logName); len(after) != len(log) {
+		t.Error("truncated damaged log")
+	}
+}
+
+func TestFileStateCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileState(t, dir, WithCompactionThreshold(10), WithSyncInterval(-1))
+	for i := 0; i < 25; i++ {
+		_ = s.Add(fmt.Sprintf("x%d", i%3), fmt.Sprintf("p%d", i))
+		if i%4 == 3 {
+			_, _ = s.Delete(fmt.Sprintf("x%d", i%3))
+		}
+	}
+	wanted := fileStateContents(t, s)
+	if s.count >= 10 {
+		t.Errorf("log has %d records", s.count)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileStateSnapshot)); err != nil {
+		t.Error(err)
+	}
+
+	// as if the process stopped after writing a snapshot but before emptying the log
+	logName := filepath.Join(dir, fileStateLog)
+	log, _ := os.ReadFile(logName)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	_ = os.WriteFile(logName, log, 0o644)
+
+	s = openFileState(t, dir)
+	if got := fileStateContents(t, s); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+	if s.patterns != len(strings.Fields(wanted)) {
+		t.Errorf("counted %d patterns in %s", s.patterns, wanted)
+	}
+	_ = s.Close()
+
+	// a snapshot is never torn, so damage at its end isn't tolerated the way it is in the log
+	snapshotName := filepath.Join(dir, fileStateSnapshot)
+	snapshot, _ := os.ReadFile(snapshotName)
+	for _, damage := range []string{"partial", "garbage"} {
+		damaged := append([]byte{}, snapshot...)
+		if damage == "partial" {
+			damaged = damaged[:len(damaged)-1]
+		} else {
+			damaged[len(damaged)-1] ^= 0xff
+		}
+		_ = os.WriteFile(snapshotName, damaged, 0o644)
+		if _, err := NewFileState(dir); err == nil {
+			t.Errorf("%s: accepted damaged snapshot", damage)
+		}
+	}
+
+	if _, err := NewFileState(dir, WithCompactionThreshold(0)); err == nil {
+		t.Error("accepted zero compaction threshold")
+	}
+}
+
+func TestFileStateSyncInterval(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileState(t, dir, WithSyncInterval(time.Millisecond))
+	_ = s.Add("a", "1")
+	time.Sleep(20 * time.Millisecond)
+	s.lock.Lock()
+	dirty := s.dirty
+	s.lock.Unlock()
+	if dirty {
+		t.Error("not synced in the background")
+	}
+	_ = s.Add("b", "2")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openFileState(t, dir)
+	if got := fileStateContents(t, s); got != "a=1 b=2" {
+		t.Errorf("got %s", got)
+	}
+	_ = s.Close()
+}
+
+func TestFileStatePatternStorage(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileState(t, dir)
+	q, err := New(WithPatternStorage(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = q.AddPattern("queso", `{"likes": ["queso"]}`)
+	_ = q.AddPattern("tacos", `{"likes": ["tacos"]}`)
+	_ = q.DeletePatterns("tacos")
+	if err = q.AddPattern(17, `{"likes": ["numbers"]}`); err == nil {
+		t.Error("accepted a non-string X")
+	}
+	_ = s.Close()
+
+	s = openFileState(t, dir)
+	defer func() { _ = s.Close() }()
+	q, err = New(WithPatternStorage(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for event, wanted := range map[string]int{`{"likes": "queso"}`: 1, `{"likes": "tacos"}`: 0, `{"likes": "numbers"}`: 0} {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != wanted {
+			t.Errorf("%s: got %v", event, matches)
+		}
+	}
+}
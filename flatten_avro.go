@@ -0,0 +1,539 @@
+package quamina
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// flattenAvro implements Flattener for Avro records in the binary encoding, written with a schema which the
+// Flattener is given. As with the other binary formats, it produces the Fields that flattenJSON would for
+// the JSON form of the record, in which records and maps are objects, arrays are arrays, enums are their
+// symbols, and bytes and fixed values are base64 strings. Unions don't appear; the value is whichever branch
+// is present. Floats are written the way JavaScript would write them, with NaN and the infinities becoming
+// null. The record has to be bare, without the header of an object container file or a schema registry.
+// The schema says what every byte of the record is, so fields that no Pattern mentions are skipped without
+// being decoded, and once all the mentioned fields at the top level have been read, the rest of the record
+// is ignored. Arrays and maps written with the block sizes that Avro allows for this purpose are skipped a
+// block at a time.
+// Like flattenMsgpack, this keeps buffers for the values and ArrayTrails that it has to write, which are
+// re-used from one event to the next.
+type flattenAvro struct {
+	schema     *avroSchema
+	event      []byte
+	eventIndex int
+	fields     []Field
+	arrayTrail []ArrayPos
+	arrayCount int32
+
+	vals   []byte     // backing store for the values that aren't slices of the event
+	trails []ArrayPos // backing store for the ArrayTrail values
+
+	canonicalizeNumbers bool
+}
+
+// memberCounts is how many of the fields and nodes mentioned in a pathNode are still to be found in an object,
+// which for Avro is a record or map
+type memberCounts struct {
+	fields int
+	nodes  int
+}
+
+// NewAvroFlattener returns a Flattener for binary-encoded Avro records written with the given schema, which is
+// in the usual JSON form and whose top level has to be a record. Pass it to Quamina with WithFlattener.
+func NewAvroFlattener(schema []byte) (Flattener, error) {
+	parsed, err := parseAvroSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &flattenAvro{schema: parsed, fields: make([]Field, 0, 32)}, nil
+}
+
+func (fa *flattenAvro) Copy() Flattener {
+	return &flattenAvro{schema: fa.schema, fields: make([]Field, 0, 32), canonicalizeNumbers: fa.canonicalizeNumbers}
+}
+
+func (fa *flattenAvro) setCanonicalizeNumbers(b bool) {
+	fa.canonicalizeNumbers = b
+}
+
+// Flatten implements the Flattener interface. The Fields returned are only good until the next call.
+func (fa *flattenAvro) Flatten(event []byte, tracker SegmentsTreeTracker) ([]Field, error) {
+	fa.event = event
+	fa.eventIndex = 0
+	fa.fields = fa.fields[:0]
+	fa.arrayTrail = fa.arrayTrail[:0]
+	fa.arrayCount = 0
+	fa.vals = fa.vals[:0]
+	fa.trails = fa.trails[:0]
+
+	err := fa.readRecord(fa.schema, tracker)
+	if err != nil {
+		if errors.Is(err, errEarlyStop) {
+			return fa.fields, nil
+		}
+		return nil, err
+	}
+	if fa.eventIndex != len(event) {
+		return nil, fa.error("garbage after Avro record")
+	}
+	return fa.fields, nil
+}
+
+// readRecord reads a record's fields, storing Fields for those that the pathNode says are used, and skipping
+// the rest. Once it has seen all the fields mentioned in the pathNode, it skips the rest of the record, or
+// stops if this is the top level.
+func (fa *flattenAvro) readRecord(record *avroSchema, pathNode SegmentsTreeTracker) error {
+	counts := memberCounts{fields: pathNode.FieldsCount(), nodes: pathNode.NodesCount()}
+
+	// as in flattenJSON, the array trail doesn't change while we're in the record
+	arrayTrail := fa.trailCopy()
+
+	for i, field := range record.fields {
+		if counts.nodes == 0 && counts.fields == 0 {
+			if pathNode.IsRoot() {
+				return errEarlyStop
+			}
+			for _, rest := range record.fields[i:] {
+				if err := fa.skip(rest.schema); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		var err error
+		if pathNode.IsSegmentUsed(field.name) {
+			err = fa.readMember(field.name, field.schema, pathNode, arrayTrail, &counts)
+		} else {
+			err = fa.skip(field.schema)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMap reads a map, which is like a record but with names that come from the data, in blocks
+func (fa *flattenAvro) readMap(values *avroSchema, pathNode SegmentsTreeTracker) error {
+	counts := memberCounts{fields: pathNode.FieldsCount(), nodes: pathNode.NodesCount()}
+	arrayTrail := fa.trailCopy()
+
+	for {
+		count, err := fa.blockCount()
+		if err != nil || count == 0 {
+			return err
+		}
+		for ; count > 0; count-- {
+			if counts.nodes == 0 && counts.fields == 0 {
+				if err = fa.skipEntries(values, count); err != nil {
+					return err
+				}
+				return fa.skipBlocks(values, true)
+			}
+			key, err := fa.readBytes()
+			if err != nil {
+				return err
+			}
+			if pathNode.IsSegmentUsed(key) {
+				err = fa.readMember(key, values, pathNode, arrayTrail, &counts)
+			} else {
+				err = fa.skip(values)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readMember reads the value of a field in a record or an entry in a map, whose name the pathNode uses
+func (fa *flattenAvro) readMember(name []byte, schema *avroSchema, pathNode SegmentsTreeTracker, arrayTrail []ArrayPos, counts *memberCounts) error {
+	schema, err := fa.resolveUnion(schema)
+	if err != nil {
+		return err
+	}
+	path := pathNode.PathForSegment(name)
+	switch schema.typ {
+	case avroRecord, avroMap:
+		if needsPresenceMarker(pathNode, name) {
+			fa.storeField(path, arrayTrail, nil)
+			counts.fields--
+		}
+		objectPathNode, ok := pathNode.Get(name)
+		if !ok {
+			return fa.skip(schema)
+		}
+		counts.nodes--
+		if schema.typ == avroRecord {
+			return fa.readRecord(schema, objectPathNode)
+		}
+		return fa.readMap(schema.values, objectPathNode)
+
+	case avroArray:
+		// an empty array is encoded as a zero block count
+		empty := fa.eventIndex < len(fa.event) && fa.event[fa.eventIndex] == 0
+		marker, arrayPathNode := arrayMember(pathNode, name, empty)
+		if marker {
+			fa.storeField(path, arrayTrail, nil)
+			counts.fields--
+		}
+		return fa.readArray(path, arrayPathNode, schema.items)
+
+	default:
+		val, err := fa.readLeaf(schema)
+		if err != nil {
+			return err
+		}
+		if path != nil {
+			fa.storeField(path, arrayTrail, val)
+			counts.fields--
+		}
+		return nil
+	}
+}
+
+// readArray reads the elements of an array, which are in blocks
+func (fa *flattenAvro) readArray(pathName []byte, pathNode SegmentsTreeTracker, items *avroSchema) error {
+	fa.arrayCount++
+	fa.arrayTrail = append(fa.arrayTrail, ArrayPos{fa.arrayCount, 0})
+
+	for {
+		count, err := fa.blockCount()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			break
+		}
+		for ; count > 0; count-- {
+			fa.arrayTrail[len(fa.arrayTrail)-1].Pos++
+			item, err := fa.resolveUnion(items)
+			if err != nil {
+				return err
+			}
+			switch item.typ {
+			case avroRecord:
+				err = fa.readRecord(item, pathNode)
+			case avroMap:
+				err = fa.readMap(item.values, pathNode)
+			case avroArray:
+				err = fa.readArray(pathName, pathNode, item.items)
+			default:
+				if pathName == nil {
+					err = fa.skip(item)
+					break
+				}
+				var val []byte
+				val, err = fa.readLeaf(item)
+				if err == nil {
+					fa.storeField(pathName, fa.trailCopy(), val)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	fa.arrayTrail = fa.arrayTrail[:len(fa.arrayTrail)-1]
+	return nil
+}
+
+func (fa *flattenAvro) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	fa.fields = append(fa.fields, Field{Path: path, ArrayTrail: arrayTrail, Val: val})
+}
+
+// trailCopy returns a copy of the current array trail, see flattenMsgpack.trailCopy
+func (fa *flattenAvro) trailCopy() []ArrayPos {
+	if len(fa.arrayTrail) == 0 {
+		return nil
+	}
+	start := len(fa.trails)
+	fa.trails = append(fa.trails, fa.arrayTrail...)
+	return fa.trails[start:len(fa.trails):len(fa.trails)]
+}
+
+// valFrom returns what's been written to the vals buffer since start, see flattenMsgpack.valFrom
+func (fa *flattenAvro) valFrom(start int) []byte {
+	return fa.vals[start:len(fa.vals):len(fa.vals)]
+}
+
+// resolveUnion reads a union's branch index and returns the branch's schema. Other schemas are returned as is.
+func (fa *flattenAvro) resolveUnion(schema *avroSchema) (*avroSchema, error) {
+	if schema.typ != avroUnion {
+		return schema, nil
+	}
+	index, err := fa.readLong()
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= int64(len(schema.branches)) {
+		return nil, fa.error(fmt.Sprintf("Avro union branch %d out of range", index))
+	}
+	return schema.branches[index], nil
+}
+
+// readLeaf reads a value that's not a record, map, or array, and returns its JSON form
+func (fa *flattenAvro) readLeaf(schema *avroSchema) ([]byte, error) {
+	start := len(fa.vals)
+	switch schema.typ {
+	case avroNull:
+		return nullBytes, nil
+
+	case avroBoolean:
+		b, err := fa.readFixed(1)
+		if err != nil {
+			return nil, err
+		}
+		switch b[0] {
+		case 0:
+			return falseBytes, nil
+		case 1:
+			return trueBytes, nil
+		}
+		return nil, fa.error("invalid Avro boolean")
+
+	case avroInt, avroLong:
+		n, err := fa.readLong()
+		if err != nil {
+			return nil, err
+		}
+		fa.vals = strconv.AppendInt(fa.vals, n, 10)
+		return numberValue(fa.valFrom(start), fa.canonicalizeNumbers), nil
+
+	case avroFloat, avroDouble:
+		var f float64
+		bitSize := 64
+		if schema.typ == avroFloat {
+			b, err := fa.readFixed(4)
+			if err != nil {
+				return nil, err
+			}
+			f, bitSize = float64(math.Float32frombits(uint32(littleEndian(b)))), 32
+		} else {
+			b, err := fa.readFixed(8)
+			if err != nil {
+				return nil, err
+			}
+			f = math.Float64frombits(littleEndian(b))
+		}
+		var ok bool
+		fa.vals, ok = appendFloatText(fa.vals, f, bitSize)
+		if !ok {
+			return nullBytes, nil
+		}
+		return numberValue(fa.valFrom(start), fa.canonicalizeNumbers), nil
+
+	case avroString:
+		s, err := fa.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(s) {
+			return nil, fa.error("invalid UTF-8 in string")
+		}
+		fa.vals = append(fa.vals, '"')
+		fa.vals = append(fa.vals, s...)
+		fa.vals = append(fa.vals, '"')
+		return fa.valFrom(start), nil
+
+	case avroBytes, avroFixed:
+		var b []byte
+		var err error
+		if schema.typ == avroBytes {
+			b, err = fa.readBytes()
+		} else {
+			b, err = fa.readFixed(schema.size)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fa.vals = append(fa.vals, '"')
+		encodedStart := len(fa.vals)
+		for i := base64.StdEncoding.EncodedLen(len(b)); i > 0; i-- {
+			fa.vals = append(fa.vals, 0)
+		}
+		base64.StdEncoding.Encode(fa.vals[encodedStart:], b)
+		fa.vals = append(fa.vals, '"')
+		return fa.valFrom(start), nil
+
+	case avroEnum:
+		index, err := fa.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(schema.symbols)) {
+			return nil, fa.error(fmt.Sprintf("Avro enum index %d out of range", index))
+		}
+		return schema.symbols[index], nil
+	}
+	return nil, fa.error("unexpected Avro type")
+}
+
+// skip moves past a value without decoding any more of it than it has to
+func (fa *flattenAvro) skip(schema *avroSchema) error {
+	var err error
+	switch schema.typ {
+	case avroNull:
+	case avroBoolean:
+		_, err = fa.readFixed(1)
+	case avroInt, avroLong, avroEnum:
+		_, err = fa.readLong()
+	case avroFloat:
+		_, err = fa.readFixed(4)
+	case avroDouble:
+		_, err = fa.readFixed(8)
+	case avroBytes, avroString:
+		_, err = fa.readBytes()
+	case avroFixed:
+		_, err = fa.readFixed(schema.size)
+	case avroRecord:
+		for _, field := range schema.fields {
+			if err = fa.skip(field.schema); err != nil {
+				break
+			}
+		}
+	case avroArray:
+		err = fa.skipBlocks(schema.items, false)
+	case avroMap:
+		err = fa.skipBlocks(schema.values, true)
+	case avroUnion:
+		var branch *avroSchema
+		branch, err = fa.resolveUnion(schema)
+		if err == nil {
+			err = fa.skip(branch)
+		}
+	}
+	return err
+}
+
+// skipBlocks skips the remaining blocks of an array or map, using the block sizes when they're given
+func (fa *flattenAvro) skipBlocks(schema *avroSchema, isMap bool) error {
+	for {
+		count, err := fa.readLong()
+		if err != nil || count == 0 {
+			return err
+		}
+		if count < 0 {
+			size, err := fa.readLong()
+			if err != nil {
+				return err
+			}
+			if size < 0 {
+				return fa.error("negative Avro block size")
+			}
+			if _, err = fa.readFixed(int(size)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = fa.checkCount(count); err != nil {
+			return err
+		}
+		if isMap {
+			err = fa.skipEntries(schema, count)
+		} else {
+			for ; count > 0 && err == nil; count-- {
+				err = fa.skip(schema)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipEntries skips count entries in a block of a map
+func (fa *flattenAvro) skipEntries(values *avroSchema, count int64) error {
+	for ; count > 0; count-- {
+		if _, err := fa.readBytes(); err != nil {
+			return err
+		}
+		if err := fa.skip(values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockCount reads the count at the start of a block of an array or map. A negative count means that the
+// block's size in bytes follows, which is only useful when skipping.
+func (fa *flattenAvro) blockCount() (int64, error) {
+	count, err := fa.readLong()
+	if err != nil {
+		return 0, err
+	}
+	if count < 0 {
+		if count == math.MinInt64 {
+			return 0, fa.error("invalid Avro block count")
+		}
+		count = -count
+		if _, err = fa.readLong(); err != nil {
+			return 0, err
+		}
+	}
+	return count, fa.checkCount(count)
+}
+
+// checkCount rejects block counts bigger than what's left of the event, so that a corrupt count can't send us
+// round a loop for a very long time. That would only be legitimate for an array of nulls.
+func (fa *flattenAvro) checkCount(count int64) error {
+	if count > int64(len(fa.event)-fa.eventIndex) {
+		return fa.error("Avro block count too large")
+	}
+	return nil
+}
+
+// readLong reads a zig-zag varint, which is how ints and longs are written
+func (fa *flattenAvro) readLong() (int64, error) {
+	var u uint64
+	for shift := 0; shift < 64; shift += 7 {
+		if fa.eventIndex >= len(fa.event) {
+			return 0, fa.error("Avro record truncated")
+		}
+		b := fa.event[fa.eventIndex]
+		fa.eventIndex++
+		u |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return int64(u>>1) ^ -int64(u&1), nil
+		}
+	}
+	return 0, fa.error("Avro varint too long")
+}
+
+// readBytes reads a length-prefixed bytes or string value
+func (fa *flattenAvro) readBytes() ([]byte, error) {
+	length, err := fa.readLong()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, fa.error("negative Avro length")
+	}
+	return fa.readFixed(int(length))
+}
+
+func (fa *flattenAvro) readFixed(size int) ([]byte, error) {
+	if size > len(fa.event)-fa.eventIndex {
+		return nil, fa.error("Avro record truncated")
+	}
+	b := fa.event[fa.eventIndex : fa.eventIndex+size]
+	fa.eventIndex += size
+	return b, nil
+}
+
+func littleEndian(b []byte) uint64 {
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	return n
+}
+
+func (fa *flattenAvro) error(message string) error {
+	return fmt.Errorf("at offset %d in Avro record: %s", fa.eventIndex, message)
+}
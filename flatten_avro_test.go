@@ -0,0 +1,332 @@
+package quamina
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testAvroSchema = `{
+  "type": "record", "name": "Order", "namespace": "example",
+  "fields": [
+    {"name": "id", "type": "string"},
+    {"name": "amount", "type": "long"},
+    {"name": "items", "type": {"type": "array", "items": {
+      "type": "record", "name": "LineItem",
+      "fields": [ {"name": "sku", "type": "string"}, {"name": "qty", "type": "int"} ]
+    }}},
+    {"name": "tags", "type": {"type": "map", "values": "string"}},
+    {"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["PENDING", "SHIPPED"]}},
+    {"name": "note", "type": ["null", "string"]},
+    {"name": "ratio", "type": "double"},
+    {"name": "temperature", "type": "float"},
+    {"name": "hash", "type": {"type": "fixed", "name": "Hash", "size": 4}},
+    {"name": "blob", "type": "bytes"},
+    {"name": "rush", "type": "boolean"},
+    {"name": "address", "type": ["null", {"type": "record", "name": "Address", "fields": [ {"name": "city", "type": "string"} ]}]},
+    {"name": "codes", "type": {"type": "array", "items": "int"}},
+    {"name": "created", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "previous", "type": ["null", "example.Order"]}
+  ]
+}`
+
+// avroEncoder writes the Avro binary encoding
+type avroEncoder []byte
+
+func (a avroEncoder) long(n int64) avroEncoder {
+	u := uint64(n<<1) ^ uint64(n>>63)
+	for u >= 0x80 {
+		a = append(a, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(a, byte(u))
+}
+
+func (a avroEncoder) str(s string) avroEncoder {
+	return append(a.long(int64(len(s))), s...)
+}
+
+func (a avroEncoder) double(f float64) avroEncoder {
+	return appendLittleEndian(a, math.Float64bits(f), 8)
+}
+
+func (a avroEncoder) float(f float32) avroEncoder {
+	return appendLittleEndian(a, uint64(math.Float32bits(f)), 4)
+}
+
+// testAvroOrder writes an Order whose previous Order has the given id and no previous Order
+func testAvroOrder(previousID string) []byte {
+	codes := avroEncoder{}.long(3).long(-4).long(5)
+	a := avroEncoder{}.
+		str("order-1").
+		long(-5000).
+		long(1).str("apple").long(1).
+		long(1).str("banana").long(2).
+		long(0).
+		long(2).str("color").str("red").str("size").str("L").long(0).
+		long(1).
+		long(0).
+		double(0.25).
+		float(0.1)
+	a = append(a, 1, 2, 3, 4)
+	a = append(a.str("\x05\x06"), 1)
+	a = a.long(1).str("Vancouver").
+		long(-3).long(int64(len(codes)))
+	a = append(a, codes...)
+	a = a.long(0).
+		long(1700000000000)
+	if previousID == "" {
+		return a.long(0)
+	}
+	previous := testAvroOrder("")
+	a = a.long(1).str(previousID)
+	return append(a, previous[len(avroEncoder{}.str("order-1")):]...)
+}
+
+func TestAvroFlatten(t *testing.T) {
+	f, err := NewAvroFlattener([]byte(testAvroSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := fakeMatcher("id", "amount", "items\nsku", "items\nqty", "tags\ncolor", "status", "note", "ratio",
+		"temperature", "hash", "blob", "rush", "address\ncity", "codes", "created", "previous\nid",
+		"previous\nprevious").getSegmentsTreeTracker()
+	fields, err := f.Flatten(testAvroOrder("order-0"), tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, field := range fields {
+		got = append(got, strings.ReplaceAll(string(field.Path), "\n", ".")+"="+string(field.Val))
+	}
+	sort.Strings(got)
+	wanted := []string{
+		`address.city="Vancouver"`,
+		`amount=-5000`,
+		`blob="BQY="`,
+		`codes=-4`,
+		`codes=3`,
+		`codes=5`,
+		`created=1700000000000`,
+		`hash="AQIDBA=="`,
+		`id="order-1"`,
+		`items.qty=1`,
+		`items.qty=2`,
+		`items.sku="apple"`,
+		`items.sku="banana"`,
+		`note=null`,
+		`previous.id="order-0"`,
+		`previous.previous=null`,
+		`ratio=0.25`,
+		`rush=true`,
+		`status="SHIPPED"`,
+		`tags.color="red"`,
+		`temperature=0.1`,
+	}
+	if strings.Join(got, " ") != strings.Join(wanted, " ") {
+		t.Errorf("wanted\n%v\ngot\n%v", wanted, got)
+	}
+}
+
+func TestAvroMatching(t *testing.T) {
+	f, err := NewAvroFlattener([]byte(testAvroSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(WithFlattener(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, map[X]string{
+		"apple1":    `{"items": {"sku": ["apple"], "qty": [1]}}`,
+		"apple2":    `{"items": {"sku": ["apple"], "qty": [2]}}`,
+		"shipped":   `{"status": ["SHIPPED"], "amount": [ {"numeric": ["<", 0]} ]}`,
+		"red":       `{"tags": {"color": ["red"]}}`,
+		"address":   `{"address": [ {"exists": true} ]}`,
+		"noNote":    `{"note": [null], "codes": [5]}`,
+		"previous":  `{"previous": {"id": [ {"suffix": "-0"} ]}}`,
+		"vancouver": `{"address": {"city": [ {"equals-ignore-case": "VANCOUVER"} ]}}`,
+		"pending":   `{"status": ["PENDING"]}`,
+	})
+	matches, err := q.MatchesForEvent(testAvroOrder("order-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, "order", matches, []X{"apple1", "shipped", "red", "address", "noNote", "previous", "vancouver"})
+}
+
+func TestAvroSkipping(t *testing.T) {
+	f, err := NewAvroFlattener([]byte(testAvroSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the last field is used, so everything else is skipped, including the codes block by its size
+	event := testAvroOrder("order-0")
+	fields, err := f.Flatten(event, fakeMatcher("previous\ncreated").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || string(fields[0].Val) != "1700000000000" {
+		t.Errorf("got %v", fields)
+	}
+
+	// once the first field is read, the rest isn't looked at
+	event = append(testAvroOrder("")[:9], 0xff)
+	fields, err = f.Flatten(event, fakeMatcher("id").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || string(fields[0].Val) != `"order-1"` {
+		t.Errorf("got %v", fields)
+	}
+}
+
+func TestAvroEmptyArrays(t *testing.T) {
+	f, err := NewAvroFlattener([]byte(`{"type": "record", "name": "r", "fields": [
+		{"name": "codes", "type": {"type": "array", "items": "long"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(WithFlattener(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("exists", `{"codes": [ {"exists": true} ]}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("missing", `{"codes": [ {"exists": false} ]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// as in JSON, an empty array doesn't exist, and this is the case however its blocks are laid out
+	events := map[string]avroEncoder{
+		"empty":        avroEncoder{}.long(0),
+		"one":          avroEncoder{}.long(1).long(7).long(0),
+		"sized block":  avroEncoder{}.long(-1).long(1).long(7).long(0),
+		"second block": avroEncoder{}.long(1).long(7).long(1).long(8).long(0),
+	}
+	for name, event := range events {
+		wanted := X("exists")
+		if name == "empty" {
+			wanted = "missing"
+		}
+		matches, err := q.MatchesForEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 || matches[0] != wanted {
+			t.Errorf("%s: wanted %v got %v", name, wanted, matches)
+		}
+	}
+}
+
+func TestAvroSchemaErrors(t *testing.T) {
+	bads := []string{
+		`"string"`,
+		`{"type": "record", "name": "R"}`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "R", "fields": [ {"name": "x", "type": "Nope"} ]}`,
+		`{"type": "record", "name": "R", "fields": [ {"name": "x"} ]}`,
+		`{"type": "record", "name": "R", "fields": [ {"name": "x", "type": ["null", ["int"]]} ]}`,
+		`{"type": "record", "name": "R", "fields": [ {"name": "x", "type": []} ]}`,
+		`{"type": "record", "name": "R", "fields": [ {"name": "x", "type": {"type": "fixed", "name": "F"}} ]}`,
+		`{"type": "record", "name": "R", "fields": [ {"name": "x", "type": {"type": "array"}} ]}`,
+		`{"type": "record", "name": "R", "fields": [ {"name": "x", "type": {"type": "enum", "name": "R", "symbols": []}} ]}`,
+		`{"type": "record", "name": "R", "fields": [`,
+		`{"type": "record", "name": "A", "fields": [ {"name": "a", "type": "A"} ]}`,
+		`{"type": "record", "name": "A", "fields": [ {"name": "a", "type": ["A"]} ]}`,
+		`{"type": "record", "name": "A", "fields": [ {"name": "b", "type":
+			{"type": "record", "name": "B", "fields": [ {"name": "a", "type": ["A"]} ]}} ]}`,
+	}
+	for _, bad := range bads {
+		if _, err := NewAvroFlattener([]byte(bad)); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+
+	// references to named types resolve using the enclosing namespace
+	good := `{"type": "record", "name": "a.R", "fields": [
+		{"name": "x", "type": {"type": "record", "name": "S", "fields": []}},
+		{"name": "y", "type": "S"},
+		{"name": "z", "type": "a.S"},
+		{"name": "w", "type": {"type": "enum", "name": "b.E", "symbols": ["E1"]}},
+		{"name": "v", "type": "b.E"}
+	]}`
+	if _, err := NewAvroFlattener([]byte(good)); err != nil {
+		t.Error(err)
+	}
+
+	// records can contain themselves as long as the recursion can stop
+	for _, recursive := range []string{
+		`{"type": "record", "name": "A", "fields": [ {"name": "a", "type": ["null", "A"]} ]}`,
+		`{"type": "record", "name": "A", "fields": [ {"name": "a", "type": {"type": "array", "items": "A"}} ]}`,
+		`{"type": "record", "name": "A", "fields": [ {"name": "a", "type": {"type": "map", "values": "A"}} ]}`,
+		`{"type": "record", "name": "A", "fields": [ {"name": "b", "type":
+			{"type": "record", "name": "B", "fields": [ {"name": "a", "type": ["A", "int"]} ]}} ]}`,
+	} {
+		f, err := NewAvroFlattener([]byte(recursive))
+		if err != nil {
+			t.Errorf("%s: %s", recursive, err.Error())
+			continue
+		}
+		_, _ = f.Flatten([]byte{0}, fakeMatcher("a").getSegmentsTreeTracker())
+	}
+}
+
+func TestAvroErrors(t *testing.T) {
+	schema := `{"type": "record", "name": "R", "fields": [
+		{"name": "a", "type": ["null", "string"]},
+		{"name": "b", "type": "boolean"},
+		{"name": "c", "type": {"type": "enum", "name": "E", "symbols": ["X"]}},
+		{"name": "d", "type": {"type": "array", "items": "long"}}
+	]}`
+	f, err := NewAvroFlattener([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := fakeMatcher("a", "b", "c", "d").getSegmentsTreeTracker()
+	good := avroEncoder{}.long(1).str("x")
+	good = append(good, 1)
+	good = good.long(0).long(1).long(7).long(0)
+	if _, err := f.Flatten(good, tracker); err != nil {
+		t.Fatal(err)
+	}
+	badString := append(avroEncoder{}.long(1).str("\xff"), 1)
+	badString = badString.long(0).long(1).long(7).long(0)
+	bads := [][]byte{
+		{},
+		avroEncoder{}.long(2),
+		avroEncoder{}.long(-1),
+		append(avroEncoder{}.long(1).str("x"), 2),
+		append(append(avroEncoder{}.long(0), 0), avroEncoder{}.long(1)...),
+		append(append(avroEncoder{}.long(0), 0), avroEncoder{}.long(0).long(1000)...),
+		append(good, 0),
+		{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01},
+		badString,
+	}
+	for _, bad := range bads {
+		if _, err := f.Flatten(bad, tracker); err == nil {
+			t.Errorf("accepted % x", bad)
+		}
+	}
+}
+
+func TestAvroAllocations(t *testing.T) {
+	f, err := NewAvroFlattener([]byte(testAvroSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := fakeMatcher("id", "items\nsku", "items\nqty", "codes", "tags\ncolor", "ratio").getSegmentsTreeTracker()
+	event := testAvroOrder("order-0")
+	allocs := testing.AllocsPerRun(100, func() {
+		fields, err := f.Flatten(event, tracker)
+		if err != nil || len(fields) != 10 {
+			t.Errorf("flatten: %v %v", fields, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per flatten", allocs)
+	}
+}
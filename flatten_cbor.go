@@ -0,0 +1,571 @@
+package quamina
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"unicode/utf8"
+)
+
+// flattenCBOR implements Flattener for events encoded in CBOR, as specified in RFC 8949. It produces the same
+// Fields that flattenJSON would for the JSON equivalent of the event, so that the same Patterns work on both.
+// The conversions follow section 6.1 of the RFC: byte strings become base64url strings (or base64 or hex,
+// if tagged that way), NaN and the infinities become null, as does undefined. Floats are written the way
+// JavaScript would write them, and bignums and decimal fractions become numbers. Other tags are ignored.
+// Map keys have to be text strings or integers.
+// Like flattenJSON, this assumes the event is immutable, and uses the SegmentsTreeTracker to skip over parts
+// of the event that no Pattern mentions.
+type flattenCBOR struct {
+	event      []byte
+	eventIndex int
+	fields     []Field
+	arrayTrail []ArrayPos
+	arrayCount int32
+
+	canonicalizeNumbers bool
+}
+
+// CBOR major types
+const (
+	cborUnsigned byte = iota
+	cborNegative
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// CBOR tags that affect the conversion of the tagged item
+const (
+	cborTagPositiveBignum  = 2
+	cborTagNegativeBignum  = 3
+	cborTagDecimalFraction = 4
+	cborTagExpectBase64    = 22
+	cborTagExpectBase16    = 23
+	cborNoTag              = math.MaxUint64
+)
+
+// cborIndefinite is the additional information that marks an indefinite-length item, which ends with cborBreak
+const (
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+// cborHead is the information at the start of each CBOR data item. arg is the value given by the additional
+// information, which is a count or a length for most of the major types.
+type cborHead struct {
+	major      byte
+	additional byte
+	arg        uint64
+}
+
+func (h cborHead) indefinite() bool {
+	return h.additional == cborIndefinite
+}
+
+func newCBORFlattener() Flattener {
+	return &flattenCBOR{fields: make([]Field, 0, 32)}
+}
+
+func (fc *flattenCBOR) Copy() Flattener {
+	return &flattenCBOR{fields: make([]Field, 0, 32), canonicalizeNumbers: fc.canonicalizeNumbers}
+}
+
+func (fc *flattenCBOR) setCanonicalizeNumbers(b bool) {
+	fc.canonicalizeNumbers = b
+}
+
+// Flatten implements the Flattener interface. The event has to be a single CBOR map.
+func (fc *flattenCBOR) Flatten(event []byte, tracker SegmentsTreeTracker) ([]Field, error) {
+	fc.event = event
+	fc.eventIndex = 0
+	fc.fields = fc.fields[:0]
+	fc.arrayTrail = fc.arrayTrail[:0]
+	fc.arrayCount = 0
+	if len(event) == 0 {
+		return nil, errors.New("empty event")
+	}
+
+	_, head, err := fc.readTaggedHead()
+	if err != nil {
+		return nil, err
+	}
+	if head.major != cborMap {
+		return nil, errors.New("CBOR event is not a map")
+	}
+	err = fc.readMap(tracker, head)
+	if err != nil {
+		if errors.Is(err, errEarlyStop) {
+			return fc.fields, nil
+		}
+		return nil, err
+	}
+	if fc.eventIndex != len(event) {
+		return nil, fc.error("garbage after CBOR map")
+	}
+	return fc.fields, nil
+}
+
+// readMap reads the members of a map whose head has been read, storing Fields for those that the pathNode
+// says are used, and skipping the rest. Once it has seen all the members mentioned in the pathNode, it skips
+// the rest of the map, or stops if this is the top level.
+func (fc *flattenCBOR) readMap(pathNode SegmentsTreeTracker, head cborHead) error {
+	fieldsCount := pathNode.FieldsCount()
+	nodesCount := pathNode.NodesCount()
+
+	// as in flattenJSON, the array trail doesn't change while we're in the map
+	arrayTrail := make([]ArrayPos, len(fc.arrayTrail))
+	copy(arrayTrail, fc.arrayTrail)
+
+	for remaining := head.arg; head.indefinite() || remaining > 0; remaining-- {
+		if head.indefinite() {
+			atBreak, err := fc.atBreak()
+			if err != nil {
+				return err
+			}
+			if atBreak {
+				return nil
+			}
+		}
+		if nodesCount == 0 && fieldsCount == 0 {
+			if pathNode.IsRoot() {
+				return errEarlyStop
+			}
+			return fc.skipMembers(head, remaining)
+		}
+
+		memberName, err := fc.readMemberName()
+		if err != nil {
+			return err
+		}
+		if !pathNode.IsSegmentUsed(memberName) {
+			err = fc.skipItem()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		path := pathNode.PathForSegment(memberName)
+		tag, valHead, err := fc.readTaggedHead()
+		if err != nil {
+			return err
+		}
+		switch {
+		case valHead.major == cborMap:
+			if needsPresenceMarker(pathNode, memberName) {
+				fc.storeField(path, arrayTrail, nil)
+				fieldsCount--
+			}
+			objectPathNode, ok := pathNode.Get(memberName)
+			if ok {
+				nodesCount--
+				err = fc.readMap(objectPathNode, valHead)
+			} else {
+				err = fc.skipMembers(valHead, valHead.arg)
+			}
+
+		case valHead.major == cborArray && tag != cborTagDecimalFraction:
+			marker, arrayPathNode := arrayMember(pathNode, memberName, fc.emptyArray(valHead))
+			if marker {
+				fc.storeField(path, arrayTrail, nil)
+				fieldsCount--
+			}
+			err = fc.readArray(path, arrayPathNode, valHead)
+
+		default:
+			var val []byte
+			val, err = fc.readLeaf(tag, valHead)
+			if err == nil && path != nil {
+				fc.storeField(path, arrayTrail, val)
+				fieldsCount--
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readArray reads the elements of an array whose head has been read
+func (fc *flattenCBOR) readArray(pathName []byte, pathNode SegmentsTreeTracker, head cborHead) error {
+	fc.arrayCount++
+	fc.arrayTrail = append(fc.arrayTrail, ArrayPos{fc.arrayCount, 0})
+	defer func() { fc.arrayTrail = fc.arrayTrail[:len(fc.arrayTrail)-1] }()
+
+	for remaining := head.arg; head.indefinite() || remaining > 0; remaining-- {
+		if head.indefinite() {
+			atBreak, err := fc.atBreak()
+			if err != nil {
+				return err
+			}
+			if atBreak {
+				return nil
+			}
+		}
+		tag, elementHead, err := fc.readTaggedHead()
+		if err != nil {
+			return err
+		}
+		fc.arrayTrail[len(fc.arrayTrail)-1].Pos++
+		switch {
+		case elementHead.major == cborMap:
+			err = fc.readMap(pathNode, elementHead)
+		case elementHead.major == cborArray && tag != cborTagDecimalFraction:
+			err = fc.readArray(pathName, pathNode, elementHead)
+		default:
+			var val []byte
+			val, err = fc.readLeaf(tag, elementHead)
+			if err == nil && pathName != nil {
+				trail := make([]ArrayPos, len(fc.arrayTrail))
+				copy(trail, fc.arrayTrail)
+				fc.storeField(pathName, trail, val)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fc *flattenCBOR) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	fc.fields = append(fc.fields, Field{Path: path, ArrayTrail: arrayTrail, Val: val})
+}
+
+// readMemberName reads a map key, which has to be a text string or an integer, in which case its decimal
+// form is used as the name
+func (fc *flattenCBOR) readMemberName() ([]byte, error) {
+	_, head, err := fc.readTaggedHead()
+	if err != nil {
+		return nil, err
+	}
+	switch head.major {
+	case cborText:
+		return fc.readString(head)
+	case cborUnsigned, cborNegative:
+		return fc.integerText(head), nil
+	default:
+		return nil, fc.error("CBOR map key must be a text string or integer")
+	}
+}
+
+// readLeaf converts a data item which isn't a map or array, apart from a decimal fraction, to the form it
+// would have in JSON
+func (fc *flattenCBOR) readLeaf(tag uint64, head cborHead) ([]byte, error) {
+	switch head.major {
+	case cborUnsigned, cborNegative:
+		return numberValue(fc.integerText(head), fc.canonicalizeNumbers), nil
+
+	case cborBytes:
+		b, err := fc.readString(head)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case cborTagPositiveBignum, cborTagNegativeBignum:
+			n := new(big.Int).SetBytes(b)
+			if tag == cborTagNegativeBignum {
+				n.Not(n)
+			}
+			return numberValue([]byte(n.String()), fc.canonicalizeNumbers), nil
+		case cborTagExpectBase64:
+			return quoted([]byte(base64.StdEncoding.EncodeToString(b))), nil
+		case cborTagExpectBase16:
+			return quoted([]byte(hex.EncodeToString(b))), nil
+		default:
+			return quoted([]byte(base64.RawURLEncoding.EncodeToString(b))), nil
+		}
+
+	case cborText:
+		s, err := fc.readString(head)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(s) {
+			return nil, fc.error("invalid UTF-8 in CBOR text string")
+		}
+		return quoted(s), nil
+
+	case cborArray:
+		// only decimal fractions get here
+		return fc.readDecimalFraction(head)
+
+	case cborSimple:
+		switch head.additional {
+		case 20:
+			return falseBytes, nil
+		case 21:
+			return trueBytes, nil
+		case 25:
+			return fc.floatValue(halfToFloat(uint16(head.arg)), 64), nil
+		case 26:
+			return fc.floatValue(float64(math.Float32frombits(uint32(head.arg))), 32), nil
+		case 27:
+			return fc.floatValue(math.Float64frombits(head.arg), 64), nil
+		case cborIndefinite:
+			return nil, fc.error("unexpected CBOR break")
+		default:
+			// null, undefined, and unassigned simple values
+			return nullBytes, nil
+		}
+	}
+	return nil, fc.error(fmt.Sprintf("unexpected CBOR major type %d", head.major))
+}
+
+// readDecimalFraction reads the [exponent, mantissa] array in a decimal fraction and writes it in JSON's
+// exponential notation
+func (fc *flattenCBOR) readDecimalFraction(head cborHead) ([]byte, error) {
+	if head.indefinite() || head.arg != 2 {
+		return nil, fc.error("CBOR decimal fraction must be an array of two items")
+	}
+	_, exponentHead, err := fc.readTaggedHead()
+	if err != nil {
+		return nil, err
+	}
+	if exponentHead.major != cborUnsigned && exponentHead.major != cborNegative {
+		return nil, fc.error("CBOR decimal fraction exponent must be an integer")
+	}
+	exponent := fc.integerText(exponentHead)
+	tag, mantissaHead, err := fc.readTaggedHead()
+	if err != nil {
+		return nil, err
+	}
+	var mantissa []byte
+	switch {
+	case mantissaHead.major == cborUnsigned || mantissaHead.major == cborNegative:
+		mantissa = fc.integerText(mantissaHead)
+	case mantissaHead.major == cborBytes && (tag == cborTagPositiveBignum || tag == cborTagNegativeBignum):
+		saved := fc.canonicalizeNumbers
+		fc.canonicalizeNumbers = false
+		mantissa, err = fc.readLeaf(tag, mantissaHead)
+		fc.canonicalizeNumbers = saved
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fc.error("CBOR decimal fraction mantissa must be an integer")
+	}
+	number := append(append(mantissa, 'e'), exponent...)
+	return numberValue(number, fc.canonicalizeNumbers), nil
+}
+
+// integerText returns the decimal form of an integer whose head has been read. A negative integer's argument
+// is -1 minus its value, which can be 2^64, so can't always be computed with an int64
+func (fc *flattenCBOR) integerText(head cborHead) []byte {
+	if head.major == cborUnsigned {
+		return strconv.AppendUint(nil, head.arg, 10)
+	}
+	if head.arg == math.MaxUint64 {
+		return []byte("-18446744073709551616")
+	}
+	return strconv.AppendUint([]byte{'-'}, head.arg+1, 10)
+}
+
+// floatValue writes a float as appendFloatText does. JSON has no NaN or infinities, so those become null.
+func (fc *flattenCBOR) floatValue(f float64, bitSize int) []byte {
+	text, ok := appendFloatText(nil, f, bitSize)
+	if !ok {
+		return nullBytes
+	}
+	return numberValue(text, fc.canonicalizeNumbers)
+}
+
+// halfToFloat converts an IEEE 754 half-precision float, which Go doesn't have
+func halfToFloat(half uint16) float64 {
+	exponent := int(half>>10) & 0x1f
+	mantissa := float64(half & 0x3ff)
+	var f float64
+	switch exponent {
+	case 0:
+		f = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if half&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+func quoted(s []byte) []byte {
+	q := make([]byte, 0, len(s)+2)
+	q = append(q, '"')
+	q = append(q, s...)
+	return append(q, '"')
+}
+
+// readString returns the bytes of a byte or text string whose head has been read. If it's of definite length,
+// that's a slice of the event; otherwise the chunks have to be copied together.
+func (fc *flattenCBOR) readString(head cborHead) ([]byte, error) {
+	if !head.indefinite() {
+		return fc.readBytes(head.arg)
+	}
+	s := []byte{}
+	for {
+		atBreak, err := fc.atBreak()
+		if err != nil {
+			return nil, err
+		}
+		if atBreak {
+			return s, nil
+		}
+		chunkHead, err := fc.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if chunkHead.major != head.major || chunkHead.indefinite() {
+			return nil, fc.error("bad chunk in indefinite-length CBOR string")
+		}
+		chunk, err := fc.readBytes(chunkHead.arg)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+}
+
+func (fc *flattenCBOR) readBytes(length uint64) ([]byte, error) {
+	if length > uint64(len(fc.event)-fc.eventIndex) {
+		return nil, fc.error("CBOR string runs past end of event")
+	}
+	b := fc.event[fc.eventIndex : fc.eventIndex+int(length)]
+	fc.eventIndex += int(length)
+	return b, nil
+}
+
+// skipItem moves past a data item, including anything it contains
+func (fc *flattenCBOR) skipItem() error {
+	head, err := fc.readHead()
+	if err != nil {
+		return err
+	}
+	switch head.major {
+	case cborBytes, cborText:
+		_, err = fc.readString(head)
+	case cborArray:
+		err = fc.skipItems(head, head.arg)
+	case cborMap:
+		err = fc.skipMembers(head, head.arg)
+	case cborTag:
+		err = fc.skipItem()
+	case cborSimple:
+		if head.indefinite() {
+			err = fc.error("unexpected CBOR break")
+		}
+	}
+	return err
+}
+
+// skipMembers skips the remaining members of a map whose head has been read
+func (fc *flattenCBOR) skipMembers(head cborHead, remaining uint64) error {
+	if !head.indefinite() && remaining > math.MaxUint64/2 {
+		return fc.error("CBOR map too large")
+	}
+	return fc.skipItems(head, remaining*2)
+}
+
+// skipItems skips the remaining items in an array or map whose head has been read
+func (fc *flattenCBOR) skipItems(head cborHead, remaining uint64) error {
+	for ; head.indefinite() || remaining > 0; remaining-- {
+		if head.indefinite() {
+			atBreak, err := fc.atBreak()
+			if err != nil {
+				return err
+			}
+			if atBreak {
+				return nil
+			}
+		}
+		err := fc.skipItem()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyArray says whether the array whose head has just been read has no elements
+func (fc *flattenCBOR) emptyArray(head cborHead) bool {
+	if head.indefinite() {
+		return fc.eventIndex < len(fc.event) && fc.event[fc.eventIndex] == cborBreak
+	}
+	return head.arg == 0
+}
+
+// atBreak checks for the break that ends an indefinite-length item, and moves past it if found
+func (fc *flattenCBOR) atBreak() (bool, error) {
+	if fc.eventIndex >= len(fc.event) {
+		return false, fc.error("CBOR event truncated")
+	}
+	if fc.event[fc.eventIndex] == cborBreak {
+		fc.eventIndex++
+		return true, nil
+	}
+	return false, nil
+}
+
+// readTaggedHead reads a data item's head, first reading any tags, and returns the innermost tag, or cborNoTag
+func (fc *flattenCBOR) readTaggedHead() (uint64, cborHead, error) {
+	tag := uint64(cborNoTag)
+	for {
+		head, err := fc.readHead()
+		if err != nil {
+			return tag, head, err
+		}
+		if head.major != cborTag {
+			return tag, head, nil
+		}
+		tag = head.arg
+	}
+}
+
+func (fc *flattenCBOR) readHead() (cborHead, error) {
+	var head cborHead
+	if fc.eventIndex >= len(fc.event) {
+		return head, fc.error("CBOR event truncated")
+	}
+	initial := fc.event[fc.eventIndex]
+	fc.eventIndex++
+	head.major = initial >> 5
+	head.additional = initial & 0x1f
+	switch {
+	case head.additional < 24:
+		head.arg = uint64(head.additional)
+	case head.additional <= 27:
+		size := 1 << (head.additional - 24)
+		if fc.eventIndex+size > len(fc.event) {
+			return head, fc.error("CBOR event truncated")
+		}
+		for _, b := range fc.event[fc.eventIndex : fc.eventIndex+size] {
+			head.arg = head.arg<<8 | uint64(b)
+		}
+		fc.eventIndex += size
+	case head.additional == cborIndefinite:
+		switch head.major {
+		case cborBytes, cborText, cborArray, cborMap, cborSimple:
+		default:
+			return head, fc.error(fmt.Sprintf("CBOR major type %d can't have indefinite length", head.major))
+		}
+	default:
+		return head, fc.error(fmt.Sprintf("reserved CBOR additional information %d", head.additional))
+	}
+	return head, nil
+}
+
+func (fc *flattenCBOR) error(message string) error {
+	return fmt.Errorf("at offset %d in CBOR event: %s", fc.eventIndex, message)
+}
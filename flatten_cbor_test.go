@@ -0,0 +1,294 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCBORLeafValues(t *testing.T) {
+	// mostly from Appendix A of RFC 8949
+	leaves := map[string]string{
+		"00":                           "0",
+		"17":                           "23",
+		"1818":                         "24",
+		"1b000000e8d4a51000":           "1000000000000",
+		"1bffffffffffffffff":           "18446744073709551615",
+		"c249010000000000000000":       "18446744073709551616",
+		"3bffffffffffffffff":           "-18446744073709551616",
+		"c349010000000000000000":       "-18446744073709551617",
+		"20":                           "-1",
+		"3863":                         "-100",
+		"f90000":                       "0",
+		"f98000":                       "0",
+		"f93c00":                       "1",
+		"fb3ff199999999999a":           "1.1",
+		"f93e00":                       "1.5",
+		"f97bff":                       "65504",
+		"fa47c35000":                   "100000",
+		"fa7f7fffff":                   "3.4028235e+38",
+		"fa3dcccccd":                   "0.1",
+		"fb7e37e43c8800759c":           "1e+300",
+		"f90001":                       "5.960464477539063e-8",
+		"f90400":                       "0.00006103515625",
+		"f9c400":                       "-4",
+		"fbc010666666666666":           "-4.1",
+		"f97c00":                       "null",
+		"f9fc00":                       "null",
+		"f97e00":                       "null",
+		"fa7fc00000":                   "null",
+		"f4":                           "false",
+		"f5":                           "true",
+		"f6":                           "null",
+		"f7":                           "null",
+		"40":                           `""`,
+		"4401020304":                   `"AQIDBA"`,
+		"5f42010243030405ff":           `"AQIDBAU"`,
+		"d64401020304":                 `"AQIDBA=="`,
+		"d74401020304":                 `"01020304"`,
+		"d818456449455446":             `"ZElFVEY"`,
+		"60":                           `""`,
+		"6161":                         `"a"`,
+		"62c3bc":                       `"ü"`,
+		"7f657374726561646d696e67ff":   `"streaming"`,
+		"c11a514b67b0":                 "1363896240",
+		"c48221196ab3":                 "27315e-2",
+		"c48201c249010000000000000000": "18446744073709551616e1",
+	}
+	f := newCBORFlattener()
+	tracker := fakeMatcher("a").getSegmentsTreeTracker()
+	for leaf, wanted := range leaves {
+		item, _ := hex.DecodeString(leaf)
+		event := append([]byte{0xa1, 0x61, 'a'}, item...)
+		fields, err := f.Flatten(event, tracker)
+		if err != nil {
+			t.Errorf("%s: %s", leaf, err.Error())
+			continue
+		}
+		if len(fields) != 1 || string(fields[0].Val) != wanted {
+			t.Errorf("%s: wanted %s got %v", leaf, wanted, fields)
+		}
+	}
+}
+
+func TestCBORErrors(t *testing.T) {
+	bads := []string{
+		"",
+		"01",
+		"80",
+		"a1",
+		"a16161",
+		"a161611c",
+		"a1616119",
+		"a1616164616263",
+		"a1f46161",
+		"a1a0616101",
+		"a16161ff",
+		"a161619f01",
+		"a161615f6161ff",
+		"a161611f",
+		"a1616101ff",
+		"a1616101a0",
+		"a16161c482010203",
+		"a16161c48201f5",
+		"bf616101",
+		"a1616161ff",
+		"a161617f61ffff",
+	}
+	f := newCBORFlattener()
+	tracker := fakeMatcher("a", "b").getSegmentsTreeTracker()
+	for _, bad := range bads {
+		event, _ := hex.DecodeString(bad)
+		_, err := f.Flatten(event, tracker)
+		if err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestCBORMatchesJSON(t *testing.T) {
+	patterns := []string{
+		`{"Image": {"Width": [800], "Animated": [false]}}`,
+		`{"Image": {"Thumbnail": {"Url": [ {"prefix": "https:"} ]}}}`,
+		`{"Image": {"IDs": [943, 38793]}}`,
+		`{"Image": {"Title": [ {"equals-ignore-case": "view from 15th floor"} ]}}`,
+		`{"Image": {"Thumbnail": [ {"exists": true} ]}}`,
+		`{"Image": {"Missing": [ {"exists": false} ]}}`,
+		`{"Image": {"IDs": [ {"exists": false} ]}}`,
+		`{"Image": {"Ratio": [1.5], "Caption": [null]}}`,
+		`{"a": {"b": [1], "c": [4]}}`,
+		`{"a": {"b": [3], "c": [4]}}`,
+		`{"z": [ {"numeric": ["<", 0]} ]}`,
+	}
+	events := []string{
+		`{
+			"Image": {
+				"Width":  800,
+				"Height": 600,
+				"Title":  "View from 15th Floor",
+				"Thumbnail": {
+					"Url":    "https://www.example.com/image/481989943",
+					"Height": 125,
+					"Width":  100
+				},
+				"Animated" : false,
+				"IDs": [116, 943, 234, 38793],
+				"Ratio": 1.5,
+				"Caption": null
+			}
+		}`,
+		`{"Image": {"Thumbnail": {"Url": "http://example.com"}, "Width": 800, "Animated": true}}`,
+		`{"Image": {"IDs": [], "Width": 800, "Animated": false}}`,
+		`{"a": [ {"b": 1, "c": 2}, {"b": 3, "c": 4} ], "z": -0.25}`,
+		`{"x": {"y": [1, [2, {"z": 3}]]}, "z": [1, [-1]]}`,
+	}
+	qJSON, _ := New()
+	qCBOR, _ := New(WithMediaType("application/cbor"))
+	for _, pattern := range patterns {
+		if err := qJSON.AddPattern(pattern, pattern); err != nil {
+			t.Fatal(err)
+		}
+		if err := qCBOR.AddPattern(pattern, pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, event := range events {
+		jsonMatches, err := qJSON.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cborMatches, err := qCBOR.MatchesForEvent(jsonToCBOR(t, event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jsonMatches) == 0 && !strings.HasPrefix(event, `{"x"`) {
+			t.Errorf("no matches for %s", event)
+		}
+		if len(jsonMatches) != len(cborMatches) {
+			t.Errorf("%s: JSON %v CBOR %v", event, jsonMatches, cborMatches)
+			continue
+		}
+		for _, m := range jsonMatches {
+			if !containsX(cborMatches, m) {
+				t.Errorf("%s: JSON %v CBOR %v", event, jsonMatches, cborMatches)
+			}
+		}
+	}
+}
+
+func TestCBORInvalidUTF8(t *testing.T) {
+	q, _ := New(WithMediaType("application/cbor"))
+	if err := q.AddPattern("p", `{"a": ["x", "y"]}`); err != nil {
+		t.Fatal(err)
+	}
+	_, err := q.MatchesForEvent([]byte{0xa1, 0x61, 'a', 0x61, 0xff})
+	if err == nil {
+		t.Error("accepted invalid UTF-8")
+	}
+}
+
+func TestCBORCanonicalNumbers(t *testing.T) {
+	q, _ := New(WithMediaType("application/cbor"), WithNumberCanonicalization(true))
+	if err := q.AddPattern("p", `{"a": [35]}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"1823", "f95060", "fa420c0000", "c482011823", "c482001823"} {
+		b, _ := hex.DecodeString(item)
+		event := append([]byte{0xa1, 0x61, 'a'}, b...)
+		matches, err := q.MatchesForEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wanted := 1
+		if item == "c482011823" {
+			wanted = 0
+		}
+		if len(matches) != wanted {
+			t.Errorf("%s: got %v", item, matches)
+		}
+	}
+}
+
+// jsonToCBOR encodes the JSON text as CBOR, with integers as integers and other numbers as doubles
+func jsonToCBOR(t *testing.T, jsonText string) []byte {
+	t.Helper()
+	d := json.NewDecoder(strings.NewReader(jsonText))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeCBOR(&buf, v)
+	return buf.Bytes()
+}
+
+func writeCBOR(buf *bytes.Buffer, v any) {
+	switch tv := v.(type) {
+	case map[string]any:
+		writeCBORHead(buf, cborMap, uint64(len(tv)))
+		keys := make([]string, 0, len(tv))
+		for k := range tv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeCBOR(buf, k)
+			writeCBOR(buf, tv[k])
+		}
+	case []any:
+		writeCBORHead(buf, cborArray, uint64(len(tv)))
+		for _, element := range tv {
+			writeCBOR(buf, element)
+		}
+	case string:
+		writeCBORHead(buf, cborText, uint64(len(tv)))
+		buf.WriteString(tv)
+	case json.Number:
+		if i, err := tv.Int64(); err == nil {
+			if i >= 0 {
+				writeCBORHead(buf, cborUnsigned, uint64(i))
+			} else {
+				writeCBORHead(buf, cborNegative, uint64(-1-i))
+			}
+			return
+		}
+		f, _ := tv.Float64()
+		buf.WriteByte(0xfb)
+		bits := math.Float64bits(f)
+		for shift := 56; shift >= 0; shift -= 8 {
+			buf.WriteByte(byte(bits >> shift))
+		}
+	case bool:
+		if tv {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case nil:
+		buf.WriteByte(0xf6)
+	}
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		buf.WriteByte(byte(arg >> 8))
+		buf.WriteByte(byte(arg))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		for shift := 56; shift >= 0; shift -= 8 {
+			buf.WriteByte(byte(arg >> shift))
+		}
+	}
+}
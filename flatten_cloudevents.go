@@ -0,0 +1,202 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// flattenCloudEvent implements Flattener for CloudEvents (https://cloudevents.io/) in the structured mode of the
+// JSON event format, where the event is a JSON object whose members are the context attributes, such as "type"
+// and "source", plus the payload in "data", or base64-encoded in "data_base64". The event is flattened as JSON,
+// except that a "data_base64" payload is decoded and presented as "data", so that Patterns can reach into it
+// regardless of how it was sent. It also flattens HTTP requests carrying CloudEvents in binary mode, where the
+// context attributes are "ce-" headers and the body is the payload, into the same layout.
+//
+// A payload is presented as JSON if its content type, from "datacontenttype" or the Content-Type header, is
+// JSON or absent and it is valid JSON, and otherwise as a string, if it's valid UTF-8.
+type flattenCloudEvent struct {
+	envelope Flattener // for the event
+	payload  Flattener // for a payload that had to be decoded
+	fields   []Field
+	wrapped  []byte // a decoded payload, as the "data" member of a JSON object
+
+	// maxBodySize is how big the body of a request can be, see flattenRequest
+	maxBodySize int64
+
+	canonicalizeNumbers bool
+}
+
+var (
+	cloudEventDataSegment        = []byte("data")
+	cloudEventContentTypeSegment = []byte("datacontenttype")
+	cloudEventBase64Member       = []byte(`"data_base64"`)
+)
+
+const cloudEventsMediaType = "application/cloudevents+json"
+
+func newCloudEventFlattener() Flattener {
+	return &flattenCloudEvent{envelope: newJSONFlattener(), payload: newJSONFlattener(), fields: make([]Field, 0, 32),
+		maxBodySize: defaultMaxRequestBodySize}
+}
+
+func (fc *flattenCloudEvent) Copy() Flattener {
+	f := newCloudEventFlattener()
+	f.(numberCanonicalizer).setCanonicalizeNumbers(fc.canonicalizeNumbers)
+	return f
+}
+
+func (fc *flattenCloudEvent) setCanonicalizeNumbers(b bool) {
+	fc.canonicalizeNumbers = b
+	fc.envelope.(numberCanonicalizer).setCanonicalizeNumbers(b)
+	fc.payload.(numberCanonicalizer).setCanonicalizeNumbers(b)
+}
+
+// Flatten implements the Flattener interface for a CloudEvent in structured mode
+func (fc *flattenCloudEvent) Flatten(event []byte, tracker SegmentsTreeTracker) ([]Field, error) {
+	fields, err := fc.envelope.Flatten(event, tracker)
+	if err != nil {
+		return nil, err
+	}
+	fc.fields = append(fc.fields[:0], fields...)
+	if !tracker.IsSegmentUsed(cloudEventDataSegment) || !bytes.Contains(event, cloudEventBase64Member) {
+		return fc.fields, nil
+	}
+
+	// this means reading the event again, but only when there's a base64 payload that a Pattern wants
+	var envelope struct {
+		DataBase64      *string `json:"data_base64"`
+		DataContentType string  `json:"datacontenttype"`
+	}
+	if err = json.Unmarshal(event, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.DataBase64 == nil {
+		return fc.fields, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(*envelope.DataBase64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data_base64: %w", err)
+	}
+	if err = fc.addPayload(payload, envelope.DataContentType, tracker); err != nil {
+		return nil, err
+	}
+	return fc.fields, nil
+}
+
+// flattenRequest flattens an HTTP request carrying a CloudEvent, in binary mode, or in structured mode if its
+// Content-Type says so. The body is only read if it's needed, and is replaced with a copy so that handlers can
+// still read it. Attribute values that aren't valid UTF-8 are an error.
+func (fc *flattenCloudEvent) flattenRequest(r *http.Request, tracker SegmentsTreeTracker) ([]Field, error) {
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == cloudEventsMediaType {
+		body, err := readRequestBody(r, fc.maxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		return fc.Flatten(body, tracker)
+	}
+
+	fc.fields = fc.fields[:0]
+	for name, values := range r.Header {
+		if len(name) <= 3 || !strings.EqualFold(name[:3], "ce-") || len(values) == 0 {
+			continue
+		}
+		path := tracker.PathForSegment([]byte(strings.ToLower(name[3:])))
+		if path == nil {
+			continue
+		}
+		// the HTTP binding percent-encodes attribute values, which can decode to anything
+		value, err := url.PathUnescape(values[0])
+		if err != nil {
+			value = values[0]
+		}
+		val, err := requestValue(value)
+		if err != nil {
+			return nil, err
+		}
+		fc.fields = append(fc.fields, Field{Path: path, Val: val})
+	}
+	if path := tracker.PathForSegment(cloudEventContentTypeSegment); path != nil && contentType != "" {
+		val, err := requestValue(contentType)
+		if err != nil {
+			return nil, err
+		}
+		fc.fields = append(fc.fields, Field{Path: path, Val: val})
+	}
+	if tracker.IsSegmentUsed(cloudEventDataSegment) {
+		body, err := readRequestBody(r, fc.maxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		if err = fc.addPayload(body, contentType, tracker); err != nil {
+			return nil, err
+		}
+	}
+	return fc.fields, nil
+}
+
+// addPayload adds the Fields for a payload, which it presents to the JSON flattener as the "data" member of an
+// object, so the Paths come out right
+func (fc *flattenCloudEvent) addPayload(payload []byte, contentType string, tracker SegmentsTreeTracker) error {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return nil
+	}
+	fc.wrapped = append(fc.wrapped[:0], `{"data":`...)
+	switch {
+	case isJSONMediaType(contentType) && json.Valid(trimmed):
+		fc.wrapped = append(fc.wrapped, trimmed...)
+	case utf8.Valid(payload):
+		asString, _ := json.Marshal(string(payload))
+		fc.wrapped = append(fc.wrapped, asString...)
+	default:
+		return nil
+	}
+	fc.wrapped = append(fc.wrapped, '}')
+	fields, err := fc.payload.Flatten(fc.wrapped, tracker)
+	if err != nil {
+		return err
+	}
+
+	// both flatteners number their arrays from 1, so the payload's arrays are renumbered to follow the others
+	var arrayCount int32
+	for _, field := range fc.fields {
+		for _, pos := range field.ArrayTrail {
+			if pos.Array > arrayCount {
+				arrayCount = pos.Array
+			}
+		}
+	}
+	for _, field := range fields {
+		if arrayCount > 0 && len(field.ArrayTrail) > 0 {
+			// trails may be shared between fields, so they're copied rather than changed
+			trail := make([]ArrayPos, len(field.ArrayTrail))
+			for i, pos := range field.ArrayTrail {
+				trail[i] = ArrayPos{Array: pos.Array + arrayCount, Pos: pos.Pos}
+			}
+			field.ArrayTrail = trail
+		}
+		fc.fields = append(fc.fields, field)
+	}
+	return nil
+}
+
+// isJSONMediaType says whether a content type is JSON, taking its absence to mean JSON, as the JSON event
+// format does
+func isJSONMediaType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
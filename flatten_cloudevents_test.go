@@ -0,0 +1,141 @@
+package quamina
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testCloudEventData = `{"order": {"id": 17, "items": [{"sku": "a", "qty": 1}, {"sku": "b", "qty": 2}]}}`
+
+var testCloudEventPatterns = map[X]string{
+	"type":    `{"type": ["com.example.order.created"], "source": [ {"prefix": "/shop/"} ]}`,
+	"ext":     `{"tenant": ["acme"]}`,
+	"a1":      `{"data": {"order": {"items": {"sku": ["a"], "qty": [1]}}}}`,
+	"a2":      `{"data": {"order": {"items": {"sku": ["a"], "qty": [2]}}}}`,
+	"orderID": `{"data": {"order": {"id": [17]}}, "datacontenttype": [ {"prefix": "application/json"} ]}`,
+	"subject": `{"subject": [ {"exists": true} ]}`,
+}
+
+// testCloudEventWanted is what the Patterns above match in a CloudEvent with testCloudEventData
+var testCloudEventWanted = []X{"type", "ext", "a1", "orderID"}
+
+func newCloudEventQuamina(t *testing.T, opts ...Option) *Quamina {
+	t.Helper()
+	q, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, testCloudEventPatterns)
+	return q
+}
+
+func structuredCloudEvent(data string) string {
+	return `{"specversion": "1.0", "type": "com.example.order.created", "source": "/shop/eu", "id": "e-1",
+  "tenant": "acme", "datacontenttype": "application/json", ` + data + `}`
+}
+
+func TestCloudEventStructured(t *testing.T) {
+	q := newCloudEventQuamina(t, WithMediaType("application/cloudevents+json"))
+	encoded := base64.StdEncoding.EncodeToString([]byte(testCloudEventData))
+	for _, data := range []string{`"data": ` + testCloudEventData, `"data_base64": "` + encoded + `"`} {
+		matches, err := q.MatchesForEvent([]byte(structuredCloudEvent(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMatches(t, data, matches, testCloudEventWanted)
+	}
+
+	if _, err := q.MatchesForEvent([]byte(structuredCloudEvent(`"data_base64": "!!"`))); err == nil {
+		t.Error("accepted bad base64")
+	}
+}
+
+func TestCloudEventPayloads(t *testing.T) {
+	tracker := fakeMatcher("data", "data\nx").getSegmentsTreeTracker()
+	tests := []struct {
+		contentType string
+		payload     string
+		wanted      string
+	}{
+		{"", `{"x": 1}`, `data.x=1`},
+		{"application/vnd.example+json; charset=utf-8", `{"x": [1, 2]}`, `data.x=1 data.x=2`},
+		{"application/json", `"just a string"`, `data="just a string"`},
+		{"application/json", `not JSON`, `data="not JSON"`},
+		{"text/plain", `{"x": 1}`, `data="{"x": 1}"`},
+		{"application/octet-stream", "\xff\xfe", ``},
+		{"application/json", "  ", ``},
+	}
+	for _, test := range tests {
+		fc := newCloudEventFlattener().(*flattenCloudEvent)
+		if err := fc.addPayload([]byte(test.payload), test.contentType, tracker); err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(valueFieldStrings(fc.fields), " ")
+		if got != test.wanted {
+			t.Errorf("%s %q: wanted %s got %s", test.contentType, test.payload, test.wanted, got)
+		}
+	}
+
+	// arrays in the envelope and in a decoded payload mustn't be confused
+	fields, err := newCloudEventFlattener().Flatten([]byte(`{"list": [1, 2], "data_base64": "`+
+		base64.StdEncoding.EncodeToString([]byte(`{"x": [3, 4]}`))+`"}`), fakeMatcher("list", "data\nx").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrays := make(map[int32]string)
+	for _, field := range fields {
+		for _, pos := range field.ArrayTrail {
+			if path, ok := arrays[pos.Array]; ok && path != string(field.Path) {
+				t.Errorf("array %d used for %q and %q", pos.Array, path, field.Path)
+			}
+			arrays[pos.Array] = string(field.Path)
+		}
+	}
+	if len(arrays) != 2 {
+		t.Errorf("arrays: %v", arrays)
+	}
+}
+
+func TestCloudEventHTTP(t *testing.T) {
+	q := newCloudEventQuamina(t, WithNumberCanonicalization(true))
+
+	binary := httptest.NewRequest("POST", "/events", strings.NewReader(testCloudEventData))
+	binary.Header.Set("Content-Type", "application/json")
+	binary.Header.Set("Ce-Specversion", "1.0")
+	binary.Header.Set("ce-type", "com.example.order.created")
+	binary.Header.Set("ce-source", "%2Fshop%2Feu")
+	binary.Header.Set("ce-id", "e-1")
+	binary.Header.Set("ce-tenant", "acme")
+	matches, err := q.MatchesForCloudEvent(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, "binary", matches, testCloudEventWanted)
+	body, _ := io.ReadAll(binary.Body)
+	if string(body) != testCloudEventData {
+		t.Errorf("body afterward: %q", body)
+	}
+
+	structured := httptest.NewRequest("POST", "/events", strings.NewReader(structuredCloudEvent(`"data": `+testCloudEventData)))
+	structured.Header.Set("Content-Type", "application/cloudevents+json; charset=UTF-8")
+	matches, err = q.MatchesForCloudEvent(structured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, "structured", matches, testCloudEventWanted)
+
+	bad := httptest.NewRequest("POST", "/events", strings.NewReader("{"))
+	bad.Header.Set("Content-Type", "application/cloudevents+json")
+	if _, err = q.MatchesForCloudEvent(bad); err == nil {
+		t.Error("accepted bad structured event")
+	}
+
+	bad = httptest.NewRequest("POST", "/events", strings.NewReader(testCloudEventData))
+	bad.Header.Set("ce-type", "%FF")
+	if _, err = q.MatchesForCloudEvent(bad); err == nil {
+		t.Error("accepted attribute that isn't UTF-8")
+	}
+}
@@ -24,6 +24,9 @@ type flattenJSON struct {
 	arrayCount int32      // how many arrays we've seen, used in building arrayTrail
 	cleanSheet bool       // initially true, don't have to call Reset()
 	isSpace    [256]bool
+
+	// canonicalizeNumbers, if set, means numbers are returned in canonical form, see numbers.go
+	canonicalizeNumbers bool
 }
 
 // Reset an flattenJSON struct so it can be re-used and won't need to be reconstructed for each event to be flattened
@@ -77,7 +80,13 @@ func newJSONFlattener() Flattener {
 }
 
 func (fj *flattenJSON) Copy() Flattener {
-	return newJSONFlattener()
+	f := newJSONFlattener()
+	f.(*flattenJSON).canonicalizeNumbers = fj.canonicalizeNumbers
+	return f
+}
+
+func (fj *flattenJSON) setCanonicalizeNumbers(b bool) {
+	fj.canonicalizeNumbers = b
 }
 
 // Flatten implements the Flattener interface. It assumes that the event is immutable - if you modify the event
@@ -213,7 +222,6 @@ func (fj *flattenJSON) readObject(pathNode SegmentsTreeTracker) error {
 			}
 
 			var val []byte
-			var alt []byte
 			switch ch {
 			case '"':
 				if fj.skipping > 0 || !memberIsUsed {
@@ -232,12 +240,20 @@ func (fj *flattenJSON) readObject(pathNode SegmentsTreeTracker) error {
 				val, err = fj.readLiteral(nullBytes)
 				isLeaf = true
 			case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				val, alt, err = fj.readNumber()
+				val, err = fj.readNumber()
+				if memberIsUsed {
+					val = numberValue(val, fj.canonicalizeNumbers)
+				}
 				isLeaf = true
 			case '[':
 				if !pathNode.IsSegmentUsed(memberName) {
 					fj.skipping++
 				}
+				// an empty array has no value, so it doesn't exist
+				if memberIsUsed && needsPresenceMarker(pathNode, memberName) && !fj.atEmptyArray() {
+					fj.storeObjectMemberField(pathNode.PathForSegment(memberName), arrayTrail, nil)
+					fieldsCount--
+				}
 
 				if fj.skipping > 0 || !memberIsUsed {
 					err = fj.skipBlock('[', ']')
@@ -264,13 +280,17 @@ func (fj *flattenJSON) readObject(pathNode SegmentsTreeTracker) error {
 				if !pathNode.IsSegmentUsed(memberName) {
 					fj.skipping++
 				}
+				if memberIsUsed && needsPresenceMarker(pathNode, memberName) {
+					fj.storeObjectMemberField(pathNode.PathForSegment(memberName), arrayTrail, nil)
+					fieldsCount--
+				}
 				if fj.skipping > 0 || !memberIsUsed {
 					err = fj.skipBlock('{', '}')
 				} else {
 					objectPathNode, ok := pathNode.Get(memberName)
 					if !ok {
-						// This can happen if we got a pattern which is doing matching on object (for example: exists on object)
-						// Currently, we don't support this case, so we will skip the block.
+						// This can happen if we got a pattern which is doing matching on object (for example: exists
+						// on object), in which case the presence marker has been stored and there's nothing else to do
 						err = fj.skipBlock('{', '}')
 					} else {
 						// Traversing into node, reduce the count.
@@ -299,9 +319,6 @@ func (fj *flattenJSON) readObject(pathNode SegmentsTreeTracker) error {
 					fieldsCount--
 				}
 			}
-			if alt != nil {
-				alt = nil
-			}
 			state = afterValueState
 		case afterValueState:
 			switch {
@@ -342,7 +359,6 @@ func (fj *flattenJSON) readArray(pathName []byte, pathNode SegmentsTreeTracker)
 	for {
 		ch := fj.ch()
 		var val []byte // resets on each loop
-		var alt []byte
 		switch state {
 		case inArrayState:
 			// bypass space before element value. A bit klunky but allows for immense simplification
@@ -367,7 +383,10 @@ func (fj *flattenJSON) readArray(pathName []byte, pathNode SegmentsTreeTracker)
 				val, err = fj.readLiteral(nullBytes)
 				isLeaf = true
 			case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				val, alt, err = fj.readNumber()
+				val, err = fj.readNumber()
+				if fj.skipping == 0 {
+					val = numberValue(val, fj.canonicalizeNumbers)
+				}
 				isLeaf = true
 			case '{':
 				if fj.skipping == 0 {
@@ -403,9 +422,6 @@ func (fj *flattenJSON) readArray(pathName []byte, pathNode SegmentsTreeTracker)
 					fj.storeArrayElementField(pathName, val)
 				}
 			}
-			if alt != nil {
-				alt = nil
-			}
 			state = afterValueState
 		case afterValueState:
 			switch {
@@ -432,7 +448,7 @@ func (fj *flattenJSON) readArray(pathName []byte, pathNode SegmentsTreeTracker)
  *  these higher-level funcs are going to advance the pointer after each invocation
  */
 
-func (fj *flattenJSON) readNumber() ([]byte, []byte, error) {
+func (fj *flattenJSON) readNumber() ([]byte, error) {
 	// points at the first character in the number
 	numStart := fj.eventIndex
 	state := numberStartState
@@ -456,16 +472,9 @@ func (fj *flattenJSON) readNumber() ([]byte, []byte, error) {
 				state = numberAfterEState
 			case ',', ']', '}', ' ', '\t', '\n', '\r':
 				fj.eventIndex--
-				// TODO: Too expensive; make it possible for people to ask for this
-				// bytes := fj.event[numStart : fj.eventIndex+1]
-				// c, err := canonicalize(bytes)
-				var alt []byte
-				//if err == nil {
-				//	alt = []byte(c)
-				//}
-				return fj.event[numStart : fj.eventIndex+1], alt, nil
+				return fj.event[numStart : fj.eventIndex+1], nil
 			default:
-				return nil, nil, fj.error(fmt.Sprintf("illegal char '%c' in number", ch))
+				return nil, fj.error(fmt.Sprintf("illegal char '%c' in number", ch))
 			}
 		case numberFracState:
 			switch ch {
@@ -473,25 +482,18 @@ func (fj *flattenJSON) readNumber() ([]byte, []byte, error) {
 				// no-op
 			case ',', ']', '}', ' ', '\t', '\n', '\r':
 				fj.eventIndex--
-				bytes := fj.event[numStart : fj.eventIndex+1]
-				// TODO: Too expensive; make it possible for people to ask for this
-				// c, err := canonicalize(bytes)
-				var alt []byte
-				//if err == nil {
-				//	alt = []byte(c)
-				//}
-				return bytes, alt, nil
+				return fj.event[numStart : fj.eventIndex+1], nil
 			case 'e', 'E':
 				state = numberAfterEState
 			default:
-				return nil, nil, fj.error(fmt.Sprintf("illegal char '%c' in number", ch))
+				return nil, fj.error(fmt.Sprintf("illegal char '%c' in number", ch))
 			}
 		case numberAfterEState:
 			switch ch {
 			case '-', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 				// no-op
 			default:
-				return nil, nil, fj.error(fmt.Sprintf("illegal char '%c' after 'e' in number", ch))
+				return nil, fj.error(fmt.Sprintf("illegal char '%c' after 'e' in number", ch))
 			}
 			state = numberExpState
 
@@ -501,20 +503,13 @@ func (fj *flattenJSON) readNumber() ([]byte, []byte, error) {
 				// no-op
 			case ',', ']', '}', ' ', '\t', '\n', '\r':
 				fj.eventIndex--
-				// bytes := fj.event[numStart : fj.eventIndex+1]
-				// TODO: Too expensive; make it possible for people to ask for this
-				// c, err := canonicalize(bytes)
-				var alt []byte
-				// if err == nil {
-				//	alt = []byte(c)
-				// }
-				return fj.event[numStart : fj.eventIndex+1], alt, nil
+				return fj.event[numStart : fj.eventIndex+1], nil
 			default:
-				return nil, nil, fj.error(fmt.Sprintf("illegal char '%c' in exponent", ch))
+				return nil, fj.error(fmt.Sprintf("illegal char '%c' in exponent", ch))
 			}
 		}
 		if fj.step() != nil {
-			return nil, nil, fj.error("event truncated in number")
+			return nil, fj.error("event truncated in number")
 		}
 	}
 }
@@ -589,6 +584,16 @@ func (fj *flattenJSON) skipBlock(openSymbol byte, closeSymbol byte) error {
 	return fj.error("truncated block")
 }
 
+// atEmptyArray says whether the array that starts at the current position has no elements
+func (fj *flattenJSON) atEmptyArray() bool {
+	for i := fj.eventIndex + 1; i < len(fj.event); i++ {
+		if !fj.isSpace[fj.event[i]] {
+			return fj.event[i] == ']'
+		}
+	}
+	return false
+}
+
 func (fj *flattenJSON) skipStringValue() error {
 	if fj.step() != nil {
 		return fj.error("event truncated in mid-string")
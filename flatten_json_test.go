@@ -25,8 +25,8 @@ func TestFJObjects(t *testing.T) {
 
 	flattener := newJSONFlattener()
 
-	// Verify the case on object pointers, this can happen if we get a pattern of "exists" on object
-	// currently we don't support this case, and we don't pluck it.
+	// Verify the case on object pointers, this can happen if we get a pattern of "exists" on object.
+	// Unless the path is used in an "exists" pattern, we don't pluck it.
 	matcher := fakeMatcher("Image\nThumbnail")
 
 	list, err := flattener.Flatten([]byte(event), matcher.getSegmentsTreeTracker())
@@ -53,6 +53,25 @@ func TestFJObjects(t *testing.T) {
 		[]string{"Image\nThumbnail\nUrl"},
 		[]string{`"https://www.example.com/image/481989943"`},
 	)
+
+	// with "exists", objects and arrays get presence markers, whose Val is nil
+	matcher = fakeMatcher("Image\nThumbnail", "Image\nThumbnail\nUrl", "Image\nIDs")
+	matcher.fields().segmentsTree.addPresence("Image\nThumbnail")
+	matcher.fields().segmentsTree.addPresence("Image\nIDs")
+
+	list, err = flattener.Flatten([]byte(event), matcher.getSegmentsTreeTracker())
+	if err != nil {
+		t.Errorf("Failed to flatten: %s", err)
+	}
+
+	expectToHavePaths(t,
+		list,
+		[]string{"Image\nThumbnail", "Image\nThumbnail\nUrl", "Image\nIDs", "Image\nIDs", "Image\nIDs", "Image\nIDs", "Image\nIDs"},
+		[]string{"", `"https://www.example.com/image/481989943"`, "", "116", "943", "234", "38793"},
+	)
+	if list[0].Val != nil || list[2].Val != nil {
+		t.Error("presence markers should have nil Val")
+	}
 }
 
 func TestFJBasic(t *testing.T) {
@@ -0,0 +1,494 @@
+package quamina
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// flattenMsgpack implements Flattener for events encoded in MessagePack. Like flattenCBOR, it produces the
+// same Fields that flattenJSON would for the JSON equivalent of the event, so that the same Patterns work on
+// both. Integers, floats, strings, nil, and booleans map onto their JSON counterparts, with floats written
+// the way JavaScript would write them and NaN and the infinities becoming null. Binary data becomes a base64
+// string, as encoding/json would produce for a []byte, and timestamps become RFC 3339 strings. Other
+// extension types have no JSON equivalent and are ignored. Map keys have to be strings or integers.
+// The event is assumed to be immutable, so strings in it are used in place. Quoted strings and numbers have
+// to be written somewhere though, as do the ArrayTrail values, and for those the flattener keeps a couple of
+// buffers that are re-used from one event to the next, so once they've grown to fit the events, flattening
+// doesn't allocate, unless numbers are being canonicalized.
+type flattenMsgpack struct {
+	event      []byte
+	eventIndex int
+	fields     []Field
+	arrayTrail []ArrayPos
+	arrayCount int32
+
+	vals   []byte     // backing store for the values that aren't slices of the event
+	trails []ArrayPos // backing store for the ArrayTrail values
+
+	canonicalizeNumbers bool
+}
+
+type msgpackKind byte
+
+const (
+	msgpackNil msgpackKind = iota
+	msgpackBool
+	msgpackUint
+	msgpackInt
+	msgpackFloat32
+	msgpackFloat64
+	msgpackStr
+	msgpackBin
+	msgpackArray
+	msgpackMap
+	msgpackExt
+)
+
+// msgpackTimestamp is the extension type reserved for timestamps
+const msgpackTimestamp = -1
+
+// msgpackHead is what's learned by reading the format byte at the start of each item and whatever follows
+// it up to the data. n is the length of a string, binary, or extension item, the number of elements or
+// members in an array or map, the bits of a float, or the value of an integer; for a signed integer it's the
+// two's complement.
+type msgpackHead struct {
+	kind    msgpackKind
+	n       uint64
+	extType int8
+}
+
+func newMsgpackFlattener() Flattener {
+	return &flattenMsgpack{fields: make([]Field, 0, 32)}
+}
+
+func (fm *flattenMsgpack) Copy() Flattener {
+	return &flattenMsgpack{fields: make([]Field, 0, 32), canonicalizeNumbers: fm.canonicalizeNumbers}
+}
+
+func (fm *flattenMsgpack) setCanonicalizeNumbers(b bool) {
+	fm.canonicalizeNumbers = b
+}
+
+// Flatten implements the Flattener interface. The event has to be a single MessagePack map. The Fields
+// returned are only good until the next call.
+func (fm *flattenMsgpack) Flatten(event []byte, tracker SegmentsTreeTracker) ([]Field, error) {
+	fm.event = event
+	fm.eventIndex = 0
+	fm.fields = fm.fields[:0]
+	fm.arrayTrail = fm.arrayTrail[:0]
+	fm.arrayCount = 0
+	fm.vals = fm.vals[:0]
+	fm.trails = fm.trails[:0]
+	if len(event) == 0 {
+		return nil, errors.New("empty event")
+	}
+
+	head, err := fm.readHead()
+	if err != nil {
+		return nil, err
+	}
+	if head.kind != msgpackMap {
+		return nil, errors.New("event is not a MessagePack map")
+	}
+	err = fm.readMap(tracker, head.n)
+	if err != nil {
+		if errors.Is(err, errEarlyStop) {
+			return fm.fields, nil
+		}
+		return nil, err
+	}
+	if fm.eventIndex != len(event) {
+		return nil, fm.error("garbage after MessagePack map")
+	}
+	return fm.fields, nil
+}
+
+// readMap reads the members of a map whose head has been read, storing Fields for those that the pathNode
+// says are used, and skipping the rest. Once it has seen all the members mentioned in the pathNode, it skips
+// the rest of the map, or stops if this is the top level.
+func (fm *flattenMsgpack) readMap(pathNode SegmentsTreeTracker, count uint64) error {
+	fieldsCount := pathNode.FieldsCount()
+	nodesCount := pathNode.NodesCount()
+
+	// as in flattenJSON, the array trail doesn't change while we're in the map
+	arrayTrail := fm.trailCopy()
+
+	for remaining := count; remaining > 0; remaining-- {
+		if nodesCount == 0 && fieldsCount == 0 {
+			if pathNode.IsRoot() {
+				return errEarlyStop
+			}
+			return fm.skipItems(remaining * 2)
+		}
+
+		memberName, err := fm.readMemberName()
+		if err != nil {
+			return err
+		}
+		if !pathNode.IsSegmentUsed(memberName) {
+			err = fm.skipItem()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		path := pathNode.PathForSegment(memberName)
+		valHead, err := fm.readHead()
+		if err != nil {
+			return err
+		}
+		switch valHead.kind {
+		case msgpackMap:
+			if needsPresenceMarker(pathNode, memberName) {
+				fm.storeField(path, arrayTrail, nil)
+				fieldsCount--
+			}
+			objectPathNode, ok := pathNode.Get(memberName)
+			if ok {
+				nodesCount--
+				err = fm.readMap(objectPathNode, valHead.n)
+			} else {
+				err = fm.skipItems(valHead.n * 2)
+			}
+
+		case msgpackArray:
+			marker, arrayPathNode := arrayMember(pathNode, memberName, valHead.n == 0)
+			if marker {
+				fm.storeField(path, arrayTrail, nil)
+				fieldsCount--
+			}
+			err = fm.readArray(path, arrayPathNode, valHead.n)
+
+		default:
+			var val []byte
+			val, err = fm.readLeaf(valHead)
+			if err == nil && val != nil && path != nil {
+				fm.storeField(path, arrayTrail, val)
+				fieldsCount--
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readArray reads the elements of an array whose head has been read
+func (fm *flattenMsgpack) readArray(pathName []byte, pathNode SegmentsTreeTracker, count uint64) error {
+	fm.arrayCount++
+	fm.arrayTrail = append(fm.arrayTrail, ArrayPos{fm.arrayCount, 0})
+
+	for remaining := count; remaining > 0; remaining-- {
+		elementHead, err := fm.readHead()
+		if err != nil {
+			return err
+		}
+		fm.arrayTrail[len(fm.arrayTrail)-1].Pos++
+		switch elementHead.kind {
+		case msgpackMap:
+			err = fm.readMap(pathNode, elementHead.n)
+		case msgpackArray:
+			err = fm.readArray(pathName, pathNode, elementHead.n)
+		default:
+			var val []byte
+			val, err = fm.readLeaf(elementHead)
+			if err == nil && val != nil && pathName != nil {
+				fm.storeField(pathName, fm.trailCopy(), val)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fm.arrayTrail = fm.arrayTrail[:len(fm.arrayTrail)-1]
+	return nil
+}
+
+func (fm *flattenMsgpack) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	fm.fields = append(fm.fields, Field{Path: path, ArrayTrail: arrayTrail, Val: val})
+}
+
+// trailCopy returns a copy of the current array trail, stored in the trails buffer. If the buffer has to grow,
+// the copies already handed out stay where they are.
+func (fm *flattenMsgpack) trailCopy() []ArrayPos {
+	if len(fm.arrayTrail) == 0 {
+		return nil
+	}
+	start := len(fm.trails)
+	fm.trails = append(fm.trails, fm.arrayTrail...)
+	return fm.trails[start:len(fm.trails):len(fm.trails)]
+}
+
+// valFrom returns what's been written to the vals buffer since start. As with trailCopy, values already
+// handed out aren't disturbed if the buffer grows.
+func (fm *flattenMsgpack) valFrom(start int) []byte {
+	return fm.vals[start:len(fm.vals):len(fm.vals)]
+}
+
+// readMemberName reads a map key, which has to be a string or an integer, in which case its decimal form is
+// used as the name
+func (fm *flattenMsgpack) readMemberName() ([]byte, error) {
+	head, err := fm.readHead()
+	if err != nil {
+		return nil, err
+	}
+	switch head.kind {
+	case msgpackStr:
+		return fm.readBytes(head.n)
+	case msgpackUint, msgpackInt:
+		start := len(fm.vals)
+		fm.appendInteger(head)
+		return fm.valFrom(start), nil
+	default:
+		return nil, fm.error("MessagePack map key must be a string or integer")
+	}
+}
+
+// readLeaf converts an item which isn't a map or array to the form it would have in JSON. It returns nil for
+// extension types that have no JSON form.
+func (fm *flattenMsgpack) readLeaf(head msgpackHead) ([]byte, error) {
+	switch head.kind {
+	case msgpackNil:
+		return nullBytes, nil
+
+	case msgpackBool:
+		if head.n == 1 {
+			return trueBytes, nil
+		}
+		return falseBytes, nil
+
+	case msgpackUint, msgpackInt:
+		start := len(fm.vals)
+		fm.appendInteger(head)
+		return numberValue(fm.valFrom(start), fm.canonicalizeNumbers), nil
+
+	case msgpackFloat32, msgpackFloat64:
+		f, bitSize := math.Float64frombits(head.n), 64
+		if head.kind == msgpackFloat32 {
+			f, bitSize = float64(math.Float32frombits(uint32(head.n))), 32
+		}
+		start := len(fm.vals)
+		var ok bool
+		fm.vals, ok = appendFloatText(fm.vals, f, bitSize)
+		if !ok {
+			return nullBytes, nil
+		}
+		return numberValue(fm.valFrom(start), fm.canonicalizeNumbers), nil
+
+	case msgpackStr:
+		s, err := fm.readBytes(head.n)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(s) {
+			return nil, fm.error("invalid UTF-8 in MessagePack string")
+		}
+		start := len(fm.vals)
+		fm.vals = append(fm.vals, '"')
+		fm.vals = append(fm.vals, s...)
+		fm.vals = append(fm.vals, '"')
+		return fm.valFrom(start), nil
+
+	case msgpackBin:
+		b, err := fm.readBytes(head.n)
+		if err != nil {
+			return nil, err
+		}
+		start := len(fm.vals)
+		fm.vals = append(fm.vals, '"')
+		encodedStart := len(fm.vals)
+		for i := base64.StdEncoding.EncodedLen(len(b)); i > 0; i-- {
+			fm.vals = append(fm.vals, 0)
+		}
+		base64.StdEncoding.Encode(fm.vals[encodedStart:], b)
+		fm.vals = append(fm.vals, '"')
+		return fm.valFrom(start), nil
+
+	case msgpackExt:
+		data, err := fm.readBytes(head.n)
+		if err != nil {
+			return nil, err
+		}
+		if head.extType != msgpackTimestamp {
+			return nil, nil
+		}
+		return fm.timestampValue(data)
+	}
+	return nil, fm.error("unexpected MessagePack item")
+}
+
+// timestampValue writes a timestamp extension in one of its three sizes as a quoted RFC 3339 UTC time
+func (fm *flattenMsgpack) timestampValue(data []byte) ([]byte, error) {
+	var seconds, nanos int64
+	switch len(data) {
+	case 4:
+		seconds = int64(bigEndian(data))
+	case 8:
+		both := bigEndian(data)
+		nanos = int64(both >> 34)
+		seconds = int64(both & (1<<34 - 1))
+	case 12:
+		nanos = int64(bigEndian(data[:4]))
+		seconds = int64(bigEndian(data[4:]))
+	default:
+		return nil, fm.error("MessagePack timestamp must be 4, 8, or 12 bytes")
+	}
+	if nanos > 999999999 {
+		return nil, fm.error("MessagePack timestamp nanoseconds out of range")
+	}
+	start := len(fm.vals)
+	fm.vals = append(fm.vals, '"')
+	fm.vals = time.Unix(seconds, nanos).UTC().AppendFormat(fm.vals, time.RFC3339Nano)
+	fm.vals = append(fm.vals, '"')
+	return fm.valFrom(start), nil
+}
+
+func (fm *flattenMsgpack) appendInteger(head msgpackHead) {
+	if head.kind == msgpackUint {
+		fm.vals = strconv.AppendUint(fm.vals, head.n, 10)
+	} else {
+		fm.vals = strconv.AppendInt(fm.vals, int64(head.n), 10)
+	}
+}
+
+func (fm *flattenMsgpack) readBytes(length uint64) ([]byte, error) {
+	if length > uint64(len(fm.event)-fm.eventIndex) {
+		return nil, fm.error("MessagePack item runs past end of event")
+	}
+	b := fm.event[fm.eventIndex : fm.eventIndex+int(length)]
+	fm.eventIndex += int(length)
+	return b, nil
+}
+
+// skipItem moves past an item, including anything it contains
+func (fm *flattenMsgpack) skipItem() error {
+	head, err := fm.readHead()
+	if err != nil {
+		return err
+	}
+	switch head.kind {
+	case msgpackStr, msgpackBin, msgpackExt:
+		_, err = fm.readBytes(head.n)
+	case msgpackArray:
+		err = fm.skipItems(head.n)
+	case msgpackMap:
+		err = fm.skipItems(head.n * 2)
+	}
+	return err
+}
+
+// skipItems skips count items. Each takes at least a byte, which rules out absurd counts before we start.
+func (fm *flattenMsgpack) skipItems(count uint64) error {
+	if count > uint64(len(fm.event)-fm.eventIndex) {
+		return fm.error("MessagePack event truncated")
+	}
+	for ; count > 0; count-- {
+		err := fm.skipItem()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHead reads the format byte at the start of an item and whatever follows it up to the data
+func (fm *flattenMsgpack) readHead() (msgpackHead, error) {
+	var head msgpackHead
+	if fm.eventIndex >= len(fm.event) {
+		return head, fm.error("MessagePack event truncated")
+	}
+	format := fm.event[fm.eventIndex]
+	fm.eventIndex++
+
+	// the fix formats, which carry their value or length in the format byte
+	switch {
+	case format <= 0x7f:
+		head.kind, head.n = msgpackUint, uint64(format)
+		return head, nil
+	case format <= 0x8f:
+		head.kind, head.n = msgpackMap, uint64(format&0x0f)
+		return head, nil
+	case format <= 0x9f:
+		head.kind, head.n = msgpackArray, uint64(format&0x0f)
+		return head, nil
+	case format <= 0xbf:
+		head.kind, head.n = msgpackStr, uint64(format&0x1f)
+		return head, nil
+	case format >= 0xe0:
+		head.kind, head.n = msgpackInt, uint64(int64(int8(format)))
+		return head, nil
+	}
+
+	var size int
+	switch format {
+	case 0xc0:
+		head.kind = msgpackNil
+		return head, nil
+	case 0xc2, 0xc3:
+		head.kind, head.n = msgpackBool, uint64(format-0xc2)
+		return head, nil
+	case 0xc4, 0xc5, 0xc6:
+		head.kind, size = msgpackBin, 1<<(format-0xc4)
+	case 0xc7, 0xc8, 0xc9:
+		head.kind, size = msgpackExt, 1<<(format-0xc7)
+	case 0xca:
+		head.kind, size = msgpackFloat32, 4
+	case 0xcb:
+		head.kind, size = msgpackFloat64, 8
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		head.kind, size = msgpackUint, 1<<(format-0xcc)
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		head.kind, size = msgpackInt, 1<<(format-0xd0)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// fixext, whose length is in the format byte, with the type following
+		head.kind, head.n = msgpackExt, 1<<(format-0xd4)
+	case 0xd9, 0xda, 0xdb:
+		head.kind, size = msgpackStr, 1<<(format-0xd9)
+	case 0xdc, 0xdd:
+		head.kind, size = msgpackArray, 2<<(format-0xdc)
+	case 0xde, 0xdf:
+		head.kind, size = msgpackMap, 2<<(format-0xde)
+	default:
+		return head, fm.error(fmt.Sprintf("invalid MessagePack format byte 0x%x", format))
+	}
+
+	if size > 0 {
+		if size > len(fm.event)-fm.eventIndex {
+			return head, fm.error("MessagePack event truncated")
+		}
+		head.n = bigEndian(fm.event[fm.eventIndex : fm.eventIndex+size])
+		fm.eventIndex += size
+		if head.kind == msgpackInt {
+			// sign-extend
+			shift := 64 - 8*size
+			head.n = uint64(int64(head.n<<shift) >> shift)
+		}
+	}
+	if head.kind == msgpackExt {
+		if fm.eventIndex >= len(fm.event) {
+			return head, fm.error("MessagePack event truncated")
+		}
+		head.extType = int8(fm.event[fm.eventIndex])
+		fm.eventIndex++
+	}
+	return head, nil
+}
+
+func bigEndian(b []byte) uint64 {
+	var n uint64
+	for _, x := range b {
+		n = n<<8 | uint64(x)
+	}
+	return n
+}
+
+func (fm *flattenMsgpack) error(message string) error {
+	return fmt.Errorf("at offset %d in MessagePack event: %s", fm.eventIndex, message)
+}
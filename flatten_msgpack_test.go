@@ -0,0 +1,341 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackLeafValues(t *testing.T) {
+	leaves := map[string]string{
+		"00":                             "0",
+		"7f":                             "127",
+		"cc80":                           "128",
+		"cd0100":                         "256",
+		"ce00010000":                     "65536",
+		"cfffffffffffffffff":             "18446744073709551615",
+		"ff":                             "-1",
+		"e0":                             "-32",
+		"d080":                           "-128",
+		"d1ff7f":                         "-129",
+		"d2ffff7fff":                     "-32769",
+		"d38000000000000000":             "-9223372036854775808",
+		"ca3dcccccd":                     "0.1",
+		"ca7f7fffff":                     "3.4028235e+38",
+		"cb3ff199999999999a":             "1.1",
+		"cb7e37e43c8800759c":             "1e+300",
+		"cb3eb0c6f7a0b5ed8d":             "0.000001",
+		"cb3e7ad7f29abcaf48":             "1e-7",
+		"cb8000000000000000":             "0",
+		"cb7ff0000000000000":             "null",
+		"cb7ff8000000000000":             "null",
+		"c0":                             "null",
+		"c2":                             "false",
+		"c3":                             "true",
+		"a0":                             `""`,
+		"a161":                           `"a"`,
+		"a2c3bc":                         `"ü"`,
+		"d90568656c6c6f":                 `"hello"`,
+		"da000568656c6c6f":               `"hello"`,
+		"db0000000568656c6c6f":           `"hello"`,
+		"c40401020304":                   `"AQIDBA=="`,
+		"c5000101":                       `"AQ=="`,
+		"c400":                           `""`,
+		"d6ff514b67b0":                   `"2013-03-21T20:04:00Z"`,
+		"d7ff0000000c514b67b0":           `"2013-03-21T20:04:00.000000003Z"`,
+		"c70cff00000001ffffffffffffffff": `"1969-12-31T23:59:59.000000001Z"`,
+	}
+	f := newMsgpackFlattener()
+	tracker := fakeMatcher("a").getSegmentsTreeTracker()
+	for leaf, wanted := range leaves {
+		item, _ := hex.DecodeString(leaf)
+		event := append([]byte{0x81, 0xa1, 'a'}, item...)
+		fields, err := f.Flatten(event, tracker)
+		if err != nil {
+			t.Errorf("%s: %s", leaf, err.Error())
+			continue
+		}
+		if len(fields) != 1 || string(fields[0].Val) != wanted {
+			t.Errorf("%s: wanted %s got %v", leaf, wanted, fields)
+		}
+	}
+
+	// other extension types are ignored
+	for _, ext := range []string{"d40101", "c70301010203"} {
+		item, _ := hex.DecodeString(ext)
+		event := append([]byte{0x81, 0xa1, 'a'}, item...)
+		fields, err := f.Flatten(event, tracker)
+		if err != nil {
+			t.Errorf("%s: %s", ext, err.Error())
+		}
+		if len(fields) != 0 {
+			t.Errorf("%s: got %v", ext, fields)
+		}
+	}
+
+	// integer keys
+	event, _ := hex.DecodeString("82a1610107a162")
+	fields, err := newMsgpackFlattener().Flatten(event, fakeMatcher("a", "7").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 2 || string(fields[1].Path) != "7" || string(fields[1].Val) != `"b"` {
+		t.Errorf("integer key: got %v", fields)
+	}
+}
+
+func TestMsgpackErrors(t *testing.T) {
+	bads := []string{
+		"",
+		"01",
+		"90",
+		"81",
+		"81a161",
+		"81a161c1",
+		"81a161cd01",
+		"81a161a46162",
+		"81c3a161",
+		"8180a16101",
+		"81a16191",
+		"81a161da0005616263",
+		"81a161d6ff0102",
+		"81a161d5ff0102",
+		"81a161d7ffffffffff00000000",
+		"81a16101c0",
+		"81a16180c0",
+		"81a161dcffff",
+		"81a161dfffffffff",
+		"81a161a1ff",
+	}
+	f := newMsgpackFlattener()
+	tracker := fakeMatcher("a", "b").getSegmentsTreeTracker()
+	for _, bad := range bads {
+		event, _ := hex.DecodeString(bad)
+		_, err := f.Flatten(event, tracker)
+		if err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestMsgpackMatchesJSON(t *testing.T) {
+	patterns := []string{
+		`{"Image": {"Width": [800], "Animated": [false]}}`,
+		`{"Image": {"Thumbnail": {"Url": [ {"prefix": "https:"} ]}}}`,
+		`{"Image": {"IDs": [943, 38793]}}`,
+		`{"Image": {"Title": [ {"equals-ignore-case": "view from 15th floor"} ]}}`,
+		`{"Image": {"Thumbnail": [ {"exists": true} ]}}`,
+		`{"Image": {"Missing": [ {"exists": false} ]}}`,
+		`{"Image": {"IDs": [ {"exists": false} ]}}`,
+		`{"Image": {"Ratio": [1.5], "Caption": [null]}}`,
+		`{"a": {"b": [1], "c": [4]}}`,
+		`{"a": {"b": [3], "c": [4]}}`,
+		`{"a": {"b": [1], "c": [2]}}`,
+		`{"z": [ {"numeric": ["<", 0]} ]}`,
+	}
+	events := []string{
+		`{
+			"Image": {
+				"Width":  800,
+				"Height": 600,
+				"Title":  "View from 15th Floor",
+				"Thumbnail": {
+					"Url":    "https://www.example.com/image/481989943",
+					"Height": 125,
+					"Width":  100
+				},
+				"Animated" : false,
+				"IDs": [116, 943, 234, 38793],
+				"Ratio": 1.5,
+				"Caption": null
+			}
+		}`,
+		`{"Image": {"Thumbnail": {"Url": "http://example.com"}, "Width": 800, "Animated": true}}`,
+		`{"Image": {"IDs": [], "Width": 800, "Animated": false}}`,
+		`{"a": [ {"b": 1, "c": 2}, {"b": 3, "c": 4} ], "z": -0.25}`,
+		`{"a": [ {"b": 1, "c": 4}, {"b": 3, "c": 2} ]}`,
+		`{"x": {"y": [1, [2, {"z": 3}]]}, "z": [1, [-1]]}`,
+	}
+	qJSON, _ := New()
+	qMsgpack, _ := New(WithMediaType("application/msgpack"))
+	for _, pattern := range patterns {
+		if err := qJSON.AddPattern(pattern, pattern); err != nil {
+			t.Fatal(err)
+		}
+		if err := qMsgpack.AddPattern(pattern, pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, event := range events {
+		jsonMatches, err := qJSON.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgpackMatches, err := qMsgpack.MatchesForEvent(jsonToMsgpack(t, event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jsonMatches) == 0 && !strings.HasPrefix(event, `{"x"`) {
+			t.Errorf("no matches for %s", event)
+		}
+		if len(jsonMatches) != len(msgpackMatches) {
+			t.Errorf("%s: JSON %v MessagePack %v", event, jsonMatches, msgpackMatches)
+			continue
+		}
+		for _, m := range jsonMatches {
+			if !containsX(msgpackMatches, m) {
+				t.Errorf("%s: JSON %v MessagePack %v", event, jsonMatches, msgpackMatches)
+			}
+		}
+	}
+}
+
+// TestMsgpackArrayTrails checks that the fields from different elements of an array have ArrayTrails that
+// conflict, and that fields in the same element don't, even though they share storage
+func TestMsgpackArrayTrails(t *testing.T) {
+	event := jsonToMsgpack(t, `{"a": [ {"b": 1, "c": 2}, {"b": 3, "c": [4, 5]} ]}`)
+	f := newMsgpackFlattener()
+	fields, err := f.Flatten(event, fakeMatcher("a\nb", "a\nc").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 5 {
+		t.Fatalf("wanted 5 fields, got %v", fields)
+	}
+	if !noArrayTrailConflict(fields[0].ArrayTrail, fields[1].ArrayTrail) {
+		t.Error("b:1 and c:2 should be in the same element")
+	}
+	if noArrayTrailConflict(fields[0].ArrayTrail, fields[3].ArrayTrail) {
+		t.Error("b:1 and c:4 should be in different elements")
+	}
+	if !noArrayTrailConflict(fields[2].ArrayTrail, fields[4].ArrayTrail) {
+		t.Error("b:3 and c:5 should be in the same element")
+	}
+	if noArrayTrailConflict(fields[3].ArrayTrail, fields[4].ArrayTrail) {
+		t.Error("c:4 and c:5 should be in different elements")
+	}
+}
+
+func TestMsgpackEarlyStop(t *testing.T) {
+	// the second member would be an error, but we never get there
+	event, _ := hex.DecodeString("82a16101a162c1")
+	fields, err := newMsgpackFlattener().Flatten(event, fakeMatcher("a").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 {
+		t.Errorf("got %v", fields)
+	}
+}
+
+func TestMsgpackZeroAllocation(t *testing.T) {
+	event := jsonToMsgpack(t, `{"a": [ {"b": 1.5, "c": "two"}, {"b": -3, "c": [4, "five"]} ], "d": {"e": "six"}}`)
+	f := newMsgpackFlattener()
+	tracker := fakeMatcher("a\nb", "a\nc", "d\ne").getSegmentsTreeTracker()
+	allocs := testing.AllocsPerRun(100, func() {
+		fields, err := f.Flatten(event, tracker)
+		if err != nil || len(fields) != 6 {
+			t.Errorf("flatten: %v %v", fields, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per flatten", allocs)
+	}
+}
+
+func TestMsgpackInvalidUTF8(t *testing.T) {
+	q, _ := New(WithMediaType("application/msgpack"))
+	if err := q.AddPattern("p", `{"a": ["x", "y"]}`); err != nil {
+		t.Fatal(err)
+	}
+	_, err := q.MatchesForEvent([]byte{0x81, 0xa1, 'a', 0xa1, 0xff})
+	if err == nil {
+		t.Error("accepted invalid UTF-8")
+	}
+}
+
+func TestMsgpackCanonicalNumbers(t *testing.T) {
+	q, _ := New(WithMediaType("application/msgpack"), WithNumberCanonicalization(true))
+	if err := q.AddPattern("p", `{"a": [35]}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"23", "cc23", "d10023", "ca420c0000", "cb4041800000000000"} {
+		b, _ := hex.DecodeString(item)
+		event := append([]byte{0x81, 0xa1, 'a'}, b...)
+		matches, err := q.MatchesForEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 {
+			t.Errorf("%s: got %v", item, matches)
+		}
+	}
+}
+
+// jsonToMsgpack encodes the JSON text as MessagePack, with integers as integers and other numbers as float64
+func jsonToMsgpack(t *testing.T, jsonText string) []byte {
+	t.Helper()
+	d := json.NewDecoder(strings.NewReader(jsonText))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeMsgpack(&buf, v)
+	return buf.Bytes()
+}
+
+func writeMsgpack(buf *bytes.Buffer, v any) {
+	switch tv := v.(type) {
+	case map[string]any:
+		buf.WriteByte(0xdf)
+		writeBigEndian(buf, uint64(len(tv)), 4)
+		keys := make([]string, 0, len(tv))
+		for k := range tv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeMsgpack(buf, k)
+			writeMsgpack(buf, tv[k])
+		}
+	case []any:
+		buf.WriteByte(0xdd)
+		writeBigEndian(buf, uint64(len(tv)), 4)
+		for _, element := range tv {
+			writeMsgpack(buf, element)
+		}
+	case string:
+		buf.WriteByte(0xdb)
+		writeBigEndian(buf, uint64(len(tv)), 4)
+		buf.WriteString(tv)
+	case json.Number:
+		if i, err := tv.Int64(); err == nil {
+			buf.WriteByte(0xd3)
+			writeBigEndian(buf, uint64(i), 8)
+			return
+		}
+		f, _ := tv.Float64()
+		buf.WriteByte(0xcb)
+		writeBigEndian(buf, math.Float64bits(f), 8)
+	case bool:
+		if tv {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case nil:
+		buf.WriteByte(0xc0)
+	}
+}
+
+func writeBigEndian(buf *bytes.Buffer, n uint64, size int) {
+	for shift := 8 * (size - 1); shift >= 0; shift -= 8 {
+		buf.WriteByte(byte(n >> shift))
+	}
+}
@@ -0,0 +1,414 @@
+package quamina
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// flattenProtobuf implements Flattener for protobuf-encoded events, all of them instances of the same message
+// type, which is described by a FileDescriptorSet. As with the other binary formats, it produces the Fields
+// that flattenJSON would for the JSON form of the event, as given by the protobuf JSON mapping, except that
+// fields are named by their names in the .proto file, and 64-bit integers are numbers rather than strings,
+// so that numeric Patterns work on them. Repeated fields are arrays, maps are objects, and enums are the
+// names of their values, or numbers for values the descriptor doesn't know about. Bytes are base64 strings.
+// Fields not in the descriptor, and groups, are ignored.
+// Since a repeated field's elements needn't be together on the wire, and a later occurrence of a field can
+// replace or merge with an earlier one, the whole message has to be read, but fields that no Pattern
+// mentions are skipped without being decoded. A singular field that occurs more than once produces a Field
+// for each occurrence.
+type flattenProtobuf struct {
+	message    *protoMessage
+	r          protoReader
+	fields     []Field
+	arrayCount int32
+	repeats    []protoRepeat // repeated fields seen so far in the messages being read
+
+	vals   []byte     // backing store for the values that aren't slices of the event
+	trails []ArrayPos // backing store for the ArrayTrail values
+
+	canonicalizeNumbers bool
+}
+
+// protoRepeat tracks a repeated field in a message, which is an array in JSON terms
+type protoRepeat struct {
+	number uint64
+	array  int32
+	pos    int32
+}
+
+// NewProtobufFlattener returns a Flattener for protobuf messages of the named type, e.g. "example.Order".
+// descriptorSet is a serialized google.protobuf.FileDescriptorSet which describes the type, as produced by
+// "protoc --include_imports --descriptor_set_out" or "buf build". Pass it to Quamina with WithFlattener.
+func NewProtobufFlattener(descriptorSet []byte, messageName string) (Flattener, error) {
+	message, err := parseFileDescriptorSet(descriptorSet, messageName)
+	if err != nil {
+		return nil, err
+	}
+	return &flattenProtobuf{message: message, fields: make([]Field, 0, 32)}, nil
+}
+
+func (fp *flattenProtobuf) Copy() Flattener {
+	return &flattenProtobuf{message: fp.message, fields: make([]Field, 0, 32), canonicalizeNumbers: fp.canonicalizeNumbers}
+}
+
+func (fp *flattenProtobuf) setCanonicalizeNumbers(b bool) {
+	fp.canonicalizeNumbers = b
+}
+
+// Flatten implements the Flattener interface. The Fields returned are only good until the next call.
+func (fp *flattenProtobuf) Flatten(event []byte, tracker SegmentsTreeTracker) ([]Field, error) {
+	fp.r = protoReader{buf: event}
+	fp.fields = fp.fields[:0]
+	fp.arrayCount = 0
+	fp.repeats = fp.repeats[:0]
+	fp.vals = fp.vals[:0]
+	fp.trails = fp.trails[:0]
+
+	err := fp.readMessage(len(event), fp.message, tracker, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fp.fields, nil
+}
+
+// readMessage reads the fields of a message from the current position up to end, storing Fields for those
+// that the pathNode says are used.
+func (fp *flattenProtobuf) readMessage(end int, message *protoMessage, pathNode SegmentsTreeTracker, arrayTrail []ArrayPos) error {
+	outer := fp.r.buf
+	fp.r.buf = fp.r.buf[:end]
+	repeatsBase := len(fp.repeats)
+
+	for !fp.r.done() {
+		number, wireType, err := fp.r.key()
+		if err != nil {
+			return err
+		}
+		field := message.fields[number]
+		if field == nil || field.typ == protoTypeGroup || !pathNode.IsSegmentUsed(field.name) {
+			if err = fp.r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// a repeated field is only an array if there's something in it, so this is where it starts
+		repeat := -1
+		if field.repeated {
+			repeat = fp.repeat(repeatsBase, number)
+			if fp.repeats[repeat].pos == 0 && needsPresenceMarker(pathNode, field.name) {
+				fp.storeField(pathNode.PathForSegment(field.name), arrayTrail, nil)
+			}
+		}
+
+		switch {
+		case field.isMap():
+			err = fp.readMapEntry(field, wireType, pathNode, arrayTrail)
+		case field.typ == protoTypeMessage:
+			err = fp.readMessageField(field, wireType, repeat, pathNode, arrayTrail)
+		default:
+			err = fp.readScalarField(field, wireType, repeat, pathNode, arrayTrail)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	fp.repeats = fp.repeats[:repeatsBase]
+	fp.r.buf = outer
+	return nil
+}
+
+// readMessageField reads a field whose value is a message, which is an object in JSON terms
+func (fp *flattenProtobuf) readMessageField(field *protoField, wireType uint64, repeat int, pathNode SegmentsTreeTracker, arrayTrail []ArrayPos) error {
+	if wireType != protoLength {
+		return fp.r.error(fmt.Sprintf("wrong wire type %d for message field %s", wireType, field.name))
+	}
+	if repeat < 0 && needsPresenceMarker(pathNode, field.name) {
+		fp.storeField(pathNode.PathForSegment(field.name), arrayTrail, nil)
+	}
+	b, err := fp.r.bytes()
+	if err != nil {
+		return err
+	}
+	messagePathNode, ok := pathNode.Get(field.name)
+	if !ok {
+		return nil
+	}
+	trail := arrayTrail
+	if repeat >= 0 {
+		trail = fp.nextElement(arrayTrail, repeat)
+	}
+	end := fp.r.index
+	fp.r.index -= len(b)
+	return fp.readMessage(end, field.message, messagePathNode, trail)
+}
+
+// readScalarField reads a field whose value isn't a message. A repeated field of numbers may be packed, all
+// its elements in a single length-delimited value.
+func (fp *flattenProtobuf) readScalarField(field *protoField, wireType uint64, repeat int, pathNode SegmentsTreeTracker, arrayTrail []ArrayPos) error {
+	path := pathNode.PathForSegment(field.name)
+	if repeat >= 0 && wireType == protoLength && field.wireType() != protoLength {
+		packed, err := fp.r.bytes()
+		if err != nil {
+			return err
+		}
+		outer := fp.r
+		fp.r = protoReader{buf: outer.buf[:outer.index], index: outer.index - len(packed)}
+		for !fp.r.done() {
+			val, err := fp.scalar(field, field.wireType())
+			if err != nil {
+				return err
+			}
+			trail := fp.nextElement(arrayTrail, repeat)
+			if path != nil {
+				fp.storeField(path, trail, val)
+			}
+		}
+		fp.r = outer
+		return nil
+	}
+
+	if wireType != field.wireType() {
+		return fp.r.error(fmt.Sprintf("wrong wire type %d for field %s", wireType, field.name))
+	}
+	val, err := fp.scalar(field, wireType)
+	if err != nil {
+		return err
+	}
+	trail := arrayTrail
+	if repeat >= 0 {
+		trail = fp.nextElement(arrayTrail, repeat)
+	}
+	if path != nil {
+		fp.storeField(path, trail, val)
+	}
+	return nil
+}
+
+// readMapEntry reads one entry of a map field. The map is an object whose member names are the keys, which
+// have to be found before the value can be dealt with, although they usually come first.
+func (fp *flattenProtobuf) readMapEntry(field *protoField, wireType uint64, pathNode SegmentsTreeTracker, arrayTrail []ArrayPos) error {
+	if wireType != protoLength {
+		return fp.r.error(fmt.Sprintf("wrong wire type %d for map field %s", wireType, field.name))
+	}
+	entry, err := fp.r.bytes()
+	if err != nil {
+		return err
+	}
+	mapPathNode, ok := pathNode.Get(field.name)
+	if !ok {
+		return nil
+	}
+	keyField, valueField := field.message.fields[1], field.message.fields[2]
+	if keyField == nil || valueField == nil {
+		return fp.r.error(fmt.Sprintf("bad map entry type for field %s", field.name))
+	}
+
+	outer := fp.r
+	fp.r = protoReader{buf: outer.buf[:outer.index], index: outer.index - len(entry)}
+	var key []byte
+	valueAt, valueWireType := -1, uint64(0)
+	for !fp.r.done() {
+		number, entryWireType, err := fp.r.key()
+		if err != nil {
+			return err
+		}
+		switch {
+		case number == 1 && entryWireType == keyField.wireType():
+			if key, err = fp.scalar(keyField, entryWireType); err != nil {
+				return err
+			}
+		case number == 2:
+			valueAt, valueWireType = fp.r.index, entryWireType
+			err = fp.r.skip(entryWireType)
+		default:
+			err = fp.r.skip(entryWireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if key == nil {
+		key = fp.formatScalar(keyField, 0, nil)
+	}
+	if keyField.typ == protoTypeString {
+		// member names aren't quoted
+		key = key[1 : len(key)-1]
+	}
+
+	if mapPathNode.IsSegmentUsed(key) {
+		if valueAt >= 0 {
+			fp.r.index = valueAt
+		}
+		if valueField.typ == protoTypeMessage {
+			err = fp.readMapMessageValue(valueField, valueAt, valueWireType, key, mapPathNode, arrayTrail)
+		} else {
+			err = fp.readMapScalarValue(valueField, valueAt, valueWireType, key, mapPathNode, arrayTrail)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fp.r = outer
+	return nil
+}
+
+func (fp *flattenProtobuf) readMapMessageValue(valueField *protoField, valueAt int, wireType uint64, key []byte, mapPathNode SegmentsTreeTracker, arrayTrail []ArrayPos) error {
+	if needsPresenceMarker(mapPathNode, key) {
+		fp.storeField(mapPathNode.PathForSegment(key), arrayTrail, nil)
+	}
+	valuePathNode, ok := mapPathNode.Get(key)
+	if valueAt < 0 || !ok {
+		return nil
+	}
+	if wireType != protoLength {
+		return fp.r.error(fmt.Sprintf("wrong wire type %d for map value", wireType))
+	}
+	b, err := fp.r.bytes()
+	if err != nil {
+		return err
+	}
+	end := fp.r.index
+	fp.r.index -= len(b)
+	return fp.readMessage(end, valueField.message, valuePathNode, arrayTrail)
+}
+
+func (fp *flattenProtobuf) readMapScalarValue(valueField *protoField, valueAt int, wireType uint64, key []byte, mapPathNode SegmentsTreeTracker, arrayTrail []ArrayPos) error {
+	path := mapPathNode.PathForSegment(key)
+	if path == nil {
+		return nil
+	}
+	var val []byte
+	if valueAt < 0 {
+		val = fp.formatScalar(valueField, 0, nil)
+	} else {
+		if wireType != valueField.wireType() {
+			return fp.r.error(fmt.Sprintf("wrong wire type %d for map value", wireType))
+		}
+		var err error
+		if val, err = fp.scalar(valueField, wireType); err != nil {
+			return err
+		}
+	}
+	fp.storeField(path, arrayTrail, val)
+	return nil
+}
+
+// repeat returns the index of the protoRepeat for a repeated field in the message whose repeats start at
+// base, adding one if this is the first time the field has been seen
+func (fp *flattenProtobuf) repeat(base int, number uint64) int {
+	for i := base; i < len(fp.repeats); i++ {
+		if fp.repeats[i].number == number {
+			return i
+		}
+	}
+	fp.arrayCount++
+	fp.repeats = append(fp.repeats, protoRepeat{number: number, array: fp.arrayCount})
+	return len(fp.repeats) - 1
+}
+
+// nextElement moves a repeated field on to its next element and returns the ArrayTrail for it, stored in the
+// trails buffer. If the buffer has to grow, the ArrayTrails already handed out stay where they are.
+func (fp *flattenProtobuf) nextElement(arrayTrail []ArrayPos, repeat int) []ArrayPos {
+	fp.repeats[repeat].pos++
+	start := len(fp.trails)
+	fp.trails = append(fp.trails, arrayTrail...)
+	fp.trails = append(fp.trails, ArrayPos{fp.repeats[repeat].array, fp.repeats[repeat].pos})
+	return fp.trails[start:len(fp.trails):len(fp.trails)]
+}
+
+func (fp *flattenProtobuf) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	fp.fields = append(fp.fields, Field{Path: path, ArrayTrail: arrayTrail, Val: val})
+}
+
+// scalar reads a value that isn't a message and returns its JSON form
+func (fp *flattenProtobuf) scalar(field *protoField, wireType uint64) ([]byte, error) {
+	var u uint64
+	var b []byte
+	var err error
+	switch wireType {
+	case protoVarint:
+		u, err = fp.r.varint()
+	case protoFixed64:
+		u, err = fp.r.fixed(8)
+	case protoFixed32:
+		u, err = fp.r.fixed(4)
+	case protoLength:
+		b, err = fp.r.bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if field.typ == protoTypeString && !utf8.Valid(b) {
+		return nil, fp.r.error(fmt.Sprintf("invalid UTF-8 in string field %s", field.name))
+	}
+	return fp.formatScalar(field, u, b), nil
+}
+
+// formatScalar returns the JSON form of a value that isn't a message, given the integer or bits it was
+// encoded as, or its bytes. Called with zeroes, it returns the default value.
+func (fp *flattenProtobuf) formatScalar(field *protoField, u uint64, b []byte) []byte {
+	start := len(fp.vals)
+	switch field.typ {
+	case protoTypeBool:
+		if u != 0 {
+			return trueBytes
+		}
+		return falseBytes
+
+	case protoTypeEnum:
+		if name, ok := field.enum.values[int32(u)]; ok {
+			return name
+		}
+		fp.vals = strconv.AppendInt(fp.vals, int64(int32(u)), 10)
+
+	case protoTypeString:
+		fp.vals = append(fp.vals, '"')
+		fp.vals = append(fp.vals, b...)
+		fp.vals = append(fp.vals, '"')
+		return fp.valFrom(start)
+
+	case protoTypeBytes:
+		fp.vals = append(fp.vals, '"')
+		encodedStart := len(fp.vals)
+		for i := base64.StdEncoding.EncodedLen(len(b)); i > 0; i-- {
+			fp.vals = append(fp.vals, 0)
+		}
+		base64.StdEncoding.Encode(fp.vals[encodedStart:], b)
+		fp.vals = append(fp.vals, '"')
+		return fp.valFrom(start)
+
+	case protoTypeDouble, protoTypeFloat:
+		var ok bool
+		if field.typ == protoTypeDouble {
+			fp.vals, ok = appendFloatText(fp.vals, math.Float64frombits(u), 64)
+		} else {
+			fp.vals, ok = appendFloatText(fp.vals, float64(math.Float32frombits(uint32(u))), 32)
+		}
+		if !ok {
+			return nullBytes
+		}
+
+	case protoTypeInt64, protoTypeSfixed64:
+		fp.vals = strconv.AppendInt(fp.vals, int64(u), 10)
+	case protoTypeInt32, protoTypeSfixed32:
+		fp.vals = strconv.AppendInt(fp.vals, int64(int32(u)), 10)
+	case protoTypeUint64, protoTypeFixed64:
+		fp.vals = strconv.AppendUint(fp.vals, u, 10)
+	case protoTypeUint32, protoTypeFixed32:
+		fp.vals = strconv.AppendUint(fp.vals, uint64(uint32(u)), 10)
+	case protoTypeSint32:
+		fp.vals = strconv.AppendInt(fp.vals, int64(int32(uint32(u)>>1)^-int32(u&1)), 10)
+	case protoTypeSint64:
+		fp.vals = strconv.AppendInt(fp.vals, int64(u>>1)^-int64(u&1), 10)
+	}
+	return numberValue(fp.valFrom(start), fp.canonicalizeNumbers)
+}
+
+// valFrom returns what's been written to the vals buffer since start, see flattenMsgpack.valFrom
+func (fp *flattenProtobuf) valFrom(start int) []byte {
+	return fp.vals[start:len(fp.vals):len(fp.vals)]
+}
@@ -0,0 +1,328 @@
+package quamina
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// protoEncoder writes the protobuf wire format, for building descriptors and events
+type protoEncoder []byte
+
+func (p protoEncoder) varint(number uint64, v uint64) protoEncoder {
+	p = appendUvarint(p, number<<3|protoVarint)
+	return appendUvarint(p, v)
+}
+
+func (p protoEncoder) fixed32(number uint64, v uint32) protoEncoder {
+	p = appendUvarint(p, number<<3|protoFixed32)
+	return appendLittleEndian(p, uint64(v), 4)
+}
+
+func (p protoEncoder) fixed64(number uint64, v uint64) protoEncoder {
+	p = appendUvarint(p, number<<3|protoFixed64)
+	return appendLittleEndian(p, v, 8)
+}
+
+func (p protoEncoder) bytes(number uint64, b []byte) protoEncoder {
+	p = appendUvarint(p, number<<3|protoLength)
+	p = appendUvarint(p, uint64(len(b)))
+	return append(p, b...)
+}
+
+func (p protoEncoder) str(number uint64, s string) protoEncoder {
+	return p.bytes(number, []byte(s))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendLittleEndian(b []byte, v uint64, size int) []byte {
+	for i := 0; i < size; i++ {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+func fieldDescriptor(name string, number uint64, typ uint64, typeName string, repeated bool) []byte {
+	label := uint64(1)
+	if repeated {
+		label = protoLabelRepeated
+	}
+	f := protoEncoder{}.str(1, name).varint(3, number).varint(4, label).varint(5, typ)
+	if typeName != "" {
+		f = f.str(6, typeName)
+	}
+	return f
+}
+
+func messageDescriptor(name string, fields ...[]byte) protoEncoder {
+	m := protoEncoder{}.str(1, name)
+	for _, f := range fields {
+		m = m.bytes(2, f)
+	}
+	return m
+}
+
+func mapEntryDescriptor(name string, keyType, valueType uint64, valueTypeName string) []byte {
+	m := messageDescriptor(name,
+		fieldDescriptor("key", 1, keyType, "", false),
+		fieldDescriptor("value", 2, valueType, valueTypeName, false))
+	return m.bytes(7, protoEncoder{}.varint(7, 1))
+}
+
+func enumDescriptor(name string, values ...string) []byte {
+	e := protoEncoder{}.str(1, name)
+	for i, v := range values {
+		e = e.bytes(2, protoEncoder{}.str(1, v).varint(2, uint64(i)))
+	}
+	return e
+}
+
+// testDescriptorSet describes these messages:
+//
+//	package example;
+//	message Order {
+//	  enum Status { UNKNOWN = 0; SHIPPED = 1; }
+//	  string id = 1;
+//	  int64 amount = 2;
+//	  repeated LineItem items = 3;
+//	  map<string, string> tags = 4;
+//	  Status status = 5;
+//	  repeated sint32 codes = 6;
+//	  double ratio = 7;
+//	  bytes blob = 8;
+//	  sint64 delta = 9;
+//	  Address address = 10;
+//	  bool rush = 11;
+//	  map<int32, LineItem> by_number = 12;
+//	  float temperature = 13;
+//	  fixed32 f32 = 14;
+//	  sfixed64 sf64 = 15;
+//	  uint64 big = 16;
+//	}
+//	message LineItem { string sku = 1; int32 qty = 2; }
+//	message Address { string city = 1; }
+func testDescriptorSet() []byte {
+	order := messageDescriptor("Order",
+		fieldDescriptor("id", 1, protoTypeString, "", false),
+		fieldDescriptor("amount", 2, protoTypeInt64, "", false),
+		fieldDescriptor("items", 3, protoTypeMessage, ".example.LineItem", true),
+		fieldDescriptor("tags", 4, protoTypeMessage, ".example.Order.TagsEntry", true),
+		fieldDescriptor("status", 5, protoTypeEnum, "Status", false),
+		fieldDescriptor("codes", 6, protoTypeSint32, "", true),
+		fieldDescriptor("ratio", 7, protoTypeDouble, "", false),
+		fieldDescriptor("blob", 8, protoTypeBytes, "", false),
+		fieldDescriptor("delta", 9, protoTypeSint64, "", false),
+		fieldDescriptor("address", 10, protoTypeMessage, "Address", false),
+		fieldDescriptor("rush", 11, protoTypeBool, "", false),
+		fieldDescriptor("by_number", 12, protoTypeMessage, "ByNumberEntry", true),
+		fieldDescriptor("temperature", 13, protoTypeFloat, "", false),
+		fieldDescriptor("f32", 14, protoTypeFixed32, "", false),
+		fieldDescriptor("sf64", 15, protoTypeSfixed64, "", false),
+		fieldDescriptor("big", 16, protoTypeUint64, "", false),
+	)
+	order = order.bytes(3, mapEntryDescriptor("TagsEntry", protoTypeString, protoTypeString, ""))
+	order = order.bytes(3, mapEntryDescriptor("ByNumberEntry", protoTypeInt32, protoTypeMessage, ".example.LineItem"))
+	order = order.bytes(4, enumDescriptor("Status", "UNKNOWN", "SHIPPED"))
+	lineItem := messageDescriptor("LineItem",
+		fieldDescriptor("sku", 1, protoTypeString, "", false),
+		fieldDescriptor("qty", 2, protoTypeInt32, "", false))
+	address := messageDescriptor("Address", fieldDescriptor("city", 1, protoTypeString, "", false))
+	file := protoEncoder{}.str(1, "example.proto").str(2, "example").bytes(4, order).bytes(4, lineItem).bytes(4, address)
+	return protoEncoder{}.bytes(1, file)
+}
+
+func zigzag(n int64) uint64 {
+	return uint64(n<<1) ^ uint64(n>>63)
+}
+
+func lineItem(sku string, qty int64) []byte {
+	return protoEncoder{}.str(1, sku).varint(2, uint64(qty))
+}
+
+// testOrder has its repeated fields split up, as they may be on the wire
+func testOrder() []byte {
+	amount, sf64 := int64(-5000), int64(-9)
+	packed := protoEncoder{}
+	for _, code := range []int64{3, -4} {
+		packed = appendUvarint(packed, zigzag(code))
+	}
+	return protoEncoder{}.
+		str(1, "order-1").
+		varint(2, uint64(amount)).
+		bytes(3, lineItem("apple", 1)).
+		bytes(4, protoEncoder{}.str(1, "color").str(2, "red")).
+		varint(5, 1).
+		bytes(6, packed).
+		fixed64(7, math.Float64bits(0.25)).
+		bytes(8, []byte{1, 2, 3, 4}).
+		varint(9, zigzag(-77)).
+		bytes(10, protoEncoder{}.str(1, "Vancouver")).
+		varint(11, 1).
+		bytes(3, lineItem("banana", 2)).
+		bytes(12, protoEncoder{}.varint(1, 7).bytes(2, lineItem("cherry", 9))).
+		fixed32(13, math.Float32bits(0.1)).
+		fixed32(14, 4000000000).
+		fixed64(15, uint64(sf64)).
+		varint(16, math.MaxUint64).
+		varint(6, zigzag(5)).
+		bytes(4, protoEncoder{}.str(1, "size")).
+		varint(99, 1)
+}
+
+func TestProtobufFlatten(t *testing.T) {
+	f, err := NewProtobufFlattener(testDescriptorSet(), "example.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := fakeMatcher("id", "amount", "items\nsku", "items\nqty", "tags\ncolor", "tags\nsize", "status",
+		"codes", "ratio", "blob", "delta", "address\ncity", "rush", "by_number\n7\nsku", "temperature", "f32", "sf64",
+		"big").getSegmentsTreeTracker()
+	fields, err := f.Flatten(testOrder(), tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, field := range fields {
+		got = append(got, strings.ReplaceAll(string(field.Path), "\n", ".")+"="+string(field.Val))
+	}
+	sort.Strings(got)
+	wanted := []string{
+		`address.city="Vancouver"`,
+		`amount=-5000`,
+		`big=18446744073709551615`,
+		`blob="AQIDBA=="`,
+		`by_number.7.sku="cherry"`,
+		`codes=-4`,
+		`codes=3`,
+		`codes=5`,
+		`delta=-77`,
+		`f32=4000000000`,
+		`id="order-1"`,
+		`items.qty=1`,
+		`items.qty=2`,
+		`items.sku="apple"`,
+		`items.sku="banana"`,
+		`ratio=0.25`,
+		`rush=true`,
+		`sf64=-9`,
+		`status="SHIPPED"`,
+		`tags.color="red"`,
+		`tags.size=""`,
+		`temperature=0.1`,
+	}
+	if strings.Join(got, " ") != strings.Join(wanted, " ") {
+		t.Errorf("wanted\n%v\ngot\n%v", wanted, got)
+	}
+
+	// the elements of a repeated field are in the same array even when they're apart on the wire
+	var codes []Field
+	for _, field := range fields {
+		if string(field.Path) == "codes" {
+			codes = append(codes, field)
+		}
+	}
+	for i, field := range codes {
+		if len(field.ArrayTrail) != 1 || field.ArrayTrail[0].Array != codes[0].ArrayTrail[0].Array ||
+			field.ArrayTrail[0].Pos != int32(i+1) {
+			t.Errorf("codes element %d has trail %v", i, field.ArrayTrail)
+		}
+	}
+}
+
+func TestProtobufMatching(t *testing.T) {
+	f, err := NewProtobufFlattener(testDescriptorSet(), ".example.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(WithFlattener(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, map[X]string{
+		"apple1":    `{"items": {"sku": ["apple"], "qty": [1]}}`,
+		"apple2":    `{"items": {"sku": ["apple"], "qty": [2]}}`,
+		"shipped":   `{"status": ["SHIPPED"], "amount": [ {"numeric": ["<", 0]} ]}`,
+		"red":       `{"tags": {"color": ["red"]}}`,
+		"address":   `{"address": [ {"exists": true} ]}`,
+		"noGift":    `{"gift": [ {"exists": false} ], "codes": [5]}`,
+		"cherry":    `{"by_number": {"7": {"sku": [ {"prefix": "ch"} ]}}}`,
+		"vancouver": `{"address": {"city": [ {"equals-ignore-case": "VANCOUVER"} ]}}`,
+		"unknown":   `{"status": ["UNKNOWN"]}`,
+	})
+	matches, err := q.MatchesForEvent(testOrder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, "order", matches, []X{"apple1", "shipped", "red", "address", "noGift", "cherry", "vancouver"})
+}
+
+func TestProtobufErrors(t *testing.T) {
+	_, err := NewProtobufFlattener(testDescriptorSet(), "example.Missing")
+	if err == nil {
+		t.Error("accepted missing message")
+	}
+	badFile := protoEncoder{}.str(2, "example").bytes(4, messageDescriptor("M", fieldDescriptor("x", 1, protoTypeMessage, "Nope", false)))
+	_, err = NewProtobufFlattener(protoEncoder{}.bytes(1, badFile), "example.M")
+	if err == nil {
+		t.Error("accepted unresolvable type")
+	}
+	_, err = NewProtobufFlattener([]byte{0x0a, 0x05, 0x01}, "example.M")
+	if err == nil {
+		t.Error("accepted truncated descriptor set")
+	}
+
+	f, err := NewProtobufFlattener(testDescriptorSet(), "example.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := fakeMatcher("id", "amount", "items\nsku", "tags\ncolor").getSegmentsTreeTracker()
+	bads := [][]byte{
+		{0x0a, 0x05, 'a'},
+		{0x10},
+		{0x10, 0x80},
+		{0x0d, 0, 0, 0, 0},
+		{0x15, 0, 0, 0, 0},
+		{0x00, 0x01},
+		{0x1a, 0x02, 0x0a, 0x05},
+		{0x22, 0x02, 0x0a, 0x05},
+		{0x07},
+		{0x0a, 0x01, 0xff},
+	}
+	for _, bad := range bads {
+		if _, err := f.Flatten(bad, tracker); err == nil {
+			t.Errorf("accepted % x", bad)
+		}
+	}
+
+	// unused fields are skipped, not checked
+	fields, err := f.Flatten(protoEncoder{}.str(1, "x").fixed32(7, 0), tracker)
+	if err != nil || len(fields) != 1 {
+		t.Errorf("skipping: %v %v", fields, err)
+	}
+}
+
+func TestProtobufAllocations(t *testing.T) {
+	f, err := NewProtobufFlattener(testDescriptorSet(), "example.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := fakeMatcher("id", "items\nsku", "items\nqty", "codes", "tags\ncolor", "ratio").getSegmentsTreeTracker()
+	event := testOrder()
+	allocs := testing.AllocsPerRun(100, func() {
+		fields, err := f.Flatten(event, tracker)
+		if err != nil || len(fields) != 10 {
+			t.Errorf("flatten: %v %v", fields, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per flatten", allocs)
+	}
+}
@@ -0,0 +1,204 @@
+package quamina
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// flattenRequest turns an HTTP request into Fields, as if it were a JSON object like this:
+//
+//	{"method": "POST", "path": "/orders", "headers": {"content-type": ["application/json"]},
+//	 "query": {"page": ["2"]}, "body": { ... }}
+//
+// Header names are lower-cased, and headers and query parameters are arrays of strings even when they have
+// only one value. "host" comes from the Host header, which net/http keeps separately. Since the automaton only
+// works on UTF-8, a request whose values aren't valid UTF-8 is an error. The body is only read if a Pattern
+// mentions it, and has to be a JSON object no bigger than maxBodySize; it's replaced with a copy so that handlers
+// can still read it.
+// Like flattenValue, it doesn't implement Flattener, since requests aren't []byte, but uses the
+// SegmentsTreeTracker in the same way.
+type flattenRequest struct {
+	fields      []Field
+	arrayCount  int32
+	body        Flattener
+	name        []byte // where lower-cased header names are put
+	maxBodySize int64
+}
+
+var (
+	requestMethodSegment  = []byte("method")
+	requestPathSegment    = []byte("path")
+	requestHeadersSegment = []byte("headers")
+	requestQuerySegment   = []byte("query")
+	requestBodySegment    = []byte("body")
+	requestHostHeader     = []byte("host")
+)
+
+// defaultMaxRequestBodySize is how big a request body can be, unless WithMaxRequestBodySize says otherwise
+const defaultMaxRequestBodySize = 10 << 20
+
+func newRequestFlattener(canonicalizeNumbers bool) *flattenRequest {
+	body := newJSONFlattener()
+	body.(numberCanonicalizer).setCanonicalizeNumbers(canonicalizeNumbers)
+	return &flattenRequest{fields: make([]Field, 0, 32), body: body, maxBodySize: defaultMaxRequestBodySize}
+}
+
+// flatten returns the Fields for a request. An error is returned if a value that's needed isn't valid UTF-8, or
+// if the body is needed and can't be read, is too big, or isn't a JSON object.
+func (fr *flattenRequest) flatten(r *http.Request, tracker SegmentsTreeTracker) ([]Field, error) {
+	fr.fields = fr.fields[:0]
+	fr.arrayCount = 0
+
+	// the body goes first, because the JSON flattener numbers its arrays from 1, and the headers and query
+	// parameters need array numbers that don't clash
+	if tracker.IsSegmentUsed(requestBodySegment) {
+		if err := fr.readBody(r, tracker); err != nil {
+			return nil, err
+		}
+	}
+	if path := tracker.PathForSegment(requestMethodSegment); path != nil {
+		if err := fr.readString(path, r.Method); err != nil {
+			return nil, err
+		}
+	}
+	if path := tracker.PathForSegment(requestPathSegment); path != nil && r.URL != nil {
+		if err := fr.readString(path, r.URL.Path); err != nil {
+			return nil, err
+		}
+	}
+	if needsPresenceMarker(tracker, requestHeadersSegment) && (len(r.Header) > 0 || r.Host != "") {
+		fr.storeField(tracker.PathForSegment(requestHeadersSegment), nil, nil)
+	}
+	if headersNode, ok := tracker.Get(requestHeadersSegment); ok {
+		for name, values := range r.Header {
+			fr.name = append(fr.name[:0], strings.ToLower(name)...)
+			if err := fr.readStrings(headersNode.PathForSegment(fr.name), values); err != nil {
+				return nil, err
+			}
+		}
+		if r.Host != "" {
+			if err := fr.readStrings(headersNode.PathForSegment(requestHostHeader), []string{r.Host}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if tracker.IsSegmentUsed(requestQuerySegment) && r.URL != nil {
+		query := r.URL.Query()
+		if needsPresenceMarker(tracker, requestQuerySegment) && len(query) > 0 {
+			fr.storeField(tracker.PathForSegment(requestQuerySegment), nil, nil)
+		}
+		if queryNode, ok := tracker.Get(requestQuerySegment); ok {
+			for name, values := range query {
+				if err := fr.readStrings(queryNode.PathForSegment([]byte(name)), values); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return fr.fields, nil
+}
+
+// readString stores the Field for the method or path
+func (fr *flattenRequest) readString(path []byte, value string) error {
+	val, err := requestValue(value)
+	if err != nil {
+		return err
+	}
+	fr.storeField(path, nil, val)
+	return nil
+}
+
+// readStrings stores the Fields for the values of a header or query parameter, which are an array
+func (fr *flattenRequest) readStrings(path []byte, values []string) error {
+	if path == nil {
+		return nil
+	}
+	fr.arrayCount++
+	for i, value := range values {
+		val, err := requestValue(value)
+		if err != nil {
+			return err
+		}
+		fr.storeField(path, []ArrayPos{{Array: fr.arrayCount, Pos: int32(i + 1)}}, val)
+	}
+	return nil
+}
+
+// requestValue returns the JSON form of a string from a request. Query parameters are percent-decoded and
+// headers can contain any byte, so they may not be UTF-8.
+func requestValue(value string) ([]byte, error) {
+	if !utf8.ValidString(value) {
+		return nil, errors.New("request value is not valid UTF-8")
+	}
+	return quoted([]byte(value)), nil
+}
+
+// readBody reads the body, puts back a copy for handlers to read, and stores the Fields the JSON flattener finds
+// in it
+func (fr *flattenRequest) readBody(r *http.Request, tracker SegmentsTreeTracker) error {
+	body, err := readRequestBody(r, fr.maxBodySize)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if needsPresenceMarker(tracker, requestBodySegment) {
+		fr.storeField(tracker.PathForSegment(requestBodySegment), nil, nil)
+	}
+	bodyNode, ok := tracker.Get(requestBodySegment)
+	if !ok {
+		return nil
+	}
+	fields, err := fr.body.Flatten(body, bodyNode)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		for _, pos := range field.ArrayTrail {
+			if pos.Array > fr.arrayCount {
+				fr.arrayCount = pos.Array
+			}
+		}
+		fr.fields = append(fr.fields, field)
+	}
+	return nil
+}
+
+// readRequestBody reads a request's body, replacing it with a copy so that handlers can still read it. If the
+// body is bigger than limit, it gives up, and handlers get what was read followed by the rest.
+func readRequestBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	original := r.Body
+	readLimit := limit
+	if readLimit < math.MaxInt64 {
+		// one more byte than the limit, to tell if there's too much
+		readLimit++
+	}
+	body, err := io.ReadAll(io.LimitReader(original, readLimit))
+	if err == nil && int64(len(body)) > limit {
+		err = fmt.Errorf("request body is bigger than %d bytes", limit)
+	}
+	if err != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), original), original}
+		return nil, err
+	}
+	_ = original.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func (fr *flattenRequest) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	fr.fields = append(fr.fields, Field{Path: path, ArrayTrail: arrayTrail, Val: val})
+}
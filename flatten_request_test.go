@@ -0,0 +1,228 @@
+package quamina
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testRequest(t *testing.T, body string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("POST", "http://api.example.com/orders/17?page=2&tag=a&tag=b", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Add("X-Tenant", "acme")
+	r.Header.Add("X-Tenant", "globex")
+	return r
+}
+
+const testRequestBody = `{"customer": {"tier": "gold"}, "items": [{"sku": "a", "qty": 1}, {"sku": "b", "qty": 2}]}`
+
+func TestRequestFlatten(t *testing.T) {
+	tracker := fakeMatcher("method", "path", "headers\ncontent-type", "headers\nx-tenant", "headers\nhost",
+		"query\npage", "query\ntag", "body\ncustomer\ntier", "body\nitems\nsku").getSegmentsTreeTracker()
+	fields, err := newRequestFlattener(false).flatten(testRequest(t, testRequestBody), tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := []string{
+		`body.customer.tier="gold"`,
+		`body.items.sku="a"`,
+		`body.items.sku="b"`,
+		`headers.content-type="application/json"`,
+		`headers.host="api.example.com"`,
+		`headers.x-tenant="acme"`,
+		`headers.x-tenant="globex"`,
+		`method="POST"`,
+		`path="/orders/17"`,
+		`query.page="2"`,
+		`query.tag="a"`,
+		`query.tag="b"`,
+	}
+	got := valueFieldStrings(fields)
+	if strings.Join(got, " ") != strings.Join(wanted, " ") {
+		t.Errorf("wanted\n%v\ngot\n%v", wanted, got)
+	}
+
+	// arrays in the body and in the headers and query mustn't be confused
+	arrays := make(map[int32][]byte)
+	for _, field := range fields {
+		for _, pos := range field.ArrayTrail {
+			if path, ok := arrays[pos.Array]; ok && string(path) != string(field.Path) {
+				t.Errorf("array %d used for %q and %q", pos.Array, path, field.Path)
+			}
+			arrays[pos.Array] = field.Path
+		}
+	}
+}
+
+// failingReader is a body that mustn't be read
+type failingReader struct{}
+
+func (failingReader) Read(_ []byte) (int, error) {
+	return 0, errors.New("body was read")
+}
+
+func TestRequestBodyHandling(t *testing.T) {
+	// not read unless a Pattern mentions it
+	r := httptest.NewRequest("GET", "/x", failingReader{})
+	fields, err := newRequestFlattener(false).flatten(r, fakeMatcher("method").getSegmentsTreeTracker())
+	if err != nil || len(fields) != 1 {
+		t.Errorf("got %v, %v", fields, err)
+	}
+
+	// still there for handlers after it's been read
+	r = testRequest(t, testRequestBody)
+	if _, err = newRequestFlattener(false).flatten(r, fakeMatcher("body\nitems\nsku").getSegmentsTreeTracker()); err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil || string(body) != testRequestBody {
+		t.Errorf("body afterward: %q, %v", body, err)
+	}
+
+	// an empty body has no fields, but one that isn't JSON is an error
+	tracker := fakeMatcher("body\nx").getSegmentsTreeTracker()
+	fields, err = newRequestFlattener(false).flatten(testRequest(t, ""), tracker)
+	if err != nil || len(fields) != 0 {
+		t.Errorf("empty body: %v, %v", fields, err)
+	}
+	if _, err = newRequestFlattener(false).flatten(testRequest(t, "x=1"), tracker); err == nil {
+		t.Error("accepted non-JSON body")
+	}
+
+	// a body that's too big is an error, but handlers can still read all of it
+	fr := newRequestFlattener(false)
+	fr.maxBodySize = int64(len(testRequestBody) - 1)
+	r = testRequest(t, testRequestBody)
+	if _, err = fr.flatten(r, tracker); err == nil {
+		t.Error("accepted body that's too big")
+	}
+	body, err = io.ReadAll(r.Body)
+	if err != nil || string(body) != testRequestBody {
+		t.Errorf("body afterward: %q, %v", body, err)
+	}
+	fr.maxBodySize = int64(len(testRequestBody))
+	if _, err = fr.flatten(testRequest(t, testRequestBody), tracker); err != nil {
+		t.Errorf("body of exactly the maximum size: %s", err.Error())
+	}
+}
+
+func TestRequestInvalidUTF8(t *testing.T) {
+	tracker := fakeMatcher("path", "query\na", "headers\nx-a").getSegmentsTreeTracker()
+	bads := []*http.Request{
+		httptest.NewRequest("GET", "/x?a=%FF", nil),
+		httptest.NewRequest("GET", "/%FF", nil),
+		httptest.NewRequest("GET", "/x", nil),
+	}
+	bads[2].Header.Set("X-A", "\xff")
+	for _, bad := range bads {
+		if _, err := newRequestFlattener(false).flatten(bad, tracker); err == nil {
+			t.Errorf("accepted %s %v", bad.URL, bad.Header)
+		}
+	}
+}
+
+func TestMaxRequestBodySize(t *testing.T) {
+	if _, err := New(WithMaxRequestBodySize(0)); err == nil {
+		t.Error("accepted zero maximum")
+	}
+	if _, err := New(WithMaxRequestBodySize(10), WithMaxRequestBodySize(10)); err == nil {
+		t.Error("accepted maximum twice")
+	}
+	q, err := New(WithMaxRequestBodySize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("gold", `{"body": {"customer": {"tier": ["gold"]}}}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = q.Copy().MatchesForRequest(testRequest(t, testRequestBody)); err == nil {
+		t.Error("accepted body that's too big")
+	}
+}
+
+func TestRequestMatching(t *testing.T) {
+	q, err := New(WithNumberCanonicalization(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, map[X]string{
+		"orders":   `{"method": ["POST"], "path": [ {"prefix": "/orders/"} ]}`,
+		"acme":     `{"headers": {"x-tenant": ["acme"]}}`,
+		"json":     `{"headers": {"content-type": [ {"prefix": "application/json"} ]}}`,
+		"tagB":     `{"query": {"tag": ["b"], "page": ["2"]}}`,
+		"gold":     `{"body": {"customer": {"tier": ["gold"]}}}`,
+		"a1":       `{"body": {"items": {"sku": ["a"], "qty": [1.0]}}}`,
+		"a2":       `{"body": {"items": {"sku": ["a"], "qty": [2]}}}`,
+		"hasQuery": `{"query": [ {"exists": true} ]}`,
+		"get":      `{"method": ["GET"]}`,
+		"noAuth":   `{"headers": {"authorization": [ {"exists": false} ]}}`,
+	})
+	matches, err := q.MatchesForRequest(testRequest(t, testRequestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, "request", matches, []X{"orders", "acme", "json", "tagB", "gold", "a1", "hasQuery", "noAuth"})
+}
+
+func TestMiddleware(t *testing.T) {
+	q, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("acme", `{"headers": {"x-tenant": ["acme"]}}`); err != nil {
+		t.Fatal(err)
+	}
+	var seen []X
+	var body string
+	handler := q.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestMatches(r)
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, testRequest(t, testRequestBody))
+	if w.Code != http.StatusOK || len(seen) != 1 || seen[0] != "acme" || body != testRequestBody {
+		t.Errorf("got %d %v %q", w.Code, seen, body)
+	}
+
+	// Patterns added later take effect
+	if err = q.AddPattern("body", `{"body": {"customer": [ {"exists": true} ]}}`); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, testRequest(t, testRequestBody))
+	if len(seen) != 2 || body != testRequestBody {
+		t.Errorf("got %v %q", seen, body)
+	}
+
+	seen = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, testRequest(t, "not JSON"))
+	if w.Code != http.StatusBadRequest || seen != nil {
+		t.Errorf("got %d %v", w.Code, seen)
+	}
+
+	// the client isn't told what was wrong
+	if strings.TrimSpace(w.Body.String()) != http.StatusText(http.StatusBadRequest) {
+		t.Errorf("error leaked: %q", w.Body.String())
+	}
+
+	// values that aren't UTF-8 are rejected, not passed to the automaton
+	if err = q.AddPattern("xy", `{"query": {"a": ["x", "y"]}}`); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/x?a=%FF", nil))
+	if w.Code != http.StatusBadRequest || seen != nil {
+		t.Errorf("got %d %v", w.Code, seen)
+	}
+
+	if RequestMatches(testRequest(t, "")) != nil {
+		t.Error("matches for a request that didn't go through the middleware")
+	}
+}
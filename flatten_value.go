@@ -0,0 +1,518 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// flattenValue turns a Go value into Fields, as flattenJSON would for the JSON that encoding/json would
+// produce from the value, but without producing it. Maps with string or integer keys, and structs, are
+// objects; slices and arrays, except for []byte which becomes a base64 string, are arrays. Struct fields
+// are named and omitted according to their json tags, and values that implement json.Marshaler or
+// encoding.TextMarshaler, such as time.Time, are marshaled. Unlike encoding/json, NaN and the infinities are
+// allowed, and become null, as they do in the other Flatteners for formats that have them.
+// It doesn't implement Flattener, since events are []byte, but uses the SegmentsTreeTracker in the same way,
+// so parts of the value that no Pattern mentions aren't looked at.
+type flattenValue struct {
+	fields     []Field
+	arrayTrail []ArrayPos
+	arrayCount int32
+
+	canonicalizeNumbers bool
+}
+
+// maxValueDepth is how deeply values may be nested, which protects against pointer cycles
+const maxValueDepth = 1000
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonNumberType    = reflect.TypeOf(json.Number(""))
+)
+
+func newValueFlattener(canonicalizeNumbers bool) *flattenValue {
+	return &flattenValue{fields: make([]Field, 0, 32), canonicalizeNumbers: canonicalizeNumbers}
+}
+
+// flatten returns the Fields for a value, which has to be something that would be a JSON object
+func (fv *flattenValue) flatten(v any, tracker SegmentsTreeTracker) ([]Field, error) {
+	fv.fields = fv.fields[:0]
+	fv.arrayTrail = fv.arrayTrail[:0]
+	fv.arrayCount = 0
+
+	rv, err := fv.resolve(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	if !isObject(rv) {
+		return nil, fmt.Errorf("value of type %T is not an object", v)
+	}
+	err = fv.readObject(rv, tracker, 0)
+	if err != nil {
+		return nil, err
+	}
+	return fv.fields, nil
+}
+
+// resolve follows pointers and interfaces, and replaces values that marshal themselves with what they
+// marshal to. A nil pointer, interface, map, or slice becomes the zero Value, which is null.
+func (fv *flattenValue) resolve(v reflect.Value) (reflect.Value, error) {
+	for {
+		if !v.IsValid() {
+			return v, nil
+		}
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			if v.IsNil() {
+				return reflect.Value{}, nil
+			}
+		}
+		if v.Kind() != reflect.Interface {
+			if m, ok := marshaler(v, jsonMarshalerType); ok {
+				return unmarshalToValue(m.(json.Marshaler))
+			}
+			if v.Kind() != reflect.String {
+				if m, ok := marshaler(v, textMarshalerType); ok {
+					text, err := m.(encoding.TextMarshaler).MarshalText()
+					if err != nil {
+						return v, err
+					}
+					return reflect.ValueOf(string(text)), nil
+				}
+			}
+		}
+		if v.Kind() != reflect.Pointer && v.Kind() != reflect.Interface {
+			return v, nil
+		}
+		v = v.Elem()
+	}
+}
+
+// marshaler returns v, or a pointer to it if that's what has the method, as an interface of type t
+func marshaler(v reflect.Value, t reflect.Type) (any, bool) {
+	if v.Type().Implements(t) {
+		return v.Interface(), true
+	}
+	if v.Kind() != reflect.Pointer && v.CanAddr() && v.Addr().Type().Implements(t) {
+		return v.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+func unmarshalToValue(m json.Marshaler) (reflect.Value, error) {
+	marshaled, err := m.MarshalJSON()
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	d := json.NewDecoder(bytes.NewReader(marshaled))
+	d.UseNumber()
+	var decoded any
+	if err = d.Decode(&decoded); err != nil {
+		return reflect.Value{}, err
+	}
+	return reflect.ValueOf(decoded), nil
+}
+
+func isObject(v reflect.Value) bool {
+	return v.IsValid() && (v.Kind() == reflect.Map || v.Kind() == reflect.Struct)
+}
+
+func isArray(v reflect.Value) bool {
+	if !v.IsValid() {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	case reflect.Array:
+		return true
+	}
+	return false
+}
+
+// readObject reads the members of a map or struct, storing Fields for those that the pathNode says are used.
+// Once it has seen all the members mentioned in the pathNode, it stops.
+func (fv *flattenValue) readObject(v reflect.Value, pathNode SegmentsTreeTracker, depth int) error {
+	if depth > maxValueDepth {
+		return errors.New("value nested too deeply")
+	}
+	counts := memberCounts{fields: pathNode.FieldsCount(), nodes: pathNode.NodesCount()}
+
+	// as in flattenJSON, the array trail doesn't change while we're in the object
+	var arrayTrail []ArrayPos
+	if len(fv.arrayTrail) > 0 {
+		arrayTrail = make([]ArrayPos, len(fv.arrayTrail))
+		copy(arrayTrail, fv.arrayTrail)
+	}
+
+	if v.Kind() == reflect.Map {
+		members := v.MapRange()
+		for members.Next() {
+			if counts.nodes == 0 && counts.fields == 0 {
+				return nil
+			}
+			name, err := mapKeyName(members.Key())
+			if err != nil {
+				return err
+			}
+			if !pathNode.IsSegmentUsed(name) {
+				continue
+			}
+			if err = fv.readMember(name, members.Value(), pathNode, arrayTrail, &counts, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, field := range structFields(v.Type()) {
+		if counts.nodes == 0 && counts.fields == 0 {
+			return nil
+		}
+		if !pathNode.IsSegmentUsed(field.name) {
+			continue
+		}
+		member, ok := fieldByIndex(v, field.index)
+		if !ok || (field.omitEmpty && isEmptyValue(member)) {
+			continue
+		}
+		var err error
+		if field.asString {
+			err = fv.readStringOption(field.name, member, pathNode, arrayTrail, &counts)
+		} else {
+			err = fv.readMember(field.name, member, pathNode, arrayTrail, &counts, depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMember reads the value of an object member whose name the pathNode uses
+func (fv *flattenValue) readMember(name []byte, v reflect.Value, pathNode SegmentsTreeTracker, arrayTrail []ArrayPos, counts *memberCounts, depth int) error {
+	v, err := fv.resolve(v)
+	if err != nil {
+		return err
+	}
+	path := pathNode.PathForSegment(name)
+	switch {
+	case isObject(v):
+		if needsPresenceMarker(pathNode, name) {
+			fv.storeField(path, arrayTrail, nil)
+			counts.fields--
+		}
+		objectPathNode, ok := pathNode.Get(name)
+		if !ok {
+			return nil
+		}
+		counts.nodes--
+		return fv.readObject(v, objectPathNode, depth+1)
+
+	case isArray(v):
+		marker, arrayPathNode := arrayMember(pathNode, name, v.Len() == 0)
+		if marker {
+			fv.storeField(path, arrayTrail, nil)
+			counts.fields--
+		}
+		return fv.readArray(path, arrayPathNode, v, depth+1)
+
+	default:
+		if path == nil {
+			return nil
+		}
+		val, err := fv.leaf(v)
+		if err != nil {
+			return err
+		}
+		fv.storeField(path, arrayTrail, val)
+		counts.fields--
+		return nil
+	}
+}
+
+// readStringOption reads a struct field with the ",string" option, which encoding/json writes as a JSON
+// string containing the JSON form of the value
+func (fv *flattenValue) readStringOption(name []byte, v reflect.Value, pathNode SegmentsTreeTracker, arrayTrail []ArrayPos, counts *memberCounts) error {
+	path := pathNode.PathForSegment(name)
+	if path == nil {
+		return nil
+	}
+	v, err := fv.resolve(v)
+	if err != nil {
+		return err
+	}
+	val, err := fv.leaf(v)
+	if err != nil {
+		return err
+	}
+	if v.IsValid() {
+		switch v.Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			val = quoted(val)
+		}
+	}
+	fv.storeField(path, arrayTrail, val)
+	counts.fields--
+	return nil
+}
+
+// readArray reads the elements of a slice or array
+func (fv *flattenValue) readArray(pathName []byte, pathNode SegmentsTreeTracker, v reflect.Value, depth int) error {
+	if depth > maxValueDepth {
+		return errors.New("value nested too deeply")
+	}
+	fv.arrayCount++
+	fv.arrayTrail = append(fv.arrayTrail, ArrayPos{fv.arrayCount, 0})
+
+	for i := 0; i < v.Len(); i++ {
+		fv.arrayTrail[len(fv.arrayTrail)-1].Pos++
+		element, err := fv.resolve(v.Index(i))
+		if err != nil {
+			return err
+		}
+		switch {
+		case isObject(element):
+			err = fv.readObject(element, pathNode, depth+1)
+		case isArray(element):
+			err = fv.readArray(pathName, pathNode, element, depth+1)
+		case pathName != nil:
+			var val []byte
+			val, err = fv.leaf(element)
+			if err == nil {
+				trail := make([]ArrayPos, len(fv.arrayTrail))
+				copy(trail, fv.arrayTrail)
+				fv.storeField(pathName, trail, val)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fv.arrayTrail = fv.arrayTrail[:len(fv.arrayTrail)-1]
+	return nil
+}
+
+func (fv *flattenValue) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	fv.fields = append(fv.fields, Field{Path: path, ArrayTrail: arrayTrail, Val: val})
+}
+
+// leaf returns the JSON form of a value that's not an object or an array
+func (fv *flattenValue) leaf(v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return nullBytes, nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return trueBytes, nil
+		}
+		return falseBytes, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return numberValue(strconv.AppendInt(nil, v.Int(), 10), fv.canonicalizeNumbers), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return numberValue(strconv.AppendUint(nil, v.Uint(), 10), fv.canonicalizeNumbers), nil
+	case reflect.Float32, reflect.Float64:
+		text, ok := appendFloatText(nil, v.Float(), v.Type().Bits())
+		if !ok {
+			return nullBytes, nil
+		}
+		return numberValue(text, fv.canonicalizeNumbers), nil
+	case reflect.String:
+		if !utf8.ValidString(v.String()) {
+			return nil, errors.New("string is not valid UTF-8")
+		}
+		if v.Type() == jsonNumberType {
+			if v.String() == "" {
+				return []byte("0"), nil
+			}
+			return numberValue([]byte(v.String()), fv.canonicalizeNumbers), nil
+		}
+		return quoted([]byte(v.String())), nil
+	case reflect.Slice:
+		// only []byte gets here
+		b := v.Bytes()
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+		base64.StdEncoding.Encode(encoded, b)
+		return quoted(encoded), nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// mapKeyName returns the member name that encoding/json would use for a map key
+func mapKeyName(key reflect.Value) ([]byte, error) {
+	if key.Kind() == reflect.String {
+		return []byte(key.String()), nil
+	}
+	if m, ok := marshaler(key, textMarshalerType); ok {
+		if key.Kind() == reflect.Pointer && key.IsNil() {
+			return nil, nil
+		}
+		return m.(encoding.TextMarshaler).MarshalText()
+	}
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(nil, key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.AppendUint(nil, key.Uint(), 10), nil
+	}
+	return nil, fmt.Errorf("unsupported map key type %s", key.Type())
+}
+
+// isEmptyValue is what encoding/json considers empty for the purposes of omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but reports a nil embedded pointer rather than panicking
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// valueStructField describes a struct field as encoding/json sees it
+type valueStructField struct {
+	name      []byte
+	index     []int
+	tagged    bool
+	omitEmpty bool
+	asString  bool
+}
+
+var structFieldsCache sync.Map // map[reflect.Type][]valueStructField
+
+// structFields returns the fields that encoding/json would write for a struct type, including those promoted
+// from embedded structs. When embedded structs supply more than one field with the same name, the least
+// deeply nested wins, unless there's a tie, in which case a field with a json tag wins, and if that doesn't
+// settle it, none of them is used.
+func structFields(t reflect.Type) []valueStructField {
+	if cached, ok := structFieldsCache.Load(t); ok {
+		return cached.([]valueStructField)
+	}
+	var all []valueStructField
+	collectStructFields(t, nil, map[reflect.Type]bool{}, &all)
+
+	// stable sort by name, then depth, then tagged first, so the winner for each name is first
+	sort.SliceStable(all, func(i, j int) bool {
+		if c := bytes.Compare(all[i].name, all[j].name); c != 0 {
+			return c < 0
+		}
+		if len(all[i].index) != len(all[j].index) {
+			return len(all[i].index) < len(all[j].index)
+		}
+		return all[i].tagged && !all[j].tagged
+	})
+	var fields []valueStructField
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && bytes.Equal(all[j].name, all[i].name) {
+			j++
+		}
+		dominant := all[i]
+		if j == i+1 || len(all[i+1].index) > len(dominant.index) || all[i+1].tagged != dominant.tagged {
+			fields = append(fields, dominant)
+		}
+		i = j
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return lessIndex(fields[i].index, fields[j].index)
+	})
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+func collectStructFields(t reflect.Type, indexPrefix []int, visited map[reflect.Type]bool, fields *[]valueStructField) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+	defer delete(visited, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		index := make([]int, len(indexPrefix)+1)
+		copy(index, indexPrefix)
+		index[len(indexPrefix)] = i
+
+		if sf.Anonymous {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if name == "" && ft.Kind() == reflect.Struct {
+				collectStructFields(ft, index, visited, fields)
+				continue
+			}
+			if !sf.IsExported() && ft.Kind() != reflect.Struct {
+				continue
+			}
+		} else if !sf.IsExported() {
+			continue
+		}
+
+		field := valueStructField{name: []byte(sf.Name), index: index, tagged: name != ""}
+		if name != "" {
+			field.name = []byte(name)
+		}
+		for options != "" {
+			var option string
+			option, options, _ = strings.Cut(options, ",")
+			switch option {
+			case "omitempty":
+				field.omitEmpty = true
+			case "string":
+				field.asString = true
+			}
+		}
+		*fields = append(*fields, field)
+	}
+}
+
+func lessIndex(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,356 @@
+package quamina
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type valueAddress struct {
+	City    string `json:"city"`
+	Country string `json:"country,omitempty"`
+}
+
+type valueAudit struct {
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	Revision  int       `json:"revision"`
+}
+
+type valueLineItem struct {
+	SKU string  `json:"sku"`
+	Qty int     `json:"qty"`
+	Tax float32 `json:"tax"`
+}
+
+type valueOrder struct {
+	valueAudit
+	ID        string            `json:"id"`
+	Amount    int64             `json:"amount,string"`
+	Items     []valueLineItem   `json:"items"`
+	Tags      map[string]string `json:"tags"`
+	Address   *valueAddress     `json:"address"`
+	Note      *string           `json:"note"`
+	Ratio     float64           `json:"ratio"`
+	Blob      []byte            `json:"blob"`
+	Codes     [3]uint8          `json:"codes"`
+	Rush      bool              `json:"rush,omitempty"`
+	Grid      [][]int           `json:"grid"`
+	Extra     any               `json:"extra"`
+	Raw       json.RawMessage   `json:"raw"`
+	Untagged  string
+	Ignored   string `json:"-"`
+	Revision  int    `json:"revision"`
+	unexposed string
+}
+
+func testValueOrder() valueOrder {
+	return valueOrder{
+		valueAudit: valueAudit{CreatedBy: "tim", Created: time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC), Revision: 3},
+		ID:         "order-1",
+		Amount:     -5000,
+		Items: []valueLineItem{
+			{SKU: "apple", Qty: 1, Tax: 0.1},
+			{SKU: "banana", Qty: 2, Tax: 0.2},
+		},
+		Tags:     map[string]string{"color": "red", "size": "L"},
+		Address:  &valueAddress{City: "Vancouver"},
+		Ratio:    0.25,
+		Blob:     []byte{5, 6},
+		Codes:    [3]uint8{3, 4, 5},
+		Grid:     [][]int{{1, 2}, {3}},
+		Extra:    map[string]any{"nested": []any{"x", 1.5, nil, true}},
+		Raw:      json.RawMessage(`{"r": [1, {"s": "t"}]}`),
+		Untagged: "plain",
+		Ignored:  "nope",
+		Revision: 7,
+	}
+}
+
+func valueFieldStrings(fields []Field) []string {
+	var got []string
+	for _, field := range fields {
+		got = append(got, strings.ReplaceAll(string(field.Path), "\n", ".")+"="+string(field.Val))
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestValueFlatten(t *testing.T) {
+	paths := []string{"id", "amount", "items\nsku", "items\nqty", "items\ntax", "tags\ncolor", "address\ncity",
+		"address\ncountry", "note", "ratio", "blob", "codes", "rush", "grid", "extra\nnested", "raw\nr", "raw\nr\ns",
+		"Untagged", "Ignored", "unexposed", "createdBy", "created", "revision"}
+	tracker := fakeMatcher(paths...).getSegmentsTreeTracker()
+
+	order := testValueOrder()
+	fields, err := newValueFlattener(false).flatten(&order, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := valueFieldStrings(fields)
+
+	// it should be just what flattenJSON makes of the JSON encoding/json produces
+	event, err := json.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFields, err := newJSONFlattener().Flatten(event, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := valueFieldStrings(jsonFields)
+	if strings.Join(got, " ") != strings.Join(wanted, " ") {
+		t.Errorf("wanted\n%v\ngot\n%v", wanted, got)
+	}
+	for _, expected := range []string{`amount="-5000"`, `created="2024-03-01T12:00:00.0000005Z"`, `revision=7`,
+		`blob="BQY="`, `items.tax=0.1`, `note=null`} {
+		if !containsString(got, expected) {
+			t.Errorf("missing %s in %v", expected, got)
+		}
+	}
+
+	// a map is flattened the same way as a struct
+	var decoded map[string]any
+	if err = json.Unmarshal(event, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	fields, err = newValueFlattener(false).flatten(decoded, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = valueFieldStrings(fields)
+	if strings.Join(got, " ") != strings.Join(wanted, " ") {
+		t.Errorf("wanted\n%v\ngot\n%v", wanted, got)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValueMatching(t *testing.T) {
+	q, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, map[X]string{
+		"apple1":    `{"items": {"sku": ["apple"], "qty": [1]}}`,
+		"apple2":    `{"items": {"sku": ["apple"], "qty": [2]}}`,
+		"red":       `{"tags": {"color": ["red"]}}`,
+		"address":   `{"address": [ {"exists": true} ]}`,
+		"noNote":    `{"note": [null], "codes": [5]}`,
+		"vancouver": `{"address": {"city": [ {"equals-ignore-case": "VANCOUVER"} ]}}`,
+		"noCountry": `{"address": {"country": [ {"exists": false} ]}}`,
+		"tim":       `{"createdBy": [ {"prefix": "ti"} ], "revision": [7]}`,
+		"nested":    `{"extra": {"nested": [1.5]}}`,
+		"raw":       `{"raw": {"r": {"s": ["t"]}}}`,
+		"rush":      `{"rush": [false]}`,
+		"ignored":   `{"Ignored": ["nope"]}`,
+		"untagged":  `{"Untagged": ["plain"]}`,
+	})
+	order := testValueOrder()
+	event, err := json.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted, err := q.MatchesForEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wanted) != 10 {
+		t.Errorf("JSON matches: %v", wanted)
+	}
+	for what, v := range map[string]any{"struct": order, "pointer": &order} {
+		matches, err := q.MatchesForValue(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMatches(t, what, matches, wanted)
+	}
+}
+
+type valueInner struct {
+	Name  string `json:"name"`
+	Depth int
+}
+
+type valueOther struct {
+	Name string `json:"name"`
+}
+
+type valueTagged struct {
+	Label string `json:"Depth"`
+}
+
+type valueEmbedding struct {
+	valueInner
+	*valueOther
+	valueTagged
+	Local string `json:"local"`
+}
+
+type valueKey int
+
+func (k valueKey) MarshalText() ([]byte, error) {
+	return []byte("key-" + string(rune('a'+int(k)))), nil
+}
+
+func TestValueEmbeddingAndKeys(t *testing.T) {
+	tracker := fakeMatcher("name", "Depth", "local", "1", "key-b", "x").getSegmentsTreeTracker()
+	fv := newValueFlattener(false)
+
+	// name is ambiguous, with both fields tagged, so it vanishes; for Depth, the tagged field wins, just as in
+	// encoding/json
+	values := []any{
+		valueEmbedding{valueInner: valueInner{Name: "inner", Depth: 2}, valueOther: &valueOther{Name: "other"}, valueTagged: valueTagged{"deep"}, Local: "l"},
+		valueEmbedding{valueInner: valueInner{Name: "inner", Depth: 2}, Local: "l"},
+		map[int]string{1: "one", 2: "two"},
+		map[valueKey]string{1: "b", 2: "c"},
+		map[string]any{"x": []any{[]any{1, 2}, map[string]any{}}},
+	}
+	for _, v := range values {
+		fields, err := fv.flatten(v, tracker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := valueFieldStrings(fields)
+		event, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonFields, err := newJSONFlattener().Flatten(event, tracker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wanted := valueFieldStrings(jsonFields)
+		if strings.Join(got, " ") != strings.Join(wanted, " ") {
+			t.Errorf("%s: wanted\n%v\ngot\n%v", event, wanted, got)
+		}
+	}
+}
+
+func TestValueArrayTrails(t *testing.T) {
+	q, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("p", `{"items": {"sku": ["apple"], "qty": [2]}}`); err != nil {
+		t.Fatal(err)
+	}
+	items := []map[string]any{{"sku": "apple", "qty": 1}, {"sku": "banana", "qty": 2}}
+	matches, err := q.MatchesForValue(map[string]any{"items": items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("matched across array elements: %v", matches)
+	}
+	items[1]["sku"] = "apple"
+	matches, err = q.MatchesForValue(map[string]any{"items": items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("wanted a match, got %v", matches)
+	}
+}
+
+func TestValueEmptyArrays(t *testing.T) {
+	q, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("exists", `{"items": [ {"exists": true} ]}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("missing", `{"items": [ {"exists": false} ]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// as in JSON, an empty array doesn't exist
+	tests := []struct {
+		items  any
+		wanted X
+	}{
+		{[]int{}, "missing"},
+		{[0]string{}, "missing"},
+		{[]any{1}, "exists"},
+		{[]any{[]any{}}, "exists"},
+	}
+	for _, test := range tests {
+		matches, err := q.MatchesForValue(map[string]any{"items": test.items})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 || matches[0] != test.wanted {
+			t.Errorf("%v: wanted %v got %v", test.items, test.wanted, matches)
+		}
+	}
+}
+
+func TestValueNumbers(t *testing.T) {
+	tracker := fakeMatcher("a", "b", "c", "d", "e").getSegmentsTreeTracker()
+	v := map[string]any{"a": math.NaN(), "b": math.Inf(-1), "c": json.Number("35.0"), "d": uint64(math.MaxUint64), "e": 1e21}
+	fields, err := newValueFlattener(false).flatten(v, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := "a=null b=null c=35.0 d=18446744073709551615 e=1e+21"
+	if got := strings.Join(valueFieldStrings(fields), " "); got != wanted {
+		t.Errorf("wanted %s got %s", wanted, got)
+	}
+
+	q, err := New(WithNumberCanonicalization(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("p", `{"c": [35]}`); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := q.Copy().MatchesForValue(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("wanted a match, got %v", matches)
+	}
+}
+
+func TestValueErrors(t *testing.T) {
+	tracker := fakeMatcher("a").getSegmentsTreeTracker()
+	fv := newValueFlattener(false)
+
+	// objects can only be followed as deep as the patterns go, but arrays within arrays can't be pruned
+	cycle := []any{nil}
+	cycle[0] = cycle
+	bads := []any{
+		nil,
+		"string",
+		[]any{1},
+		(*valueOrder)(nil),
+		map[string]any{"a": make(chan int)},
+		map[string]any{"a": complex(1, 2)},
+		map[float64]int{1: 1},
+		map[string]any{"a": cycle},
+		map[string]any{"a": "\xff"},
+		map[string]any{"a": json.Number("\xff")},
+	}
+	for _, bad := range bads {
+		if _, err := fv.flatten(bad, tracker); err == nil {
+			t.Errorf("accepted %#v", bad)
+		}
+	}
+
+	// values that no pattern uses aren't looked at
+	if _, err := fv.flatten(map[string]any{"b": make(chan int)}, tracker); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,561 @@
+package quamina
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// flattenXML implements Flattener for XML documents, which it maps onto the structure that Patterns describe
+// like this:
+//   - The document element is the only member of the top-level object, so its name is the first segment of
+//     every path.
+//   - The child elements of an element are its members, and so are its attributes, whose names are preceded by
+//     "@" to tell them apart from elements. Namespace prefixes are dropped, so <soap:Body> is "Body", and
+//     xmlns attributes are ignored.
+//   - An element with neither child elements nor attributes has its text content as its value. Otherwise, if
+//     its text content isn't just whitespace, that's the value of a member named "#text".
+//   - Sibling elements with the same name are an array, so a Pattern that mentions several of their members
+//     only matches if they're in the same element. Every element is treated as a member of such an array, with
+//     one member if it has no siblings of the same name, which Patterns can't tell from a lone element; that way
+//     the flattener never has to look ahead.
+//   - Text is used as it is, except that references and CDATA sections are expanded, and all values are strings,
+//     since XML has no other types.
+//
+// For example, <order id="1"><item><sku>a</sku></item><item><sku>b</sku></item></order> is matched by
+// {"order": {"@id": ["1"], "item": {"sku": ["b"]}}}. Elements that no Pattern mentions are skipped without
+// being looked at closely. Comments, processing instructions, and the DOCTYPE are ignored, and entities
+// declared in a DOCTYPE aren't supported.
+type flattenXML struct {
+	event      []byte
+	eventIndex int
+	fields     []Field
+	arrayTrail []ArrayPos
+	arrayCount int32
+	siblings   []xmlSiblings // for each element being read, the names of the child elements seen so far
+	segment    []byte        // where the "@" names of attributes are put together
+}
+
+// xmlSiblings is the array that the child elements of an element with a given name belong to
+type xmlSiblings struct {
+	name  []byte
+	array int32
+	count int32
+}
+
+var xmlTextSegment = []byte("#text")
+
+func newXMLFlattener() Flattener {
+	return &flattenXML{fields: make([]Field, 0, 32)}
+}
+
+func (fx *flattenXML) Copy() Flattener {
+	return newXMLFlattener()
+}
+
+// Flatten implements the Flattener interface. It assumes that the event is immutable and encoded in UTF-8.
+func (fx *flattenXML) Flatten(event []byte, tracker SegmentsTreeTracker) ([]Field, error) {
+	fx.event = event
+	fx.eventIndex = 0
+	fx.fields = fx.fields[:0]
+	fx.arrayTrail = fx.arrayTrail[:0]
+	fx.arrayCount = 0
+	fx.siblings = fx.siblings[:0]
+
+	if bytes.HasPrefix(event, []byte("\xef\xbb\xbf")) {
+		fx.eventIndex = 3
+	}
+	if err := fx.skipMisc(true); err != nil {
+		return nil, err
+	}
+	if fx.eventIndex == len(fx.event) || fx.ch() != '<' {
+		return nil, fx.error("no XML element")
+	}
+	if err := fx.readElement(tracker, 0); err != nil {
+		return nil, err
+	}
+	if err := fx.skipMisc(false); err != nil {
+		return nil, err
+	}
+	if fx.eventIndex < len(fx.event) {
+		return nil, fx.error("garbage after the document element")
+	}
+	return fx.fields, nil
+}
+
+// readElement reads an element, starting at its "<", that's a child of the one whose pathNode is given, and
+// whose siblings are in fx.siblings from siblingsStart on
+func (fx *flattenXML) readElement(pathNode SegmentsTreeTracker, siblingsStart int) error {
+	fx.eventIndex++
+	qName, err := fx.readName()
+	if err != nil {
+		return err
+	}
+	name := localName(qName)
+	if !pathNode.IsSegmentUsed(name) {
+		return fx.skipElement()
+	}
+
+	// find the array that this element is a member of
+	var siblings *xmlSiblings
+	for i := siblingsStart; i < len(fx.siblings); i++ {
+		if bytes.Equal(fx.siblings[i].name, name) {
+			siblings = &fx.siblings[i]
+			break
+		}
+	}
+	if siblings == nil {
+		fx.arrayCount++
+		fx.siblings = append(fx.siblings, xmlSiblings{name: name, array: fx.arrayCount})
+		siblings = &fx.siblings[len(fx.siblings)-1]
+	}
+	siblings.count++
+	parentTrailLength := len(fx.arrayTrail)
+	fx.arrayTrail = append(fx.arrayTrail, ArrayPos{Array: siblings.array, Pos: siblings.count})
+	defer func() { fx.arrayTrail = fx.arrayTrail[:parentTrailLength] }()
+
+	path := pathNode.PathForSegment(name)
+	elementNode, isNode := pathNode.Get(name)
+	wantText := path != nil || (isNode && elementNode.IsSegmentUsed(xmlTextSegment))
+
+	hasAttributes, selfClosing, err := fx.readAttributes(elementNode, isNode)
+	if err != nil {
+		return err
+	}
+	hasChildren := false
+	var text []byte
+	if !selfClosing {
+		childrenStart := len(fx.siblings)
+		hasChildren, text, err = fx.readContent(qName, elementNode, isNode, wantText, childrenStart)
+		fx.siblings = fx.siblings[:childrenStart]
+		if err != nil {
+			return err
+		}
+	}
+
+	if !hasChildren && !hasAttributes {
+		if path != nil {
+			fx.storeField(path, fx.arrayTrail[:parentTrailLength], quoted(text))
+		}
+		return nil
+	}
+	if needsPresenceMarker(pathNode, name) {
+		fx.storeField(path, fx.arrayTrail[:parentTrailLength], nil)
+	}
+	if isNode && len(bytes.TrimSpace(text)) > 0 {
+		if textPath := elementNode.PathForSegment(xmlTextSegment); textPath != nil {
+			fx.storeField(textPath, fx.arrayTrail, quoted(text))
+		}
+	}
+	return nil
+}
+
+// readAttributes reads the attributes in a start tag, storing the values of those that the elementNode says
+// are used, and says whether there were any, not counting namespace declarations, and whether the tag was
+// an empty-element tag, i.e. ended with "/>"
+func (fx *flattenXML) readAttributes(elementNode SegmentsTreeTracker, isNode bool) (hasAttributes bool, selfClosing bool, err error) {
+	for {
+		fx.skipSpace()
+		if fx.eventIndex == len(fx.event) {
+			return false, false, fx.error("unterminated start tag")
+		}
+		switch fx.ch() {
+		case '>':
+			fx.eventIndex++
+			return hasAttributes, false, nil
+		case '/':
+			if fx.at(fx.eventIndex+1) != '>' {
+				return false, false, fx.error("'/' not followed by '>' in start tag")
+			}
+			fx.eventIndex += 2
+			return hasAttributes, true, nil
+		}
+
+		qName, err := fx.readName()
+		if err != nil {
+			return false, false, err
+		}
+		fx.skipSpace()
+		if fx.ch() != '=' {
+			return false, false, fx.error("attribute without '='")
+		}
+		fx.eventIndex++
+		fx.skipSpace()
+		if bytes.Equal(qName, []byte("xmlns")) || bytes.HasPrefix(qName, []byte("xmlns:")) {
+			if _, err = fx.readAttributeValue(false); err != nil {
+				return false, false, err
+			}
+			continue
+		}
+		hasAttributes = true
+
+		var path []byte
+		if isNode {
+			fx.segment = append(append(fx.segment[:0], '@'), localName(qName)...)
+			path = elementNode.PathForSegment(fx.segment)
+		}
+		value, err := fx.readAttributeValue(path != nil)
+		if err != nil {
+			return false, false, err
+		}
+		if path != nil {
+			fx.storeField(path, fx.arrayTrail, quoted(value))
+		}
+	}
+}
+
+// readAttributeValue reads a quoted attribute value, normalizing whitespace and expanding references if the
+// value is wanted
+func (fx *flattenXML) readAttributeValue(want bool) ([]byte, error) {
+	quote := fx.ch()
+	if quote != '"' && quote != '\'' {
+		return nil, fx.error("attribute value not quoted")
+	}
+	fx.eventIndex++
+	start := fx.eventIndex
+	var value []byte
+	for fx.eventIndex < len(fx.event) {
+		c := fx.ch()
+		switch {
+		case c == quote:
+			fx.eventIndex++
+			if value == nil {
+				// the common case, where nothing had to be changed
+				value = fx.event[start : fx.eventIndex-1]
+			}
+			if want && !utf8.Valid(value) {
+				return nil, fx.error("invalid UTF-8 in attribute value")
+			}
+			return value, nil
+		case c == '<':
+			return nil, fx.error("'<' in attribute value")
+		case !want:
+			fx.eventIndex++
+		case c == '&' || c == '\t' || c == '\n' || c == '\r':
+			if value == nil {
+				value = append([]byte{}, fx.event[start:fx.eventIndex]...)
+			}
+			if c == '&' {
+				var err error
+				if value, err = fx.readReference(value); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			value = append(value, ' ')
+			fx.eventIndex++
+			if c == '\r' && fx.ch() == '\n' {
+				fx.eventIndex++
+			}
+		default:
+			if value != nil {
+				value = append(value, c)
+			}
+			fx.eventIndex++
+		}
+	}
+	return nil, fx.error("unterminated attribute value")
+}
+
+// readContent reads what's between the start and end tags of an element, returning its text if it's wanted,
+// and saying whether there were any child elements
+func (fx *flattenXML) readContent(qName []byte, elementNode SegmentsTreeTracker, isNode bool, wantText bool, childrenStart int) (hasChildren bool, text []byte, err error) {
+	text = []byte{}
+	for {
+		if fx.eventIndex == len(fx.event) {
+			return false, nil, fx.error(fmt.Sprintf("element %s not closed", qName))
+		}
+		c := fx.ch()
+		switch {
+		case c == '<' && fx.at(fx.eventIndex+1) == '/':
+			fx.eventIndex += 2
+			endName, err := fx.readName()
+			if err != nil {
+				return false, nil, err
+			}
+			if !bytes.Equal(endName, qName) {
+				return false, nil, fx.error(fmt.Sprintf("element %s closed by %s", qName, endName))
+			}
+			fx.skipSpace()
+			if fx.ch() != '>' {
+				return false, nil, fx.error("end tag not closed")
+			}
+			fx.eventIndex++
+			if wantText && !utf8.Valid(text) {
+				return false, nil, fx.error(fmt.Sprintf("invalid UTF-8 in text of element %s", qName))
+			}
+			return hasChildren, text, nil
+
+		case fx.lookingAt("<![CDATA["):
+			fx.eventIndex += len("<![CDATA[")
+			end := bytes.Index(fx.event[fx.eventIndex:], []byte("]]>"))
+			if end < 0 {
+				return false, nil, fx.error("unterminated CDATA section")
+			}
+			if wantText {
+				text = append(text, fx.event[fx.eventIndex:fx.eventIndex+end]...)
+			}
+			fx.eventIndex += end + len("]]>")
+
+		case fx.lookingAt("<!--") || fx.lookingAt("<?"):
+			if err = fx.skipCommentOrPI(); err != nil {
+				return false, nil, err
+			}
+
+		case c == '<':
+			hasChildren = true
+			if isNode {
+				err = fx.readElement(elementNode, childrenStart)
+			} else {
+				fx.eventIndex++
+				if _, err = fx.readName(); err == nil {
+					err = fx.skipElement()
+				}
+			}
+			if err != nil {
+				return false, nil, err
+			}
+
+		case !wantText:
+			fx.eventIndex++
+		case c == '&':
+			if text, err = fx.readReference(text); err != nil {
+				return false, nil, err
+			}
+		case c == '\r':
+			// line ends are normalized to \n
+			text = append(text, '\n')
+			fx.eventIndex++
+			if fx.ch() == '\n' {
+				fx.eventIndex++
+			}
+		default:
+			text = append(text, c)
+			fx.eventIndex++
+		}
+	}
+}
+
+// skipElement skips the rest of an element whose name has been read, without looking closely at its content
+func (fx *flattenXML) skipElement() error {
+	depth := 0
+	for {
+		_, selfClosing, err := fx.readAttributes(nil, false)
+		if err != nil {
+			return err
+		}
+		if !selfClosing {
+			depth++
+		}
+		for {
+			if depth == 0 {
+				return nil
+			}
+			next := bytes.IndexByte(fx.event[fx.eventIndex:], '<')
+			if next < 0 {
+				return fx.error("element not closed")
+			}
+			fx.eventIndex += next
+			if fx.lookingAt("<![CDATA[") {
+				end := bytes.Index(fx.event[fx.eventIndex:], []byte("]]>"))
+				if end < 0 {
+					return fx.error("unterminated CDATA section")
+				}
+				fx.eventIndex += end + len("]]>")
+				continue
+			}
+			if fx.lookingAt("<!--") || fx.lookingAt("<?") {
+				if err = fx.skipCommentOrPI(); err != nil {
+					return err
+				}
+				continue
+			}
+			if fx.at(fx.eventIndex+1) == '/' {
+				end := bytes.IndexByte(fx.event[fx.eventIndex:], '>')
+				if end < 0 {
+					return fx.error("end tag not closed")
+				}
+				fx.eventIndex += end + 1
+				depth--
+				continue
+			}
+			// a child element's start tag
+			fx.eventIndex++
+			if _, err = fx.readName(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+}
+
+// skipMisc skips whitespace, comments, and processing instructions, which can appear before and after the
+// document element, and before it, the XML declaration and DOCTYPE
+func (fx *flattenXML) skipMisc(prolog bool) error {
+	for {
+		fx.skipSpace()
+		switch {
+		case fx.lookingAt("<!--") || fx.lookingAt("<?"):
+			if err := fx.skipCommentOrPI(); err != nil {
+				return err
+			}
+		case prolog && fx.lookingAt("<!DOCTYPE"):
+			if err := fx.skipDoctype(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (fx *flattenXML) skipCommentOrPI() error {
+	terminator := []byte("?>")
+	if fx.lookingAt("<!--") {
+		terminator = []byte("-->")
+	}
+	end := bytes.Index(fx.event[fx.eventIndex+2:], terminator)
+	if end < 0 {
+		return fx.error("unterminated comment or processing instruction")
+	}
+	fx.eventIndex += 2 + end + len(terminator)
+	return nil
+}
+
+// skipDoctype skips a DOCTYPE declaration, including an internal subset in [], in which there may be quoted
+// strings and comments containing anything
+func (fx *flattenXML) skipDoctype() error {
+	inSubset := false
+	for fx.eventIndex < len(fx.event) {
+		switch c := fx.ch(); {
+		case c == '"' || c == '\'':
+			end := bytes.IndexByte(fx.event[fx.eventIndex+1:], c)
+			if end < 0 {
+				return fx.error("unterminated string in DOCTYPE")
+			}
+			fx.eventIndex += end + 2
+			continue
+		case inSubset && fx.lookingAt("<!--"):
+			if err := fx.skipCommentOrPI(); err != nil {
+				return err
+			}
+			continue
+		case c == '[':
+			inSubset = true
+		case c == ']':
+			inSubset = false
+		case c == '>' && !inSubset:
+			fx.eventIndex++
+			return nil
+		}
+		fx.eventIndex++
+	}
+	return fx.error("unterminated DOCTYPE")
+}
+
+// readReference reads an entity or character reference, starting at its "&", and appends the character it
+// stands for
+func (fx *flattenXML) readReference(text []byte) ([]byte, error) {
+	end := bytes.IndexByte(fx.event[fx.eventIndex:], ';')
+	if end < 0 {
+		return nil, fx.error("unterminated reference")
+	}
+	name := fx.event[fx.eventIndex+1 : fx.eventIndex+end]
+	fx.eventIndex += end + 1
+	switch string(name) {
+	case "lt":
+		return append(text, '<'), nil
+	case "gt":
+		return append(text, '>'), nil
+	case "amp":
+		return append(text, '&'), nil
+	case "apos":
+		return append(text, '\''), nil
+	case "quot":
+		return append(text, '"'), nil
+	}
+	if len(name) < 2 || name[0] != '#' {
+		return nil, fx.error(fmt.Sprintf("unknown entity '%s'", name))
+	}
+	var r uint64
+	var err error
+	if name[1] == 'x' {
+		r, err = strconv.ParseUint(string(name[2:]), 16, 32)
+	} else {
+		r, err = strconv.ParseUint(string(name[1:]), 10, 32)
+	}
+	if err != nil || r == 0 || !utf8.ValidRune(rune(r)) {
+		return nil, fx.error(fmt.Sprintf("invalid character reference '%s'", name))
+	}
+	return utf8.AppendRune(text, rune(r)), nil
+}
+
+// readName reads an element or attribute name
+func (fx *flattenXML) readName() ([]byte, error) {
+	start := fx.eventIndex
+	for fx.eventIndex < len(fx.event) {
+		c := fx.ch()
+		if isXMLSpace(c) || c == '/' || c == '>' || c == '=' || c == '<' || c == '"' || c == '\'' {
+			break
+		}
+		fx.eventIndex++
+	}
+	if fx.eventIndex == start {
+		return nil, fx.error("missing name")
+	}
+	return fx.event[start:fx.eventIndex], nil
+}
+
+// localName drops the namespace prefix, if any, from a name
+func localName(qName []byte) []byte {
+	if colon := bytes.LastIndexByte(qName, ':'); colon >= 0 {
+		return qName[colon+1:]
+	}
+	return qName
+}
+
+func (fx *flattenXML) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	trail := make([]ArrayPos, len(arrayTrail))
+	copy(trail, arrayTrail)
+	fx.fields = append(fx.fields, Field{Path: path, ArrayTrail: trail, Val: val})
+}
+
+func (fx *flattenXML) lookingAt(s string) bool {
+	return bytes.HasPrefix(fx.event[fx.eventIndex:], []byte(s))
+}
+
+func (fx *flattenXML) skipSpace() {
+	for fx.eventIndex < len(fx.event) && isXMLSpace(fx.ch()) {
+		fx.eventIndex++
+	}
+}
+
+func isXMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// ch returns the byte at eventIndex, which the caller has to make sure is in the event
+func (fx *flattenXML) ch() byte {
+	return fx.at(fx.eventIndex)
+}
+
+func (fx *flattenXML) at(i int) byte {
+	if i < len(fx.event) {
+		return fx.event[i]
+	}
+	return 0
+}
+
+func (fx *flattenXML) error(message string) error {
+	// let's be helpful and let them know where the error is
+	lineNum := 1
+	lastLineStart := 0
+	for i := 0; i < fx.eventIndex && i < len(fx.event); i++ {
+		if fx.event[i] == '\n' {
+			lineNum++
+			lastLineStart = i
+		}
+	}
+	return fmt.Errorf("at line %d col %d: %s", lineNum, fx.eventIndex-lastLineStart, message)
+}
@@ -0,0 +1,146 @@
+package quamina
+
+import (
+	"strings"
+	"testing"
+)
+
+const testXMLEvent = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE order [ <!ELEMENT order ANY> <!-- a "subset" ]> -->]>
+<!-- an order -->
+<order id="1" xmlns="http://example.com/order" xmlns:x="http://example.com/x">
+  <customer tier='gold'>Ann &amp; Bob</customer>
+  <item>
+    <sku>apple</sku>
+    <qty>1</qty>
+  </item>
+  <x:item x:kind="fruit">
+    <sku>banana</sku>
+    <qty>2</qty>
+    <?note ignore me?>
+  </x:item>
+  <note><![CDATA[<fragile>]]> handle &lt;carefully&#x21;</note>
+  <empty/>
+  <blank></blank>
+  <unused a="&lt;b>"><deep><deeper>text</deeper></deep><!-- </unused> --></unused>
+  <tag>red</tag>
+  <tag>large</tag>
+</order>
+`
+
+func TestXMLFlatten(t *testing.T) {
+	tracker := fakeMatcher("order\n@id", "order\ncustomer\n@tier", "order\ncustomer\n#text", "order\nitem\nsku",
+		"order\nitem\n@kind", "order\nnote", "order\nempty", "order\nblank", "order\ntag").getSegmentsTreeTracker()
+	fields, err := newXMLFlattener().Flatten([]byte(testXMLEvent), tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := []string{
+		`order.@id="1"`,
+		`order.blank=""`,
+		`order.customer.#text="Ann & Bob"`,
+		`order.customer.@tier="gold"`,
+		`order.empty=""`,
+		`order.item.@kind="fruit"`,
+		`order.item.sku="apple"`,
+		`order.item.sku="banana"`,
+		`order.note="<fragile> handle <carefully!"`,
+		`order.tag="large"`,
+		`order.tag="red"`,
+	}
+	got := valueFieldStrings(fields)
+	if strings.Join(got, " ") != strings.Join(wanted, " ") {
+		t.Errorf("wanted\n%v\ngot\n%v", wanted, got)
+	}
+}
+
+func TestXMLMatching(t *testing.T) {
+	q, err := New(WithMediaType("application/xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, map[X]string{
+		"apple1":    `{"order": {"item": {"sku": ["apple"], "qty": ["1"]}}}`,
+		"apple2":    `{"order": {"item": {"sku": ["apple"], "qty": ["2"]}}}`,
+		"fruit":     `{"order": {"item": {"sku": ["banana"], "@kind": ["fruit"]}}}`,
+		"id":        `{"order": {"@id": ["1"]}}`,
+		"gold":      `{"order": {"customer": {"@tier": ["gold"], "#text": [ {"prefix": "Ann"} ]}}}`,
+		"tags":      `{"order": {"tag": ["large"]}}`,
+		"exists":    `{"order": {"customer": [ {"exists": true} ]}}`,
+		"missing":   `{"order": {"nope": [ {"exists": true} ]}}`,
+		"notNumber": `{"order": {"@id": [1]}}`,
+		"deep":      `{"order": {"unused": {"deep": {"deeper": ["text"]}}}}`,
+	})
+	matches, err := q.Copy().MatchesForEvent([]byte(testXMLEvent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, "order", matches, []X{"apple1", "fruit", "id", "gold", "tags", "exists", "deep"})
+}
+
+func TestXMLSOAP(t *testing.T) {
+	soap := `<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope">
+  <soap:Header/>
+  <soap:Body>
+    <m:GetPrice xmlns:m="https://www.example.org/stock"><m:Item>Apples</m:Item></m:GetPrice>
+  </soap:Body>
+</soap:Envelope>`
+	q, err := New(WithMediaType("application/xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("price", `{"Envelope": {"Body": {"GetPrice": {"Item": ["Apples"]}}}}`); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := q.MatchesForEvent([]byte(soap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("got %v", matches)
+	}
+}
+
+func TestXMLFlattenErrors(t *testing.T) {
+	tracker := fakeMatcher("a\nb", "a\n@c").getSegmentsTreeTracker()
+	bads := []string{
+		"",
+		"just text",
+		"<a>",
+		"<a></b>",
+		"<a><b></a>",
+		"<a><b>x</b>",
+		"<a c=1/>",
+		"<a c='1/>",
+		"<a c='<'/>",
+		"<a><b>&nope;</b></a>",
+		"<a><b>&#xZZ;</b></a>",
+		"<a><b><![CDATA[x</b></a>",
+		"<a><!-- x </a>",
+		"<a/><b/>",
+		"<a/>text",
+		"<a><skipped>",
+		"<a><b>x\xff\xfe</b></a>",
+		"<a><b><![CDATA[\xf6]]></b></a>",
+		"<a c='x\xff'/>",
+	}
+	for _, bad := range bads {
+		if _, err := newXMLFlattener().Flatten([]byte(bad), tracker); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+
+	// invalid UTF-8 is reported, not passed on to the automaton
+	for pattern, event := range map[string]string{
+		`{"r": {"a": ["x"]}}`:                  "<r><a>x\xff\xfe</a></r>",
+		`{"r": {"@a": [ {"wildcard": "*"} ]}}`: "<r a='x\xff\xfe'/>",
+	} {
+		q, _ := New(WithMediaType("application/xml"))
+		if err := q.AddPattern("p", pattern); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.MatchesForEvent([]byte(event)); err == nil {
+			t.Errorf("%s: accepted %q", pattern, event)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package quamina
+
+import "errors"
+
+// flattenYAML implements Flattener for YAML Events, which are read by the parser in yaml.go. Unlike flattenJSON,
+// it parses the whole Event before it looks for Fields, since where a YAML value ends depends on the indentation
+// of the lines after it, and aliases can refer back to any earlier part of the Event, so there's not much to be
+// saved by skipping. Values are the same as they'd be in the JSON equivalent of the Event.
+type flattenYAML struct {
+	fields     []Field
+	arrayTrail []ArrayPos
+	arrayCount int32
+
+	canonicalizeNumbers bool
+}
+
+func newYAMLFlattener() Flattener {
+	return &flattenYAML{fields: make([]Field, 0, 32)}
+}
+
+func (fy *flattenYAML) Copy() Flattener {
+	return &flattenYAML{fields: make([]Field, 0, 32), canonicalizeNumbers: fy.canonicalizeNumbers}
+}
+
+func (fy *flattenYAML) setCanonicalizeNumbers(b bool) {
+	fy.canonicalizeNumbers = b
+}
+
+// Flatten implements the Flattener interface. The Event has to be a single YAML document whose top level is a
+// mapping.
+func (fy *flattenYAML) Flatten(event []byte, tracker SegmentsTreeTracker) ([]Field, error) {
+	fy.fields = fy.fields[:0]
+	fy.arrayTrail = fy.arrayTrail[:0]
+	fy.arrayCount = 0
+
+	root, err := parseYAML(event)
+	if err != nil {
+		return nil, err
+	}
+	if root.kind != yamlMapping {
+		return nil, errors.New("event is not a YAML mapping")
+	}
+	fy.readMapping(root, tracker)
+	return fy.fields, nil
+}
+
+// readMapping stores Fields for the members of a mapping that the pathNode says are used. Once it has seen all
+// the members mentioned in the pathNode, it stops.
+func (fy *flattenYAML) readMapping(mapping *yamlNode, pathNode SegmentsTreeTracker) {
+	counts := memberCounts{fields: pathNode.FieldsCount(), nodes: pathNode.NodesCount()}
+
+	// as in flattenJSON, the array trail doesn't change while we're in the mapping
+	var arrayTrail []ArrayPos
+	if len(fy.arrayTrail) > 0 {
+		arrayTrail = make([]ArrayPos, len(fy.arrayTrail))
+		copy(arrayTrail, fy.arrayTrail)
+	}
+
+	for i, name := range mapping.keys {
+		if counts.nodes == 0 && counts.fields == 0 {
+			return
+		}
+		if !pathNode.IsSegmentUsed(name) {
+			continue
+		}
+		value := mapping.values[i]
+		path := pathNode.PathForSegment(name)
+		switch value.kind {
+		case yamlMapping:
+			if needsPresenceMarker(pathNode, name) {
+				fy.storeField(path, arrayTrail, nil)
+				counts.fields--
+			}
+			mappingPathNode, ok := pathNode.Get(name)
+			if !ok {
+				continue
+			}
+			counts.nodes--
+			fy.readMapping(value, mappingPathNode)
+
+		case yamlSequence:
+			marker, sequencePathNode := arrayMember(pathNode, name, len(value.values) == 0)
+			if marker {
+				fy.storeField(path, arrayTrail, nil)
+				counts.fields--
+			}
+			fy.readSequence(path, sequencePathNode, value)
+
+		default:
+			if path == nil {
+				continue
+			}
+			fy.storeField(path, arrayTrail, fy.scalarValue(value))
+			counts.fields--
+		}
+	}
+}
+
+// readSequence stores Fields for the items of a sequence, which is an array as far as matching goes
+func (fy *flattenYAML) readSequence(pathName []byte, pathNode SegmentsTreeTracker, sequence *yamlNode) {
+	fy.arrayCount++
+	fy.arrayTrail = append(fy.arrayTrail, ArrayPos{fy.arrayCount, 0})
+
+	for _, item := range sequence.values {
+		fy.arrayTrail[len(fy.arrayTrail)-1].Pos++
+		switch item.kind {
+		case yamlMapping:
+			fy.readMapping(item, pathNode)
+		case yamlSequence:
+			fy.readSequence(pathName, pathNode, item)
+		default:
+			if pathName != nil {
+				trail := make([]ArrayPos, len(fy.arrayTrail))
+				copy(trail, fy.arrayTrail)
+				fy.storeField(pathName, trail, fy.scalarValue(item))
+			}
+		}
+	}
+	fy.arrayTrail = fy.arrayTrail[:len(fy.arrayTrail)-1]
+}
+
+func (fy *flattenYAML) storeField(path []byte, arrayTrail []ArrayPos, val []byte) {
+	fy.fields = append(fy.fields, Field{Path: path, ArrayTrail: arrayTrail, Val: val})
+}
+
+// scalarValue returns the value of a scalar, see numberValue
+func (fy *flattenYAML) scalarValue(scalar *yamlNode) []byte {
+	if scalar.typ != yamlIntType && scalar.typ != yamlFloatType {
+		return scalar.val
+	}
+	return numberValue(scalar.val, fy.canonicalizeNumbers)
+}
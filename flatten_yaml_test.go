@@ -0,0 +1,158 @@
+package quamina
+
+import (
+	"strings"
+	"testing"
+)
+
+const testYAMLEvent = `# a configuration change
+kind: ConfigChange
+id: change-1
+amount: -5000
+items:
+  - sku: apple
+    qty: 1
+  - {sku: banana, qty: 2}
+tags:
+  color: red
+  size: L
+address: &home
+  city: Vancouver
+billing: *home
+note: ~
+ratio: 0.25
+codes: [3, 4, 5]
+grid:
+- [1, 2]
+- [3]
+description: |
+  multiple
+  lines
+rush: false
+`
+
+const testYAMLEventAsJSON = `{"kind": "ConfigChange", "id": "change-1", "amount": -5000,
+  "items": [ {"sku": "apple", "qty": 1}, {"sku": "banana", "qty": 2} ],
+  "tags": {"color": "red", "size": "L"}, "address": {"city": "Vancouver"}, "billing": {"city": "Vancouver"},
+  "note": null, "ratio": 0.25, "codes": [3, 4, 5], "grid": [[1, 2], [3]], "description": "multiple\nlines\n",
+  "rush": false}`
+
+func TestYAMLFlatten(t *testing.T) {
+	tracker := fakeMatcher("kind", "id", "amount", "items\nsku", "items\nqty", "tags\ncolor", "address\ncity",
+		"billing\ncity", "note", "ratio", "codes", "grid", "description", "rush").getSegmentsTreeTracker()
+	fields, err := newYAMLFlattener().Flatten([]byte(testYAMLEvent), tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFields, err := newJSONFlattener().Flatten([]byte(testYAMLEventAsJSON), tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := valueFieldStrings(fields)
+	wanted := valueFieldStrings(jsonFields)
+	if strings.Join(got, " ") != strings.Join(wanted, " ") {
+		t.Errorf("wanted\n%v\ngot\n%v", wanted, got)
+	}
+
+	// once everything used has been seen, the rest of the mapping isn't looked at
+	fields, err = newYAMLFlattener().Flatten([]byte(testYAMLEvent), fakeMatcher("id").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || string(fields[0].Val) != `"change-1"` {
+		t.Errorf("got %v", fields)
+	}
+
+	// JSON has no infinities or NaN, so in an Event they're null
+	fields, err = newYAMLFlattener().Flatten([]byte("a: [.inf, -.Inf, .NaN]"), fakeMatcher("a").getSegmentsTreeTracker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 3 || string(fields[0].Val) != "null" || string(fields[2].Val) != "null" {
+		t.Errorf("got %v", fields)
+	}
+}
+
+func TestYAMLMatching(t *testing.T) {
+	q, err := New(WithMediaType("application/yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, map[X]string{
+		"apple1":    "items:\n  sku: [apple]\n  qty: [1]",
+		"apple2":    "items:\n  sku: [apple]\n  qty: [2]",
+		"change":    "kind: [ConfigChange]\namount:\n  - numeric: ['<', 0]",
+		"red":       "tags: {color: [red]}",
+		"billing":   "billing:\n  city:\n    - equals-ignore-case: VANCOUVER",
+		"noNote":    "note: [null]\ncodes: [5]",
+		"notRush":   "rush: [false]",
+		"lines":     `description: ["multiple\nlines\n"]`,
+		"json":      `{"id": [ {"prefix": "change-"} ]}`,
+		"missing":   "nope: [ {exists: true} ]",
+		"wrongType": "amount: ['-5000']",
+	})
+	if err := q.AddPattern("bad", "a: [1"); err == nil {
+		t.Error("accepted bad YAML Pattern")
+	}
+	if err := q.AddPattern("inf", "a: [.inf]"); err == nil {
+		t.Error("accepted infinity in YAML Pattern")
+	}
+	matches, err := q.Copy().MatchesForEvent([]byte(testYAMLEvent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, "event", matches, []X{"apple1", "change", "red", "billing", "noNote", "notRush", "lines", "json"})
+}
+
+func TestYAMLEmptySequences(t *testing.T) {
+	q, err := New(WithMediaType("application/yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("exists", "codes: [ {exists: true} ]"); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("missing", "codes: [ {exists: false} ]"); err != nil {
+		t.Fatal(err)
+	}
+
+	// as in JSON, an empty sequence doesn't exist
+	for event, wanted := range map[string]X{"codes: []": "missing", "codes: [[]]": "exists", "codes:\n- 1": "exists"} {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 || matches[0] != wanted {
+			t.Errorf("%q: wanted %v got %v", event, wanted, matches)
+		}
+	}
+}
+
+func TestYAMLCanonicalNumbers(t *testing.T) {
+	q, err := New(WithMediaType("application/yaml"), WithNumberCanonicalization(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("p", "a: [35]"); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []string{"a: 35.0", "a: 3.5e1", "a: +35", "a: 0x23", "a: [1, 035]"} {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 1 {
+			t.Errorf("%q didn't match", event)
+		}
+	}
+}
+
+func TestYAMLFlattenErrors(t *testing.T) {
+	tracker := fakeMatcher("a").getSegmentsTreeTracker()
+	for _, bad := range []string{"", "- a", "just a string", "a: [1", "a: 1\n---\na: 2", "a: \xff\n",
+		"a: 1\na: 2", "{a: 1, 'a': 2}", "a:\n  b: 1\n  \"b\": 2"} {
+		if _, err := newYAMLFlattener().Flatten([]byte(bad), tracker); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package quamina
 
+import (
+	"math"
+	"strconv"
+)
+
 // nolint:goimports,gofmt
 // Flattener is an interface which provides methods to turn a data structure into a list of path-names and
 // values. The following example illustrates how it works for a JSON object:
@@ -23,6 +28,36 @@ type Flattener interface {
 	Copy() Flattener
 }
 
+// numberCanonicalizer is implemented by the built-in Flatteners, which can canonicalize numbers as they read
+// them, which saves the matcher the trouble, see numbers.go
+type numberCanonicalizer interface {
+	setCanonicalizeNumbers(b bool)
+}
+
+// appendFloatText is used by the Flatteners for binary formats. It writes a float as JavaScript would, which
+// is how it would most likely appear in JSON, except that single-precision floats are written with the fewest
+// digits that identify them as single-precision, so that a sensor's 0.1 doesn't turn into 0.10000000149011612.
+// ok is false for NaN and the infinities, which JSON can't represent.
+func appendFloatText(dst []byte, f float64, bitSize int) (text []byte, ok bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return dst, false
+	}
+	if f == 0 {
+		return append(dst, '0'), true
+	}
+	abs := math.Abs(f)
+	if abs >= 1e-6 && abs < 1e21 {
+		return strconv.AppendFloat(dst, f, 'f', -1, bitSize), true
+	}
+
+	// Go writes at least two digits in the exponent, JavaScript doesn't
+	text = strconv.AppendFloat(dst, f, 'e', -1, bitSize)
+	if n := len(text); text[n-2] == '0' && (text[n-3] == '-' || text[n-3] == '+') {
+		text = append(text[:n-2], text[n-1])
+	}
+	return text, true
+}
+
 // Arrays are invisible in the automaton.  That is to say, if an event has
 //  { "a": [ 1, 2, 3 ] }
 // Then the Flattener must produce a/1, a/2, and a/3 Same for  {"a": [[1, 2], 3]} or any
@@ -54,6 +89,9 @@ type ArrayPos struct {
 // Path is the \n-separated path from the event root to this field value.
 // Val is the value, a []byte forming a textual representation of the type
 // ArrayTrail, for each array in the Path, identifies the array and the index in it.
+// A nil Val means that the field's value is an object or array, and the Field is only there to report that
+// it is present, for the benefit of "exists" Patterns. The SegmentsTreeTracker that Quamina gives a Flattener
+// has a NeedsPresenceMarker method which says when one is needed.
 type Field struct {
 	Path       []byte
 	Val        []byte
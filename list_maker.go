@@ -1,29 +1,33 @@
 package quamina
 
-// this needs to exist so that all the lists containing a single step to X are the same list, and similarly all
-// those containing the triple step to X,Y,Z are the same list, so that pack/unpack work properly. In a large majority
-// of cases, there's only one step in the list, so those are handled straightforwardly with a map. Otherwise, we
-// laboriously look through all the lists for a match. In Java I'd implement a hashCode() method and everything
-// would be a hash, but I haven't learned yet what the Go equivalent is.
-// TODO: This can be greatly reduced when we shake down the whole DFA/NFA mess.
+import (
+	"sort"
+	"strconv"
+)
+
+// dfaMemory makes sure that when converting an NFA to a DFA, each distinct set of nfaSteps yields exactly one
+// dfaStep, no matter what order the steps arrive in. Each nfaStep gets a small integer ID the first time it's
+// seen, and a set is identified by its sorted IDs. In a large majority of cases, there's only one step in the set,
+// so those are handled straightforwardly with a map.
 type dfaMemory struct {
 	singletons map[*nfaStep]*dfaStep
-	plurals    []perList
-}
-type perList struct {
-	list []*nfaStep
-	dfa  *dfaStep
+	plurals    map[string]*dfaStep
+	ids        map[*nfaStep]int
 }
 
 func newDfaMemory() *dfaMemory {
-	return &dfaMemory{singletons: make(map[*nfaStep]*dfaStep)}
+	return &dfaMemory{
+		singletons: make(map[*nfaStep]*dfaStep),
+		plurals:    make(map[string]*dfaStep),
+		ids:        make(map[*nfaStep]int),
+	}
 }
 
 func (m *dfaMemory) rememberDfaForList(dfa *dfaStep, steps ...*nfaStep) {
 	if len(steps) == 1 {
 		m.singletons[steps[0]] = dfa
 	} else {
-		m.plurals = append(m.plurals, perList{list: steps, dfa: dfa})
+		m.plurals[m.setKey(steps)] = dfa
 	}
 }
 
@@ -32,24 +36,55 @@ func (m *dfaMemory) dfaForNfas(steps ...*nfaStep) (*dfaStep, bool) {
 		d, ok := m.singletons[steps[0]]
 		return d, ok
 	}
-	for _, p := range m.plurals {
-		if nfaListsEqual(p.list, steps) {
-			return p.dfa, true
+	d, ok := m.plurals[m.setKey(steps)]
+	return d, ok
+}
+
+func (m *dfaMemory) setKey(steps []*nfaStep) string {
+	ids := make([]int, 0, len(steps))
+	for _, step := range steps {
+		id, ok := m.ids[step]
+		if !ok {
+			id = len(m.ids)
+			m.ids[step] = id
 		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	key := make([]byte, 0, len(ids)*4)
+	for _, id := range ids {
+		key = strconv.AppendInt(key, int64(id), 36)
+		key = append(key, ' ')
 	}
-	return nil, false
+	return string(key)
 }
 
-func nfaListsEqual(l1, l2 []*nfaStep) bool {
-	if len(l1) != len(l2) {
-		return false
+// epsilonClosure returns the steps, with duplicates removed, plus all the steps that can be reached from them by
+// following epsilon transitions.
+func epsilonClosure(steps []*nfaStep) []*nfaStep {
+	if len(steps) == 1 && steps[0].epsilon == nil {
+		return steps
 	}
-	for _, e1 := range l1 {
-		if !nfaListContains(l2, e1) {
-			return false
-		}
+	closure := make([]*nfaStep, 0, len(steps))
+	seen := make(map[*nfaStep]bool, len(steps))
+	for _, step := range steps {
+		closure = appendClosure(closure, step, seen)
 	}
-	return true
+	return closure
+}
+
+// appendClosure appends step and whatever can be reached from it by epsilon transitions to closure, skipping
+// anything already in seen
+func appendClosure(closure []*nfaStep, step *nfaStep, seen map[*nfaStep]bool) []*nfaStep {
+	if seen[step] {
+		return closure
+	}
+	seen[step] = true
+	closure = append(closure, step)
+	for _, next := range step.epsilon {
+		closure = appendClosure(closure, next, seen)
+	}
+	return closure
 }
 
 func nfaListContains(list []*nfaStep, step *nfaStep) bool {
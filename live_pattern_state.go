@@ -47,15 +47,22 @@ func newMemState() *memState {
 }
 
 func (s *memState) Add(x X, pattern string) error {
+	s.add(x, pattern)
+	return nil
+}
+
+// add is Add, but reports whether the pattern wasn't already there for x
+func (s *memState) add(x X, pattern string) bool {
 	s.lock.Lock()
 	ps, have := s.m[x]
 	if !have {
 		ps = make(stringSet)
 		s.m[x] = ps
 	}
+	_, had := ps[pattern]
 	ps[pattern] = na
 	s.lock.Unlock()
-	return nil
+	return !had
 }
 
 func (s *memState) Contains(x X) (bool, error) {
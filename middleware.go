@@ -0,0 +1,37 @@
+package quamina
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// matchesKey is the context key under which Middleware stores matches
+type matchesKey struct{}
+
+// Middleware returns an http.Handler that matches each request with MatchesForRequest and then passes it on to
+// next, with the X values of the matching Patterns in its context, where RequestMatches will find them. Requests
+// are handled concurrently, so each is matched by a Copy of this instance; Patterns added to the instance later
+// still take effect. If a request can't be matched, for example because a Pattern mentions the body and it isn't
+// valid JSON, the response is 400 Bad Request and next isn't called. The response doesn't say what was wrong, since
+// that could tell the client about the Patterns.
+func (q *Quamina) Middleware(next http.Handler) http.Handler {
+	copies := sync.Pool{New: func() any { return q.Copy() }}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance := copies.Get().(*Quamina)
+		matches, err := instance.MatchesForRequest(r)
+		copies.Put(instance)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), matchesKey{}, matches)))
+	})
+}
+
+// RequestMatches returns the X values that Middleware found matching a request, which are nil if there were none
+// or the request didn't go through Middleware.
+func RequestMatches(r *http.Request) []X {
+	matches, _ := r.Context().Value(matchesKey{}).([]X)
+	return matches
+}
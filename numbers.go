@@ -1,28 +1,202 @@
 package quamina
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
 )
 
-// TODO: Make this more efficient and improve unit-test coverage
+// Numbers are canonicalized into fixed-length strings of decimal digits which sort lexically in the same order
+// as the numbers they represent, so that 35, 35.000, and 3.5e1 all have the same canonical form, and numeric
+// ranges can be matched with an automaton. The canonicalization is exact, i.e. it works directly on the decimal
+// digits and never round-trips through float64.
+//
+// Any number can be written as ±0.d1d2d3… × 10^e with d1 nonzero. The canonical form is:
+//
+//	one byte of sign: '0' negative, '1' zero, '2' positive
+//	exponentDigits digits of e + exponentBias
+//	mantissaDigits digits d1d2d3…, padded with trailing zeroes
+//
+// For negative numbers, every digit of the exponent and mantissa is replaced by 9 minus that digit, so that bigger
+// magnitudes sort lower. Zero is the sign byte followed by all zeroes.
 const (
-	nineDigits        = 1000000000.0
-	digitsOfPrecision = 18
+	mantissaDigits  = 30
+	exponentDigits  = 4
+	exponentBias    = 5000
+	canonicalLength = 1 + exponentDigits + mantissaDigits
 )
 
+// canonicalize produces the canonical form of s, which must be a number in JSON syntax. It fails if the number
+// has more than mantissaDigits significant digits or if its exponent is out of range.
 func canonicalize(s []byte) (string, error) {
-	var err error
-	if len(s) > digitsOfPrecision {
-		return "", fmt.Errorf("number has %d digits, exceeds max of %d", len(s), digitsOfPrecision)
-	}
-	var f float64
-	f, err = strconv.ParseFloat(string(s), 64)
+	c, err := appendCanonical(make([]byte, 0, canonicalLength), s)
 	if err != nil {
 		return "", err
 	}
-	if f >= nineDigits || f <= -nineDigits {
-		return "", fmt.Errorf("number is outside of range [%f, %f]", -nineDigits, nineDigits)
+	return string(c), nil
+}
+
+// appendCanonical appends the canonical form of s to dst, and is where the work of canonicalize is done
+func appendCanonical(dst []byte, s []byte) ([]byte, error) {
+	var digits [mantissaDigits]byte
+	digitCount := 0
+	negative := false
+	exponent := 0
+	sawDigit := false
+	i := 0
+
+	if i < len(s) && s[i] == '-' {
+		negative = true
+		i++
+	}
+
+	// integral part. leading zeroes are skipped, all other digits increase the exponent
+	for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		sawDigit = true
+		if digitCount == 0 && s[i] == '0' {
+			continue
+		}
+		exponent++
+		if digitCount == mantissaDigits {
+			// zeroes past the end of the mantissa are OK as long as nothing nonzero follows
+			if s[i] != '0' {
+				return nil, fmt.Errorf("number has more than %d significant digits", mantissaDigits)
+			}
+			continue
+		}
+		digits[digitCount] = s[i]
+		digitCount++
+	}
+
+	// fraction. zeroes before the first significant digit decrease the exponent
+	if i < len(s) && s[i] == '.' {
+		i++
+		sawFraction := false
+		for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+			sawFraction = true
+			if digitCount == 0 && s[i] == '0' {
+				exponent--
+				continue
+			}
+			if digitCount == mantissaDigits {
+				if s[i] != '0' {
+					return nil, fmt.Errorf("number has more than %d significant digits", mantissaDigits)
+				}
+				continue
+			}
+			digits[digitCount] = s[i]
+			digitCount++
+		}
+		if !sawFraction {
+			return nil, errors.New("no digits after decimal point")
+		}
+	}
+	if !sawDigit {
+		return nil, errors.New("number has no digits")
+	}
+
+	// exponent
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		expNegative := false
+		if i < len(s) && (s[i] == '-' || s[i] == '+') {
+			expNegative = s[i] == '-'
+			i++
+		}
+		explicit := 0
+		sawExpDigit := false
+		for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+			sawExpDigit = true
+			// don't let a silly exponent overflow; anything this big is out of range anyhow
+			if explicit < 10*exponentBias {
+				explicit = explicit*10 + int(s[i]-'0')
+			}
+		}
+		if !sawExpDigit {
+			return nil, errors.New("no digits in exponent")
+		}
+		if expNegative {
+			explicit = -explicit
+		}
+		exponent += explicit
+	}
+	if i != len(s) {
+		return nil, fmt.Errorf("illegal character '%c' in number", s[i])
+	}
+
+	// trailing zeroes aren't significant
+	for digitCount > 0 && digits[digitCount-1] == '0' {
+		digitCount--
+	}
+
+	start := len(dst)
+	dst = append(dst, make([]byte, canonicalLength)...)
+	canonical := dst[start:]
+	if digitCount == 0 {
+		canonical[0] = '1'
+		for j := 1; j < canonicalLength; j++ {
+			canonical[j] = '0'
+		}
+		return dst, nil
+	}
+
+	biased := exponent + exponentBias
+	if biased < 0 || biased >= exponentBias*2 {
+		return nil, fmt.Errorf("number exponent is outside of range [%d, %d]", -exponentBias, exponentBias-1)
+	}
+	canonical[0] = '2'
+	for j := exponentDigits; j > 0; j-- {
+		canonical[j] = byte('0' + biased%10)
+		biased /= 10
+	}
+	for j := 0; j < mantissaDigits; j++ {
+		if j < digitCount {
+			canonical[1+exponentDigits+j] = digits[j]
+		} else {
+			canonical[1+exponentDigits+j] = '0'
+		}
+	}
+	if negative {
+		canonical[0] = '0'
+		for j := 1; j < canonicalLength; j++ {
+			canonical[j] = '9' - canonical[j] + '0'
+		}
+	}
+	return dst, nil
+}
+
+// numberMarker precedes the canonical form of a number wherever it is used in an automaton. Canonical numbers
+// are strings of digits, so without a marker they could collide with the textual form of some other number
+// in an event. 0xC0 can never appear in a UTF-8 string, and thus can't start any value a Flattener produces.
+const numberMarker byte = 0xc0
+
+// canonicalNumber returns the form that numeric patterns are matched against: numberMarker followed by the
+// output of canonicalize
+func canonicalNumber(s []byte) ([]byte, error) {
+	c := make([]byte, 1, canonicalLength+1)
+	c[0] = numberMarker
+	return appendCanonical(c, s)
+}
+
+// numberValue is applied by the Flatteners to numbers that will be returned in Fields. It returns the bytes of a
+// number as they appear in the event, unless canonicalize is set, in which case it returns the canonical form.
+// Numbers that can't be canonicalized, for example because they have too many digits, are returned unchanged.
+func numberValue(number []byte, canonicalize bool) []byte {
+	if !canonicalize {
+		return number
+	}
+	canonical, err := canonicalNumber(number)
+	if err != nil {
+		return number
+	}
+	return canonical
+}
+
+// looksLikeNumber checks whether a value might be the textual form of a number, as opposed to a string or a
+// literal, to avoid the cost of trying to canonicalize values that can't possibly be numbers
+func looksLikeNumber(val []byte) bool {
+	if len(val) == 0 {
+		return false
 	}
-	return fmt.Sprintf("%019.0f", (f+nineDigits)*nineDigits), nil
+	ch := val[0]
+	return ch == '-' || (ch >= '0' && ch <= '9')
 }
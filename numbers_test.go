@@ -10,17 +10,71 @@ import (
 
 func TestBadNumbers(t *testing.T) {
 	var err error
-	_, err = canonicalize([]byte("9999999999999999999"))
+	_, err = canonicalize([]byte("1234567890123456789012345678901"))
 	if err == nil {
-		t.Error("took 20 9's")
+		t.Error("took 31 digits")
 	}
-	_, err = canonicalize([]byte("2z3z"))
+	_, err = canonicalize([]byte("0.0000001234567890123456789012345678901"))
 	if err == nil {
-		t.Error("took 2z3z")
+		t.Error("took 31 fractional digits")
 	}
-	_, err = canonicalize([]byte("9000000000000"))
-	if err == nil {
-		t.Error("took huge number")
+	bads := []string{"2z3z", "", "-", ".5", "5.", "1e", "1e+", "--3", "3-", "1.2.3", "9e5000", "1e-5002"}
+	for _, bad := range bads {
+		_, err = canonicalize([]byte(bad))
+		if err == nil {
+			t.Errorf("took %s", bad)
+		}
+	}
+}
+
+func TestWideNumbers(t *testing.T) {
+	goods := []string{
+		"9999999999999999999",
+		"9000000000000",
+		"123456789012345678901234567890",
+		"1.23456789012345678901234567890",
+		"-1e300",
+		"4.9e-324",
+		"12345678901234567890123456789000000000",
+		"5.00000000000000000000000000000000000000000",
+	}
+	for _, good := range goods {
+		c, err := canonicalize([]byte(good))
+		if err != nil {
+			t.Errorf("canon err on %s: %s", good, err.Error())
+		}
+		if len(c) != canonicalLength {
+			t.Errorf("%s: length %d", c, len(c))
+		}
+	}
+
+	// these are all different, and bigger than each other
+	ordered := []string{
+		"-1e4998",
+		"-12345678901234567890.5",
+		"-12345678901234567890",
+		"-0.000000000000000000001",
+		"0",
+		"0.000000000000000000001",
+		"0.0000000000000000000011",
+		"999999999.999999999",
+		"1000000000",
+		"123456789012345678901234567890",
+		"123456789012345678901234567891",
+		"1e4998",
+	}
+	var out []string
+	for _, o := range ordered {
+		c, err := canonicalize([]byte(o))
+		if err != nil {
+			t.Errorf("canon err on %s: %s", o, err.Error())
+		}
+		out = append(out, c)
+	}
+	for i := 1; i < len(out); i++ {
+		if out[i-1] >= out[i] {
+			t.Errorf("%s sorts ahead of %s", ordered[i-1], ordered[i])
+		}
 	}
 }
 
@@ -30,6 +84,10 @@ func TestVariants(t *testing.T) {
 		"350.0",
 		"350.0000000000",
 		"3.5e2",
+		"3.5E+2",
+		"0.35e3",
+		"35000e-2",
+		"000350",
 	}
 	var o []string
 	for _, s := range f {
@@ -51,7 +109,7 @@ func TestOrdering(t *testing.T) {
 	for i := 0; i < 10000; i++ {
 		// nolint:gosec
 		f := rand.Float64() * math.Pow(10, 9) * 2
-		f -= nineDigits
+		f -= math.Pow(10, 9)
 		in = append(in, f)
 	}
 	sort.Float64s(in)
@@ -68,8 +126,92 @@ func TestOrdering(t *testing.T) {
 		t.Errorf("Not sorted")
 	}
 	for i, c := range out {
-		if len(c) != 19 {
+		if len(c) != canonicalLength {
 			t.Errorf("%s: %d at %d", c, len(c), i)
 		}
 	}
 }
+
+func TestNumberCanonicalization(t *testing.T) {
+	variants := []string{"35", "35.0", "35.000", "3.5e1", "350e-1", "0.35E2"}
+	for _, deletion := range []bool{false, true} {
+		q, err := New(WithNumberCanonicalization(true), WithPatternDeletion(deletion))
+		if err != nil {
+			t.Error("New: " + err.Error())
+		}
+		err = q.AddPattern("p35", `{"a": [ 35.00 ]}`)
+		if err != nil {
+			t.Error("AddP: " + err.Error())
+		}
+		err = q.AddPattern("pRange", `{"a": [ {"numeric": [">", 30, "<", 40]} ]}`)
+		if err != nil {
+			t.Error("AddP: " + err.Error())
+		}
+		err = q.AddPattern("pBig", `{"a": [ 1e400, "35" ]}`)
+		if err != nil {
+			t.Error("AddP: " + err.Error())
+		}
+		for _, q1 := range []*Quamina{q, q.Copy()} {
+			for _, variant := range variants {
+				matches, err := q1.MatchesForEvent([]byte(`{"a": ` + variant + `}`))
+				if err != nil {
+					t.Error("M4E: " + err.Error())
+				}
+				if len(matches) != 2 || !containsX(matches, "p35") || !containsX(matches, "pRange") {
+					t.Errorf("%s: wrong matches %v", variant, matches)
+				}
+			}
+			matches, _ := q1.MatchesForEvent([]byte(`{"a": [36, "35", 10e399]}`))
+			if len(matches) != 2 || !containsX(matches, "pBig") || !containsX(matches, "pRange") {
+				t.Errorf("wrong matches %v", matches)
+			}
+		}
+		if deletion {
+			pm := q.matcher.(*prunerMatcher)
+			err = pm.rebuild(false)
+			if err != nil {
+				t.Error("rebuild: " + err.Error())
+			}
+			matches, _ := q.MatchesForEvent([]byte(`{"a": 3.5e1}`))
+			if len(matches) != 2 {
+				t.Errorf("after rebuild, wrong matches %v", matches)
+			}
+		}
+	}
+
+	// without the option, the textual forms have to match
+	q, _ := New()
+	_ = q.AddPattern("p35", `{"a": [ 35 ]}`)
+	for _, variant := range variants[1:] {
+		matches, _ := q.MatchesForEvent([]byte(`{"a": ` + variant + `}`))
+		if len(matches) != 0 {
+			t.Errorf("%s matched without canonicalization", variant)
+		}
+	}
+
+	// a Flattener other than the built-in one doesn't canonicalize, but the matcher takes care of it
+	f := &rawFieldsFlattener{fields: []Field{{Path: []byte("a"), Val: []byte("3.50e1")}}}
+	q, _ = New(WithNumberCanonicalization(true), WithFlattener(f))
+	_ = q.AddPattern("p35", `{"a": [ 35 ]}`)
+	matches, _ := q.MatchesForEvent([]byte(`{"a": 3.50e1}`))
+	if len(matches) != 1 {
+		t.Errorf("missed with raw flattener")
+	}
+
+	_, err := New(WithNumberCanonicalization(true), WithNumberCanonicalization(false))
+	if err == nil {
+		t.Error("allowed 2 number canonicalizations")
+	}
+}
+
+type rawFieldsFlattener struct {
+	fields []Field
+}
+
+func (f *rawFieldsFlattener) Flatten(_ []byte, _ SegmentsTreeTracker) ([]Field, error) {
+	return f.fields, nil
+}
+
+func (f *rawFieldsFlattener) Copy() Flattener {
+	return &rawFieldsFlattener{fields: f.fields}
+}
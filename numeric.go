@@ -0,0 +1,214 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// numericRange represents the constraints in a pattern like {"numeric": [">", 0, "<=", 5]}. bottom and top
+// are canonicalized numbers, see numbers.go; a nil value means there's no bound on that side. The open flags
+// say whether the bound itself is excluded from the range.
+type numericRange struct {
+	bottom     []byte
+	top        []byte
+	openBottom bool
+	openTop    bool
+}
+
+// readNumericSpecial parses a numeric object in a Pattern. The value has to be an array containing either
+// one or two operator/number pairs, where the operators are "=", "<", "<=", ">", and ">="
+func readNumericSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
+	t, err := pb.jd.Token()
+	if err != nil {
+		return
+	}
+	pathVals = valsIn
+	delim, ok := t.(json.Delim)
+	if (!ok) || delim != '[' {
+		err = errors.New("value for 'numeric' must be an array")
+		return
+	}
+
+	nr := &numericRange{}
+	var hasBottom, hasTop, hasEquals bool
+	pairs := 0
+	for {
+		t, err = pb.jd.Token()
+		if errors.Is(err, io.EOF) {
+			err = errors.New("'numeric' list truncated")
+			return
+		} else if err != nil {
+			return
+		}
+		if tt, isDelim := t.(json.Delim); isDelim && tt == ']' {
+			break
+		}
+		operator, isString := t.(string)
+		if !isString {
+			err = errors.New("'numeric' list must contain operator/number pairs")
+			return
+		}
+
+		t, err = pb.jd.Token()
+		if errors.Is(err, io.EOF) {
+			err = errors.New("'numeric' list truncated")
+			return
+		} else if err != nil {
+			return
+		}
+		number, isNumber := t.(json.Number)
+		if !isNumber {
+			err = fmt.Errorf("'numeric' operator %s must be followed by a number", operator)
+			return
+		}
+		var canonical string
+		canonical, err = canonicalize([]byte(number.String()))
+		if err != nil {
+			err = fmt.Errorf("unusable number %s in 'numeric' pattern: %s", number.String(), err.Error())
+			return
+		}
+
+		c := []byte(canonical)
+		pairs++
+		switch operator {
+		case "=":
+			hasEquals = true
+			nr.bottom, nr.top = c, c
+		case ">", ">=":
+			if hasBottom {
+				err = errors.New("'numeric' pattern has more than one lower bound")
+				return
+			}
+			hasBottom = true
+			nr.bottom = c
+			nr.openBottom = operator == ">"
+		case "<", "<=":
+			if hasTop {
+				err = errors.New("'numeric' pattern has more than one upper bound")
+				return
+			}
+			hasTop = true
+			nr.top = c
+			nr.openTop = operator == "<"
+		default:
+			err = fmt.Errorf("unknown operator %s in 'numeric' pattern", operator)
+			return
+		}
+	}
+
+	switch {
+	case pairs == 0:
+		err = errors.New("empty 'numeric' pattern")
+		return
+	case hasEquals && pairs > 1:
+		err = errors.New("'=' cannot be combined with other operators in 'numeric' pattern")
+		return
+	case hasBottom && hasTop:
+		comparison := bytes.Compare(nr.bottom, nr.top)
+		if comparison > 0 || (comparison == 0 && (nr.openBottom || nr.openTop)) {
+			err = errors.New("'numeric' pattern can never match")
+			return
+		}
+	}
+	pathVals = append(pathVals, typedVal{vType: numericType, numRange: nr})
+
+	// has to be } or tokenizer will throw error
+	_, err = pb.jd.Token()
+	return
+}
+
+// makeNumericAutomaton builds a DFA which matches canonicalized numbers, i.e. numberMarker followed by a
+// fixed-length string of digits, which fall within a numericRange. Since the canonical forms sort the same
+// way the numbers do, this is a matter of comparing bytes. At each position in the number we need to know
+// whether we're still "pinned" to the bottom and/or top bound, i.e. the bytes so far have exactly matched that
+// bound, in which case the current byte is constrained by the bound. Once we're not pinned to either, any
+// byte will do until we run out. So there are at most 3 states per position, and they are memoized.
+func makeNumericAutomaton(nr *numericRange, useThisTransition *fieldMatcher) (*smallTable[*dfaStep], *fieldMatcher) {
+	var nextField *fieldMatcher
+	if useThisTransition != nil {
+		nextField = useThisTransition
+	} else {
+		nextField = newFieldMatcher()
+	}
+	length := len(nr.bottom)
+	if nr.bottom == nil {
+		length = len(nr.top)
+	}
+	nb := &numericBuilder{
+		nr:        nr,
+		length:    length,
+		nextField: nextField,
+		memoize:   make(map[numericStepKey]*dfaStep),
+	}
+	first := nb.step(0, nr.bottom != nil, nr.top != nil)
+	return makeSmallDfaTable(nil, []byte{numberMarker}, []*dfaStep{first}), nextField
+}
+
+type numericStepKey struct {
+	index        int
+	pinnedBottom bool
+	pinnedTop    bool
+}
+
+type numericBuilder struct {
+	nr        *numericRange
+	length    int
+	nextField *fieldMatcher
+	memoize   map[numericStepKey]*dfaStep
+}
+
+// step returns the dfaStep that's reached after matching index bytes of the number, or nil if no number
+// arriving here can be in the range.
+func (nb *numericBuilder) step(index int, pinnedBottom bool, pinnedTop bool) *dfaStep {
+	key := numericStepKey{index: index, pinnedBottom: pinnedBottom, pinnedTop: pinnedTop}
+	if step, ok := nb.memoize[key]; ok {
+		return step
+	}
+
+	var step *dfaStep
+	if index == nb.length {
+		// all the bytes are consumed; we're only in range if we're not sitting on an excluded bound
+		if !((pinnedBottom && nb.nr.openBottom) || (pinnedTop && nb.nr.openTop)) {
+			lastStep := &dfaStep{table: newSmallTable[*dfaStep](), fieldTransitions: []*fieldMatcher{nb.nextField}}
+			step = &dfaStep{table: makeSmallDfaTable(nil, []byte{valueTerminator}, []*dfaStep{lastStep})}
+		}
+	} else {
+		floor := 0
+		if pinnedBottom {
+			floor = int(nb.nr.bottom[index])
+		}
+		ceiling := int(valueTerminator) - 1
+		if pinnedTop {
+			ceiling = int(nb.nr.top[index])
+		}
+		var u unpackedTable[*dfaStep]
+		for utf8Byte := floor; utf8Byte <= ceiling; utf8Byte++ {
+			u[utf8Byte] = nb.step(index+1, pinnedBottom && utf8Byte == floor, pinnedTop && utf8Byte == ceiling)
+		}
+		step = &dfaStep{table: newSmallTable[*dfaStep]()}
+		step.table.pack(&u)
+	}
+	nb.memoize[key] = step
+	return step
+}
+
+// canonicalizeNumberVals is used when number canonicalization has been requested, and turns each number value
+// in a pattern into the equivalent of {"numeric": ["=", value]}, so that it matches the canonical form of
+// the number. Numbers that can't be canonicalized are left alone.
+func canonicalizeNumberVals(fields []*patternField) {
+	for _, field := range fields {
+		for i, val := range field.vals {
+			if val.vType != numberType {
+				continue
+			}
+			c, err := canonicalize([]byte(val.val))
+			if err != nil {
+				continue
+			}
+			field.vals[i] = typedVal{vType: numericType, val: val.val, numRange: &numericRange{bottom: []byte(c), top: []byte(c)}}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package quamina
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseNumericPattern(t *testing.T) {
+	goods := []string{
+		`{"a": [ {"numeric": [ "=", 3 ] } ] }`,
+		`{"a": [ {"numeric": [ "<", 3.5e1 ] } ] }`,
+		`{"a": [ {"numeric": [ ">", 0, "<=", 5 ] } ] }`,
+		`{"a": [ {"numeric": [ "<=", 5, ">=", -5 ] } ] }`,
+		`{"a": [ {"numeric": [ ">=", 5, "<=", 5 ] } ] }`,
+		`{"a": [ 3, {"numeric": [ ">", 10 ] }, "x" ] }`,
+	}
+	bads := []string{
+		`{"a": [ {"numeric": 3 } ] }`,
+		`{"a": [ {"numeric": [ ] } ] }`,
+		`{"a": [ {"numeric": [ "=" ] } ] }`,
+		`{"a": [ {"numeric": [ "=", "3" ] } ] }`,
+		`{"a": [ {"numeric": [ 3, "=" ] } ] }`,
+		`{"a": [ {"numeric": [ "==", 3 ] } ] }`,
+		`{"a": [ {"numeric": [ "=", 3, "<", 5 ] } ] }`,
+		`{"a": [ {"numeric": [ ">", 3, ">", 5 ] } ] }`,
+		`{"a": [ {"numeric": [ "<", 3, "<=", 5 ] } ] }`,
+		`{"a": [ {"numeric": [ ">", 5, "<", 3 ] } ] }`,
+		`{"a": [ {"numeric": [ ">", 5, "<=", 5 ] } ] }`,
+		`{"a": [ {"numeric": [ "<", 1e6000 ] } ] }`,
+		`{"a": [ {"numeric": [ "<", 3 `,
+		`{"a": [ {"numeric": [ "<", 3 ] x`,
+	}
+	for _, good := range goods {
+		alternatives, err := patternsFromJSON([]byte(good))
+		if err != nil {
+			t.Errorf("parse numeric %s: %s", good, err.Error())
+			continue
+		}
+		fields := alternatives[0]
+		if len(fields) != 1 {
+			t.Errorf("wanted 1 field got %d", len(fields))
+		}
+	}
+	for _, bad := range bads {
+		_, err := patternsFromJSON([]byte(bad))
+		if err == nil {
+			t.Errorf("accepted numeric %s", bad)
+		}
+	}
+}
+
+func TestNumericRangeMatching(t *testing.T) {
+	type numericTest struct {
+		pattern string
+		matches []string
+		misses  []string
+	}
+	tests := []numericTest{
+		{
+			pattern: `[ ">", 0, "<=", 5 ]`,
+			matches: []string{"0.0001", "1", "5", "5.0", "4.99999", "0.5e1", "3e-2"},
+			misses:  []string{"0", "-1", "5.0001", "6", "500", "-0.5", `"3"`, "true"},
+		},
+		{
+			pattern: `[ "<", 100 ]`,
+			matches: []string{"99", "-99", "0", "99.999", "-999999999", "-1e300", "99.99999999999999999999999"},
+			misses:  []string{"100", "1e2", "100.0", "101", "999999999", "1e300"},
+		},
+		{
+			pattern: `[ ">=", 250 ]`,
+			matches: []string{"250", "250.0", "2.5e2", "251", "999999999", "1e10", "12345678901234567890123"},
+			misses:  []string{"249.99", "249.999999999999999999999999", "-250", "0", "-1e10"},
+		},
+		{
+			pattern: `[ "=", 35 ]`,
+			matches: []string{"35", "35.0", "35.000", "3.5e1", "350e-1"},
+			misses:  []string{"34", "36", "35.01", `"35"`},
+		},
+		{
+			pattern: `[ ">=", -10.5, "<", -10.25 ]`,
+			matches: []string{"-10.5", "-10.4", "-10.26"},
+			misses:  []string{"-10.25", "-10.51", "10.4"},
+		},
+	}
+	for _, test := range tests {
+		q, _ := New()
+		pattern := fmt.Sprintf(`{"a": [ {"numeric": %s } ] }`, test.pattern)
+		err := q.AddPattern("N", pattern)
+		if err != nil {
+			t.Errorf("add %s: %s", pattern, err.Error())
+			continue
+		}
+		for _, m := range test.matches {
+			matches, err := q.MatchesForEvent([]byte(`{"a": ` + m + `}`))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 1 {
+				t.Errorf("%s should match %s", test.pattern, m)
+			}
+		}
+		for _, m := range test.misses {
+			matches, err := q.MatchesForEvent([]byte(`{"a": ` + m + `}`))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 0 {
+				t.Errorf("%s should not match %s", test.pattern, m)
+			}
+		}
+	}
+}
+
+func TestNumericMixedWithOtherPatterns(t *testing.T) {
+	q, _ := New()
+	patterns := map[X]string{
+		"small":  `{"price": [ {"numeric": [ ">=", 10, "<", 100 ] } ] }`,
+		"big":    `{"price": [ {"numeric": [ ">=", 100 ] } ] }`,
+		"exact":  `{"price": [ 50 ] }`,
+		"string": `{"price": [ "free", {"prefix": "call"} ] }`,
+		"both":   `{"price": [ {"numeric": [ ">", 0 ] } ], "currency": [ "EUR" ] }`,
+	}
+	for x, p := range patterns {
+		err := q.AddPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"price": 50}`:                     {"small", "exact"},
+		`{"price": 50.0}`:                   {"small"},
+		`{"price": 100, "currency": "EUR"}`: {"big", "both"},
+		`{"price": 5, "currency": "EUR"}`:   {"both"},
+		`{"price": 5, "currency": "USD"}`:   {},
+		`{"price": "free"}`:                 {"string"},
+		`{"price": "call us"}`:              {"string"},
+		`{"price": [1, 20, 2000]}`:          {"small", "big"},
+		`{"price": -3, "currency": "EUR"}`:  {},
+	}
+	for event, want := range wanted {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
+
+func containsX(list []X, x X) bool {
+	for _, l := range list {
+		if l == x {
+			return true
+		}
+	}
+	return false
+}
+
+// addTestPatterns adds Patterns to q, stopping the test if one can't be added
+func addTestPatterns(t *testing.T, q *Quamina, patterns map[X]string) {
+	t.Helper()
+	for x, p := range patterns {
+		if err := q.AddPattern(x, p); err != nil {
+			t.Fatalf("add %s: %s", p, err.Error())
+		}
+	}
+}
+
+// checkMatches checks that the X values matched by what are those wanted, in any order
+func checkMatches(t *testing.T, what string, matches []X, wanted []X) {
+	t.Helper()
+	if len(matches) != len(wanted) {
+		t.Errorf("%s: wanted %v got %v", what, wanted, matches)
+	}
+	for _, w := range wanted {
+		if !containsX(matches, w) {
+			t.Errorf("%s: missing %v in %v", what, w, matches)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"strings"
 )
 
@@ -20,14 +21,28 @@ const (
 	shellStyleType
 	anythingButType
 	prefixType
+	numericType
+	monocaseType
+	suffixType
+	wildcardType
+	regexpType
+	cidrType
 )
 
 // typedVal represents the value of a field in a pattern, giving the value and the type of pattern.
 // list is used to handle anything-but matches with multiple values.
+// negated is used by anything-but matches that contain another pattern, such as a prefix.
+// numRange is used by numeric patterns, which have bounds rather than a single value.
+// parsedRegexp is used by regexp patterns, so they only have to be parsed once.
+// ipPrefix is used by cidr patterns.
 type typedVal struct {
-	vType valType
-	val   string
-	list  [][]byte
+	vType        valType
+	val          string
+	list         [][]byte
+	negated      *typedVal
+	numRange     *numericRange
+	parsedRegexp *regexpNode
+	ipPrefix     *netip.Prefix
 }
 
 // patternField represents a field in a pattern.
@@ -37,19 +52,28 @@ type patternField struct {
 	vals []typedVal
 }
 
-// patternBuild tracks the progress of patternFromJSON through a pattern-compilation project.
+// patternBuild tracks the progress of patternsFromJSON through a pattern-compilation project.
+// results holds the fields that are common to every alternative the pattern expands into; each member of ors
+// holds the alternatives from one "$or" in the pattern.
 type patternBuild struct {
 	jd      *json.Decoder
 	path    []string
 	results []*patternField
+	ors     [][][]*patternField
 }
 
-// patternFromJSON compiles a JSON text provided in jsonBytes into a list of patternField structures.
+// maxOrAlternatives limits the number of field lists that a pattern's "$or" constructs can expand into,
+// because each one is added to the automaton separately and the number multiplies with each "$or".
+const maxOrAlternatives = 1000
+
+// patternsFromJSON compiles a JSON text provided in jsonBytes into lists of patternField structures, one for
+// each alternative produced by "$or" constructs in the pattern, or just one if there aren't any. An event
+// matches the pattern if it matches any of the alternatives.
 // I love naked returns and I cannot lie
-func patternFromJSON(jsonBytes []byte) (fields []*patternField, err error) {
+func patternsFromJSON(jsonBytes []byte) (alternatives [][]*patternField, err error) {
 	// we can't use json.Unmarshal because it round-trips numbers through float64 and %f so they won't end up matching
 	// what the caller actually wrote in the patternField. json.Decoder is kind of slow due to excessive
-	// memory allocation, but I haven't got around to prematurely optimizing the patternFromJSON code path
+	// memory allocation, but I haven't got around to prematurely optimizing the patternsFromJSON code path
 	var pb patternBuild
 	pb.jd = json.NewDecoder(bytes.NewReader(jsonBytes))
 	pb.jd.UseNumber()
@@ -75,10 +99,35 @@ func patternFromJSON(jsonBytes []byte) (fields []*patternField, err error) {
 	}
 
 	err = readPatternObject(&pb)
-	fields = pb.results
+	if err != nil {
+		return
+	}
+	alternatives, err = pb.alternatives()
 	return
 }
 
+// alternatives combines the fields that have been read with each alternative from each "$or", so that
+// {"a": [1], "$or": [ {"b": [2]}, {"c": [3]} ]} produces [a, b] and [a, c].
+func (pb *patternBuild) alternatives() ([][]*patternField, error) {
+	alternatives := [][]*patternField{pb.results}
+	for _, or := range pb.ors {
+		if len(alternatives)*len(or) > maxOrAlternatives {
+			return nil, fmt.Errorf("pattern expands into more than %d alternatives", maxOrAlternatives)
+		}
+		var combined [][]*patternField
+		for _, alternative := range alternatives {
+			for _, orAlternative := range or {
+				fields := make([]*patternField, 0, len(alternative)+len(orAlternative))
+				fields = append(fields, alternative...)
+				fields = append(fields, orAlternative...)
+				combined = append(combined, fields)
+			}
+		}
+		alternatives = combined
+	}
+	return alternatives, nil
+}
+
 func readPatternObject(pb *patternBuild) error {
 	for {
 		t, err := pb.jd.Token()
@@ -90,6 +139,13 @@ func readPatternObject(pb *patternBuild) error {
 
 		switch tt := t.(type) {
 		case string:
+			if tt == "$or" {
+				err = readOrPattern(pb)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 			pb.path = append(pb.path, tt)
 			err = readPatternMember(pb)
 			if err != nil {
@@ -104,6 +160,57 @@ func readPatternObject(pb *patternBuild) error {
 	}
 }
 
+// readOrPattern reads the array of objects that is the value of "$or". Each object is read as if it were part
+// of the object containing the "$or", but separately, and may itself expand into more than one alternative.
+func readOrPattern(pb *patternBuild) error {
+	t, err := pb.jd.Token()
+	if err != nil {
+		return errors.New("pattern malformed: " + err.Error())
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '[' {
+		return errors.New("value of $or must be an array of objects")
+	}
+	var or [][]*patternField
+	objectCount := 0
+	for {
+		t, err = pb.jd.Token()
+		if errors.Is(err, io.EOF) {
+			return errors.New("pattern ends mid-$or")
+		} else if err != nil {
+			return errors.New("pattern malformed: " + err.Error())
+		}
+		delim, ok := t.(json.Delim)
+		if !ok {
+			return errors.New("value of $or must be an array of objects")
+		}
+		if delim == ']' {
+			break
+		}
+		if delim != '{' {
+			return errors.New("value of $or must be an array of objects")
+		}
+		alternativeBuild := &patternBuild{jd: pb.jd, path: pb.path}
+		err = readPatternObject(alternativeBuild)
+		if err != nil {
+			return err
+		}
+		if len(alternativeBuild.results) == 0 && len(alternativeBuild.ors) == 0 {
+			return errors.New("empty object in $or")
+		}
+		objectCount++
+		alternatives, err := alternativeBuild.alternatives()
+		if err != nil {
+			return err
+		}
+		or = append(or, alternatives...)
+	}
+	if objectCount < 2 {
+		return errors.New("$or must contain at least two objects")
+	}
+	pb.ors = append(pb.ors, or)
+	return nil
+}
+
 func readPatternMember(pb *patternBuild) error {
 	t, err := pb.jd.Token()
 	if errors.Is(err, io.EOF) {
@@ -197,8 +304,20 @@ func readSpecialPattern(pb *patternBuild, valsIn []typedVal) (pathVals []typedVa
 		pathVals, err = readExistsSpecial(pb, pathVals)
 	case "shellstyle":
 		pathVals, err = readShellStyleSpecial(pb, pathVals)
+	case "wildcard":
+		pathVals, err = readWildcardSpecial(pb, pathVals)
+	case "regexp":
+		pathVals, err = readRegexpSpecial(pb, pathVals)
 	case "prefix":
 		pathVals, err = readPrefixSpecial(pb, pathVals)
+	case "suffix":
+		pathVals, err = readSuffixSpecial(pb, pathVals)
+	case "numeric":
+		pathVals, err = readNumericSpecial(pb, pathVals)
+	case "equals-ignore-case":
+		pathVals, err = readEqualsIgnoreCaseSpecial(pb, pathVals)
+	case "cidr":
+		pathVals, err = readCidrSpecial(pb, pathVals)
 	default:
 		err = errors.New("unrecognized in special pattern: " + tt)
 	}
@@ -228,6 +347,52 @@ func readPrefixSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal
 	return
 }
 
+func readSuffixSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
+	t, err := pb.jd.Token()
+	if err != nil {
+		return
+	}
+	pathVals = valsIn
+
+	suffixString, ok := t.(string)
+	if !ok {
+		err = errors.New("value for 'suffix' must be a string")
+		return
+	}
+	val := typedVal{
+		vType: suffixType,
+		val:   `"` + suffixString + `"`,
+	}
+	pathVals = append(pathVals, val)
+
+	// has to be } or tokenizer will throw error
+	_, err = pb.jd.Token()
+	return
+}
+
+func readEqualsIgnoreCaseSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
+	t, err := pb.jd.Token()
+	if err != nil {
+		return
+	}
+	pathVals = valsIn
+
+	monocaseString, ok := t.(string)
+	if !ok {
+		err = errors.New("value for 'equals-ignore-case' must be a string")
+		return
+	}
+	val := typedVal{
+		vType: monocaseType,
+		val:   `"` + monocaseString + `"`,
+	}
+	pathVals = append(pathVals, val)
+
+	// has to be } or tokenizer will throw error
+	_, err = pb.jd.Token()
+	return
+}
+
 func readExistsSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
 	t, err := pb.jd.Token()
 	if err != nil {
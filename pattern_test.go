@@ -1,41 +1,43 @@
 package quamina
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestPatternErrorHandling(t *testing.T) {
-	_, err := patternFromJSON([]byte{})
+	_, err := patternsFromJSON([]byte{})
 	if err == nil {
 		t.Error("accepted empty pattern")
 	}
-	_, err = patternFromJSON([]byte("33"))
+	_, err = patternsFromJSON([]byte("33"))
 	if err == nil {
 		t.Error("accepted non-object JSON text")
 	}
-	_, err = patternFromJSON([]byte("{"))
+	_, err = patternsFromJSON([]byte("{"))
 	if err == nil {
 		t.Error("accepted stub JSON object")
 	}
-	_, err = patternFromJSON([]byte("{ ="))
+	_, err = patternsFromJSON([]byte("{ ="))
 	if err == nil {
 		t.Error("accepted malformed JSON object")
 	}
-	_, err = patternFromJSON([]byte(`{ "foo": `))
+	_, err = patternsFromJSON([]byte(`{ "foo": `))
 	if err == nil {
 		t.Error("accepted stub JSON object")
 	}
-	_, err = patternFromJSON([]byte(`{ "foo": [`))
+	_, err = patternsFromJSON([]byte(`{ "foo": [`))
 	if err == nil {
 		t.Error("accepted stub JSON array")
 	}
 
-	_, err = patternFromJSON([]byte(`{ "foo": [ { "exists" == ] }`))
+	_, err = patternsFromJSON([]byte(`{ "foo": [ { "exists" == ] }`))
 	if err == nil {
 		t.Error("accepted stub JSON array")
 	}
 
-	_, err = patternFromJSON([]byte(`{ "foo": [ { "exists": false . ] }`))
+	_, err = patternsFromJSON([]byte(`{ "foo": [ { "exists": false . ] }`))
 	if err == nil {
 		t.Error("accepted stub JSON array")
 	}
@@ -66,9 +68,16 @@ func TestPatternFromJSON(t *testing.T) {
 		`{"abc": [ {"prefix": - }, "foo" ] }`,
 		`{"abc": [ {"prefix":  - "a" }, "foo" ] }`,
 		`{"abc": [ {"prefix":  "a" {, "foo" ] }`,
+		`{"abc": [ {"suffix":23}, "foo" ] }`,
+		`{"abc": [ {"suffix":["a", "b"]}, "foo" ] }`,
+		`{"abc": [ {"suffix":  "a" {, "foo" ] }`,
+		`{"abc": [ {"equals-ignore-case":23}, "foo" ] }`,
+		`{"abc": [ {"equals-ignore-case":["a", "b"]}, "foo" ] }`,
+		`{"abc": [ {"equals-ignore-case": - }, "foo" ] }`,
+		`{"abc": [ {"equals-ignore-case":  "a" {, "foo" ] }`,
 	}
 	for _, b := range bads {
-		_, err := patternFromJSON([]byte(b))
+		_, err := patternsFromJSON([]byte(b))
 		if err == nil {
 			t.Error("accepted bad pattern: " + b)
 		}
@@ -82,23 +91,25 @@ func TestPatternFromJSON(t *testing.T) {
 		`{"x": { "y": [ {"exists": false} ] } }`,
 		`{"abc": [ 3, {"shellstyle":"a*b"} ] }`,
 		`{"abc": [ {"shellstyle":"a*b"}, "foo" ] }`,
+		`{"abc": [ {"equals-ignore-case":"FoO"}, "foo" ] }`,
+		`{"abc": [ {"suffix":".gz"}, {"prefix":"a"} ] }`,
 	}
 	w1 := []*patternField{{path: "x", vals: []typedVal{{vType: numberType, val: "2"}}}}
 	w2 := []*patternField{{path: "x", vals: []typedVal{
-		{literalType, "null", nil},
-		{literalType, "true", nil},
-		{literalType, "false", nil},
-		{stringType, `"hopp"`, nil},
-		{numberType, "3.072e-11", nil},
+		{vType: literalType, val: "null"},
+		{vType: literalType, val: "true"},
+		{vType: literalType, val: "false"},
+		{vType: stringType, val: `"hopp"`},
+		{vType: numberType, val: "3.072e-11"},
 	}}}
 	w3 := []*patternField{
 		{path: "x\na", vals: []typedVal{
-			{numberType, "27", nil},
-			{numberType, "28", nil},
+			{vType: numberType, val: "27"},
+			{vType: numberType, val: "28"},
 		}},
 		{path: "x\nb\nm", vals: []typedVal{
-			{stringType, `"a"`, nil},
-			{stringType, `"b"`, nil},
+			{vType: stringType, val: `"a"`},
+			{vType: stringType, val: `"b"`},
 		}},
 	}
 	w4 := []*patternField{
@@ -131,13 +142,30 @@ func TestPatternFromJSON(t *testing.T) {
 			},
 		},
 	}
-	wanted := [][]*patternField{w1, w2, w3, w4, w5, w6, w7}
+	w8 := []*patternField{
+		{
+			path: "abc", vals: []typedVal{
+				{vType: monocaseType, val: `"FoO"`},
+				{vType: stringType, val: `"foo"`},
+			},
+		},
+	}
+	w9 := []*patternField{
+		{
+			path: "abc", vals: []typedVal{
+				{vType: suffixType, val: `".gz"`},
+				{vType: prefixType, val: `"a"`},
+			},
+		},
+	}
+	wanted := [][]*patternField{w1, w2, w3, w4, w5, w6, w7, w8, w9}
 
 	for i, good := range goods {
-		fields, err := patternFromJSON([]byte(good))
+		alternatives, err := patternsFromJSON([]byte(good))
 		if err != nil {
 			t.Error("pattern:" + good + ": " + err.Error())
 		}
+		fields := alternatives[0]
 		w := wanted[i]
 		if len(w) != len(fields) {
 			t.Errorf("at %d len(w)=%d, len(fields)=%d", i, len(w), len(fields))
@@ -154,3 +182,79 @@ func TestPatternFromJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestOrPatterns(t *testing.T) {
+	type orTest struct {
+		pattern string
+		wanted  [][]string
+	}
+	tests := []orTest{
+		{
+			pattern: `{"a": [1], "$or": [ {"b": [2]}, {"c": [3]} ] }`,
+			wanted:  [][]string{{"a", "b"}, {"a", "c"}},
+		},
+		{
+			pattern: `{"$or": [ {"b": [2]}, {"c": [3], "d": [4]} ], "a": [1] }`,
+			wanted:  [][]string{{"a", "b"}, {"a", "c", "d"}},
+		},
+		{
+			pattern: `{"x": {"$or": [ {"b": [2]}, {"c": {"d": [4]}} ] } }`,
+			wanted:  [][]string{{"x\nb"}, {"x\nc\nd"}},
+		},
+		{
+			pattern: `{"$or": [ {"a": [1]}, {"b": [2]} ], "$or": [ {"c": [3]}, {"d": [4]} ] }`,
+			wanted:  [][]string{{"a", "c"}, {"a", "d"}, {"b", "c"}, {"b", "d"}},
+		},
+		{
+			pattern: `{"$or": [ {"a": [1]}, {"$or": [ {"b": [2]}, {"c": [3]} ] } ] }`,
+			wanted:  [][]string{{"a"}, {"b"}, {"c"}},
+		},
+	}
+	for _, test := range tests {
+		alternatives, err := patternsFromJSON([]byte(test.pattern))
+		if err != nil {
+			t.Errorf("%s: %s", test.pattern, err.Error())
+			continue
+		}
+		if len(alternatives) != len(test.wanted) {
+			t.Errorf("%s: wanted %d alternatives, got %d", test.pattern, len(test.wanted), len(alternatives))
+			continue
+		}
+		for i, alternative := range alternatives {
+			var paths []string
+			for _, field := range alternative {
+				paths = append(paths, field.path)
+			}
+			if strings.Join(paths, " ") != strings.Join(test.wanted[i], " ") {
+				t.Errorf("%s: alternative %d wanted %v got %v", test.pattern, i, test.wanted[i], paths)
+			}
+		}
+	}
+
+	bads := []string{
+		`{"$or": {"a": [1]} }`,
+		`{"$or": [ {"a": [1]} ] }`,
+		`{"$or": [ ] }`,
+		`{"$or": [ {"a": [1]}, 3 ] }`,
+		`{"$or": [ {"a": [1]}, {} ] }`,
+		`{"$or": [ {"a": [1]}, {"b": [2]} `,
+		`{"$or": [ {"a": [1]}, {"b": 2} ] }`,
+	}
+	for _, bad := range bads {
+		_, err := patternsFromJSON([]byte(bad))
+		if err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+
+	// 2^10 alternatives is too many
+	pattern := `{`
+	for i := 0; i < 10; i++ {
+		pattern += fmt.Sprintf(`"$or": [ {"a%d": [1]}, {"b%d": [2]} ],`, i, i)
+	}
+	pattern += `"c": [3] }`
+	_, err := patternsFromJSON([]byte(pattern))
+	if err == nil {
+		t.Error("accepted too many alternatives")
+	}
+}
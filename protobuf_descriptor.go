@@ -0,0 +1,527 @@
+package quamina
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// This file reads the parts of a FileDescriptorSet, as produced by "protoc --descriptor_set_out" or
+// "buf build", that are needed to flatten protobuf messages. Quamina doesn't otherwise depend on the
+// protobuf libraries, so it decodes the descriptor's own wire format directly, using the field numbers in
+// google/protobuf/descriptor.proto.
+
+// protobuf wire types
+const (
+	protoVarint     = 0
+	protoFixed64    = 1
+	protoLength     = 2
+	protoStartGroup = 3
+	protoEndGroup   = 4
+	protoFixed32    = 5
+)
+
+// protobuf field types, from FieldDescriptorProto.Type
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+)
+
+const protoLabelRepeated = 3
+
+type protoMessage struct {
+	name     string
+	fields   map[uint64]*protoField
+	mapEntry bool
+}
+
+type protoField struct {
+	name     []byte
+	number   uint64
+	typ      uint64
+	typeName string
+	repeated bool
+	message  *protoMessage
+	enum     *protoEnum
+}
+
+// protoEnum holds the JSON forms of an enum's values, i.e. their quoted names
+type protoEnum struct {
+	values map[int32][]byte
+}
+
+// isMap says whether the field is a map<k, v>, which appears in the descriptor as a repeated field whose
+// message type is a generated map entry
+func (f *protoField) isMap() bool {
+	return f.repeated && f.message != nil && f.message.mapEntry
+}
+
+// wireType is what the field's values have on the wire, apart from packed repeated fields
+func (f *protoField) wireType() uint64 {
+	switch f.typ {
+	case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+		return protoFixed64
+	case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+		return protoFixed32
+	case protoTypeString, protoTypeBytes, protoTypeMessage:
+		return protoLength
+	case protoTypeGroup:
+		return protoStartGroup
+	default:
+		return protoVarint
+	}
+}
+
+// protoDescriptors collects the messages and enums in a FileDescriptorSet, by fully-qualified name
+type protoDescriptors struct {
+	messages map[string]*protoMessage
+	enums    map[string]*protoEnum
+	scopes   map[*protoField]string
+}
+
+// parseFileDescriptorSet reads the descriptor set and returns the named message, which may be given with or
+// without a leading ".", e.g. "example.Order"
+func parseFileDescriptorSet(descriptorSet []byte, messageName string) (*protoMessage, error) {
+	d := &protoDescriptors{
+		messages: make(map[string]*protoMessage),
+		enums:    make(map[string]*protoEnum),
+		scopes:   make(map[*protoField]string),
+	}
+	r := &protoReader{buf: descriptorSet}
+	for !r.done() {
+		number, wireType, err := r.key()
+		if err != nil {
+			return nil, err
+		}
+		if number == 1 && wireType == protoLength {
+			file, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			err = d.readFile(file)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err = r.skip(wireType); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.resolve(); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(messageName, ".") {
+		messageName = "." + messageName
+	}
+	message, ok := d.messages[messageName]
+	if !ok {
+		return nil, fmt.Errorf("message %s not found in descriptor set", messageName[1:])
+	}
+	return message, nil
+}
+
+// readFile reads a FileDescriptorProto, for its package and top-level messages and enums
+func (d *protoDescriptors) readFile(file []byte) error {
+	var pkg string
+	var messages, enums [][]byte
+	r := &protoReader{buf: file}
+	for !r.done() {
+		number, wireType, err := r.key()
+		if err != nil {
+			return err
+		}
+		if wireType != protoLength {
+			if err = r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		switch number {
+		case 2:
+			pkg = string(b)
+		case 4:
+			messages = append(messages, b)
+		case 5:
+			enums = append(enums, b)
+		}
+	}
+
+	// the package may come after the messages, although protoc doesn't do that
+	scope := ""
+	if pkg != "" {
+		scope = "." + pkg
+	}
+	for _, message := range messages {
+		if err := d.readMessage(message, scope); err != nil {
+			return err
+		}
+	}
+	for _, enum := range enums {
+		if err := d.readEnum(enum, scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMessage reads a DescriptorProto, including its nested messages and enums
+func (d *protoDescriptors) readMessage(descriptor []byte, scope string) error {
+	message := &protoMessage{fields: make(map[uint64]*protoField)}
+	var fields, nested, enums [][]byte
+	r := &protoReader{buf: descriptor}
+	for !r.done() {
+		number, wireType, err := r.key()
+		if err != nil {
+			return err
+		}
+		if wireType != protoLength {
+			if err = r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		switch number {
+		case 1:
+			message.name = scope + "." + string(b)
+		case 2:
+			fields = append(fields, b)
+		case 3:
+			nested = append(nested, b)
+		case 4:
+			enums = append(enums, b)
+		case 7:
+			message.mapEntry, err = readMapEntryOption(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if message.name == "" {
+		return errors.New("message descriptor has no name")
+	}
+	d.messages[message.name] = message
+
+	for _, b := range fields {
+		field, err := readField(b)
+		if err != nil {
+			return err
+		}
+		message.fields[field.number] = field
+		d.scopes[field] = message.name
+	}
+	for _, b := range nested {
+		if err := d.readMessage(b, message.name); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err := d.readEnum(b, message.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMapEntryOption looks for map_entry in a MessageOptions
+func readMapEntryOption(options []byte) (bool, error) {
+	mapEntry := false
+	r := &protoReader{buf: options}
+	for !r.done() {
+		number, wireType, err := r.key()
+		if err != nil {
+			return false, err
+		}
+		if number == 7 && wireType == protoVarint {
+			v, err := r.varint()
+			if err != nil {
+				return false, err
+			}
+			mapEntry = v != 0
+			continue
+		}
+		if err = r.skip(wireType); err != nil {
+			return false, err
+		}
+	}
+	return mapEntry, nil
+}
+
+// readField reads a FieldDescriptorProto
+func readField(descriptor []byte) (*protoField, error) {
+	field := &protoField{}
+	r := &protoReader{buf: descriptor}
+	for !r.done() {
+		number, wireType, err := r.key()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case wireType == protoLength && (number == 1 || number == 6):
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if number == 1 {
+				field.name = append([]byte(nil), b...)
+			} else {
+				field.typeName = string(b)
+			}
+		case wireType == protoVarint && (number == 3 || number == 4 || number == 5):
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			switch number {
+			case 3:
+				field.number = v
+			case 4:
+				field.repeated = v == protoLabelRepeated
+			case 5:
+				field.typ = v
+			}
+		default:
+			if err = r.skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(field.name) == 0 || field.number == 0 {
+		return nil, errors.New("field descriptor needs a name and a number")
+	}
+	return field, nil
+}
+
+// readEnum reads an EnumDescriptorProto
+func (d *protoDescriptors) readEnum(descriptor []byte, scope string) error {
+	enum := &protoEnum{values: make(map[int32][]byte)}
+	var name string
+	r := &protoReader{buf: descriptor}
+	for !r.done() {
+		number, wireType, err := r.key()
+		if err != nil {
+			return err
+		}
+		if wireType != protoLength || (number != 1 && number != 2) {
+			if err = r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		if number == 1 {
+			name = string(b)
+			continue
+		}
+		valueName, value, err := readEnumValue(b)
+		if err != nil {
+			return err
+		}
+		// with allow_alias, the first name is the one used
+		if _, ok := enum.values[value]; !ok {
+			enum.values[value] = quoted(valueName)
+		}
+	}
+	if name == "" {
+		return errors.New("enum descriptor has no name")
+	}
+	d.enums[scope+"."+name] = enum
+	return nil
+}
+
+// readEnumValue reads an EnumValueDescriptorProto
+func readEnumValue(descriptor []byte) ([]byte, int32, error) {
+	var name []byte
+	var value int32
+	r := &protoReader{buf: descriptor}
+	for !r.done() {
+		number, wireType, err := r.key()
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case number == 1 && wireType == protoLength:
+			name, err = r.bytes()
+		case number == 2 && wireType == protoVarint:
+			var v uint64
+			v, err = r.varint()
+			value = int32(v)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return name, value, nil
+}
+
+// resolve finds the messages and enums that fields refer to. protoc writes fully-qualified type names, but
+// other tools might not, in which case the name is looked up as protoc would, starting in the scope of the
+// field's message and working outwards.
+func (d *protoDescriptors) resolve() error {
+	for field, scope := range d.scopes {
+		if field.typeName == "" {
+			if field.typ == protoTypeMessage || field.typ == protoTypeEnum || field.typ == protoTypeGroup {
+				return fmt.Errorf("field %s in %s has no type name", field.name, scope)
+			}
+			continue
+		}
+		var candidates []string
+		if strings.HasPrefix(field.typeName, ".") {
+			candidates = []string{field.typeName}
+		} else {
+			for s := scope; ; s = s[:strings.LastIndex(s, ".")] {
+				candidates = append(candidates, s+"."+field.typeName)
+				if s == "" {
+					break
+				}
+			}
+		}
+		for _, candidate := range candidates {
+			if message, ok := d.messages[candidate]; ok {
+				field.message = message
+				if field.typ == 0 {
+					field.typ = protoTypeMessage
+				}
+				break
+			}
+			if enum, ok := d.enums[candidate]; ok {
+				field.enum = enum
+				if field.typ == 0 {
+					field.typ = protoTypeEnum
+				}
+				break
+			}
+		}
+		if field.message == nil && field.enum == nil {
+			return fmt.Errorf("type %s of field %s in %s not found", field.typeName, field.name, scope[1:])
+		}
+	}
+	return nil
+}
+
+// protoReader reads the protobuf wire format
+type protoReader struct {
+	buf   []byte
+	index int
+}
+
+func (r *protoReader) done() bool {
+	return r.index >= len(r.buf)
+}
+
+func (r *protoReader) key() (number uint64, wireType uint64, err error) {
+	k, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	number, wireType = k>>3, k&7
+	if number == 0 {
+		return 0, 0, r.error("field number 0")
+	}
+	return number, wireType, nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	var v uint64
+	for shift := 0; shift < 64; shift += 7 {
+		if r.index >= len(r.buf) {
+			return 0, r.error("truncated varint")
+		}
+		b := r.buf[r.index]
+		r.index++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, r.error("varint too long")
+}
+
+func (r *protoReader) fixed(size int) (uint64, error) {
+	if size > len(r.buf)-r.index {
+		return 0, r.error("truncated fixed-size value")
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(r.buf[r.index+i])
+	}
+	r.index += size
+	return v, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(r.buf)-r.index) {
+		return nil, r.error("length-delimited value runs past end")
+	}
+	b := r.buf[r.index : r.index+int(length)]
+	r.index += int(length)
+	return b, nil
+}
+
+// skip moves past a value of the given wire type, whose key has been read
+func (r *protoReader) skip(wireType uint64) error {
+	var err error
+	switch wireType {
+	case protoVarint:
+		_, err = r.varint()
+	case protoFixed64:
+		_, err = r.fixed(8)
+	case protoLength:
+		_, err = r.bytes()
+	case protoFixed32:
+		_, err = r.fixed(4)
+	case protoStartGroup:
+		for {
+			// protoc doesn't check that the end-group number matches, so we don't either
+			var groupWireType uint64
+			_, groupWireType, err = r.key()
+			if err != nil || groupWireType == protoEndGroup {
+				break
+			}
+			if err = r.skip(groupWireType); err != nil {
+				break
+			}
+		}
+	default:
+		err = r.error(fmt.Sprintf("unexpected wire type %d", wireType))
+	}
+	return err
+}
+
+func (r *protoReader) error(message string) error {
+	return fmt.Errorf("at offset %d in protobuf data: %s", r.index, message)
+}
@@ -1,12 +1,14 @@
 package quamina
 
 import (
+	"errors"
 	"sync"
 	"time"
 )
 
-// prunerStats reports basic counts to aid in deciding when to rebuildWhileLocked.
-type prunerStats struct {
+// PrunerStats reports basic counts, for instances that allow Patterns to be deleted, to aid in deciding when
+// to rebuild. The Quamina PrunerStats method returns them, and RebuildPolicy implementations are given them.
+type PrunerStats struct {
 	// Some of these values are ints instead of uints because Go
 	// likes to print uints in hex, and I'd like to see some
 	// temporary logging output in decimal.  ToDo: back to uints?
@@ -42,47 +44,56 @@ type prunerStats struct {
 
 // prunerMatcher provides DeletePattern on top of quamina.matcher.
 //
-// prunerMatcher maintains the set of live patterns, and it will rebuildWhileLocked the
-// underlying matcher synchronously periodically during standard
-// operations (addPattern, DeletePattern, MatchesForFields).
+// prunerMatcher maintains the set of live patterns, and it will rebuild the
+// underlying matcher periodically, in the background, when standard
+// operations (addPattern, DeletePattern, MatchesForFields) trigger it.
+// Matching carries on with the old matcher until the new one is ready.
 //
 // Roughly speaking, the current rebuildWhileLocked policy automatically rebuilds
 // the index when the ratio of filtered patterns to emitted patterns
 // exceeds 0.2 (and if there's been some traffic).
 //
 // An application can call rebuild to force a rebuildWhileLocked at any time.
-// See prunerStats() to obtain some useful statistics about the matcher.
+// See getStats() to obtain some useful statistics about the matcher.
 //
-// Eventually automatically-invoked rebuildWhileLocked policies might be
-// pluggable.
+// The policy that decides when to rebuild is pluggable; see RebuildPolicy.
 type prunerMatcher struct {
 	// Matcher is the underlying matcher that does the hard work.
 	Matcher *coreMatcher
 
 	// Maybe prunerMatcher should maybe not be embedded or public.
 
-	// live is live set of patterns.
+	// live is live set of patterns.  The pointer is protected by
+	// lock, since Load replaces it.
 	live LivePatternsState
 
-	stats prunerStats
+	stats PrunerStats
 
-	// rebuildTrigger, if not nil, determines when a mutation
+	// rebuildPolicy, if not nil, determines when a mutation
 	// triggers a rebuildWhileLocked.
 	//
 	// If nil, no automatic rebuild is ever triggered.
-	rebuildTrigger rebuildTrigger
+	rebuildPolicy RebuildPolicy
 
 	// lock protects the pointer the underlying Matcher as well as stats.
 	//
 	// The Matcher pointer is updated after a successful rebuild.
 	// Stats are updated by Add, Delete, and rebuild.
 	lock sync.RWMutex
+
+	// rebuilding, if not nil, is the background rebuild in progress.
+	// It's protected by lock.
+	rebuilding *backgroundRebuild
+
+	// canonicalizeNumbers is passed along to the coreMatchers
+	// built by rebuilds.
+	canonicalizeNumbers bool
 }
 
 var defaultRebuildTrigger = newTooMuchFiltering(0.2, 1000)
 
 // nolint:gofmt,goimports
-// tooMuchFiltering is the standard rebuildTrigger, which will fire
+// tooMuchFiltering is the standard rebuildPolicy, which will fire
 // when:
 //
 //	MinAction is less than the sum of counts of found and filtered
@@ -105,8 +116,15 @@ func newTooMuchFiltering(ratio float64, min int64) *tooMuchFiltering {
 	}
 }
 
-// TODO: Figure out how to expose this through the Quamina type
-func (t *tooMuchFiltering) rebuild(added bool, s *prunerStats) bool {
+// NewFilteringRebuildPolicy returns the RebuildPolicy that Quamina uses by default, with ratio 0.2 and minAction
+// 1000. It calls for a rebuild when, since the last one, matching has found more than minAction Patterns, and the
+// ratio of those filtered out because they'd been deleted to those returned is more than ratio. So it suits
+// instances that delete Patterns which are still being matched.
+func NewFilteringRebuildPolicy(ratio float64, minAction int64) RebuildPolicy {
+	return newTooMuchFiltering(ratio, minAction)
+}
+
+func (t *tooMuchFiltering) ShouldRebuild(added bool, s *PrunerStats) bool {
 	if added {
 		// No need to think when we're adding a pattern since
 		// that operation cannot result in an increase of
@@ -141,25 +159,26 @@ func (t *tooMuchFiltering) rebuild(added bool, s *prunerStats) bool {
 // disableRebuild will prevent any automatic rebuilds.
 func (m *prunerMatcher) disableRebuild() {
 	m.lock.Lock()
-	m.rebuildTrigger = nil
+	m.rebuildPolicy = nil
 	m.lock.Unlock()
 }
 
-// rebuildTrigger provides a way to control when rebuilds are
-// automatically triggered during standard operations.
+// RebuildPolicy provides a way to control when rebuilds are
+// automatically triggered during standard operations, in instances
+// that allow Patterns to be deleted; see WithRebuildPolicy.
 //
-// Currently an addPattern, deletePatterns, or matchesForFields can
-// trigger a rebuild.  When a rebuild is triggered, it's executed
-// synchronously: the the Add/Delete/Match method doesn't return until
-// the rebuild is complete.
-type rebuildTrigger interface {
-	// rebuild should return true to trigger a rebuild.
+// Currently AddPattern, DeletePatterns, or matching can trigger a
+// rebuild.  When a rebuild is triggered, it's started on another
+// goroutine, and the Add/Delete/Match method returns without waiting
+// for it.  While it's in progress, no more are triggered.
+type RebuildPolicy interface {
+	// ShouldRebuild should return true to trigger a rebuild.
 	//
-	// This method is called by AddPatter,deletePatterns, and
-	// matchesForFields.  added is true when called by addPattern;
-	// false otherwise. These methods currently do not return
-	// until the rebuild is complete, so beware.
-	rebuild(added bool, s *prunerStats) bool
+	// This method is called by AddPattern, DeletePatterns, and the
+	// matching methods, with a lock held that stops the others, so it
+	// should be quick and mustn't call the Quamina instance.  added is
+	// true when called by AddPattern; false otherwise.
+	ShouldRebuild(added bool, s *PrunerStats) bool
 }
 
 // newPrunerMatcher does what you'd expect.
@@ -171,53 +190,88 @@ func newPrunerMatcher(s LivePatternsState) *prunerMatcher {
 	}
 	trigger := *defaultRebuildTrigger // Copy
 	return &prunerMatcher{
-		Matcher:        newCoreMatcher(),
-		live:           s,
-		rebuildTrigger: &trigger,
+		Matcher:       newCoreMatcher(),
+		live:          s,
+		rebuildPolicy: &trigger,
 	}
 }
 
-// maybeRebuild calls rebuildTrigger and calls rebuildWhileLocked() if that
-// trigger said to do that.  If rebuildTrigger is nil, no rebuildWhileLocked is
-// executed.
+// maybeRebuild calls rebuildPolicy and starts a background rebuild if
+// that trigger said to do that and there isn't one in progress.  If
+// rebuildPolicy is nil, no rebuild is started.
 //
 // This method assumes the caller has a write lock.
 func (m *prunerMatcher) maybeRebuild(added bool) error {
-	if m.rebuildTrigger == nil {
+	if m.rebuildPolicy == nil || m.rebuilding != nil {
 		return nil
 	}
-	if m.rebuildTrigger.rebuild(added, &m.stats) {
-		return m.rebuildWhileLocked(added)
+	if m.rebuildPolicy.ShouldRebuild(added, &m.stats) {
+		m.startRebuildWhileLocked()
 	}
 
 	return nil
 }
 
+// current returns the underlying matcher, which a rebuild may replace at any time.
+func (m *prunerMatcher) current() *coreMatcher {
+	m.lock.RLock()
+	matcher := m.Matcher
+	m.lock.RUnlock()
+	return matcher
+}
+
+// currentWithLive returns the underlying matcher and the live set,
+// which Load may replace at any time.
+func (m *prunerMatcher) currentWithLive() (*coreMatcher, LivePatternsState) {
+	m.lock.RLock()
+	matcher, live := m.Matcher, m.live
+	m.lock.RUnlock()
+	return matcher, live
+}
+
 // addPattern calls the underlying quamina.coreMatcher.addPattern
-// method and then maybe rebuilds the index (if the addPattern
-// succeeded).
+// method, then adds the pattern to the live set, and then maybe
+// rebuilds the index (if both succeeded).
+//
+// If a background rebuild finished while the pattern was being added,
+// it's added to the new matcher.  If a background rebuild is in
+// progress, which may be another one that started after that, the
+// pattern is also passed to it, so that the matcher it's building has
+// it too.
+//
+// The pattern goes into the matcher first so that a pattern that
+// doesn't compile never reaches the live set.  If the live set's Add
+// fails, its error is returned and the pattern is not live, but it
+// stays in the matcher until the next rebuild.  Matches are filtered
+// by the live set, so that only matters if x has other live patterns.
 func (m *prunerMatcher) addPattern(x X, pat string) error {
-	var err error
-
-	// Do we m.live.Add first or do we m.prunerMatcher.addPattern first?
-	if err = m.Matcher.addPattern(x, pat); err == nil {
-		m.lock.Lock()
-		m.stats.Added++
-		m.stats.Live++
-		_ = m.maybeRebuild(true)
-		m.lock.Unlock()
-		err = m.live.Add(x, pat)
-		// ToDo: Contemplate what do to about an error here
-		// (or if we got an error from addPattern after we did
-		// live.Add.
+	matcher, live := m.currentWithLive()
+	if err := matcher.addPattern(x, pat); err != nil {
+		return err
+	}
+	if err := live.Add(x, pat); err != nil {
+		return err
 	}
 
-	return err
+	m.lock.Lock()
+	if m.Matcher != matcher {
+		// it compiled once, so it will again
+		_ = m.Matcher.addPattern(x, pat)
+	}
+	if m.rebuilding != nil {
+		m.rebuilding.pending = append(m.rebuilding.pending, pendingPattern{x, pat})
+		m.rebuilding.added++
+	}
+	m.stats.Added++
+	m.stats.Live++
+	_ = m.maybeRebuild(true)
+	m.lock.Unlock()
+	return nil
 }
 
 // MatchesForJSONEvent calls MatchesForFields with a new Flattener.
 func (m *prunerMatcher) MatchesForJSONEvent(event []byte) ([]X, error) {
-	fs, err := newJSONFlattener().Flatten(event, m.Matcher.fields().segmentsTree)
+	fs, err := newJSONFlattener().Flatten(event, m.current().fields().segmentsTree)
 	if err != nil {
 		return nil, err
 	}
@@ -228,7 +282,8 @@ func (m *prunerMatcher) MatchesForJSONEvent(event []byte) ([]X, error) {
 // quamina.coreMatcher.matchesForFields and then maybe rebuilds the
 // index.
 func (m *prunerMatcher) matchesForFields(fields []Field) ([]X, error) {
-	xs, err := m.Matcher.matchesForFields(fields)
+	matcher, live := m.currentWithLive()
+	xs, err := matcher.matchesForFields(fields)
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +294,7 @@ func (m *prunerMatcher) matchesForFields(fields []Field) ([]X, error) {
 
 	var emitted, filtered int64
 	for _, x := range xs {
-		have, err := m.live.Contains(x)
+		have, err := live.Contains(x)
 		if err != nil {
 			return nil, err
 		}
@@ -261,12 +316,17 @@ func (m *prunerMatcher) matchesForFields(fields []Field) ([]X, error) {
 }
 
 // DeletePattern removes the pattern from the index and maybe rebuilds
-// the index.
+// the index.  If the live set's Delete fails, its error is returned;
+// whether the patterns are still live is then up to the live set.
 func (m *prunerMatcher) deletePatterns(x X) error {
-	n, err := m.live.Delete(x)
+	_, live := m.currentWithLive()
+	n, err := live.Delete(x)
 	if err == nil {
 		if 0 < n {
 			m.lock.Lock()
+			if m.rebuilding != nil {
+				m.rebuilding.deleted += n
+			}
 			m.stats.Deleted += n
 			m.stats.Live -= n
 			_ = m.maybeRebuild(false)
@@ -277,12 +337,29 @@ func (m *prunerMatcher) deletePatterns(x X) error {
 	return err
 }
 
-// rebuild rebuilds the matcher state based on only live patterns.
+// rebuildAndWait cancels any background rebuild in progress, starts
+// another, and waits for it.  Unlike rebuild, it doesn't hold the lock
+// while the new matcher is built, so matching carries on meanwhile.
+// If the rebuild is cancelled before it's done, errRebuildCancelled
+// is returned.
+func (m *prunerMatcher) rebuildAndWait() error {
+	m.lock.Lock()
+	m.cancelRebuildWhileLocked()
+	m.startRebuildWhileLocked()
+	b := m.rebuilding
+	m.lock.Unlock()
+	<-b.done
+	return b.err
+}
+
+// rebuild rebuilds the matcher state based on only live patterns,
+// without waiting for, and cancelling, any background rebuild.  It
+// holds the lock throughout, so nothing can be matched meanwhile.
 //
 // If calling fearlessly, then the old matcher is released before
 // building the new one.
 //
-// This method resets the prunerStats.
+// This method resets the PrunerStats.
 func (m *prunerMatcher) rebuild(fearlessly bool) error {
 	m.lock.Lock()
 	err := m.rebuildWhileLocked(fearlessly)
@@ -295,11 +372,13 @@ func (m *prunerMatcher) rebuildWhileLocked(fearlessly bool) error {
 	// We assume we have the lock.
 
 	// Nothing fancy here now.
+	m.cancelRebuildWhileLocked()
 
 	var (
 		then = time.Now()
 		m1   = newCoreMatcher()
 	)
+	m1.canonicalizeNumbers = m.canonicalizeNumbers
 
 	if fearlessly {
 		// Let the GC reduce heap requirements?
@@ -321,6 +400,7 @@ func (m *prunerMatcher) rebuildWhileLocked(fearlessly bool) error {
 		m.stats.Live = count
 		m.stats.Added = 0
 		m.stats.Deleted = 0
+		m.stats.Emitted = 0
 		m.stats.Filtered = 0
 		m.stats.LastRebuilt = then
 		m.stats.RebuildDuration = time.Since(then)
@@ -329,9 +409,9 @@ func (m *prunerMatcher) rebuildWhileLocked(fearlessly bool) error {
 	return err
 }
 
-// prunerStats returns some statistics that might be helpful to rebuildWhileLocked
+// getStats returns some statistics that might be helpful to rebuild
 // policies.
-func (m *prunerMatcher) getStats() prunerStats {
+func (m *prunerMatcher) getStats() PrunerStats {
 	m.lock.RLock()
 	s := m.stats // Copies
 	m.lock.RUnlock()
@@ -339,5 +419,142 @@ func (m *prunerMatcher) getStats() prunerStats {
 }
 
 func (m *prunerMatcher) getSegmentsTreeTracker() SegmentsTreeTracker {
-	return m.Matcher.getSegmentsTreeTracker()
+	return m.current().getSegmentsTreeTracker()
+}
+
+var errRebuildCancelled = errors.New("rebuild cancelled")
+
+// backgroundRebuild is a rebuild running on its own goroutine.  It
+// builds a new coreMatcher from a snapshot of the live set, then adds
+// the patterns that were added while it was doing that, which
+// addPattern leaves in pending, and finally replaces the prunerMatcher's
+// Matcher.  Patterns deleted meanwhile need no attention, since the
+// live set filters them out of matches until the next rebuild.
+type backgroundRebuild struct {
+	// pending, added, and deleted are protected by the prunerMatcher's lock.
+	pending []pendingPattern
+	added   int
+	deleted int
+
+	started   time.Time
+	cancelled chan struct{}
+	done      chan struct{}
+	err       error // set before done is closed
+}
+
+type pendingPattern struct {
+	x       X
+	pattern string
+}
+
+// startRebuildWhileLocked starts a background rebuild.
+//
+// This method assumes the caller has a write lock.
+func (m *prunerMatcher) startRebuildWhileLocked() {
+	b := &backgroundRebuild{
+		started:   time.Now(),
+		cancelled: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	m.rebuilding = b
+	live := m.live
+	go func() {
+		b.err = m.rebuildInBackground(b, live)
+		close(b.done)
+	}()
+}
+
+func (m *prunerMatcher) rebuildInBackground(b *backgroundRebuild, live LivePatternsState) error {
+	// take the snapshot first, so the live set isn't held up while
+	// the patterns are compiled
+	var snapshot []pendingPattern
+	err := live.Iterate(func(x X, p string) error {
+		snapshot = append(snapshot, pendingPattern{x, p})
+		return nil
+	})
+	if err != nil {
+		m.abandonRebuild(b)
+		return err
+	}
+
+	m1 := newCoreMatcher()
+	m1.canonicalizeNumbers = m.canonicalizeNumbers
+	for {
+		for _, p := range snapshot {
+			select {
+			case <-b.cancelled:
+				return errRebuildCancelled
+			default:
+			}
+			if err = m1.addPattern(p.x, p.pattern); err != nil {
+				m.abandonRebuild(b)
+				return err
+			}
+		}
+
+		// keep going until nothing was added meanwhile, then switch
+		// while holding the lock, so nothing can be added in between
+		m.lock.Lock()
+		if m.rebuilding != b {
+			m.lock.Unlock()
+			return errRebuildCancelled
+		}
+		if len(b.pending) > 0 {
+			snapshot, b.pending = b.pending, nil
+			m.lock.Unlock()
+			continue
+		}
+		m.Matcher = m1
+		m.rebuilding = nil
+		m.stats.RebuildPurged = m.stats.Deleted - b.deleted
+		m.stats.Added = b.added
+		m.stats.Deleted = b.deleted
+		m.stats.Emitted = 0
+		m.stats.Filtered = 0
+		m.stats.LastRebuilt = b.started
+		m.stats.RebuildDuration = time.Since(b.started)
+		m.lock.Unlock()
+		return nil
+	}
+}
+
+// abandonRebuild forgets about a background rebuild that failed, so
+// that another can be triggered.
+func (m *prunerMatcher) abandonRebuild(b *backgroundRebuild) {
+	m.lock.Lock()
+	if m.rebuilding == b {
+		m.rebuilding = nil
+	}
+	m.lock.Unlock()
+}
+
+// waitForRebuild waits until the background rebuild in progress, if
+// there is one, has finished, and returns its error, which is
+// errRebuildCancelled if it was cancelled.
+func (m *prunerMatcher) waitForRebuild() error {
+	m.lock.RLock()
+	b := m.rebuilding
+	m.lock.RUnlock()
+	if b == nil {
+		return nil
+	}
+	<-b.done
+	return b.err
+}
+
+// cancelRebuild stops the background rebuild in progress, if there
+// is one, leaving the matcher as it was.  The goroutine that was doing
+// the rebuild may not have finished when this returns.
+func (m *prunerMatcher) cancelRebuild() {
+	m.lock.Lock()
+	m.cancelRebuildWhileLocked()
+	m.lock.Unlock()
+}
+
+// cancelRebuildWhileLocked is cancelRebuild but assumes having the lock.
+func (m *prunerMatcher) cancelRebuildWhileLocked() {
+	if m.rebuilding != nil {
+		close(m.rebuilding.cancelled)
+		m.rebuilding = nil
+	}
 }
@@ -145,6 +145,9 @@ func TestRebuildSome(t *testing.T) {
 		depopulate()
 		query(false)
 		m.printStats()
+		if err := m.waitForRebuild(); err != nil {
+			t.Fatal(err)
+		}
 		if s := m.getStats(); s.RebuildDuration == 0 {
 			t.Fatal(s)
 		}
@@ -169,6 +172,9 @@ func TestRebuildSome(t *testing.T) {
 		queryFast(false)
 		depopulate()
 		queryFast(false)
+		if err := m.waitForRebuild(); err != nil {
+			t.Fatal(err)
+		}
 		if s := m.getStats(); s.RebuildDuration == 0 {
 			t.Fatal(s)
 		}
@@ -178,7 +184,7 @@ func TestRebuildSome(t *testing.T) {
 func TestTriggerTooManyFilteredDenom(t *testing.T) {
 	// Verify that a zero denominator doesn't cause problems.
 	m := newPrunerMatcher(nil)
-	trigger := m.rebuildTrigger.(*tooMuchFiltering)
+	trigger := m.rebuildPolicy.(*tooMuchFiltering)
 	trigger.MinAction = 0
 
 	if err := m.addPattern(1, `{"likes":["tacos"]}`); err != nil {
@@ -199,7 +205,7 @@ func TestTriggerRebuild(t *testing.T) {
 	var (
 		then    = time.Now()
 		m       = newPrunerMatcher(nil)
-		trigger = m.rebuildTrigger.(*tooMuchFiltering)
+		trigger = m.rebuildPolicy.(*tooMuchFiltering)
 		n       = 10
 		doomed  = func(id int) bool {
 			return id%2 == 0
@@ -248,6 +254,11 @@ func TestTriggerRebuild(t *testing.T) {
 		}
 	}
 
+	// the rebuild happens in the background
+	if err := m.waitForRebuild(); err != nil {
+		t.Fatal(err)
+	}
+
 	// printState()
 	m.printStats()
 
@@ -269,6 +280,59 @@ func TestTriggerRebuild(t *testing.T) {
 	}
 }
 
+func TestTriggerRebuildAgain(t *testing.T) {
+	m := newPrunerMatcher(nil)
+	for i := 0; i < 10; i++ {
+		if err := m.addPattern(i, fmt.Sprintf(`{"n":[%d]}`, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// matchUntilRebuild matches until a rebuild starts, and says whether one did
+	matchUntilRebuild := func() bool {
+		for j := 0; j < 1000; j++ {
+			if _, err := m.MatchesForJSONEvent([]byte(fmt.Sprintf(`{"n":%d}`, j%10))); err != nil {
+				t.Fatal(err)
+			}
+			m.lock.RLock()
+			started := m.rebuilding != nil
+			m.lock.RUnlock()
+			if started {
+				return true
+			}
+		}
+		return false
+	}
+
+	// plenty of matching before the first rebuild mustn't count afterward
+	m.disableRebuild()
+	matchUntilRebuild()
+	if err := m.rebuild(false); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.getStats(); s.Emitted != 0 || s.Filtered != 0 {
+		t.Errorf("after rebuild: %#v", s)
+	}
+
+	m.lock.Lock()
+	m.rebuildPolicy = NewFilteringRebuildPolicy(0.1, 100)
+	m.lock.Unlock()
+	for round, deleted := range []int{0, 1} {
+		if err := m.deletePatterns(deleted); err != nil {
+			t.Fatal(err)
+		}
+		if !matchUntilRebuild() {
+			t.Fatalf("round %d: no rebuild, stats %#v", round, m.getStats())
+		}
+		if err := m.waitForRebuild(); err != nil {
+			t.Fatal(err)
+		}
+		if s := m.getStats(); s.Emitted != 0 || s.Filtered != 0 || s.RebuildPurged != 1 {
+			t.Errorf("round %d: after rebuild: %#v", round, s)
+		}
+	}
+}
+
 type badState struct {
 	err error
 }
@@ -337,7 +401,7 @@ func TestBadEvent(t *testing.T) {
 
 func TestUnsetRebuildTrigger(t *testing.T) {
 	m := newPrunerMatcher(&badState{})
-	m.rebuildTrigger = nil
+	m.rebuildPolicy = nil
 	if err := m.maybeRebuild(false); err != nil {
 		t.Fatal(err)
 	}
@@ -536,3 +600,249 @@ func getCityLotsLinesB(b *testing.B) [][]byte {
 }
 
 */
+
+func TestDeleteOrPattern(t *testing.T) {
+	m := newPrunerMatcher(nil)
+	if err := m.addPattern("or", `{"$or": [ {"a": [1]}, {"b": [2]} ] }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.addPattern("other", `{"a": [1]}`); err != nil {
+		t.Fatal(err)
+	}
+	xs, err := m.MatchesForJSONEvent([]byte(`{"a": 1, "b": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 2 {
+		t.Fatal(xs)
+	}
+	if err := m.deletePatterns("or"); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []string{`{"a": 1}`, `{"b": 2}`} {
+		xs, err = m.MatchesForJSONEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if containsX(xs, "or") {
+			t.Fatalf("%s matched deleted pattern", event)
+		}
+	}
+	if err := m.rebuild(false); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.getStats(); s.Live != 1 {
+		t.Fatal(s.Live)
+	}
+}
+
+// gatedState is a memState whose Iterate, once it has been through the
+// patterns, signals on iterated, if that's set, and waits for gate to be
+// closed, so that a test can act while a background rebuild is in
+// progress.  beforeAdd, if set, is called by Add before the pattern is
+// added, so that a test can act in the middle of addPattern.
+type gatedState struct {
+	*memState
+	gate      chan struct{}
+	iterated  chan struct{}
+	beforeAdd func()
+}
+
+func (s *gatedState) Iterate(f func(x X, pattern string) error) error {
+	err := s.memState.Iterate(f)
+	if s.iterated != nil {
+		s.iterated <- struct{}{}
+	}
+	<-s.gate
+	return err
+}
+
+func (s *gatedState) Add(x X, pattern string) error {
+	if s.beforeAdd != nil {
+		s.beforeAdd()
+	}
+	return s.memState.Add(x, pattern)
+}
+
+func TestBackgroundRebuild(t *testing.T) {
+	state := &gatedState{memState: newMemState(), gate: make(chan struct{})}
+	m := newPrunerMatcher(state)
+	m.rebuildPolicy = nil
+	for _, x := range []string{"tacos", "queso", "chips"} {
+		if err := m.addPattern(x, fmt.Sprintf(`{"likes":["%s"]}`, x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = m.deletePatterns("chips")
+
+	m.lock.Lock()
+	m.startRebuildWhileLocked()
+	old := m.Matcher
+	m.lock.Unlock()
+
+	// matching, adding, and deleting carry on while the rebuild is waiting
+	if err := m.addPattern("salsa", `{"likes":["salsa"]}`); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.deletePatterns("queso")
+	for likes, wanted := range map[string]int{"tacos": 1, "queso": 0, "chips": 0, "salsa": 1} {
+		got, err := m.MatchesForJSONEvent([]byte(fmt.Sprintf(`{"likes":"%s"}`, likes)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != wanted {
+			t.Errorf("during rebuild, %s: %v", likes, got)
+		}
+	}
+
+	close(state.gate)
+	if err := m.waitForRebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Matcher == old {
+		t.Fatal("matcher not replaced")
+	}
+	for likes, wanted := range map[string]int{"tacos": 1, "queso": 0, "chips": 0, "salsa": 1} {
+		got, _ := m.MatchesForJSONEvent([]byte(fmt.Sprintf(`{"likes":"%s"}`, likes)))
+		if len(got) != wanted {
+			t.Errorf("after rebuild, %s: %v", likes, got)
+		}
+	}
+
+	// chips was deleted before the rebuild, so it's gone; queso was deleted during it, so it isn't
+	s := m.getStats()
+	if s.RebuildPurged != 1 || s.Deleted != 1 || s.Added != 1 || s.Live != 2 || s.RebuildDuration == 0 {
+		t.Errorf("stats: %#v", s)
+	}
+	if err := s.sane(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddBetweenRebuilds(t *testing.T) {
+	state := &gatedState{memState: newMemState(), gate: make(chan struct{})}
+	close(state.gate)
+	m := newPrunerMatcher(state)
+	m.rebuildPolicy = nil
+	if err := m.addPattern("tacos", `{"likes":["tacos"]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// after addPattern has picked its matcher, one rebuild replaces it, and
+	// another starts and takes its snapshot before the pattern is live
+	var second *backgroundRebuild
+	state.beforeAdd = func() {
+		state.beforeAdd = nil
+		m.lock.Lock()
+		m.startRebuildWhileLocked()
+		m.lock.Unlock()
+		if err := m.waitForRebuild(); err != nil {
+			t.Error(err)
+		}
+		state.gate = make(chan struct{})
+		state.iterated = make(chan struct{})
+		m.lock.Lock()
+		m.startRebuildWhileLocked()
+		second = m.rebuilding
+		m.lock.Unlock()
+		<-state.iterated
+	}
+	if err := m.addPattern("salsa", `{"likes":["salsa"]}`); err != nil {
+		t.Fatal(err)
+	}
+	close(state.gate)
+	<-second.done
+	if second.err != nil {
+		t.Fatal(second.err)
+	}
+	for _, likes := range []string{"tacos", "salsa"} {
+		got, _ := m.MatchesForJSONEvent([]byte(fmt.Sprintf(`{"likes":"%s"}`, likes)))
+		if len(got) != 1 {
+			t.Errorf("after rebuilds, %s: %v", likes, got)
+		}
+	}
+}
+
+func TestCancelRebuild(t *testing.T) {
+	state := &gatedState{memState: newMemState(), gate: make(chan struct{})}
+	m := newPrunerMatcher(state)
+	_ = m.addPattern(1, `{"likes":["tacos"]}`)
+
+	m.lock.Lock()
+	m.startRebuildWhileLocked()
+	b := m.rebuilding
+	old := m.Matcher
+	m.lock.Unlock()
+	m.cancelRebuild()
+	if err := m.waitForRebuild(); err != nil {
+		t.Errorf("waiting with no rebuild: %s", err)
+	}
+	close(state.gate)
+	<-b.done
+	if b.err != errRebuildCancelled {
+		t.Errorf("got %v", b.err)
+	}
+	if m.Matcher != old {
+		t.Error("cancelled rebuild replaced the matcher")
+	}
+
+	// a failed rebuild leaves the matcher alone too, and makes way for another
+	failing := newPrunerMatcher(&badState{err: errBadState})
+	failing.lock.Lock()
+	failing.startRebuildWhileLocked()
+	failing.lock.Unlock()
+	if err := failing.waitForRebuild(); err != errBadState {
+		t.Errorf("got %v", err)
+	}
+	if failing.rebuilding != nil {
+		t.Error("failed rebuild still in progress")
+	}
+}
+
+func TestConcurrentRebuilds(t *testing.T) {
+	q, err := New(WithPatternDeletion(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := q.matcher.(*prunerMatcher)
+	trigger := m.rebuildPolicy.(*tooMuchFiltering)
+	trigger.MinAction = 10
+	trigger.FilteredToEmitted = 0.1
+
+	const n = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			_ = q.AddPattern(i, fmt.Sprintf(`{"n":[%d]}`, i))
+			if i%2 == 0 {
+				_ = q.DeletePatterns(i)
+			}
+		}
+	}()
+	matcher := q.Copy()
+	for adding := true; adding; {
+		select {
+		case <-done:
+			adding = false
+		default:
+		}
+		for i := 0; i < n; i++ {
+			if _, err := matcher.MatchesForEvent([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := q.WaitForRebuild(); err != nil && err != errRebuildCancelled {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		got, _ := q.MatchesForEvent([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+		if wanted := i % 2; len(got) != wanted {
+			t.Errorf("%d: %v", i, got)
+		}
+	}
+	if m.getStats().LastRebuilt.IsZero() {
+		t.Error("no rebuild happened")
+	}
+}
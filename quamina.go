@@ -3,17 +3,28 @@ package quamina
 import (
 	"errors"
 	"fmt"
+	"net/http"
 )
 
 // Quamina instances provide the public APIs of this pattern-matching library.  A single Quamina instance is
 // not thread-safe in that it cannot safely be used simultaneously in multiple goroutines. To re-use a
 // Quamina instance concurrently in multiple goroutines, create copies using the Copy API.
 type Quamina struct {
-	flattener          Flattener
-	matcher            matcher
-	flattenerSpecified bool
-	mediaTypeSpecified bool
-	deletionSpecified  bool
+	flattener                       Flattener
+	matcher                         matcher
+	flattenerSpecified              bool
+	mediaTypeSpecified              bool
+	deletionSpecified               bool
+	patternDeletion                 bool
+	numberCanonicalizationSpecified bool
+	canonicalizeNumbers             bool
+	yamlPatterns                    bool
+	valueFlattener                  *flattenValue
+	requestFlattener                *flattenRequest
+	cloudEventFlattener             *flattenCloudEvent
+	patternStorage                  LivePatternsState
+	rebuildPolicy                   RebuildPolicy
+	maxRequestBodySize              int64
 }
 
 // Option is an interface type used in Quamina's New API to pass in options. By convention, Option names
@@ -21,6 +32,7 @@ type Quamina struct {
 type Option func(q *Quamina) error
 
 // WithMediaType provides a media-type to support the selection of an appropriate Flattener.
+// For "application/yaml", Patterns may also be written in YAML.
 // This option call may not be provided more than once, nor can it be combined on the same
 // invocation of quamina.New() with the WithFlattener() option.
 func WithMediaType(mediaType string) Option {
@@ -34,6 +46,17 @@ func WithMediaType(mediaType string) Option {
 		switch mediaType {
 		case "application/json":
 			q.flattener = newJSONFlattener()
+		case "application/cbor":
+			q.flattener = newCBORFlattener()
+		case "application/msgpack":
+			q.flattener = newMsgpackFlattener()
+		case "application/yaml":
+			q.flattener = newYAMLFlattener()
+			q.yamlPatterns = true
+		case "application/xml":
+			q.flattener = newXMLFlattener()
+		case cloudEventsMediaType:
+			q.flattener = newCloudEventFlattener()
 		default:
 			return fmt.Errorf(`media type "%s" is not supported by Quamina`, mediaType)
 		}
@@ -69,26 +92,83 @@ func WithPatternDeletion(b bool) Option {
 		if q.deletionSpecified {
 			return errors.New("pattern deletion already specified")
 		}
-		if b {
-			q.matcher = newPrunerMatcher(nil)
-		} else {
-			q.matcher = newCoreMatcher()
-		}
+		q.patternDeletion = b
 		q.deletionSpecified = true
 		return nil
 	}
 }
 
+// WithNumberCanonicalization arranges, if the argument is true, that numbers in Patterns and Events are
+// compared by value rather than by their textual form, so that for example 35, 35.000, and 3.5e1 all match
+// each other. This is not free; it increases the cost of flattening and matching numbers in Events. This option
+// call may not be provided more than once.
+func WithNumberCanonicalization(b bool) Option {
+	return func(q *Quamina) error {
+		if q.numberCanonicalizationSpecified {
+			return errors.New("number canonicalization already specified")
+		}
+		q.canonicalizeNumbers = b
+		q.numberCanonicalizationSpecified = true
+		return nil
+	}
+}
+
 // WithPatternStorage supplies the Quamina instance with a LivePatternState
 // instance to be used to store the active patterns, i.e. those that have been
-// added with AddPattern but not deleted with DeletePattern. This option call
-// may not be provided more than once.
+// added with AddPattern but not deleted with DeletePattern. It implies
+// WithPatternDeletion(true), and can't be combined with WithPatternDeletion(false).
+// Any patterns already in the storage are added to the new instance by New, so
+// a persistent LivePatternState lets a set of patterns survive restarts. If the
+// storage fails to add a pattern, AddPattern returns its error and the pattern
+// isn't live, though if its X has other live patterns it may still match until
+// the next rebuild, see Rebuild; if the storage fails to delete, DeletePatterns
+// returns its error. This option call may not be provided more than once.
 func WithPatternStorage(ps LivePatternsState) Option {
 	return func(q *Quamina) error {
 		if ps == nil {
 			return errors.New("null PatternStorage")
 		}
-		return errors.New(" Pattern storage option not implemented yet")
+		if q.patternStorage != nil {
+			return errors.New("pattern storage specified more than once")
+		}
+		q.patternStorage = ps
+		return nil
+	}
+}
+
+// WithRebuildPolicy supplies the policy that decides when a Quamina instance that allows Patterns to be deleted
+// rebuilds its automaton to get rid of them, which happens in the background. The default is
+// NewFilteringRebuildPolicy(0.2, 1000); NewDeletionRatioRebuildPolicy, NewDeletionCountRebuildPolicy,
+// NewIntervalRebuildPolicy, and NewNeverRebuildPolicy provide others, or you can implement RebuildPolicy yourself.
+// It implies WithPatternDeletion(true), and can't be combined with WithPatternDeletion(false). This option call
+// may not be provided more than once.
+func WithRebuildPolicy(p RebuildPolicy) Option {
+	return func(q *Quamina) error {
+		if p == nil {
+			return errors.New("nil RebuildPolicy")
+		}
+		if q.rebuildPolicy != nil {
+			return errors.New("rebuild policy specified more than once")
+		}
+		q.rebuildPolicy = p
+		return nil
+	}
+}
+
+// WithMaxRequestBodySize sets the size, in bytes, of the biggest request body that MatchesForRequest,
+// MatchesForCloudEvent, and Middleware will read. If a Pattern needs the body of a request and it's bigger than
+// this, matching the request is an error. The default is 10 MiB. This option call may not be provided more than
+// once.
+func WithMaxRequestBodySize(n int64) Option {
+	return func(q *Quamina) error {
+		if n <= 0 {
+			return errors.New("maximum request body size must be positive")
+		}
+		if q.maxRequestBodySize != 0 {
+			return errors.New("maximum request body size specified more than once")
+		}
+		q.maxRequestBodySize = n
+		return nil
 	}
 }
 
@@ -104,8 +184,44 @@ func New(opts ...Option) (*Quamina, error) {
 	if !(q.mediaTypeSpecified || q.flattenerSpecified) {
 		q.flattener = newJSONFlattener()
 	}
-	if !q.deletionSpecified {
-		q.matcher = newCoreMatcher()
+	if q.maxRequestBodySize == 0 {
+		q.maxRequestBodySize = defaultMaxRequestBodySize
+	}
+	if q.patternStorage != nil {
+		if q.deletionSpecified && !q.patternDeletion {
+			return nil, errors.New("pattern storage requires pattern deletion")
+		}
+		q.patternDeletion = true
+	}
+	if q.rebuildPolicy != nil {
+		if q.deletionSpecified && !q.patternDeletion {
+			return nil, errors.New("rebuild policy requires pattern deletion")
+		}
+		q.patternDeletion = true
+	}
+	if q.patternDeletion {
+		pm := newPrunerMatcher(q.patternStorage)
+		pm.canonicalizeNumbers = q.canonicalizeNumbers
+		pm.Matcher.canonicalizeNumbers = q.canonicalizeNumbers
+		if q.rebuildPolicy != nil {
+			pm.rebuildPolicy = q.rebuildPolicy
+		}
+		if q.patternStorage != nil {
+			// a rebuild adds the patterns that are already in the storage
+			if err := pm.rebuild(true); err != nil {
+				return nil, fmt.Errorf("loading stored patterns: %w", err)
+			}
+		}
+		q.matcher = pm
+	} else {
+		cm := newCoreMatcher()
+		cm.canonicalizeNumbers = q.canonicalizeNumbers
+		q.matcher = cm
+	}
+
+	// the built-in flatteners can canonicalize numbers as they read them, which saves the matcher the trouble
+	if nc, ok := q.flattener.(numberCanonicalizer); ok {
+		nc.setCanonicalizeNumbers(q.canonicalizeNumbers)
 	}
 	return &q, nil
 }
@@ -114,7 +230,8 @@ func New(opts ...Option) (*Quamina, error) {
 // goroutines.  Copy'ed instances share the same underlying data structures, so a pattern added to any instance
 // with AddPattern will be visible in all of them.
 func (q *Quamina) Copy() *Quamina {
-	return &Quamina{matcher: q.matcher, flattener: q.flattener.Copy()}
+	return &Quamina{matcher: q.matcher, flattener: q.flattener.Copy(), canonicalizeNumbers: q.canonicalizeNumbers,
+		yamlPatterns: q.yamlPatterns, maxRequestBodySize: q.maxRequestBodySize}
 }
 
 // X is used in the AddPattern and MatchesForEvent APIs to identify the patterns that are added to
@@ -123,11 +240,19 @@ func (q *Quamina) Copy() *Quamina {
 type X any
 
 // AddPattern adds a pattern, identified by the x argument, to a Quamina instance.
-// patternJSON is a JSON object. error is returned in the case that the PatternJSON is invalid JSON or
-// has a leaf which is not provided as an array. AddPattern is single-threaded; if it is invoked concurrently
-// from multiple goroutines (in instances created using the Copy method) calls will block until any other
-// AddPattern call in progress succeeds.
+// patternJSON is a JSON object, or, if the instance was created with the "application/yaml" media type, a
+// YAML mapping, which is converted to JSON; since JSON is YAML too, JSON Patterns still work. error is returned
+// in the case that the PatternJSON is invalid JSON or has a leaf which is not provided as an array. AddPattern
+// is single-threaded; if it is invoked concurrently from multiple goroutines (in instances created using the Copy
+// method) calls will block until any other AddPattern call in progress succeeds.
 func (q *Quamina) AddPattern(x X, patternJSON string) error {
+	if q.yamlPatterns {
+		converted, err := yamlToJSON([]byte(patternJSON))
+		if err != nil {
+			return err
+		}
+		patternJSON = string(converted)
+	}
 	return q.matcher.addPattern(x, patternJSON)
 }
 
@@ -137,6 +262,47 @@ func (q *Quamina) DeletePatterns(x X) error {
 	return q.matcher.deletePatterns(x)
 }
 
+// Rebuild rebuilds the automaton of an instance that allows Patterns to be deleted, from its live Patterns, so
+// that the deleted ones no longer take up space or time. Like the rebuilds that its RebuildPolicy calls for, it
+// happens in the background, so matching carries on with the old automaton meanwhile, but it doesn't return until
+// it's done. It cancels any rebuild in progress. error is returned in the case that the Patterns can't be read from
+// its storage, see WithPatternStorage, or that the rebuild was cancelled by CancelRebuild or another Rebuild. For
+// other instances, it does nothing.
+func (q *Quamina) Rebuild() error {
+	if pm, ok := q.matcher.(*prunerMatcher); ok {
+		return pm.rebuildAndWait()
+	}
+	return nil
+}
+
+// PrunerStats returns the statistics, such as the numbers of live and deleted Patterns, that an instance that
+// allows Patterns to be deleted keeps to help decide when to rebuild. For other instances, they're all zero.
+func (q *Quamina) PrunerStats() PrunerStats {
+	if pm, ok := q.matcher.(*prunerMatcher); ok {
+		return pm.getStats()
+	}
+	return PrunerStats{}
+}
+
+// WaitForRebuild waits until the rebuild in progress, if any, has finished. Instances that allow Patterns to be
+// deleted rebuild their automaton from time to time to get rid of the deleted ones; this happens in the background,
+// while matching continues with the old automaton. error is returned in the case that the rebuild failed or was
+// cancelled, in which case the old automaton remains in use.
+func (q *Quamina) WaitForRebuild() error {
+	if pm, ok := q.matcher.(*prunerMatcher); ok {
+		return pm.waitForRebuild()
+	}
+	return nil
+}
+
+// CancelRebuild stops the rebuild in progress, if any, leaving the old automaton in use. Another rebuild may be
+// started the next time one is called for.
+func (q *Quamina) CancelRebuild() {
+	if pm, ok := q.matcher.(*prunerMatcher); ok {
+		pm.cancelRebuild()
+	}
+}
+
 // MatchesForEvent returns a slice of X values which identify patterns that have previously been added to this
 // Quamina instance and which “match” the event in the sense described in README. The matches slice may be empty
 // if no patterns match. error can be returned in case that the event is not a valid JSON object or contains
@@ -149,3 +315,56 @@ func (q *Quamina) MatchesForEvent(event []byte) ([]X, error) {
 	matches, err := q.matcher.matchesForFields(fields)
 	return matches, err
 }
+
+// MatchesForValue is like MatchesForEvent, but for an event that has already been decoded into a Go value, which
+// saves marshaling it to JSON. v must be a map or struct, or a pointer to one, and is matched as if it were the JSON
+// that encoding/json would produce from it, so struct fields are named according to their json tags. error is
+// returned in the case that v isn't an object or contains values that have no JSON form, such as channels.
+func (q *Quamina) MatchesForValue(v any) ([]X, error) {
+	if q.valueFlattener == nil {
+		q.valueFlattener = newValueFlattener(q.canonicalizeNumbers)
+	}
+	fields, err := q.valueFlattener.flatten(v, q.matcher.getSegmentsTreeTracker())
+	if err != nil {
+		return nil, err
+	}
+	return q.matcher.matchesForFields(fields)
+}
+
+// MatchesForRequest is like MatchesForEvent, but for an HTTP request, which is matched as if it were a JSON object
+// with the members "method", "path", "headers", "query", and "body". Header names are lower-cased, and headers and
+// query parameters are arrays of strings. The body is only read if a Pattern mentions it, in which case it has to
+// be a JSON object, and it's replaced with a copy so that handlers can still read it. error is returned in the
+// case that a value that's needed isn't valid UTF-8, or the body is needed and can't be read, is bigger than
+// WithMaxRequestBodySize allows, or isn't valid JSON.
+func (q *Quamina) MatchesForRequest(r *http.Request) ([]X, error) {
+	if q.requestFlattener == nil {
+		q.requestFlattener = newRequestFlattener(q.canonicalizeNumbers)
+		q.requestFlattener.maxBodySize = q.maxRequestBodySize
+	}
+	fields, err := q.requestFlattener.flatten(r, q.matcher.getSegmentsTreeTracker())
+	if err != nil {
+		return nil, err
+	}
+	return q.matcher.matchesForFields(fields)
+}
+
+// MatchesForCloudEvent is like MatchesForRequest, but for an HTTP request carrying a CloudEvent, in either binary
+// mode, where the context attributes are in "ce-" headers and the body is the data, or structured mode, where the
+// body is the event in the JSON format and the Content-Type is "application/cloudevents+json". Either way, the
+// request is matched as if it were the event in the JSON format, with the data in "data", where Patterns can reach
+// into it if it's JSON. The body is only read if it's needed, and it's replaced with a copy so that handlers can
+// still read it. error is returned in the case that the body can't be read or is bigger than WithMaxRequestBodySize
+// allows, or, in structured mode, isn't valid.
+func (q *Quamina) MatchesForCloudEvent(r *http.Request) ([]X, error) {
+	if q.cloudEventFlattener == nil {
+		q.cloudEventFlattener = newCloudEventFlattener().(*flattenCloudEvent)
+		q.cloudEventFlattener.setCanonicalizeNumbers(q.canonicalizeNumbers)
+		q.cloudEventFlattener.maxBodySize = q.maxRequestBodySize
+	}
+	fields, err := q.cloudEventFlattener.flattenRequest(r, q.matcher.getSegmentsTreeTracker())
+	if err != nil {
+		return nil, err
+	}
+	return q.matcher.matchesForFields(fields)
+}
@@ -96,6 +96,118 @@ func TestNewQOptions(t *testing.T) {
 	}
 }
 
+// failingState is a LivePatternsState whose Add and Iterate fail when it's told to
+type failingState struct {
+	*memState
+	failAdd     bool
+	failIterate bool
+}
+
+func (s *failingState) Add(x X, pattern string) error {
+	if s.failAdd {
+		return errBadState
+	}
+	return s.memState.Add(x, pattern)
+}
+
+func (s *failingState) Iterate(f func(x X, pattern string) error) error {
+	if s.failIterate {
+		return errBadState
+	}
+	return s.memState.Iterate(f)
+}
+
+func TestPatternStorage(t *testing.T) {
+	storage := newMemState()
+	q, err := New(WithPatternStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.matcher.(*prunerMatcher); !ok {
+		t.Error("storage without a pruner matcher")
+	}
+	for x, p := range map[X]string{"queso": `{"likes": ["queso"]}`, "tacos": `{"likes": ["tacos"]}`} {
+		if err = q.AddPattern(x, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = q.DeletePatterns("tacos"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new instance with the same storage, as after a restart, starts with the live patterns
+	restarted, err := New(WithPatternStorage(storage), WithNumberCanonicalization(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for event, wanted := range map[string]int{`{"likes": "queso"}`: 1, `{"likes": "tacos"}`: 0} {
+		matches, err := restarted.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != wanted {
+			t.Errorf("%s: got %v", event, matches)
+		}
+	}
+
+	if _, err = New(WithPatternStorage(storage), WithPatternStorage(storage)); err == nil {
+		t.Error("allowed 2 pattern storages")
+	}
+	if _, err = New(WithPatternStorage(storage), WithPatternDeletion(false)); err == nil {
+		t.Error("allowed pattern storage without deletion")
+	}
+	if _, err = New(WithPatternDeletion(true), WithPatternStorage(storage)); err != nil {
+		t.Error("pattern storage with deletion: " + err.Error())
+	}
+}
+
+func TestPatternStorageFailures(t *testing.T) {
+	storage := &failingState{memState: newMemState(), failIterate: true}
+	if err := storage.Add("x", `{"a": [1]}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(WithPatternStorage(storage)); err == nil {
+		t.Error("didn't report failure to load patterns")
+	}
+	storage.failIterate = false
+
+	q, err := New(WithPatternStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.failAdd = true
+	if err = q.AddPattern("x", `{"a": [2]}`); err == nil {
+		t.Error("didn't report failure to store pattern")
+	}
+	if err = q.AddPattern("y", `{"a": [3]}`); err == nil {
+		t.Error("didn't report failure to store pattern")
+	}
+	storage.failAdd = false
+
+	// a pattern that wasn't stored doesn't match, but one whose X has other patterns that were does until a rebuild
+	for event, wanted := range map[string]int{`{"a": 1}`: 1, `{"a": 2}`: 1, `{"a": 3}`: 0} {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != wanted {
+			t.Errorf("%s: got %v", event, matches)
+		}
+	}
+	if err = q.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	for event, wanted := range map[string]int{`{"a": 1}`: 1, `{"a": 2}`: 0, `{"a": 3}`: 0} {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != wanted {
+			t.Errorf("%s: got %v", event, matches)
+		}
+	}
+}
+
 // reduced to allow unit tests in slow GitHub actions to pass
 // const thresholdPerformance = 120000.0
 const thresholdPerformance = 1.0
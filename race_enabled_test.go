@@ -0,0 +1,7 @@
+//go:build race
+
+package quamina
+
+// raceEnabled says whether the race detector is on, which makes sync.Pool drop things on purpose, so
+// allocation counts are unreliable
+const raceEnabled = true
@@ -1,15 +1,13 @@
 package quamina
 
-// This file contains some experimental rebuildWhileLocked policies that are not
-// currently used anywhere.  Here just for examples and possible
-// future use.
+import "time"
+
+// This file contains the RebuildPolicy implementations other than the
+// default, which is tooMuchFiltering.
 
 // liveRatioTrigger's rebuild function returns true when there are at
-// least MinLive live patterns and the ratio of removed to live
-// patterns is greater than 1.
-//
-// This type is not used anywhere; just here as an example and maybe
-// for future consideration.
+// least MinLive live patterns and the ratio of deleted to live
+// patterns is at least Ratio.
 type liveRatioTrigger struct {
 	Ratio   float64
 	MinLive int
@@ -22,11 +20,20 @@ func newLiveRatioTrigger(ratio float64, min int) *liveRatioTrigger {
 	}
 }
 
-func (t *liveRatioTrigger) rebuild(added bool, s *prunerStats) bool {
+// NewDeletionRatioRebuildPolicy returns a RebuildPolicy that calls for a rebuild when there are at least minLive
+// live Patterns and the ratio of the Patterns deleted since the last rebuild to those that are live is at least
+// ratio. Unlike the default, it doesn't depend on deleted Patterns being matched, so it keeps the automaton from
+// filling up with deleted Patterns that aren't.
+func NewDeletionRatioRebuildPolicy(ratio float64, minLive int) RebuildPolicy {
+	return newLiveRatioTrigger(ratio, minLive)
+}
+
+func (t *liveRatioTrigger) ShouldRebuild(added bool, s *PrunerStats) bool {
 	if added {
 		return false
 	}
-	live := s.Live - s.Deleted
+	// Live is already net of deletions
+	live := s.Live
 	if live == 0 {
 		return false
 	}
@@ -36,18 +43,63 @@ func (t *liveRatioTrigger) rebuild(added bool, s *prunerStats) bool {
 	return t.Ratio <= float64(s.Deleted)/float64(live)
 }
 
-// neverTrigger is a rebuildTrigger that will never trigger a rebuild.
-//
-// Setting prunerMatcher.rebuildTrigger to nil will have the same effect.
+// deletedCountTrigger's rebuild function returns true when at least
+// Deleted patterns have been deleted since the last rebuild.
+type deletedCountTrigger struct {
+	Deleted int
+}
+
+// NewDeletionCountRebuildPolicy returns a RebuildPolicy that calls for a rebuild when at least deleted Patterns
+// have been deleted since the last rebuild.
+func NewDeletionCountRebuildPolicy(deleted int) RebuildPolicy {
+	return &deletedCountTrigger{Deleted: deleted}
+}
+
+func (t *deletedCountTrigger) ShouldRebuild(added bool, s *PrunerStats) bool {
+	return !added && s.Deleted > 0 && s.Deleted >= t.Deleted
+}
+
+// intervalTrigger's rebuild function returns true when patterns have
+// been deleted and at least Interval has passed since the last
+// rebuild, or since it was created if there hasn't been one.
+type intervalTrigger struct {
+	Interval time.Duration
+	created  time.Time
+}
+
+// NewIntervalRebuildPolicy returns a RebuildPolicy that calls for a rebuild when Patterns have been deleted and
+// at least interval has passed since the last rebuild, or since the policy was created if there hasn't been one.
+// Since rebuilds are only triggered by AddPattern, DeletePatterns, and matching, an idle instance isn't rebuilt.
+func NewIntervalRebuildPolicy(interval time.Duration) RebuildPolicy {
+	return &intervalTrigger{Interval: interval, created: time.Now()}
+}
+
+func (t *intervalTrigger) ShouldRebuild(added bool, s *PrunerStats) bool {
+	if added || s.Deleted == 0 {
+		return false
+	}
+	last := s.LastRebuilt
+	if last.Before(t.created) {
+		last = t.created
+	}
+	return time.Since(last) >= t.Interval
+}
+
+// neverTrigger is a RebuildPolicy that will never trigger a rebuild.
 //
-// This type is not used anywhere; just here as an example and maybe
-// for future consideration.
+// Setting prunerMatcher.rebuildPolicy to nil will have the same effect.
 type neverTrigger struct{}
 
 func newNeverTrigger() *neverTrigger {
 	return &neverTrigger{}
 }
 
-func (t *neverTrigger) rebuild(added bool, s *prunerStats) bool {
+// NewNeverRebuildPolicy returns a RebuildPolicy that never calls for a rebuild, so that rebuilds only happen
+// when the Quamina Rebuild method is called.
+func NewNeverRebuildPolicy() RebuildPolicy {
+	return newNeverTrigger()
+}
+
+func (t *neverTrigger) ShouldRebuild(added bool, s *PrunerStats) bool {
 	return false
 }
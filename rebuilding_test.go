@@ -3,63 +3,64 @@ package quamina
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestLiveRatioTrigger(t *testing.T) {
 	r := newLiveRatioTrigger(0.5, 2)
 
-	s := &prunerStats{}
+	s := &PrunerStats{}
 
-	if r.rebuild(false, s) {
+	if r.ShouldRebuild(false, s) {
 		t.Fatal("shouldn't have fired")
 	}
 
 	s.Live = 5
 	s.Deleted = 3
 
-	if r.rebuild(true, s) {
+	if r.ShouldRebuild(true, s) {
 		t.Fatal("shouldn't have fired")
 	}
 
-	if !r.rebuild(false, s) {
+	if !r.ShouldRebuild(false, s) {
 		t.Fatal("should have fired")
 	}
 
 	s.Live = 1
-	if r.rebuild(false, s) {
+	if r.ShouldRebuild(false, s) {
 		t.Fatal("shouldn't have fired")
 	}
 }
 
 func TestNeverTrigger(t *testing.T) {
 	r := newNeverTrigger()
-	s := &prunerStats{
+	s := &PrunerStats{
 		Live:    42,
 		Deleted: 17,
 	}
-	if r.rebuild(false, s) {
+	if r.ShouldRebuild(false, s) {
 		t.Fatal("you only had one job")
 	}
 }
 
-// sane verifies that certain prunerStats are not negative.
+// sane verifies that certain PrunerStats are not negative.
 //
 // The types in question aren't uint(64) but maybe they should be.
-func (s prunerStats) sane() error {
+func (s PrunerStats) sane() error {
 	if s.Live < 0 {
-		return fmt.Errorf("prunerStats.Live is negative")
+		return fmt.Errorf("PrunerStats.Live is negative")
 	}
 
 	if s.Added < 0 {
-		return fmt.Errorf("prunerStats.Added is negative")
+		return fmt.Errorf("PrunerStats.Added is negative")
 	}
 
 	if s.Deleted < 0 {
-		return fmt.Errorf("prunerStats.Deleted is negative")
+		return fmt.Errorf("PrunerStats.Deleted is negative")
 	}
 
 	if s.Filtered < 0 {
-		return fmt.Errorf("prunerStats.Filtered is negative")
+		return fmt.Errorf("PrunerStats.Filtered is negative")
 	}
 
 	return nil
@@ -68,3 +69,136 @@ func (s prunerStats) sane() error {
 func (m *prunerMatcher) checkStats() error {
 	return m.getStats().sane()
 }
+
+func TestDeletionCountPolicy(t *testing.T) {
+	r := NewDeletionCountRebuildPolicy(3)
+	s := &PrunerStats{Live: 10, Deleted: 2}
+	if r.ShouldRebuild(false, s) {
+		t.Fatal("shouldn't have fired")
+	}
+	s.Deleted = 3
+	if r.ShouldRebuild(true, s) {
+		t.Fatal("shouldn't have fired on add")
+	}
+	if !r.ShouldRebuild(false, s) {
+		t.Fatal("should have fired")
+	}
+	if NewDeletionCountRebuildPolicy(0).ShouldRebuild(false, &PrunerStats{}) {
+		t.Fatal("fired with nothing deleted")
+	}
+}
+
+func TestIntervalPolicy(t *testing.T) {
+	r := NewIntervalRebuildPolicy(time.Hour)
+	s := &PrunerStats{Live: 10, Deleted: 1}
+	if r.ShouldRebuild(false, s) {
+		t.Fatal("fired before the interval")
+	}
+	r.(*intervalTrigger).created = time.Now().Add(-2 * time.Hour)
+	if !r.ShouldRebuild(false, s) {
+		t.Fatal("should have fired")
+	}
+	s.LastRebuilt = time.Now()
+	if r.ShouldRebuild(false, s) {
+		t.Fatal("fired right after a rebuild")
+	}
+	s.LastRebuilt = time.Now().Add(-2 * time.Hour)
+	s.Deleted = 0
+	if r.ShouldRebuild(false, s) {
+		t.Fatal("fired with nothing deleted")
+	}
+}
+
+func TestWithRebuildPolicy(t *testing.T) {
+	if _, err := New(WithRebuildPolicy(nil)); err == nil {
+		t.Error("accepted nil policy")
+	}
+	if _, err := New(WithRebuildPolicy(NewNeverRebuildPolicy()), WithRebuildPolicy(NewNeverRebuildPolicy())); err == nil {
+		t.Error("accepted two policies")
+	}
+	if _, err := New(WithRebuildPolicy(NewNeverRebuildPolicy()), WithPatternDeletion(false)); err == nil {
+		t.Error("accepted policy without deletion")
+	}
+
+	q, err := New(WithRebuildPolicy(NewDeletionCountRebuildPolicy(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err = q.AddPattern(i, fmt.Sprintf(`{"n":[%d]}`, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = q.DeletePatterns(0)
+	if s := q.PrunerStats(); s.Live != 3 || s.Deleted != 1 || !s.LastRebuilt.IsZero() {
+		t.Errorf("after one deletion: %#v", s)
+	}
+	_ = q.DeletePatterns(1)
+	if err = q.WaitForRebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if s := q.PrunerStats(); s.Live != 2 || s.Deleted != 0 || s.RebuildPurged != 2 || s.LastRebuilt.IsZero() {
+		t.Errorf("after rebuild: %#v", s)
+	}
+
+	// with no automatic rebuilds, Rebuild is the only way
+	q, _ = New(WithRebuildPolicy(NewNeverRebuildPolicy()))
+	_ = q.AddPattern("a", `{"a":[1]}`)
+	_ = q.AddPattern("b", `{"b":[1]}`)
+	_ = q.DeletePatterns("a")
+	if s := q.PrunerStats(); s.Deleted != 1 {
+		t.Errorf("before Rebuild: %#v", s)
+	}
+	if err = q.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	if s := q.PrunerStats(); s.Deleted != 0 || s.Live != 1 || s.LastRebuilt.IsZero() {
+		t.Errorf("after Rebuild: %#v", s)
+	}
+	matches, _ := q.MatchesForEvent([]byte(`{"a": 1, "b": 1}`))
+	if len(matches) != 1 || matches[0] != "b" {
+		t.Errorf("got %v", matches)
+	}
+
+	// instances without deletion have no rebuilds or stats
+	q, _ = New()
+	if err = q.Rebuild(); err != nil {
+		t.Error(err)
+	}
+	if s := q.PrunerStats(); s != (PrunerStats{}) {
+		t.Errorf("got %#v", s)
+	}
+}
+
+func TestRebuildDoesntBlockMatching(t *testing.T) {
+	state := &gatedState{memState: newMemState(), gate: make(chan struct{})}
+	close(state.gate)
+	q, err := New(WithPatternStorage(state), WithRebuildPolicy(NewNeverRebuildPolicy()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("a", `{"a":[1]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	state.gate = make(chan struct{})
+	state.iterated = make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- q.Copy().Rebuild()
+	}()
+	<-state.iterated
+
+	// the rebuild is waiting, but matching carries on
+	matches, err := q.MatchesForEvent([]byte(`{"a": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("during Rebuild: %v", matches)
+	}
+	close(state.gate)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,720 @@
+package quamina
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Quamina's regexp patterns use the I-Regexp syntax defined in RFC 9485, which is a subset of the regular
+// expressions in XML Schema, designed to be interoperable across implementations. A regexp always has to match
+// the whole of a string value, i.e. it behaves as if it were anchored at both ends; '^' and '$' are just
+// characters. Regexps are parsed into a tree of regexpNodes, then compiled into an NFA with epsilon
+// transitions, which lives alongside wildcard patterns in the valueMatcher.
+
+// maxRegexpRepeat limits the numbers in a {n,m} quantifier, since each repetition becomes a copy of the
+// quantified part of the automaton
+const maxRegexpRepeat = 100
+
+// maxRegexpSize limits the number of copies of character matchers in the automaton for a regexp. Quantifiers
+// within quantifiers multiply, so keeping each of them below maxRegexpRepeat isn't enough.
+const maxRegexpSize = 10000
+
+type regexpNodeKind int
+
+const (
+	regexpChars regexpNodeKind = iota
+	regexpConcat
+	regexpAlternation
+	regexpRepeat
+)
+
+// regexpNode is a node in the parse tree of a regexp. chars is used by regexpChars, children by the other
+// kinds, and min/max by regexpRepeat, with a max of -1 meaning there's no upper limit.
+type regexpNode struct {
+	kind     regexpNodeKind
+	chars    runeSet
+	children []*regexpNode
+	min      int
+	max      int
+}
+
+// readRegexpSpecial parses a regexp object in a Pattern
+func readRegexpSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
+	t, err := pb.jd.Token()
+	if err != nil {
+		return
+	}
+	pathVals = valsIn
+	regexpString, ok := t.(string)
+	if !ok {
+		err = errors.New("value for 'regexp' must be a string")
+		return
+	}
+	parsed, err := parseRegexp(regexpString)
+	if err != nil {
+		return
+	}
+	pathVals = append(pathVals, typedVal{vType: regexpType, val: `"` + regexpString + `"`, parsedRegexp: parsed})
+
+	// has to be } or tokenizer will throw error
+	_, err = pb.jd.Token()
+	return
+}
+
+type regexpParser struct {
+	runes []rune
+	index int
+}
+
+// parseRegexp turns an I-Regexp into a tree of regexpNodes, or explains what's wrong with it
+func parseRegexp(s string) (*regexpNode, error) {
+	p := &regexpParser{runes: []rune(s)}
+	node, err := p.alternation()
+	if err != nil {
+		return nil, err
+	}
+	if !p.atEnd() {
+		// the only way to get here is an unmatched ')'
+		return nil, p.errorf("unmatched ')'")
+	}
+	if regexpSize(node) > maxRegexpSize {
+		return nil, fmt.Errorf("regexp is too big once its quantifiers are expanded, the limit is %d", maxRegexpSize)
+	}
+	return node, nil
+}
+
+// regexpSize counts the copies of character matchers that compile will make for a node. Once the count is past
+// maxRegexpSize, it doesn't matter by how much, so it stops there to avoid overflowing.
+func regexpSize(node *regexpNode) int {
+	switch node.kind {
+	case regexpChars:
+		return 1
+	case regexpRepeat:
+		copies := node.max
+		if copies == -1 {
+			// the minimum, plus the one that loops
+			copies = node.min + 1
+		}
+		size := regexpSize(node.children[0])
+		if copies > 0 && size > maxRegexpSize/copies {
+			return maxRegexpSize + 1
+		}
+		return size * copies
+	}
+	total := 0
+	for _, child := range node.children {
+		total += regexpSize(child)
+		if total > maxRegexpSize {
+			return maxRegexpSize + 1
+		}
+	}
+	return total
+}
+
+func (p *regexpParser) atEnd() bool {
+	return p.index >= len(p.runes)
+}
+
+func (p *regexpParser) peek() rune {
+	return p.runes[p.index]
+}
+
+func (p *regexpParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("regexp error at position %d: %s", p.index, fmt.Sprintf(format, args...))
+}
+
+// alternation: branch *( "|" branch )
+func (p *regexpParser) alternation() (*regexpNode, error) {
+	var branches []*regexpNode
+	for {
+		branch, err := p.branch()
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+		if p.atEnd() || p.peek() != '|' {
+			break
+		}
+		p.index++
+	}
+	if len(branches) == 1 {
+		return branches[0], nil
+	}
+	return &regexpNode{kind: regexpAlternation, children: branches}, nil
+}
+
+// branch: *piece
+func (p *regexpParser) branch() (*regexpNode, error) {
+	node := &regexpNode{kind: regexpConcat}
+	for !p.atEnd() && p.peek() != '|' && p.peek() != ')' {
+		piece, err := p.piece()
+		if err != nil {
+			return nil, err
+		}
+		node.children = append(node.children, piece)
+	}
+	if len(node.children) == 1 {
+		return node.children[0], nil
+	}
+	return node, nil
+}
+
+// piece: atom [ quantifier ]
+func (p *regexpParser) piece() (*regexpNode, error) {
+	atom, err := p.atom()
+	if err != nil {
+		return nil, err
+	}
+	if p.atEnd() {
+		return atom, nil
+	}
+	repeat := &regexpNode{kind: regexpRepeat, children: []*regexpNode{atom}}
+	switch p.peek() {
+	case '*':
+		repeat.min, repeat.max = 0, -1
+	case '+':
+		repeat.min, repeat.max = 1, -1
+	case '?':
+		repeat.min, repeat.max = 0, 1
+	case '{':
+		err = p.rangeQuantifier(repeat)
+		if err != nil {
+			return nil, err
+		}
+		return repeat, nil
+	default:
+		return atom, nil
+	}
+	p.index++
+	return repeat, nil
+}
+
+// rangeQuantifier: "{" QuantExact [ "," [ QuantExact ] ] "}"
+func (p *regexpParser) rangeQuantifier(repeat *regexpNode) error {
+	p.index++
+	var err error
+	repeat.min, err = p.quantExact()
+	if err != nil {
+		return err
+	}
+	repeat.max = repeat.min
+	if !p.atEnd() && p.peek() == ',' {
+		p.index++
+		if !p.atEnd() && p.peek() == '}' {
+			repeat.max = -1
+		} else {
+			repeat.max, err = p.quantExact()
+			if err != nil {
+				return err
+			}
+			if repeat.max < repeat.min {
+				return p.errorf("quantifier maximum %d is less than minimum %d", repeat.max, repeat.min)
+			}
+		}
+	}
+	if p.atEnd() || p.peek() != '}' {
+		return p.errorf("quantifier must end with '}'")
+	}
+	p.index++
+	return nil
+}
+
+func (p *regexpParser) quantExact() (int, error) {
+	start := p.index
+	for !p.atEnd() && p.peek() >= '0' && p.peek() <= '9' {
+		p.index++
+	}
+	if p.index == start {
+		return 0, p.errorf("quantifier requires a number")
+	}
+	n, err := strconv.Atoi(string(p.runes[start:p.index]))
+	if err != nil || n > maxRegexpRepeat {
+		return 0, p.errorf("quantifier numbers may not exceed %d", maxRegexpRepeat)
+	}
+	return n, nil
+}
+
+// atom: NormalChar / charClass / ( "(" i-regexp ")" )
+func (p *regexpParser) atom() (*regexpNode, error) {
+	r := p.peek()
+	switch r {
+	case '(':
+		p.index++
+		node, err := p.alternation()
+		if err != nil {
+			return nil, err
+		}
+		if p.atEnd() || p.peek() != ')' {
+			return nil, p.errorf("missing ')'")
+		}
+		p.index++
+		return node, nil
+	case '.':
+		// as in XML Schema, '.' matches anything but newline and carriage return
+		p.index++
+		return &regexpNode{kind: regexpChars, chars: runeSet{{'\n', '\n'}, {'\r', '\r'}}.complement()}, nil
+	case '[':
+		chars, err := p.charClassExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &regexpNode{kind: regexpChars, chars: chars}, nil
+	case '\\':
+		chars, err := p.escape()
+		if err != nil {
+			return nil, err
+		}
+		return &regexpNode{kind: regexpChars, chars: chars}, nil
+	case ')', '*', '+', '?', ']', '{', '}':
+		return nil, p.errorf("'%c' must be escaped", r)
+	}
+	p.index++
+	return &regexpNode{kind: regexpChars, chars: runeSet{{r, r}}}, nil
+}
+
+// escape handles SingleCharEsc and charClassEsc, i.e. \p{..} and \P{..}
+func (p *regexpParser) escape() (runeSet, error) {
+	p.index++
+	if p.atEnd() {
+		return nil, p.errorf("regexp may not end with '\\'")
+	}
+	r := p.peek()
+	if r != 'p' && r != 'P' {
+		single, err := p.singleCharEscape()
+		if err != nil {
+			return nil, err
+		}
+		return runeSet{{single, single}}, nil
+	}
+
+	p.index++
+	if p.atEnd() || p.peek() != '{' {
+		return nil, p.errorf("\\%c must be followed by '{'", r)
+	}
+	p.index++
+	start := p.index
+	for !p.atEnd() && p.peek() != '}' {
+		p.index++
+	}
+	if p.atEnd() {
+		return nil, p.errorf("unterminated \\%c{", r)
+	}
+	name := string(p.runes[start:p.index])
+	p.index++
+	chars, ok := unicodeCategory(name)
+	if !ok {
+		return nil, p.errorf("unknown Unicode category '%s'", name)
+	}
+	if r == 'P' {
+		chars = chars.complement()
+	}
+	return chars, nil
+}
+
+// singleCharEscape is called with the index just after a '\' that isn't followed by p or P
+func (p *regexpParser) singleCharEscape() (rune, error) {
+	r := p.peek()
+	p.index++
+	switch r {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case '(', ')', '*', '+', '-', '.', '?', '[', '\\', ']', '^', '{', '|', '}':
+		return r, nil
+	}
+	p.index--
+	return 0, p.errorf("invalid escape '\\%c'", r)
+}
+
+// charClassExpr: "[" [ "^" ] ( "-" / CCE1 ) *CCE1 [ "-" ] "]"
+func (p *regexpParser) charClassExpr() (runeSet, error) {
+	p.index++
+	negated := false
+	if !p.atEnd() && p.peek() == '^' {
+		negated = true
+		p.index++
+	}
+	var chars runeSet
+	first := true
+	for {
+		if p.atEnd() {
+			return nil, p.errorf("unterminated character class")
+		}
+		r := p.peek()
+		if r == ']' {
+			if first {
+				return nil, p.errorf("empty character class")
+			}
+			p.index++
+			break
+		}
+
+		// '-' is only a literal at the beginning or end
+		if r == '-' {
+			last := p.index+1 < len(p.runes) && p.runes[p.index+1] == ']'
+			if !(first || last) {
+				return nil, p.errorf("'-' must be escaped")
+			}
+			chars = append(chars, runeRange{'-', '-'})
+			p.index++
+			first = false
+			continue
+		}
+		first = false
+
+		if r == '\\' && p.index+1 < len(p.runes) && (p.runes[p.index+1] == 'p' || p.runes[p.index+1] == 'P') {
+			category, err := p.escape()
+			if err != nil {
+				return nil, err
+			}
+			chars = append(chars, category...)
+			continue
+		}
+
+		lo, err := p.classChar()
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if !p.atEnd() && p.peek() == '-' && p.index+1 < len(p.runes) && p.runes[p.index+1] != ']' {
+			p.index++
+			hi, err = p.classChar()
+			if err != nil {
+				return nil, err
+			}
+			if hi < lo {
+				return nil, p.errorf("character range is out of order")
+			}
+		}
+		chars = append(chars, runeRange{lo, hi})
+	}
+
+	chars = normalizeRuneSet(chars)
+	if negated {
+		chars = chars.complement()
+	}
+	return chars, nil
+}
+
+// classChar: CCchar, which may be a SingleCharEsc
+func (p *regexpParser) classChar() (rune, error) {
+	if p.atEnd() {
+		return 0, p.errorf("unterminated character class")
+	}
+	r := p.peek()
+	switch r {
+	case '\\':
+		p.index++
+		if p.atEnd() {
+			return 0, p.errorf("unterminated character class")
+		}
+		return p.singleCharEscape()
+	case '[', ']', '-':
+		return 0, p.errorf("'%c' must be escaped in a character class", r)
+	}
+	p.index++
+	return r, nil
+}
+
+// runeSet is a sorted list of non-overlapping, non-adjacent ranges of runes, excluding the surrogates, which
+// can't appear in UTF-8
+type runeSet []runeRange
+
+type runeRange struct {
+	lo rune
+	hi rune
+}
+
+const (
+	surrogateLo rune = 0xd800
+	surrogateHi rune = 0xdfff
+)
+
+func normalizeRuneSet(ranges []runeRange) runeSet {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].lo < ranges[j].lo })
+	var set runeSet
+	for _, r := range ranges {
+		last := len(set) - 1
+		if last >= 0 && r.lo <= set[last].hi+1 {
+			if r.hi > set[last].hi {
+				set[last].hi = r.hi
+			}
+			continue
+		}
+		set = append(set, r)
+	}
+
+	// take out the surrogates
+	var withoutSurrogates runeSet
+	for _, r := range set {
+		if r.hi < surrogateLo || r.lo > surrogateHi {
+			withoutSurrogates = append(withoutSurrogates, r)
+			continue
+		}
+		if r.lo < surrogateLo {
+			withoutSurrogates = append(withoutSurrogates, runeRange{r.lo, surrogateLo - 1})
+		}
+		if r.hi > surrogateHi {
+			withoutSurrogates = append(withoutSurrogates, runeRange{surrogateHi + 1, r.hi})
+		}
+	}
+	return withoutSurrogates
+}
+
+func (s runeSet) complement() runeSet {
+	var complement []runeRange
+	next := rune(0)
+	for _, r := range s {
+		if r.lo > next {
+			complement = append(complement, runeRange{next, r.lo - 1})
+		}
+		next = r.hi + 1
+	}
+	if next <= unicode.MaxRune {
+		complement = append(complement, runeRange{next, unicode.MaxRune})
+	}
+	return normalizeRuneSet(complement)
+}
+
+func runeSetFromTable(table *unicode.RangeTable) runeSet {
+	var ranges []runeRange
+	for _, r16 := range table.R16 {
+		if r16.Stride == 1 {
+			ranges = append(ranges, runeRange{rune(r16.Lo), rune(r16.Hi)})
+			continue
+		}
+		for r := rune(r16.Lo); r <= rune(r16.Hi); r += rune(r16.Stride) {
+			ranges = append(ranges, runeRange{r, r})
+		}
+	}
+	for _, r32 := range table.R32 {
+		if r32.Stride == 1 {
+			ranges = append(ranges, runeRange{rune(r32.Lo), rune(r32.Hi)})
+			continue
+		}
+		for r := rune(r32.Lo); r <= rune(r32.Hi); r += rune(r32.Stride) {
+			ranges = append(ranges, runeRange{r, r})
+		}
+	}
+	return normalizeRuneSet(ranges)
+}
+
+// unicodeCategory returns the runes in one of the general categories allowed by I-Regexp. Go's unicode package
+// has no table for Cn, unassigned code points, so it's computed as everything not in any other category, and
+// added to C.
+func unicodeCategory(name string) (runeSet, bool) {
+	switch name {
+	case "L", "Ll", "Lm", "Lo", "Lt", "Lu",
+		"M", "Mc", "Me", "Mn",
+		"N", "Nd", "Nl", "No",
+		"P", "Pc", "Pd", "Pe", "Pf", "Pi", "Po", "Ps",
+		"Z", "Zl", "Zp", "Zs",
+		"S", "Sc", "Sk", "Sm", "So",
+		"Cc", "Cf", "Co":
+		return runeSetFromTable(unicode.Categories[name]), true
+	case "C", "Cn":
+		var assigned []runeRange
+		for _, major := range []*unicode.RangeTable{unicode.L, unicode.M, unicode.N, unicode.P, unicode.S, unicode.Z, unicode.C} {
+			assigned = append(assigned, runeSetFromTable(major)...)
+		}
+		unassigned := normalizeRuneSet(assigned).complement()
+		if name == "Cn" {
+			return unassigned, true
+		}
+		return normalizeRuneSet(append(runeSetFromTable(unicode.C), unassigned...)), true
+	}
+	return nil, false
+}
+
+// utf8Range is a range of byte values, and a sequence of them matches the UTF-8 form of some range of runes
+type utf8Range struct {
+	lo byte
+	hi byte
+}
+
+// appendUTF8Sequences appends to sequences the byte-range sequences which match exactly the UTF-8 encodings of
+// the runes from lo to hi, which must not include any surrogates. The range is split until each piece's first
+// and last runes have UTF-8 encodings of the same length, which differ only in bytes where everything between
+// them is allowed; then the piece is described by pairing up their bytes.
+func appendUTF8Sequences(sequences [][]utf8Range, lo, hi rune) [][]utf8Range {
+	if lo > hi {
+		return sequences
+	}
+	for _, lengthLimit := range []rune{0x7f, 0x7ff, 0xffff} {
+		if lo <= lengthLimit && lengthLimit < hi {
+			sequences = appendUTF8Sequences(sequences, lo, lengthLimit)
+			return appendUTF8Sequences(sequences, lengthLimit+1, hi)
+		}
+	}
+	if hi <= 0x7f {
+		return append(sequences, []utf8Range{{byte(lo), byte(hi)}})
+	}
+	for i := 1; i < utf8.UTFMax; i++ {
+		lowBits := rune(1)<<(6*i) - 1
+		if lo&^lowBits != hi&^lowBits {
+			if lo&lowBits != 0 {
+				sequences = appendUTF8Sequences(sequences, lo, lo|lowBits)
+				return appendUTF8Sequences(sequences, (lo|lowBits)+1, hi)
+			}
+			if hi&lowBits != lowBits {
+				sequences = appendUTF8Sequences(sequences, lo, (hi&^lowBits)-1)
+				return appendUTF8Sequences(sequences, hi&^lowBits, hi)
+			}
+		}
+	}
+	loBytes := utf8.AppendRune(nil, lo)
+	hiBytes := utf8.AppendRune(nil, hi)
+	sequence := make([]utf8Range, len(loBytes))
+	for i := range loBytes {
+		sequence[i] = utf8Range{loBytes[i], hiBytes[i]}
+	}
+	return append(sequences, sequence)
+}
+
+// utf8Trie organizes byte-range sequences so that those with the same leading ranges share steps. Any two
+// sequences generated from a runeSet either have the same range at each level or ranges that don't overlap, so
+// the steps built from the trie are deterministic. A nil child means the sequence ends there.
+type utf8Trie struct {
+	ranges   []utf8Range
+	children []*utf8Trie
+}
+
+func (t *utf8Trie) insert(sequence []utf8Range) {
+	for i, r := range t.ranges {
+		if r == sequence[0] {
+			if len(sequence) > 1 {
+				t.children[i].insert(sequence[1:])
+			}
+			return
+		}
+	}
+	var child *utf8Trie
+	if len(sequence) > 1 {
+		child = &utf8Trie{}
+		child.insert(sequence[1:])
+	}
+	t.ranges = append(t.ranges, sequence[0])
+	t.children = append(t.children, child)
+}
+
+type regexpBuilder struct {
+	lister *listMaker
+}
+
+func newNfaStep() *nfaStep {
+	return &nfaStep{table: newSmallTable[*nfaStepList]()}
+}
+
+// makeRegexpAutomaton builds an NFA which matches a string value, including its quotes, whose content matches
+// the regexp.
+func makeRegexpAutomaton(root *regexpNode, useThisTransition *fieldMatcher) (start *smallTable[*nfaStepList], nextField *fieldMatcher) {
+	if useThisTransition != nil {
+		nextField = useThisTransition
+	} else {
+		nextField = newFieldMatcher()
+	}
+	b := &regexpBuilder{lister: newListMaker()}
+
+	first := newNfaStep()
+	regexpStart, regexpEnd := b.compile(root)
+	first.table.addByteStep('"', b.lister.getList(regexpStart))
+	closingQuote := newNfaStep()
+	regexpEnd.epsilon = append(regexpEnd.epsilon, closingQuote)
+	afterQuote := newNfaStep()
+	closingQuote.table.addByteStep('"', b.lister.getList(afterQuote))
+	lastStep := &nfaStep{table: newSmallTable[*nfaStepList](), fieldTransitions: []*fieldMatcher{nextField}}
+	afterQuote.table.addByteStep(valueTerminator, b.lister.getList(lastStep))
+	return first.table, nextField
+}
+
+// compile is a straightforward Thompson construction, returning the start and end steps of the NFA fragment
+// for the node. The pieces are joined with epsilon transitions. Each call produces new steps, which is how
+// quantifiers make copies of what they apply to.
+func (b *regexpBuilder) compile(node *regexpNode) (start *nfaStep, end *nfaStep) {
+	switch node.kind {
+	case regexpChars:
+		end = newNfaStep()
+		trie := &utf8Trie{}
+		var sequences [][]utf8Range
+		for _, r := range node.chars {
+			sequences = appendUTF8Sequences(sequences, r.lo, r.hi)
+		}
+		for _, sequence := range sequences {
+			trie.insert(sequence)
+		}
+		return b.trieStep(trie, end), end
+
+	case regexpConcat:
+		start = newNfaStep()
+		end = start
+		for _, child := range node.children {
+			childStart, childEnd := b.compile(child)
+			end.epsilon = append(end.epsilon, childStart)
+			end = childEnd
+		}
+		return
+
+	case regexpAlternation:
+		start = newNfaStep()
+		end = newNfaStep()
+		for _, child := range node.children {
+			childStart, childEnd := b.compile(child)
+			start.epsilon = append(start.epsilon, childStart)
+			childEnd.epsilon = append(childEnd.epsilon, end)
+		}
+		return
+
+	case regexpRepeat:
+		start = newNfaStep()
+		end = start
+		child := node.children[0]
+		for i := 0; i < node.min; i++ {
+			childStart, childEnd := b.compile(child)
+			end.epsilon = append(end.epsilon, childStart)
+			end = childEnd
+		}
+		exit := newNfaStep()
+		if node.max == -1 {
+			// loop back for as many more as there are
+			loop := newNfaStep()
+			childStart, childEnd := b.compile(child)
+			end.epsilon = append(end.epsilon, loop)
+			loop.epsilon = append(loop.epsilon, childStart, exit)
+			childEnd.epsilon = append(childEnd.epsilon, loop)
+		} else {
+			// each optional copy can be skipped
+			for i := node.min; i < node.max; i++ {
+				childStart, childEnd := b.compile(child)
+				end.epsilon = append(end.epsilon, childStart, exit)
+				end = childEnd
+			}
+			end.epsilon = append(end.epsilon, exit)
+		}
+		return start, exit
+	}
+	panic("unknown regexp node kind")
+}
+
+func (b *regexpBuilder) trieStep(trie *utf8Trie, end *nfaStep) *nfaStep {
+	step := newNfaStep()
+	var u unpackedTable[*nfaStepList]
+	for i, r := range trie.ranges {
+		next := end
+		if trie.children[i] != nil {
+			next = b.trieStep(trie.children[i], end)
+		}
+		list := b.lister.getList(next)
+		for utf8Byte := int(r.lo); utf8Byte <= int(r.hi); utf8Byte++ {
+			u[utf8Byte] = list
+		}
+	}
+	step.table.pack(&u)
+	return step
+}
@@ -0,0 +1,309 @@
+package quamina
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseRegexp(t *testing.T) {
+	goods := []string{
+		``,
+		`a`,
+		`abc|def`,
+		`a|`,
+		`(a|b)*c+d?`,
+		`a{3}b{2,}c{0,5}`,
+		`[abc]`,
+		`[^a-z0-9]`,
+		`[-a]`,
+		`[a-]`,
+		`[\-\[\]\\]`,
+		`\p{Lu}\P{Nd}[\p{L}\p{Nd}_]`,
+		`\p{C}\p{Cn}\p{Zs}`,
+		`\.\*\+\?\(\)\{\}\|\^\n\r\t`,
+		`^$`,
+		`.*@example\.com`,
+		`(((a)))`,
+		`ωμέγα[α-ω]+`,
+		`(a{100}){100}`,
+	}
+	for _, good := range goods {
+		_, err := parseRegexp(good)
+		if err != nil {
+			t.Errorf("rejected %s: %s", good, err.Error())
+		}
+	}
+
+	bads := []string{
+		`(`,
+		`)`,
+		`a)`,
+		`(a`,
+		`*`,
+		`a**`,
+		`a+?`,
+		`{`,
+		`a{`,
+		`a{x}`,
+		`a{2`,
+		`a{3,2}`,
+		`a{1000}`,
+		`((a{100}){100}){100}`,
+		`((a|b){100}){51}`,
+		`(a{100}){100,}`,
+		`}`,
+		`]`,
+		`[`,
+		`[]`,
+		`[a`,
+		`[z-a]`,
+		`[a-b-c]`,
+		`[[]`,
+		`\`,
+		`\d`,
+		`\w`,
+		`\p`,
+		`\p{`,
+		`\p{Lu`,
+		`\p{Xx}`,
+		`\p{Cs}`,
+		`\p{IsGreek}`,
+		`[\d]`,
+	}
+	for _, bad := range bads {
+		_, err := parseRegexp(bad)
+		if err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+
+	patterns := []string{
+		`{"x": [ {"regexp": 3} ] }`,
+		`{"x": [ {"regexp": "a(b"} ] }`,
+		`{"x": [ {"regexp": "ab" ] }`,
+	}
+	for _, pattern := range patterns {
+		_, err := patternsFromJSON([]byte(pattern))
+		if err == nil {
+			t.Errorf("accepted %s", pattern)
+		}
+	}
+}
+
+func TestUTF8Sequences(t *testing.T) {
+	ranges := []runeRange{
+		{0, 0x10ffff},
+		{'a', 'z'},
+		{0x7e, 0x81},
+		{0x7ff, 0x800},
+		{0x805, 0x1234},
+		{0xfff0, 0x10010},
+		{0x10000, 0x10ffff},
+		{0x3b1, 0x3c9},
+	}
+	for _, r := range ranges {
+		set := normalizeRuneSet([]runeRange{r})
+		trie := &utf8Trie{}
+		for _, sr := range set {
+			for _, sequence := range appendUTF8Sequences(nil, sr.lo, sr.hi) {
+				trie.insert(sequence)
+			}
+		}
+		for c := rune(0); c <= 0x10ffff; c++ {
+			if c >= surrogateLo && c <= surrogateHi {
+				continue
+			}
+			inRange := c >= r.lo && c <= r.hi
+			if trieMatches(trie, utf8.AppendRune(nil, c)) != inRange {
+				t.Errorf("range %x-%x wrong on %x", r.lo, r.hi, c)
+				break
+			}
+		}
+	}
+}
+
+func trieMatches(trie *utf8Trie, b []byte) bool {
+	for i, r := range trie.ranges {
+		if b[0] >= r.lo && b[0] <= r.hi {
+			if trie.children[i] == nil {
+				return len(b) == 1
+			}
+			return len(b) > 1 && trieMatches(trie.children[i], b[1:])
+		}
+	}
+	return false
+}
+
+func TestRegexpMatching(t *testing.T) {
+	type regexpTest struct {
+		regexp  string
+		matches []string
+		misses  []string
+	}
+	tests := []regexpTest{
+		{
+			regexp:  `abc`,
+			matches: []string{"abc"},
+			misses:  []string{"ab", "abcd", "xabc", ""},
+		},
+		{
+			regexp:  ``,
+			matches: []string{""},
+			misses:  []string{"a"},
+		},
+		{
+			regexp:  `a|bc|`,
+			matches: []string{"a", "bc", ""},
+			misses:  []string{"b", "abc"},
+		},
+		{
+			regexp:  `(ab)*c+d?`,
+			matches: []string{"c", "abc", "ababccc", "cd", "abcd"},
+			misses:  []string{"d", "abd", "aabc", "abcdd"},
+		},
+		{
+			regexp:  `a{2,3}b{2,}c{0,1}x{2}`,
+			matches: []string{"aabbxx", "aaabbbbbbcxx"},
+			misses:  []string{"abbxx", "aaaabbxx", "aabxx", "aabbccxx", "aabbx"},
+		},
+		{
+			regexp:  `[a-c][^a-c]`,
+			matches: []string{"ax", "c💋", "b\n"},
+			misses:  []string{"aa", "dx", "a"},
+		},
+		{
+			regexp:  `.`,
+			matches: []string{"a", "é", "💋", "\t"},
+			misses:  []string{"\n", "\r", "", "ab"},
+		},
+		{
+			regexp:  `.*@example\.com`,
+			matches: []string{"jane@example.com", "@example.com"},
+			misses:  []string{"jane@exampleXcom", "jane@example.com.au"},
+		},
+		{
+			regexp:  `\p{Lu}\p{Ll}+`,
+			matches: []string{"Hello", "Ωμέγα", "Éclair"},
+			misses:  []string{"hello", "HELLO", "H"},
+		},
+		{
+			regexp:  `\P{L}+`,
+			matches: []string{"123", "💋!"},
+			misses:  []string{"a1", "é"},
+		},
+		{
+			regexp:  `[\p{Nd}\-]+`,
+			matches: []string{"555-1212", "٣٤٥"},
+			misses:  []string{"555 1212"},
+		},
+		{
+			regexp:  `^$[0-9]+$`,
+			matches: []string{"^$42$"},
+			misses:  []string{"$42"},
+		},
+		{
+			regexp:  `(a|ab)(c|bcd)(d*)`,
+			matches: []string{"abcd", "abcdd", "acd"},
+			misses:  []string{"abd"},
+		},
+		{
+			regexp:  `(a*)*b`,
+			matches: []string{"b", "aaab"},
+			misses:  []string{"aaa"},
+		},
+	}
+	for _, test := range tests {
+		q, _ := New()
+		pattern := fmt.Sprintf(`{"x": [ {"regexp": %q} ] }`, test.regexp)
+		err := q.AddPattern("R", pattern)
+		if err != nil {
+			t.Errorf("add %s: %s", pattern, err.Error())
+			continue
+		}
+
+		// check the DFA too, to exercise epsilon handling in nfa2Dfa
+		parsed, _ := parseRegexp(test.regexp)
+		nfa, wanted := makeRegexpAutomaton(parsed, nil)
+		dfa := nfa2Dfa(nfa)
+
+		for _, m := range test.matches {
+			matches, err := q.MatchesForEvent([]byte(fmt.Sprintf(`{"x": %q}`, m)))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 1 {
+				t.Errorf("%s should match %q", test.regexp, m)
+			}
+			trans := transitionDfa(dfa, []byte(`"`+m+`"`), nil)
+			if len(trans) != 1 || trans[0] != wanted {
+				t.Errorf("DFA for %s should match %q", test.regexp, m)
+			}
+		}
+		for _, m := range test.misses {
+			matches, err := q.MatchesForEvent([]byte(fmt.Sprintf(`{"x": %q}`, m)))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 0 {
+				t.Errorf("%s should not match %q", test.regexp, m)
+			}
+			trans := transitionDfa(dfa, []byte(`"`+m+`"`), nil)
+			if len(trans) != 0 {
+				t.Errorf("DFA for %s should not match %q", test.regexp, m)
+			}
+		}
+	}
+}
+
+func TestRegexpWithOtherPatterns(t *testing.T) {
+	q, _ := New()
+	patterns := map[X]string{
+		"digits": `{"x": [ {"regexp": "[0-9]+"} ] }`,
+		"year":   `{"x": [ {"regexp": "(19|20)[0-9]{2}"} ] }`,
+		"exact":  `{"x": [ "2024" ] }`,
+		"prefix": `{"x": [ {"prefix": "20"} ] }`,
+		"wild":   `{"x": [ {"wildcard": "*4"} ] }`,
+		"number": `{"x": [ 2024 ] }`,
+	}
+	for x, p := range patterns {
+		err := q.AddPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"x": "2024"}`:  {"digits", "year", "exact", "prefix", "wild"},
+		`{"x": "1999"}`:  {"digits", "year"},
+		`{"x": "2099x"}`: {"prefix"},
+		`{"x": "123"}`:   {"digits"},
+		`{"x": 2024}`:    {"number"},
+	}
+	for event, want := range wanted {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
+
+func TestRegexpStats(t *testing.T) {
+	// epsilon transitions can loop, which matcherStats has to cope with
+	cm := newCoreMatcher()
+	if err := cm.addPattern("loop", `{"a": [ {"regexp": "(a?)*"} ] }`); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(matcherStats(cm), "Field matchers: 2") {
+		t.Errorf("stats: %s", matcherStats(cm))
+	}
+}
@@ -23,6 +23,10 @@ type segmentsTree struct {
 	//  leaf "id" will be mapped to []byte("context\nuser\nid")
 	//  leaf "user", if it has non-node values, will be mapped to []byte("context\nuser")
 	fields map[string][]byte
+
+	// presence records which fields are mentioned in "exists" patterns, so that if their values turn out to be
+	// objects or arrays, the Flattener can still report that they're there.
+	presence map[string]bool
 }
 
 // newSegmentsIndex creates a segmentsTree node which is the root.
@@ -38,9 +42,10 @@ func newSegmentsIndex(paths ...string) *segmentsTree {
 // newSegmentsIndexNode initializes a segmentsTree node
 func newSegmentsIndexNode(root bool) *segmentsTree {
 	return &segmentsTree{
-		root:   root,
-		nodes:  make(map[string]*segmentsTree),
-		fields: make(map[string][]byte),
+		root:     root,
+		nodes:    make(map[string]*segmentsTree),
+		fields:   make(map[string][]byte),
+		presence: make(map[string]bool),
 	}
 }
 
@@ -68,6 +73,16 @@ func (p *segmentsTree) add(path string) {
 	}
 }
 
+// addPresence records that path, which must already have been added, is used in an "exists" pattern
+func (p *segmentsTree) addPresence(path string) {
+	segments := strings.Split(path, SegmentSeparator)
+	node := p
+	for _, segment := range segments[:len(segments)-1] {
+		node = node.getOrCreate(segment)
+	}
+	node.presence[segments[len(segments)-1]] = true
+}
+
 func (p *segmentsTree) getOrCreate(name string) *segmentsTree {
 	_, ok := p.nodes[name]
 	if !ok {
@@ -113,6 +128,11 @@ func (p *segmentsTree) PathForSegment(segment []byte) []byte {
 	return p.fields[string(segment)]
 }
 
+// NeedsPresenceMarker implements presenceTracker
+func (p *segmentsTree) NeedsPresenceMarker(segment []byte) bool {
+	return p.presence[string(segment)]
+}
+
 // NodesCount implements SegmentsTreeTracker
 func (p *segmentsTree) NodesCount() int {
 	return len(p.nodes)
@@ -148,6 +168,10 @@ func (p *segmentsTree) copy() *segmentsTree {
 		np.fields[name] = path
 	}
 
+	for name := range p.presence {
+		np.presence[name] = true
+	}
+
 	// copy nodes
 	for name, node := range p.nodes {
 		np.nodes[name] = node.copy()
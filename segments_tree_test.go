@@ -60,6 +60,27 @@ func TestSegmentsTreeString(t *testing.T) {
 	}
 }
 
+// plainTracker is a SegmentsTreeTracker without NeedsPresenceMarker, as one from outside the package might be
+type plainTracker struct {
+	SegmentsTreeTracker
+}
+
+func TestPresenceMarkerIsOptional(t *testing.T) {
+	cm := newCoreMatcher()
+	if err := cm.addPattern("x", `{"a": [ {"exists": true} ]}`); err != nil {
+		t.Fatal(err)
+	}
+	event := []byte(`{"a": {"b": 1}}`)
+	fields, err := newJSONFlattener().Flatten(event, cm.getSegmentsTreeTracker())
+	if err != nil || len(fields) != 1 || fields[0].Val != nil {
+		t.Errorf("with marker: %v %v", fields, err)
+	}
+	fields, err = newJSONFlattener().Flatten(event, plainTracker{cm.getSegmentsTreeTracker()})
+	if err != nil || len(fields) != 0 {
+		t.Errorf("without marker: %v %v", fields, err)
+	}
+}
+
 func expectSegmentsToBeUsed(t *testing.T, tree SegmentsTreeTracker, segments ...string) {
 	t.Helper()
 
@@ -51,3 +51,32 @@ type SegmentsTreeTracker interface {
 	// String is used only for debugging.
 	String() string
 }
+
+// presenceTracker is implemented by the SegmentsTreeTrackers that Quamina provides. It isn't part of
+// SegmentsTreeTracker so that implementations from elsewhere don't have to provide it.
+type presenceTracker interface {
+	// Called by the Flattener when the value of an object member is an object or array, to ascertain
+	// whether any Pattern tests for the presence of that member with an "exists" Pattern. If so, the
+	// Flattener should report it with a Field whose Path comes from PathForSegment and whose Val is nil;
+	// this counts as one of the fields in FieldsCount.
+	NeedsPresenceMarker(segment []byte) bool
+}
+
+// needsPresenceMarker calls the tracker's NeedsPresenceMarker, if it has one
+func needsPresenceMarker(tracker SegmentsTreeTracker, segment []byte) bool {
+	pt, ok := tracker.(presenceTracker)
+	return ok && pt.NeedsPresenceMarker(segment)
+}
+
+// arrayMember is for Flatteners that have found an array as the value of an object member. It says whether to
+// report the member with a presence marker, which an empty array doesn't get, since it has no value and so
+// doesn't exist, and returns the tracker for the array's elements. As in flattenJSON, an array can be a field or
+// a node, so if the member isn't a node, that's the object's tracker.
+func arrayMember(tracker SegmentsTreeTracker, segment []byte, empty bool) (marker bool, arrayTracker SegmentsTreeTracker) {
+	marker = !empty && needsPresenceMarker(tracker, segment)
+	arrayTracker, ok := tracker.Get(segment)
+	if !ok {
+		arrayTracker = tracker
+	}
+	return marker, arrayTracker
+}
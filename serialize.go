@@ -0,0 +1,871 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// The compiled automaton can be saved and loaded, so that instances with lots of Patterns, which can take a long
+// time to add, can be set up quickly. The format is a header, then the X values, then the states of the
+// automaton, then the segmentsTree, then for instances that support deletion, the live Patterns, then a CRC-32
+// checksum of all that. The states are numbered in the order they're found by a breadth-first walk of the
+// automaton that visits map entries in key order, so saving the same automaton always produces the same bytes,
+// and refer to each other by number, which is how loops and sharing are preserved. Numbers of states that may be
+// nil are one more than their index, with 0 for nil. All the integers are uvarints.
+
+// automatonMagic begins every saved automaton
+var automatonMagic = []byte("quamina\x00")
+
+// automatonVersion is incremented whenever the format changes
+const automatonVersion = 1
+
+// the flags record the options that the automaton depends on
+const (
+	automatonCanonicalNumbers = 1 << iota
+	automatonPatternDeletion
+)
+
+// Save writes the instance's Patterns, in the compiled form that it uses for matching, to w, for Load to read.
+// Since X values can be anything, encodeX is called to turn each of them into bytes; if it's nil, the X values
+// have to be strings. Save can be called while other goroutines are matching, but AddPattern has to wait for it.
+func (q *Quamina) Save(w io.Writer, encodeX func(x X) ([]byte, error)) error {
+	if encodeX == nil {
+		encodeX = encodeStringX
+	}
+	aw := newAutomatonWriter(encodeX)
+	var flags uint64
+	if q.canonicalizeNumbers {
+		flags |= automatonCanonicalNumbers
+	}
+
+	var core *coreMatcher
+	var live LivePatternsState
+	switch m := q.matcher.(type) {
+	case *coreMatcher:
+		core = m
+	case *prunerMatcher:
+		flags |= automatonPatternDeletion
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		core = m.Matcher
+		live = m.live
+	default:
+		return errors.New("this instance's matcher can't be saved")
+	}
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	if err := aw.write(core.fields(), flags, live); err != nil {
+		return err
+	}
+	_, err := w.Write(aw.buf)
+	return err
+}
+
+// Load replaces the instance's Patterns with those written by Save, which must have been called on an instance
+// created with the same WithNumberCanonicalization and WithPatternDeletion options. decodeX is called to turn the
+// bytes that Save's encodeX produced back into X values; if it's nil, they're taken to be strings. The change is
+// visible in all the instance's Copies. Instances using WithPatternStorage get their Patterns from their storage,
+// and can't Load.
+func (q *Quamina) Load(r io.Reader, decodeX func(b []byte) (X, error)) error {
+	if decodeX == nil {
+		decodeX = func(b []byte) (X, error) { return string(b), nil }
+	}
+	if q.patternStorage != nil {
+		return errors.New("instances with pattern storage can't load patterns")
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var flags uint64
+	if q.canonicalizeNumbers {
+		flags |= automatonCanonicalNumbers
+	}
+	if q.patternDeletion {
+		flags |= automatonPatternDeletion
+	}
+	ar := &automatonReader{data: data, decodeX: decodeX}
+	loaded, live, err := ar.read(flags)
+	if err != nil {
+		return fmt.Errorf("can't load automaton: %w", err)
+	}
+
+	switch m := q.matcher.(type) {
+	case *coreMatcher:
+		m.lock.Lock()
+		m.updateable.Store(loaded)
+		m.lock.Unlock()
+	case *prunerMatcher:
+		core := newCoreMatcher()
+		core.canonicalizeNumbers = m.canonicalizeNumbers
+		core.updateable.Store(loaded)
+		count := 0
+		_ = live.Iterate(func(_ X, _ string) error {
+			count++
+			return nil
+		})
+		m.lock.Lock()
+		m.cancelRebuildWhileLocked()
+		m.Matcher = core
+		m.live = live
+		m.stats = PrunerStats{Live: count}
+		m.lock.Unlock()
+	}
+	return nil
+}
+
+func encodeStringX(x X) ([]byte, error) {
+	s, ok := x.(string)
+	if !ok {
+		return nil, fmt.Errorf("X values of type %T need an encoder", x)
+	}
+	return []byte(s), nil
+}
+
+// automatonWriter numbers the states of an automaton and writes them out
+type automatonWriter struct {
+	buf     []byte
+	encodeX func(x X) ([]byte, error)
+
+	xs             []X
+	xIDs           map[X]uint64
+	fieldMatchers  []*fieldMatcher
+	fmIDs          map[*fieldMatcher]uint64
+	valueMatchers  []*valueMatcher
+	vmIDs          map[*valueMatcher]uint64
+	dfaTables      []*smallTable[*dfaStep]
+	dfaTableIDs    map[*smallTable[*dfaStep]]uint64
+	dfaSteps       []*dfaStep
+	dfaStepIDs     map[*dfaStep]uint64
+	nfaTables      []*smallTable[*nfaStepList]
+	nfaTableIDs    map[*smallTable[*nfaStepList]]uint64
+	nfaStepLists   []*nfaStepList
+	nfaStepListIDs map[*nfaStepList]uint64
+	nfaSteps       []*nfaStep
+	nfaStepIDs     map[*nfaStep]uint64
+}
+
+func newAutomatonWriter(encodeX func(x X) ([]byte, error)) *automatonWriter {
+	return &automatonWriter{
+		encodeX:        encodeX,
+		xIDs:           make(map[X]uint64),
+		fmIDs:          make(map[*fieldMatcher]uint64),
+		vmIDs:          make(map[*valueMatcher]uint64),
+		dfaTableIDs:    make(map[*smallTable[*dfaStep]]uint64),
+		dfaStepIDs:     make(map[*dfaStep]uint64),
+		nfaTableIDs:    make(map[*smallTable[*nfaStepList]]uint64),
+		nfaStepListIDs: make(map[*nfaStepList]uint64),
+		nfaStepIDs:     make(map[*nfaStep]uint64),
+	}
+}
+
+func (aw *automatonWriter) write(core *coreFields, flags uint64, live LivePatternsState) error {
+	aw.number(core.state)
+
+	aw.buf = append(aw.buf, automatonMagic...)
+	aw.uvarint(automatonVersion)
+	aw.uvarint(flags)
+	aw.uvarint(uint64(len(aw.xs)))
+	for _, x := range aw.xs {
+		if err := aw.x(x); err != nil {
+			return err
+		}
+	}
+	for _, n := range []int{len(aw.fieldMatchers), len(aw.valueMatchers), len(aw.dfaTables), len(aw.dfaSteps),
+		len(aw.nfaTables), len(aw.nfaStepLists), len(aw.nfaSteps)} {
+		aw.uvarint(uint64(n))
+	}
+
+	for _, fm := range aw.fieldMatchers {
+		fields := fm.fields()
+		aw.uvarint(uint64(len(fields.matches)))
+		for _, x := range fields.matches {
+			aw.uvarint(aw.xIDs[x])
+		}
+		paths := sortedKeys(fields.transitions)
+		aw.uvarint(uint64(len(paths)))
+		for _, path := range paths {
+			aw.bytes([]byte(path))
+			aw.uvarint(aw.vmIDs[fields.transitions[path]])
+		}
+		for _, exists := range []map[string]*fieldMatcher{fields.existsTrue, fields.existsFalse} {
+			paths = sortedKeys(exists)
+			aw.uvarint(uint64(len(paths)))
+			for _, path := range paths {
+				aw.bytes([]byte(path))
+				aw.uvarint(aw.fmIDs[exists[path]])
+			}
+		}
+	}
+	for _, vm := range aw.valueMatchers {
+		fields := vm.getFields()
+		if fields.hasNumbers {
+			aw.uvarint(1)
+		} else {
+			aw.uvarint(0)
+		}
+		aw.ref(aw.dfaTableIDs, fields.startDfa)
+		aw.ref(aw.nfaTableIDs, fields.startNfa)
+		if fields.singletonMatch == nil {
+			aw.uvarint(0)
+		} else {
+			aw.uvarint(1)
+			aw.bytes(fields.singletonMatch)
+			aw.ref(aw.fmIDs, fields.singletonTransition)
+		}
+	}
+	for _, table := range aw.dfaTables {
+		aw.uvarint(uint64(len(table.ceilings)))
+		for i, ceiling := range table.ceilings {
+			aw.uvarint(uint64(ceiling))
+			aw.ref(aw.dfaStepIDs, table.steps[i])
+		}
+	}
+	for _, step := range aw.dfaSteps {
+		aw.uvarint(aw.dfaTableIDs[step.table])
+		aw.fieldMatcherList(step.fieldTransitions)
+	}
+	for _, table := range aw.nfaTables {
+		aw.uvarint(uint64(len(table.ceilings)))
+		for i, ceiling := range table.ceilings {
+			aw.uvarint(uint64(ceiling))
+			aw.ref(aw.nfaStepListIDs, table.steps[i])
+		}
+	}
+	for _, list := range aw.nfaStepLists {
+		aw.uvarint(uint64(len(list.steps)))
+		for _, step := range list.steps {
+			aw.uvarint(aw.nfaStepIDs[step])
+		}
+	}
+	for _, step := range aw.nfaSteps {
+		aw.uvarint(aw.nfaTableIDs[step.table])
+		aw.fieldMatcherList(step.fieldTransitions)
+		aw.uvarint(uint64(len(step.epsilon)))
+		for _, epsilon := range step.epsilon {
+			aw.uvarint(aw.nfaStepIDs[epsilon])
+		}
+	}
+
+	aw.segmentsTree(core.segmentsTree)
+
+	if live != nil {
+		var patterns [][2][]byte
+		err := live.Iterate(func(x X, pattern string) error {
+			encoded, err := aw.encodeX(x)
+			patterns = append(patterns, [2][]byte{encoded, []byte(pattern)})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// for the sake of stable output
+		sort.Slice(patterns, func(i, j int) bool {
+			if c := bytes.Compare(patterns[i][0], patterns[j][0]); c != 0 {
+				return c < 0
+			}
+			return bytes.Compare(patterns[i][1], patterns[j][1]) < 0
+		})
+		aw.uvarint(uint64(len(patterns)))
+		for _, pattern := range patterns {
+			aw.bytes(pattern[0])
+			aw.bytes(pattern[1])
+		}
+	}
+
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(aw.buf))
+	aw.buf = append(aw.buf, checksum[:]...)
+	return nil
+}
+
+// number walks the automaton breadth-first from the start state, numbering everything in it
+func (aw *automatonWriter) number(start *fieldMatcher) {
+	addID(aw.fmIDs, &aw.fieldMatchers, start)
+	var fmDone, vmDone, dfaTableDone, dfaStepDone, nfaTableDone, nfaStepListDone, nfaStepDone int
+	for {
+		progress := false
+		for ; fmDone < len(aw.fieldMatchers); fmDone++ {
+			progress = true
+			fields := aw.fieldMatchers[fmDone].fields()
+			for _, x := range fields.matches {
+				if _, ok := aw.xIDs[x]; !ok {
+					aw.xIDs[x] = uint64(len(aw.xs))
+					aw.xs = append(aw.xs, x)
+				}
+			}
+			for _, path := range sortedKeys(fields.transitions) {
+				addID(aw.vmIDs, &aw.valueMatchers, fields.transitions[path])
+			}
+			for _, path := range sortedKeys(fields.existsTrue) {
+				addID(aw.fmIDs, &aw.fieldMatchers, fields.existsTrue[path])
+			}
+			for _, path := range sortedKeys(fields.existsFalse) {
+				addID(aw.fmIDs, &aw.fieldMatchers, fields.existsFalse[path])
+			}
+		}
+		for ; vmDone < len(aw.valueMatchers); vmDone++ {
+			progress = true
+			fields := aw.valueMatchers[vmDone].getFields()
+			if fields.startDfa != nil {
+				addID(aw.dfaTableIDs, &aw.dfaTables, fields.startDfa)
+			}
+			if fields.startNfa != nil {
+				addID(aw.nfaTableIDs, &aw.nfaTables, fields.startNfa)
+			}
+			if fields.singletonTransition != nil {
+				addID(aw.fmIDs, &aw.fieldMatchers, fields.singletonTransition)
+			}
+		}
+		for ; dfaTableDone < len(aw.dfaTables); dfaTableDone++ {
+			progress = true
+			for _, step := range aw.dfaTables[dfaTableDone].steps {
+				if step != nil {
+					addID(aw.dfaStepIDs, &aw.dfaSteps, step)
+				}
+			}
+		}
+		for ; dfaStepDone < len(aw.dfaSteps); dfaStepDone++ {
+			progress = true
+			step := aw.dfaSteps[dfaStepDone]
+			addID(aw.dfaTableIDs, &aw.dfaTables, step.table)
+			for _, fm := range step.fieldTransitions {
+				addID(aw.fmIDs, &aw.fieldMatchers, fm)
+			}
+		}
+		for ; nfaTableDone < len(aw.nfaTables); nfaTableDone++ {
+			progress = true
+			for _, list := range aw.nfaTables[nfaTableDone].steps {
+				if list != nil {
+					addID(aw.nfaStepListIDs, &aw.nfaStepLists, list)
+				}
+			}
+		}
+		for ; nfaStepListDone < len(aw.nfaStepLists); nfaStepListDone++ {
+			progress = true
+			for _, step := range aw.nfaStepLists[nfaStepListDone].steps {
+				addID(aw.nfaStepIDs, &aw.nfaSteps, step)
+			}
+		}
+		for ; nfaStepDone < len(aw.nfaSteps); nfaStepDone++ {
+			progress = true
+			step := aw.nfaSteps[nfaStepDone]
+			addID(aw.nfaTableIDs, &aw.nfaTables, step.table)
+			for _, fm := range step.fieldTransitions {
+				addID(aw.fmIDs, &aw.fieldMatchers, fm)
+			}
+			for _, epsilon := range step.epsilon {
+				addID(aw.nfaStepIDs, &aw.nfaSteps, epsilon)
+			}
+		}
+		if !progress {
+			return
+		}
+	}
+}
+
+// addID gives a thing the next number, if it doesn't have one yet
+func addID[T comparable](ids map[T]uint64, things *[]T, thing T) {
+	if _, ok := ids[thing]; !ok {
+		ids[thing] = uint64(len(*things))
+		*things = append(*things, thing)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ref writes the number of something that may be nil
+func (aw *automatonWriter) ref(ids any, thing any) {
+	var id uint64
+	var ok bool
+	switch t := thing.(type) {
+	case *smallTable[*dfaStep]:
+		id, ok = ids.(map[*smallTable[*dfaStep]]uint64)[t]
+	case *smallTable[*nfaStepList]:
+		id, ok = ids.(map[*smallTable[*nfaStepList]]uint64)[t]
+	case *dfaStep:
+		id, ok = ids.(map[*dfaStep]uint64)[t]
+	case *nfaStepList:
+		id, ok = ids.(map[*nfaStepList]uint64)[t]
+	case *fieldMatcher:
+		id, ok = ids.(map[*fieldMatcher]uint64)[t]
+	}
+	if ok {
+		aw.uvarint(id + 1)
+	} else {
+		aw.uvarint(0)
+	}
+}
+
+func (aw *automatonWriter) fieldMatcherList(fms []*fieldMatcher) {
+	aw.uvarint(uint64(len(fms)))
+	for _, fm := range fms {
+		aw.uvarint(aw.fmIDs[fm])
+	}
+}
+
+func (aw *automatonWriter) segmentsTree(tree *segmentsTree) {
+	if tree.root {
+		aw.uvarint(1)
+	} else {
+		aw.uvarint(0)
+	}
+	names := sortedKeys(tree.fields)
+	aw.uvarint(uint64(len(names)))
+	for _, name := range names {
+		aw.bytes([]byte(name))
+		aw.bytes(tree.fields[name])
+	}
+	names = sortedKeys(tree.presence)
+	aw.uvarint(uint64(len(names)))
+	for _, name := range names {
+		aw.bytes([]byte(name))
+	}
+	names = sortedKeys(tree.nodes)
+	aw.uvarint(uint64(len(names)))
+	for _, name := range names {
+		aw.bytes([]byte(name))
+		aw.segmentsTree(tree.nodes[name])
+	}
+}
+
+func (aw *automatonWriter) x(x X) error {
+	encoded, err := aw.encodeX(x)
+	if err != nil {
+		return err
+	}
+	aw.bytes(encoded)
+	return nil
+}
+
+func (aw *automatonWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	aw.buf = append(aw.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (aw *automatonWriter) bytes(b []byte) {
+	aw.uvarint(uint64(len(b)))
+	aw.buf = append(aw.buf, b...)
+}
+
+// automatonReader reads what automatonWriter wrote. Since the data may have been damaged, or made up, everything
+// is checked, so that nothing that would make matching go wrong is loaded. Once there's an error, everything
+// returns zero values, and the error is reported at the end.
+type automatonReader struct {
+	data    []byte
+	pos     int
+	err     error
+	decodeX func(b []byte) (X, error)
+}
+
+func (ar *automatonReader) read(flags uint64) (*coreFields, LivePatternsState, error) {
+	if len(ar.data) < len(automatonMagic)+4 || !bytes.HasPrefix(ar.data, automatonMagic) {
+		return nil, nil, errors.New("not a saved automaton")
+	}
+	end := len(ar.data) - 4
+	if crc32.ChecksumIEEE(ar.data[:end]) != binary.LittleEndian.Uint32(ar.data[end:]) {
+		return nil, nil, errors.New("checksum mismatch")
+	}
+	ar.data = ar.data[:end]
+	ar.pos = len(automatonMagic)
+	if version := ar.uvarint(); version != automatonVersion {
+		return nil, nil, fmt.Errorf("unsupported version %d", version)
+	}
+	if saved := ar.uvarint(); saved != flags {
+		return nil, nil, errors.New("saved from an instance with different options")
+	}
+
+	xs := make([]X, ar.count())
+	for i := range xs {
+		encoded := ar.bytes()
+		if ar.err != nil {
+			break
+		}
+		var err error
+		if xs[i], err = ar.decodeX(encoded); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fieldMatchers := make([]*fieldMatcher, ar.count())
+	valueMatchers := make([]*valueMatcher, ar.count())
+	dfaTables := make([]*smallTable[*dfaStep], ar.count())
+	dfaSteps := make([]*dfaStep, ar.count())
+	nfaTables := make([]*smallTable[*nfaStepList], ar.count())
+	nfaStepLists := make([]*nfaStepList, ar.count())
+	nfaSteps := make([]*nfaStep, ar.count())
+	if ar.err == nil && len(fieldMatchers) == 0 {
+		return nil, nil, errors.New("no start state")
+	}
+	for i := range fieldMatchers {
+		fieldMatchers[i] = &fieldMatcher{}
+	}
+	for i := range valueMatchers {
+		valueMatchers[i] = &valueMatcher{}
+	}
+	for i := range dfaTables {
+		dfaTables[i] = &smallTable[*dfaStep]{}
+	}
+	for i := range dfaSteps {
+		dfaSteps[i] = &dfaStep{}
+	}
+	for i := range nfaTables {
+		nfaTables[i] = &smallTable[*nfaStepList]{}
+	}
+	for i := range nfaStepLists {
+		nfaStepLists[i] = &nfaStepList{}
+	}
+	for i := range nfaSteps {
+		nfaSteps[i] = &nfaStep{}
+	}
+
+	for _, fm := range fieldMatchers {
+		fields := &fmFields{
+			transitions: make(map[string]*valueMatcher),
+			existsTrue:  make(map[string]*fieldMatcher),
+			existsFalse: make(map[string]*fieldMatcher),
+		}
+		if n := ar.count(); n > 0 {
+			fields.matches = make([]X, n)
+			for i := range fields.matches {
+				fields.matches[i] = pick(ar, xs)
+			}
+		}
+		for n := ar.count(); n > 0; n-- {
+			path := string(ar.bytes())
+			fields.transitions[path] = pick(ar, valueMatchers)
+		}
+		for _, exists := range []map[string]*fieldMatcher{fields.existsTrue, fields.existsFalse} {
+			for n := ar.count(); n > 0; n-- {
+				path := string(ar.bytes())
+				exists[path] = pick(ar, fieldMatchers)
+			}
+		}
+		fm.update(fields)
+	}
+	for _, vm := range valueMatchers {
+		fields := &vmFields{hasNumbers: ar.uvarint() == 1}
+		fields.startDfa = pickOrNil(ar, dfaTables)
+		fields.startNfa = pickOrNil(ar, nfaTables)
+		if ar.uvarint() == 1 {
+			fields.singletonMatch = ar.bytes()
+			fields.singletonTransition = pickOrNil(ar, fieldMatchers)
+			if fields.singletonMatch == nil || fields.singletonTransition == nil {
+				ar.fail("incomplete singleton")
+			}
+		}
+		vm.update(fields)
+	}
+	for _, table := range dfaTables {
+		n := ar.count()
+		table.ceilings = make([]byte, n)
+		table.steps = make([]*dfaStep, n)
+		for i := range table.ceilings {
+			table.ceilings[i] = ar.ceiling(table.ceilings, i)
+			table.steps[i] = pickOrNil(ar, dfaSteps)
+		}
+		ar.checkCeilings(table.ceilings)
+	}
+	for _, step := range dfaSteps {
+		step.table = pick(ar, dfaTables)
+		step.fieldTransitions = ar.fieldMatcherList(fieldMatchers)
+	}
+	for _, table := range nfaTables {
+		n := ar.count()
+		table.ceilings = make([]byte, n)
+		table.steps = make([]*nfaStepList, n)
+		for i := range table.ceilings {
+			table.ceilings[i] = ar.ceiling(table.ceilings, i)
+			table.steps[i] = pickOrNil(ar, nfaStepLists)
+		}
+		ar.checkCeilings(table.ceilings)
+	}
+	for _, list := range nfaStepLists {
+		list.steps = make([]*nfaStep, ar.count())
+		for i := range list.steps {
+			list.steps[i] = pick(ar, nfaSteps)
+		}
+	}
+	for _, step := range nfaSteps {
+		step.table = pick(ar, nfaTables)
+		step.fieldTransitions = ar.fieldMatcherList(fieldMatchers)
+		if n := ar.count(); n > 0 {
+			step.epsilon = make([]*nfaStep, n)
+			for i := range step.epsilon {
+				step.epsilon[i] = pick(ar, nfaSteps)
+			}
+		}
+	}
+
+	if ar.err == nil && hasFieldMatcherLoop(fieldMatchers) {
+		ar.fail("field matchers loop")
+	}
+
+	tree := ar.segmentsTree(0)
+	if ar.err == nil && !tree.root {
+		ar.fail("segments tree has no root")
+	}
+
+	var live *memState
+	if flags&automatonPatternDeletion != 0 {
+		live = newMemState()
+		for n := ar.count(); n > 0; n-- {
+			encoded := ar.bytes()
+			pattern := ar.bytes()
+			if ar.err != nil {
+				break
+			}
+			x, err := ar.decodeX(encoded)
+			if err != nil {
+				return nil, nil, err
+			}
+			_ = live.Add(x, string(pattern))
+		}
+	}
+
+	if ar.err == nil && ar.pos != len(ar.data) {
+		ar.fail("unexpected data at the end")
+	}
+	if ar.err != nil {
+		return nil, nil, ar.err
+	}
+	loaded := &coreFields{state: fieldMatchers[0], segmentsTree: tree}
+	if live == nil {
+		// so as not to return a non-nil interface holding a nil pointer
+		return loaded, nil, nil
+	}
+	return loaded, live, nil
+}
+
+// hasFieldMatcherLoop checks whether a chain of fieldMatchers leads back to one that's already on it. The value
+// automata between them can loop, but the fieldMatchers can't, since each one moves on to later fields, and
+// matching would recurse through such a loop until the stack overflowed.
+func hasFieldMatcherLoop(fieldMatchers []*fieldMatcher) bool {
+	const (
+		unvisited = iota
+		onChain
+		finished
+	)
+	type frame struct {
+		fm   *fieldMatcher
+		next []*fieldMatcher
+	}
+	states := make(map[*fieldMatcher]int, len(fieldMatchers))
+	for _, start := range fieldMatchers {
+		if states[start] != unvisited {
+			continue
+		}
+		states[start] = onChain
+		chain := []frame{{start, nextFieldMatchers(start)}}
+		for len(chain) > 0 {
+			top := &chain[len(chain)-1]
+			if len(top.next) == 0 {
+				states[top.fm] = finished
+				chain = chain[:len(chain)-1]
+				continue
+			}
+			fm := top.next[0]
+			top.next = top.next[1:]
+			switch states[fm] {
+			case onChain:
+				return true
+			case unvisited:
+				states[fm] = onChain
+				chain = append(chain, frame{fm, nextFieldMatchers(fm)})
+			}
+		}
+	}
+	return false
+}
+
+// nextFieldMatchers finds the fieldMatchers that matching can move on to from fm, through its exists
+// transitions and its valueMatchers' automata
+func nextFieldMatchers(fm *fieldMatcher) []*fieldMatcher {
+	fields := fm.fields()
+	var next []*fieldMatcher
+	for _, exists := range []map[string]*fieldMatcher{fields.existsTrue, fields.existsFalse} {
+		for _, target := range exists {
+			next = append(next, target)
+		}
+	}
+	dfaSeen := make(map[*smallTable[*dfaStep]]bool)
+	nfaSeen := make(map[*nfaStep]bool)
+	var dfaTables []*smallTable[*dfaStep]
+	var nfaSteps []*nfaStep
+	for _, vm := range fields.transitions {
+		vmFields := vm.getFields()
+		if vmFields.singletonTransition != nil {
+			next = append(next, vmFields.singletonTransition)
+		}
+		if vmFields.startDfa != nil && !dfaSeen[vmFields.startDfa] {
+			dfaSeen[vmFields.startDfa] = true
+			dfaTables = append(dfaTables, vmFields.startDfa)
+		}
+		if vmFields.startNfa != nil {
+			for _, list := range vmFields.startNfa.steps {
+				if list != nil {
+					nfaSteps = append(nfaSteps, list.steps...)
+				}
+			}
+		}
+	}
+	for len(dfaTables) > 0 {
+		table := dfaTables[len(dfaTables)-1]
+		dfaTables = dfaTables[:len(dfaTables)-1]
+		for _, step := range table.steps {
+			if step == nil {
+				continue
+			}
+			next = append(next, step.fieldTransitions...)
+			if !dfaSeen[step.table] {
+				dfaSeen[step.table] = true
+				dfaTables = append(dfaTables, step.table)
+			}
+		}
+	}
+	for len(nfaSteps) > 0 {
+		step := nfaSteps[len(nfaSteps)-1]
+		nfaSteps = nfaSteps[:len(nfaSteps)-1]
+		if nfaSeen[step] {
+			continue
+		}
+		nfaSeen[step] = true
+		next = append(next, step.fieldTransitions...)
+		nfaSteps = append(nfaSteps, step.epsilon...)
+		for _, list := range step.table.steps {
+			if list != nil {
+				nfaSteps = append(nfaSteps, list.steps...)
+			}
+		}
+	}
+	return next
+}
+
+// pick reads the index of one of the things, returning the zero value if it's out of range, so that callers
+// can carry on until the error is reported
+func pick[T any](ar *automatonReader, things []T) T {
+	var zero T
+	i := ar.uvarint()
+	if i >= uint64(len(things)) {
+		ar.fail("reference out of range")
+		return zero
+	}
+	return things[i]
+}
+
+// pickOrNil is pick for references that may be 0 for nil
+func pickOrNil[T any](ar *automatonReader, things []T) T {
+	var zero T
+	i := ar.uvarint()
+	if i > uint64(len(things)) {
+		ar.fail("reference out of range")
+		return zero
+	}
+	if i == 0 {
+		return zero
+	}
+	return things[i-1]
+}
+
+func (ar *automatonReader) fieldMatcherList(fieldMatchers []*fieldMatcher) []*fieldMatcher {
+	n := ar.count()
+	if n == 0 {
+		return nil
+	}
+	fms := make([]*fieldMatcher, n)
+	for i := range fms {
+		fms[i] = pick(ar, fieldMatchers)
+	}
+	return fms
+}
+
+// segmentsTree reads a segmentsTree node and the nodes under it
+func (ar *automatonReader) segmentsTree(depth int) *segmentsTree {
+	tree := newSegmentsIndexNode(ar.uvarint() == 1)
+	if depth > maxValueDepth {
+		ar.fail("segments tree too deep")
+	}
+	for n := ar.count(); n > 0; n-- {
+		name := string(ar.bytes())
+		tree.fields[name] = ar.bytes()
+	}
+	for n := ar.count(); n > 0; n-- {
+		tree.presence[string(ar.bytes())] = true
+	}
+	for n := ar.count(); n > 0; n-- {
+		name := string(ar.bytes())
+		tree.nodes[name] = ar.segmentsTree(depth + 1)
+	}
+	return tree
+}
+
+// ceiling reads the i'th of a smallTable's ceilings, which mustn't go down
+func (ar *automatonReader) ceiling(ceilings []byte, i int) byte {
+	c := ar.uvarint()
+	if c > uint64(byteCeiling) || (i > 0 && byte(c) < ceilings[i-1]) {
+		ar.fail("bad smallTable")
+		return 0
+	}
+	return byte(c)
+}
+
+// checkCeilings makes sure a smallTable ends with byteCeiling, which smallTable.step depends on
+func (ar *automatonReader) checkCeilings(ceilings []byte) {
+	if len(ceilings) == 0 || ceilings[len(ceilings)-1] != byte(byteCeiling) {
+		ar.fail("bad smallTable")
+	}
+}
+
+// count reads the number of things to follow, each of which takes at least a byte, so it can't be more than
+// the number of bytes left
+func (ar *automatonReader) count() int {
+	n := ar.uvarint()
+	if n > uint64(len(ar.data)-ar.pos) {
+		ar.fail("count too large")
+		return 0
+	}
+	return int(n)
+}
+
+func (ar *automatonReader) uvarint() uint64 {
+	if ar.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(ar.data[ar.pos:])
+	if n <= 0 {
+		ar.fail("bad number")
+		return 0
+	}
+	ar.pos += n
+	return v
+}
+
+func (ar *automatonReader) bytes() []byte {
+	n := ar.count()
+	if ar.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, ar.data[ar.pos:])
+	ar.pos += n
+	return b
+}
+
+func (ar *automatonReader) fail(message string) {
+	if ar.err == nil {
+		ar.err = fmt.Errorf("at offset %d: %s", ar.pos, message)
+	}
+}
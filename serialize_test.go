@@ -0,0 +1,287 @@
+package quamina
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"testing"
+)
+
+var testSavePatterns = map[X]string{
+	"string":     `{"a": ["foo", 3]}`,
+	"prefix":     `{"a": [ {"prefix": "fo"} ]}`,
+	"suffix":     `{"b": [ {"suffix": "ar"} ]}`,
+	"shellstyle": `{"b": [ {"shellstyle": "b*r"} ]}`,
+	"wildcard":   `{"b": [ {"wildcard": "*a*"} ]}`,
+	"regexp":     `{"c": [ {"regexp": "a(b|c)+d"} ]}`,
+	"numeric":    `{"n": [ {"numeric": [">", 10, "<=", 20]} ]}`,
+	"but":        `{"a": [ {"anything-but": ["foo", "bar"]} ]}`,
+	"exists":     `{"x": {"y": [ {"exists": true} ]}}`,
+	"absent":     `{"z": [ {"exists": false} ], "a": ["foo"]}`,
+	"or":         `{"$or": [ {"a": ["bar"]}, {"n": [17]} ]}`,
+	"case":       `{"c": [ {"equals-ignore-case": "HeLLo"} ]}`,
+	"cidr":       `{"ip": [ {"cidr": "10.0.0.0/8"} ]}`,
+	"nested":     `{"x": {"list": {"k": ["v"]}}}`,
+}
+
+var testSaveEvents = []string{
+	`{"a": "foo", "b": "bar", "n": 15}`,
+	`{"a": "bar", "n": 17, "z": 1}`,
+	`{"a": 3, "c": "abcbd", "ip": "10.1.2.3"}`,
+	`{"a": "fox", "b": "bzzzr", "c": "hello", "ip": "11.0.0.1"}`,
+	`{"x": {"y": {"deep": true}, "list": [{"k": "v"}, {"k": "w"}]}}`,
+	`{"c": "ad", "n": 20.0, "b": "xax"}`,
+}
+
+func newSaveQuamina(t *testing.T, opts ...Option) *Quamina {
+	t.Helper()
+	q, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestPatterns(t, q, testSavePatterns)
+	return q
+}
+
+// sameMatches checks that two instances match testSaveEvents the same way
+func sameMatches(t *testing.T, wanted *Quamina, got *Quamina) {
+	t.Helper()
+	for _, event := range testSaveEvents {
+		w, err := wanted.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := got.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w) == 0 {
+			t.Errorf("%s matched nothing", event)
+		}
+		checkMatches(t, event, g, w)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	for _, opts := range [][]Option{
+		{},
+		{WithNumberCanonicalization(true)},
+		{WithPatternDeletion(true)},
+	} {
+		q := newSaveQuamina(t, opts...)
+		var saved bytes.Buffer
+		if err := q.Save(&saved, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// the same automaton always comes out the same
+		var again bytes.Buffer
+		_ = q.Save(&again, nil)
+		if !bytes.Equal(saved.Bytes(), again.Bytes()) {
+			t.Error("saved automata differ")
+		}
+
+		loaded, err := New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied := loaded.Copy()
+		if err = loaded.Load(bytes.NewReader(saved.Bytes()), nil); err != nil {
+			t.Fatal(err)
+		}
+		sameMatches(t, q, loaded)
+		sameMatches(t, q, copied)
+
+		// what was loaded can be saved again, and added to
+		again.Reset()
+		_ = loaded.Save(&again, nil)
+		if !bytes.Equal(saved.Bytes(), again.Bytes()) {
+			t.Error("reloaded automaton differs")
+		}
+		if err = loaded.AddPattern("more", `{"more": [true]}`); err != nil {
+			t.Fatal(err)
+		}
+		matches, _ := loaded.MatchesForEvent([]byte(`{"more": true, "a": "foo"}`))
+		if !containsX(matches, "more") || !containsX(matches, "string") {
+			t.Errorf("after adding: %v", matches)
+		}
+	}
+}
+
+func TestSaveLoadDeletion(t *testing.T) {
+	q := newSaveQuamina(t, WithPatternDeletion(true))
+	_ = q.DeletePatterns("string")
+	var saved bytes.Buffer
+	if err := q.Save(&saved, nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := New(WithPatternDeletion(true))
+	if err := loaded.Load(&saved, nil); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := loaded.MatchesForEvent([]byte(`{"a": "foo"}`))
+	if containsX(matches, "string") || !containsX(matches, "prefix") {
+		t.Errorf("got %v", matches)
+	}
+	if live := loaded.matcher.(*prunerMatcher).getStats().Live; live != len(testSavePatterns)-1 {
+		t.Errorf("live: %d", live)
+	}
+	_ = loaded.DeletePatterns("prefix")
+	matches, _ = loaded.MatchesForEvent([]byte(`{"a": "foo"}`))
+	if containsX(matches, "prefix") {
+		t.Errorf("after deleting: %v", matches)
+	}
+}
+
+func TestSaveLoadXCodec(t *testing.T) {
+	q, _ := New()
+	for i := 0; i < 10; i++ {
+		if err := q.AddPattern(i, fmt.Sprintf(`{"n": [%d]}`, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var saved bytes.Buffer
+	if err := q.Save(&saved, nil); err == nil {
+		t.Error("saved int X values without an encoder")
+	}
+	encode := func(x X) ([]byte, error) { return []byte(strconv.Itoa(x.(int))), nil }
+	decode := func(b []byte) (X, error) { return strconv.Atoi(string(b)) }
+	if err := q.Save(&saved, encode); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := New()
+	if err := loaded.Load(bytes.NewReader(saved.Bytes()), decode); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := loaded.MatchesForEvent([]byte(`{"n": 7}`))
+	if len(matches) != 1 || matches[0] != 7 {
+		t.Errorf("got %v", matches)
+	}
+	failing := func(b []byte) (X, error) { return nil, fmt.Errorf("no") }
+	if err := loaded.Load(bytes.NewReader(saved.Bytes()), failing); err == nil {
+		t.Error("decoder error not returned")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	q := newSaveQuamina(t)
+	var buf bytes.Buffer
+	_ = q.Save(&buf, nil)
+	saved := buf.Bytes()
+
+	loaded, _ := New()
+	bad := map[string][]byte{
+		"empty":     {},
+		"magic":     append([]byte("QUAMINA\x00"), saved[len(automatonMagic):]...),
+		"truncated": saved[:len(saved)/2],
+		"flipped":   flipByte(saved, len(saved)/2),
+	}
+	for name, data := range bad {
+		if err := loaded.Load(bytes.NewReader(data), nil); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	canonical, _ := New(WithNumberCanonicalization(true))
+	if err := canonical.Load(bytes.NewReader(saved), nil); err == nil {
+		t.Error("accepted automaton saved with different options")
+	}
+	stored, _ := New(WithPatternStorage(newMemState()))
+	if err := stored.Load(bytes.NewReader(saved), nil); err == nil {
+		t.Error("loaded into an instance with pattern storage")
+	}
+
+	// a failed Load leaves things as they were
+	if err := loaded.Load(bytes.NewReader(saved), nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = loaded.Load(bytes.NewReader(saved[:len(saved)-1]), nil)
+	sameMatches(t, q, loaded)
+
+	// damage that gets past the checksum still mustn't cause trouble
+	for i := len(automatonMagic); i < len(saved)-4; i++ {
+		data := flipByte(saved, i)[:len(saved)-4]
+		data = append(data, 0, 0, 0, 0)
+		binaryPutChecksum(data)
+		fresh, _ := New()
+		if fresh.Load(bytes.NewReader(data), nil) == nil {
+			for _, event := range testSaveEvents {
+				_, _ = fresh.MatchesForEvent([]byte(event))
+			}
+		}
+	}
+}
+
+func flipByte(data []byte, i int) []byte {
+	flipped := append([]byte{}, data...)
+	flipped[i] ^= 0x5a
+	return flipped
+}
+
+// binaryPutChecksum replaces the checksum at the end of a saved automaton
+func binaryPutChecksum(data []byte) {
+	end := len(data) - 4
+	binary.LittleEndian.PutUint32(data[end:], crc32.ChecksumIEEE(data[:end]))
+}
+
+func TestLoadFieldMatcherLoop(t *testing.T) {
+	q, _ := New()
+	if err := q.AddPattern("absent", `{"b": [ {"exists": false} ]}`); err != nil {
+		t.Fatal(err)
+	}
+	// point the exists:false transition back at the start state; Save can write that, but Load mustn't accept it
+	start := q.matcher.(*coreMatcher).fields().state
+	fields := start.fields()
+	looped := &fmFields{transitions: fields.transitions, existsTrue: fields.existsTrue, existsFalse: map[string]*fieldMatcher{}}
+	for path := range fields.existsFalse {
+		looped.existsFalse[path] = start
+	}
+	start.update(looped)
+	var saved bytes.Buffer
+	if err := q.Save(&saved, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _ := New()
+	if err := loaded.Load(&saved, nil); err == nil {
+		t.Error("loaded an automaton whose field matchers loop")
+	}
+	matches, err := loaded.MatchesForEvent([]byte(`{"a": 1}`))
+	if err != nil || len(matches) != 0 {
+		t.Errorf("after failed Load: %v %v", matches, err)
+	}
+}
+
+func TestLoadWhileMatching(t *testing.T) {
+	q := newSaveQuamina(t, WithPatternDeletion(true))
+	var saved bytes.Buffer
+	if err := q.Save(&saved, nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := New(WithPatternDeletion(true))
+	copied := loaded.Copy()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, _ = copied.MatchesForEvent([]byte(testSaveEvents[0]))
+			_ = copied.AddPattern("more", `{"more": [true]}`)
+			_ = copied.DeletePatterns("more")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := loaded.Load(bytes.NewReader(saved.Bytes()), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+	sameMatches(t, q, copied)
+}
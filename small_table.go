@@ -8,9 +8,11 @@ type dfaStep struct {
 	fieldTransitions []*fieldMatcher
 }
 
+// an nfaStep may also have epsilon transitions, to steps that can be reached without consuming a byte
 type nfaStep struct {
 	table            *smallTable[*nfaStepList]
 	fieldTransitions []*fieldMatcher
+	epsilon          []*nfaStep
 }
 
 // struct wrapper to make this comparable to help with pack/unpack
@@ -90,6 +92,54 @@ func mergeDfas(existing, newStep *smallTable[*dfaStep]) *smallTable[*dfaStep] {
 	return mergeOneDfaStep(step1, step2, make(map[dfaStepKey]*dfaStep)).table
 }
 
+// mergeNfas combines two NFAs into one which matches anything either of them does. Unlike mergeDfas, it doesn't
+// try to produce a deterministic result, so it never has to build steps for combinations of states, which is
+// how merging automata that contain loops can blow up. Where both NFAs have a single step on the same byte it
+// merges those, so that the NFAs share their common prefixes, but this only follows the new NFA's steps as long
+// as they have no epsilon transitions and haven't been seen before, which means it can't go around a loop. Once
+// that stops, the step lists are simply combined. Nothing in either NFA is modified, which means that concurrent
+// readers of the existing NFA are unaffected.
+func mergeNfas(existing, newStart *smallTable[*nfaStepList]) *smallTable[*nfaStepList] {
+	step1 := &nfaStep{table: existing}
+	step2 := &nfaStep{table: newStart}
+	return mergeOneNfaStep(step1, step2, make(map[*nfaStep]bool)).table
+}
+
+func mergeOneNfaStep(step1, step2 *nfaStep, visited map[*nfaStep]bool) *nfaStep {
+	visited[step2] = true
+	combined := &nfaStep{table: newSmallTable[*nfaStepList]()}
+	combined.fieldTransitions = append(combined.fieldTransitions, step1.fieldTransitions...)
+	combined.fieldTransitions = append(combined.fieldTransitions, step2.fieldTransitions...)
+	combined.epsilon = append(combined.epsilon, step1.epsilon...)
+	combined.epsilon = append(combined.epsilon, step2.epsilon...)
+
+	uExisting := unpackTable(step1.table)
+	uNew := unpackTable(step2.table)
+	var uComb unpackedTable[*nfaStepList]
+	for i, listExisting := range uExisting {
+		listNew := uNew[i]
+		switch {
+		case listNew == nil:
+			uComb[i] = listExisting
+		case listExisting == nil:
+			uComb[i] = listNew
+		case i > 0 && listExisting == uExisting[i-1] && listNew == uNew[i-1]:
+			// there are considerable runs of the same value
+			uComb[i] = uComb[i-1]
+		case len(listExisting.steps) == 1 && len(listNew.steps) == 1 &&
+			listNew.steps[0].epsilon == nil && !visited[listNew.steps[0]]:
+			merged := mergeOneNfaStep(listExisting.steps[0], listNew.steps[0], visited)
+			uComb[i] = &nfaStepList{steps: []*nfaStep{merged}}
+		default:
+			steps := make([]*nfaStep, 0, len(listExisting.steps)+len(listNew.steps))
+			steps = append(steps, listExisting.steps...)
+			uComb[i] = &nfaStepList{steps: append(steps, listNew.steps...)}
+		}
+	}
+	combined.table.pack(&uComb)
+	return combined
+}
+
 // dfaStepKey exists to serve as the key for the memoize map that's needed to control recursion in mergeAutomata
 type dfaStepKey struct {
 	step1 *dfaStep
@@ -147,62 +197,67 @@ func mergeOneDfaStep(step1, step2 *dfaStep, memoize map[dfaStepKey]*dfaStep) *df
 	return combined
 }
 
-// nfa2Dfa does what the name says. As of now it does not consider epsilon
-// transitions in the NFA because, as of the time of writing, none of the
-// pattern-matching required those transitions.  It is based on the algorithm
+// nfa2Dfa does what the name says, by the classic subset construction in which each dfaStep
+// stands for the set of nfaSteps the NFA could be in. Epsilon transitions are handled by taking
+// the epsilon closure of each set, i.e. adding every step reachable from its members without
+// consuming a byte. dfaMemory ensures each distinct set produces only one dfaStep. The empty set
+// produces nil rather than a dead-end dfaStep, because mergeDfas would otherwise make copies of
+// the automaton on the other side of the merge. It is based on the algorithm
 // taught in the TU München course “Automata and Formal Languages”, lecturer
 // Prof. Dr. Ernst W. Mayr in 2014-15, in particular the examples appearing in
 // http://wwwmayr.informatik.tu-muenchen.de/lehre/2014WS/afs/2014-10-14.pdf
 // especially the slide in Example 11.
 func nfa2Dfa(table *smallTable[*nfaStepList]) *smallTable[*dfaStep] {
-	firstStep := &nfaStepList{steps: []*nfaStep{{table: table}}}
-	return nfaStep2DfaStep(firstStep, newDfaMemory()).table
+	firstStep := &nfaStep{table: table}
+	return nfaStep2DfaStep(epsilonClosure([]*nfaStep{firstStep}), newDfaMemory()).table
 }
 
-func nfaStep2DfaStep(stepList *nfaStepList, memoize *dfaMemory) *dfaStep {
-	var dStep *dfaStep
-	dStep, ok := memoize.dfaForNfas(stepList.steps...)
+// nfaStep2DfaStep returns the dfaStep for a set of nfaSteps, which must already be epsilon-closed
+func nfaStep2DfaStep(steps []*nfaStep, memoize *dfaMemory) *dfaStep {
+	if len(steps) == 0 {
+		return nil
+	}
+	dStep, ok := memoize.dfaForNfas(steps...)
 	if ok {
 		return dStep
 	}
 	dStep = &dfaStep{
 		table: &smallTable[*dfaStep]{},
 	}
-	memoize.rememberDfaForList(dStep, stepList.steps...)
-	if len(stepList.steps) == 1 {
-		// there's only stepList.steps[0]
-		nStep := stepList.steps[0]
+	memoize.rememberDfaForList(dStep, steps...)
+	if len(steps) == 1 {
+		// there's only steps[0], whose table can be followed entry by entry
+		nStep := steps[0]
 		dStep.fieldTransitions = nStep.fieldTransitions
 		dStep.table.ceilings = make([]byte, len(nStep.table.ceilings))
 		dStep.table.steps = make([]*dfaStep, len(nStep.table.ceilings)) // defaults will be nil, which is OK
 		for i, nfaList := range nStep.table.steps {
 			dStep.table.ceilings[i] = nStep.table.ceilings[i]
 			if nfaList != nil {
-				dStep.table.steps[i] = nfaStep2DfaStep(nfaList, memoize)
+				dStep.table.steps[i] = nfaStep2DfaStep(epsilonClosure(nfaList.steps), memoize)
 			}
 		}
 	} else {
 		// coalesce - first, unpack each of the steps
-		unpackedNfaSteps := make([]*unpackedTable[*nfaStepList], len(stepList.steps))
+		unpackedNfaSteps := make([]*unpackedTable[*nfaStepList], len(steps))
 		var unpackedDfa unpackedTable[*dfaStep]
-		for i, list := range stepList.steps {
-			unpackedNfaSteps[i] = unpackTable(list.table)
-			dStep.fieldTransitions = append(dStep.fieldTransitions, list.fieldTransitions...)
+		for i, step := range steps {
+			unpackedNfaSteps[i] = unpackTable(step.table)
+			dStep.fieldTransitions = append(dStep.fieldTransitions, step.fieldTransitions...)
 		}
 		for utf8Byte := 0; utf8Byte < byteCeiling; utf8Byte++ {
-			steps := make(map[*nfaStep]bool)
+			// there are considerable runs of the same value
+			if utf8Byte > 0 && sameAsPreviousByte(unpackedNfaSteps, utf8Byte) {
+				unpackedDfa[utf8Byte] = unpackedDfa[utf8Byte-1]
+				continue
+			}
+			var targets []*nfaStep
 			for _, table := range unpackedNfaSteps {
 				if table[utf8Byte] != nil {
-					for _, step := range table[utf8Byte].steps {
-						steps[step] = true
-					}
+					targets = append(targets, table[utf8Byte].steps...)
 				}
 			}
-			var synthStep nfaStepList
-			for step := range steps {
-				synthStep.steps = append(synthStep.steps, step)
-			}
-			unpackedDfa[utf8Byte] = nfaStep2DfaStep(&synthStep, memoize)
+			unpackedDfa[utf8Byte] = nfaStep2DfaStep(epsilonClosure(targets), memoize)
 		}
 		dStep.table.pack(&unpackedDfa)
 	}
@@ -210,6 +265,15 @@ func nfaStep2DfaStep(stepList *nfaStepList, memoize *dfaMemory) *dfaStep {
 	return dStep
 }
 
+func sameAsPreviousByte(tables []*unpackedTable[*nfaStepList], utf8Byte int) bool {
+	for _, table := range tables {
+		if table[utf8Byte] != table[utf8Byte-1] {
+			return false
+		}
+	}
+	return true
+}
+
 // makeSmallDfaTable creates a pre-loaded small table, with all bytes not otherwise specified having the defaultStep
 // value, and then a few other values with their indexes and values specified in the other two arguments. The
 // goal is to reduce memory churn
@@ -16,6 +16,7 @@ type stats struct {
 	stEntries  int
 	stMax      int
 	stVisited  map[any]bool
+	nfaVisited map[*nfaStep]bool
 	siCount    int
 }
 
@@ -23,9 +24,10 @@ type stats struct {
 // the transition tables, returning this information in string form
 func matcherStats(m *coreMatcher) string {
 	s := stats{
-		fmVisited: make(map[*fieldMatcher]bool),
-		vmVisited: make(map[*valueMatcher]bool),
-		stVisited: make(map[any]bool),
+		fmVisited:  make(map[*fieldMatcher]bool),
+		vmVisited:  make(map[*valueMatcher]bool),
+		stVisited:  make(map[any]bool),
+		nfaVisited: make(map[*nfaStep]bool),
 	}
 	fmStats(m.fields().state, &s)
 	avgFmSize := fmt.Sprintf("%.3f", float64(s.fmEntries)/float64(s.fmTblCount))
@@ -73,6 +75,9 @@ func vmStats(m *valueMatcher, s *stats) {
 	if state.startDfa != nil {
 		dfaStats(state.startDfa, s)
 	}
+	if state.startNfa != nil {
+		nfaStats(state.startNfa, s)
+	}
 }
 
 func dfaStats(t *smallTable[*dfaStep], s *stats) {
@@ -100,3 +105,40 @@ func dfaStats(t *smallTable[*dfaStep], s *stats) {
 		}
 	}
 }
+
+func nfaStats(t *smallTable[*nfaStepList], s *stats) {
+	if s.stVisited[t] {
+		return
+	}
+	s.stVisited[t] = true
+	s.stCount++
+	tSize := len(t.ceilings)
+	if tSize > 1 {
+		if tSize > s.stMax {
+			s.stMax = tSize
+		}
+		s.stTblCount++
+		s.stEntries += len(t.ceilings)
+	}
+	for _, list := range t.steps {
+		if list != nil {
+			for _, step := range list.steps {
+				nfaStepStats(step, s)
+			}
+		}
+	}
+}
+
+func nfaStepStats(step *nfaStep, s *stats) {
+	if s.nfaVisited[step] {
+		return
+	}
+	s.nfaVisited[step] = true
+	for _, m := range step.fieldTransitions {
+		fmStats(m, s)
+	}
+	nfaStats(step.table, s)
+	for _, next := range step.epsilon {
+		nfaStepStats(next, s)
+	}
+}
@@ -0,0 +1,214 @@
+package quamina
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// recordSeparator begins each JSON text in an RFC 7464 JSON text sequence
+const recordSeparator = 0x1e
+
+// streamBufferSize is the size of the buffer used to read streams; events longer than this still work, but
+// have to be copied
+const streamBufferSize = 64 * 1024
+
+// MatchStream reads Events from r and calls fn with each of them and the X values of the Patterns it matches,
+// in the order they were read. The Events in the stream may be separated by newlines, as in NDJSON (also known
+// as JSON Lines), or each preceded by an ASCII RS character, as in the JSON text sequences of RFC 7464, which
+// lets Events contain newlines; whichever the stream starts with is used throughout. Whitespace around Events
+// is ignored, and so are empty records.
+//
+// The event slice passed to fn is only valid until fn returns, since the buffer it's in is reused. If fn returns
+// an error, MatchStream stops and returns that error. It also stops, returning an error that says which Event was
+// at fault, if an Event can't be flattened, or if reading from r fails. Otherwise it returns nil once r is
+// exhausted.
+func (q *Quamina) MatchStream(r io.Reader, fn func(event []byte, matches []X) error) error {
+	events := newEventSplitter(r)
+	for eventNumber := 1; ; eventNumber++ {
+		event, err := events.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		matches, err := q.MatchesForEvent(event)
+		if err != nil {
+			return fmt.Errorf("event %d: %w", eventNumber, err)
+		}
+		if err = fn(event, matches); err != nil {
+			return err
+		}
+	}
+}
+
+// MatchStreamConcurrently is like MatchStream, but matches Events on the given number of goroutines, each using
+// a Copy of this instance. fn is still called on the caller's goroutine, one Event at a time, in the order the
+// Events were read, so it needs no locking. When MatchStreamConcurrently returns, the matching goroutines have
+// finished. If it returns early, because fn returned an error or an Event couldn't be flattened, it doesn't wait
+// for the goroutine reading r, which may be blocked in a call to r's Read method; that goroutine finishes, without
+// reading any further, when the call returns. So r shouldn't be used again until then.
+func (q *Quamina) MatchStreamConcurrently(r io.Reader, workers int, fn func(event []byte, matches []X) error) error {
+	if workers <= 1 {
+		return q.MatchStream(r, fn)
+	}
+
+	// streamJobs carry Events from the reader to the workers and on to fn, in order, and are then reused, so
+	// there are never more than this many Events in memory
+	free := make(chan *streamJob, 2*workers)
+	for i := 0; i < cap(free); i++ {
+		free <- &streamJob{done: make(chan struct{}, 1)}
+	}
+	work := make(chan *streamJob, cap(free))
+	ordered := make(chan *streamJob, cap(free))
+	stop := make(chan struct{})
+	var readErr error
+	var wg sync.WaitGroup
+
+	// the reader isn't waited for, since r may block; readErr is safe to read once ordered is closed
+	go func() {
+		defer close(work)
+		defer close(ordered)
+		events := newEventSplitter(r)
+		for eventNumber := 1; ; eventNumber++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			event, err := events.next()
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+			var job *streamJob
+			select {
+			case job = <-free:
+			case <-stop:
+				return
+			}
+			job.number = eventNumber
+			job.event = append(job.event[:0], event...)
+			// both channels have room for every job, so these sends don't block
+			work <- job
+			ordered <- job
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(q *Quamina) {
+			defer wg.Done()
+			for {
+				var job *streamJob
+				var ok bool
+				select {
+				case job, ok = <-work:
+				case <-stop:
+					return
+				}
+				if !ok {
+					return
+				}
+				job.matches, job.err = q.MatchesForEvent(job.event)
+				job.done <- struct{}{}
+			}
+		}(q.Copy())
+	}
+
+	err := func() error {
+		for job := range ordered {
+			<-job.done
+			if job.err != nil {
+				return fmt.Errorf("event %d: %w", job.number, job.err)
+			}
+			if err := fn(job.event, job.matches); err != nil {
+				return err
+			}
+			job.matches = nil
+			free <- job
+		}
+		return nil
+	}()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// streamJob is an Event being matched by MatchStreamConcurrently
+type streamJob struct {
+	number  int
+	event   []byte
+	matches []X
+	err     error
+	done    chan struct{}
+}
+
+// eventSplitter splits a stream into Events
+type eventSplitter struct {
+	reader    *bufio.Reader
+	delimiter byte // '\n' or recordSeparator, once the start of the stream has been seen
+	long      []byte
+}
+
+func newEventSplitter(r io.Reader) *eventSplitter {
+	return &eventSplitter{reader: bufio.NewReaderSize(r, streamBufferSize)}
+}
+
+// next returns the next Event, which is only valid until the following call, or io.EOF if there are no more
+func (s *eventSplitter) next() ([]byte, error) {
+	if s.delimiter == 0 {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		record, err := s.reader.ReadSlice(s.delimiter)
+		if err == bufio.ErrBufferFull {
+			s.long = append(s.long[:0], record...)
+			for err == bufio.ErrBufferFull {
+				record, err = s.reader.ReadSlice(s.delimiter)
+				s.long = append(s.long, record...)
+			}
+			record = s.long
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		record = bytes.Trim(record, " \t\r\n\x1e")
+		if len(record) > 0 {
+			return record, nil
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+}
+
+// start looks at the first byte of the stream other than whitespace to see how Events are separated
+func (s *eventSplitter) start() error {
+	for {
+		c, err := s.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case recordSeparator:
+			s.delimiter = recordSeparator
+		default:
+			s.delimiter = '\n'
+			_ = s.reader.UnreadByte()
+		}
+		return nil
+	}
+}
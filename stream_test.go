@@ -0,0 +1,171 @@
+package quamina
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func streamTestQuamina(t *testing.T) *Quamina {
+	t.Helper()
+	q, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("even", `{"n": [0, 2, 4, 6, 8]}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.AddPattern("big", `{"n": [ {"numeric": [">=", 5]} ]}`); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// streamSummary describes what a stream callback saw as e.g. "1: 2:even", each event being identified by its n
+func streamSummary(q *Quamina, workers int, stream string) (string, error) {
+	var seen []string
+	err := q.MatchStreamConcurrently(strings.NewReader(stream), workers, func(event []byte, matches []X) error {
+		var e struct{ N int }
+		if err := json.Unmarshal(event, &e); err != nil {
+			return err
+		}
+		var names []string
+		for _, m := range matches {
+			names = append(names, m.(string))
+		}
+		seen = append(seen, fmt.Sprintf("%d:%s", e.N, strings.Join(names, ",")))
+		return nil
+	})
+	return strings.Join(seen, " "), err
+}
+
+func TestMatchStreamFormats(t *testing.T) {
+	q := streamTestQuamina(t)
+	tests := []struct {
+		stream string
+		wanted string
+	}{
+		{`{"n": 1}` + "\n" + `{"n": 2}` + "\n", "1: 2:even"},
+		{`{"n": 1}` + "\n" + `{"n": 2}`, "1: 2:even"},
+		{"\n\n  " + `{"n": 1}` + "\r\n\r\n" + `{"n": 2}` + "\r\n  \n", "1: 2:even"},
+		{"\x1e" + `{"n": 1}` + "\n\x1e" + `{"n": 2}` + "\n", "1: 2:even"},
+		{"\x1e{\n  \"n\": 1\n}\n\x1e\x1e{\n\"n\": 2}", "1: 2:even"},
+		{"", ""},
+		{" \n\n", ""},
+	}
+	for _, test := range tests {
+		for _, workers := range []int{1, 3} {
+			got, err := streamSummary(q, workers, test.stream)
+			if err != nil {
+				t.Errorf("%q: %s", test.stream, err.Error())
+			}
+			if got != test.wanted {
+				t.Errorf("%q with %d workers: wanted %q got %q", test.stream, workers, test.wanted, got)
+			}
+		}
+	}
+}
+
+func TestMatchStreamOrder(t *testing.T) {
+	q := streamTestQuamina(t)
+	var stream, wanted []string
+	for i := 0; i < 10000; i++ {
+		n := i % 10
+		stream = append(stream, fmt.Sprintf(`{"n": %d, "i": %d}`, n, i))
+		var matches []string
+		if n%2 == 0 {
+			matches = append(matches, "even")
+		}
+		if n >= 5 {
+			matches = append(matches, "big")
+		}
+		wanted = append(wanted, fmt.Sprintf("%d:%d:%d", i, n, len(matches)))
+	}
+	// an event bigger than the read buffer
+	stream = append(stream, `{"n": 8, "pad": "`+strings.Repeat("x", 3*streamBufferSize)+`"}`)
+	wanted = append(wanted, "pad:8:2")
+
+	for _, workers := range []int{1, 8} {
+		var got []string
+		err := q.MatchStreamConcurrently(strings.NewReader(strings.Join(stream, "\n")), workers, func(event []byte, matches []X) error {
+			var n, i int
+			if _, err := fmt.Sscanf(string(event), `{"n": %d, "i": %d}`, &n, &i); err == nil {
+				got = append(got, fmt.Sprintf("%d:%d:%d", i, n, len(matches)))
+			} else {
+				got = append(got, fmt.Sprintf("pad:%d:%d", n, len(matches)))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, " ") != strings.Join(wanted, " ") {
+			t.Errorf("%d workers: results differ", workers)
+		}
+	}
+}
+
+func TestMatchStreamErrors(t *testing.T) {
+	q := streamTestQuamina(t)
+	stream := `{"n": 1}` + "\n" + `{"n": 2}` + "\n" + `{"n": ` + "\n" + `{"n": 4}` + "\n"
+	for _, workers := range []int{1, 4} {
+		got, err := streamSummary(q, workers, stream)
+		if err == nil || !strings.HasPrefix(err.Error(), "event 3:") {
+			t.Errorf("%d workers: bad event gave %v", workers, err)
+		}
+		if got != "1: 2:even" {
+			t.Errorf("%d workers: got %q before the bad event", workers, got)
+		}
+
+		stop := errors.New("stop")
+		calls := 0
+		err = q.MatchStreamConcurrently(strings.NewReader(strings.Repeat(`{"n": 1}`+"\n", 1000)), workers,
+			func(event []byte, matches []X) error {
+				calls++
+				if calls == 10 {
+					return stop
+				}
+				return nil
+			})
+		if err != stop || calls != 10 {
+			t.Errorf("%d workers: callback error gave %v after %d calls", workers, err, calls)
+		}
+
+		err = q.MatchStreamConcurrently(iotest.TimeoutReader(strings.NewReader(`{"n": 1}`+"\n"+`{"n": 2}`)), workers,
+			func(event []byte, matches []X) error { return nil })
+		if err != iotest.ErrTimeout {
+			t.Errorf("%d workers: read error gave %v", workers, err)
+		}
+	}
+}
+
+func TestMatchStreamConcurrentlyStalledReader(t *testing.T) {
+	q := streamTestQuamina(t)
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		// then nothing more, so the next Read blocks until the pipe is closed
+		_, _ = pw.Write([]byte(`{"n": 1}` + "\n" + `{"n": 2}` + "\n"))
+	}()
+
+	stop := errors.New("stop")
+	result := make(chan error, 1)
+	go func() {
+		result <- q.MatchStreamConcurrently(pr, 4, func(event []byte, matches []X) error {
+			return stop
+		})
+	}()
+	select {
+	case err := <-result:
+		if err != stop {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("waited for a stalled reader after fn failed")
+	}
+}
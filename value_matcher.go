@@ -2,7 +2,10 @@ package quamina
 
 import (
 	"bytes"
+	"sync"
 	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 )
 
 // valueMatcher represents a byte-driven automaton.  The table needs to be the
@@ -18,6 +21,11 @@ import (
 // will be null and the value being matched has to exactly equal the singletonMatch
 // field; if so, the singletonTransition is the return value. This is to avoid
 // having a long chain of smallTables each with only one entry.
+// Patterns such as wildcards, whose DFAs can grow exponentially when merged,
+// are kept in an NFA, startNfa, which is run alongside the DFA or singleton.
+// If any numeric patterns have been added, hasNumbers is set, and numeric values
+// are run through the automaton a second time in their canonical form, which is
+// what the numeric patterns match.
 // To allow for concurrent access between one thread running AddPattern and many
 // others running MatchesForEvent, the valueMatcher payload is stored in an
 // atomic.Value
@@ -28,6 +36,8 @@ type vmFields struct {
 	startDfa            *smallTable[*dfaStep]
 	singletonMatch      []byte
 	singletonTransition *fieldMatcher
+	startNfa            *smallTable[*nfaStepList]
+	hasNumbers          bool
 }
 
 func (m *valueMatcher) getFields() *vmFields {
@@ -54,6 +64,22 @@ func (m *valueMatcher) transitionOn(val []byte) []*fieldMatcher {
 	var transitions []*fieldMatcher
 
 	fields := m.getFields()
+	transitions = transitionFields(fields, val, transitions)
+
+	// numeric patterns match the canonical form of a number, which the Flattener may already have provided
+	if fields.hasNumbers && looksLikeNumber(val) {
+		canonical, err := canonicalNumber(val)
+		if err == nil {
+			transitions = transitionFields(fields, canonical, transitions)
+		}
+	}
+	return transitions
+}
+
+func transitionFields(fields *vmFields, val []byte, transitions []*fieldMatcher) []*fieldMatcher {
+	if fields.startNfa != nil {
+		transitions = transitionNfa(fields.startNfa, val, transitions)
+	}
 
 	switch {
 	case fields.singletonMatch != nil:
@@ -100,28 +126,89 @@ func transitionDfa(table *smallTable[*dfaStep], val []byte, transitions []*field
 	return transitions
 }
 
+// nfaBuffers holds what transitionNfa works in: two slices which take turns holding the set of steps the NFA
+// could be in, one map for detecting duplicates, and the step it starts from. The automaton is shared by all
+// the goroutines matching with it, so they can't be kept there; instead they're pooled, so that they don't have
+// to be allocated for each value.
+type nfaBuffers struct {
+	steps     []*nfaStep
+	nextSteps []*nfaStep
+	seen      map[*nfaStep]bool
+	start     nfaStep
+}
+
+var nfaBufferPool = sync.Pool{New: func() any {
+	return &nfaBuffers{seen: make(map[*nfaStep]bool)}
+}}
+
+// transitionNfa runs val through an NFA by keeping track of the set of steps the NFA could be in after each
+// byte, which is what nfa2Dfa does ahead of time, except that only the sets that val actually visits are
+// computed. The sets are built in nfaBuffers, to avoid allocating them at each byte or for each value.
+func transitionNfa(table *smallTable[*nfaStepList], val []byte, transitions []*fieldMatcher) []*fieldMatcher {
+	bufs := nfaBufferPool.Get().(*nfaBuffers)
+	bufs.start = nfaStep{table: table}
+	seen := bufs.seen
+	for step := range seen {
+		delete(seen, step)
+	}
+	steps := appendClosure(bufs.steps[:0], &bufs.start, seen)
+	nextSteps := bufs.nextSteps
+	for _, utf8Byte := range val {
+		for step := range seen {
+			delete(seen, step)
+		}
+		nextSteps = nextSteps[:0]
+		for _, step := range steps {
+			if list := step.table.step(utf8Byte); list != nil {
+				for _, next := range list.steps {
+					nextSteps = appendClosure(nextSteps, next, seen)
+				}
+			}
+		}
+		steps, nextSteps = nextSteps, steps
+		if len(steps) == 0 {
+			break
+		}
+		for _, step := range steps {
+			transitions = append(transitions, step.fieldTransitions...)
+		}
+	}
+
+	// look for terminator after exhausting bytes of val
+	for _, step := range steps {
+		if list := step.table.step(valueTerminator); list != nil {
+			for _, lastStep := range list.steps {
+				transitions = append(transitions, lastStep.fieldTransitions...)
+			}
+		}
+	}
+	bufs.steps, bufs.nextSteps = steps[:0], nextSteps[:0]
+	nfaBufferPool.Put(bufs)
+	return transitions
+}
+
 func (m *valueMatcher) addTransition(val typedVal) *fieldMatcher {
 	valBytes := []byte(val.val)
 	fields := m.getFieldsForUpdate()
+	if val.vType == numericType {
+		fields.hasNumbers = true
+	}
+
+	// patterns that go in the NFA don't affect the DFA or singleton
+	if val.vType == wildcardType || val.vType == regexpType {
+		newNfa, nextField := makeNfaAutomaton(val, valBytes)
+		if fields.startNfa == nil {
+			fields.startNfa = newNfa
+		} else {
+			fields.startNfa = mergeNfas(fields.startNfa, newNfa)
+		}
+		m.update(fields)
+		return nextField
+	}
 
 	// there's already a table, thus an out-degree > 1
 	if fields.startDfa != nil {
-		var newDfa *smallTable[*dfaStep]
-		var nextField *fieldMatcher
-		switch val.vType {
-		case stringType, numberType, literalType:
-			newDfa, nextField = makeStringAutomaton(valBytes, nil)
-		case anythingButType:
-			newDfa, nextField = makeMultiAnythingButAutomaton(val.list, nil)
-		case shellStyleType:
-			var newNfa *smallTable[*nfaStepList]
-			newNfa, nextField = makeShellStyleAutomaton(valBytes, nil)
-			newDfa = nfa2Dfa(newNfa)
-		case prefixType:
-			newDfa, nextField = makePrefixAutomaton(valBytes, nil)
-		default:
-			panic("unknown value type")
-		}
+		newDfa, nextField := makeAutomaton(val, valBytes)
 		fields.startDfa = mergeDfas(fields.startDfa, newDfa)
 		m.update(fields)
 		return nextField
@@ -138,23 +225,11 @@ func (m *valueMatcher) addTransition(val typedVal) *fieldMatcher {
 			fields.singletonTransition = newFieldMatcher()
 			m.update(fields)
 			return fields.singletonTransition
-		case anythingButType:
-			newAutomaton, nextField := makeMultiAnythingButAutomaton(val.list, nil)
-			fields.startDfa = newAutomaton
-			m.update(fields)
-			return nextField
-		case shellStyleType:
-			newAutomaton, nextField := makeShellStyleAutomaton(valBytes, nil)
-			fields.startDfa = nfa2Dfa(newAutomaton)
-			m.update(fields)
-			return nextField
-		case prefixType:
-			newAutomaton, nextField := makePrefixAutomaton(valBytes, nil)
+		default:
+			newAutomaton, nextField := makeAutomaton(val, valBytes)
 			fields.startDfa = newAutomaton
 			m.update(fields)
 			return nextField
-		default:
-			panic("unknown value type")
 		}
 	}
 
@@ -168,29 +243,111 @@ func (m *valueMatcher) addTransition(val typedVal) *fieldMatcher {
 	// singleton is here, we don't match, so our outdegree becomes 2, so we have
 	// to build an automaton with two values in it
 	singletonAutomaton, _ := makeStringAutomaton(fields.singletonMatch, fields.singletonTransition)
-	var nextField *fieldMatcher
-	var newDfa *smallTable[*dfaStep]
+	newDfa, nextField := makeAutomaton(val, valBytes)
+
+	// now table is ready for use, nuke singleton to signal threads to use it
+	fields.startDfa = mergeDfas(singletonAutomaton, newDfa)
+	fields.singletonMatch = nil
+	fields.singletonTransition = nil
+	m.update(fields)
+	return nextField
+}
+
+// makeAutomaton builds a DFA for a single pattern value, ready to be merged into a valueMatcher, and
+// returns it along with the fieldMatcher a match leads to
+func makeAutomaton(val typedVal, valBytes []byte) (*smallTable[*dfaStep], *fieldMatcher) {
 	switch val.vType {
 	case stringType, numberType, literalType:
-		newDfa, nextField = makeStringAutomaton(valBytes, nil)
+		return makeStringAutomaton(valBytes, nil)
 	case anythingButType:
-		newDfa, nextField = makeMultiAnythingButAutomaton(val.list, nil)
+		if val.negated != nil {
+			return makeAnythingButPatternAutomaton(val.negated, nil)
+		}
+		return makeMultiAnythingButAutomaton(val.list, nil)
 	case shellStyleType:
-		var newNfa *smallTable[*nfaStepList]
-		newNfa, nextField = makeShellStyleAutomaton(valBytes, nil)
-		newDfa = nfa2Dfa(newNfa)
+		newNfa, nextField := makeShellStyleAutomaton(valBytes, nil)
+		return nfa2Dfa(newNfa), nextField
 	case prefixType:
-		newDfa, nextField = makePrefixAutomaton(valBytes, nil)
+		return makePrefixAutomaton(valBytes, nil)
+	case suffixType:
+		return makeSuffixAutomaton(valBytes, nil)
+	case numericType:
+		return makeNumericAutomaton(val.numRange, nil)
+	case monocaseType:
+		return makeMonocaseAutomaton(valBytes, nil)
+	case cidrType:
+		return makeCidrAutomaton(val.ipPrefix, nil)
 	default:
 		panic("unknown value type")
 	}
+}
 
-	// now table is ready for use, nuke singleton to signal threads to use it
-	fields.startDfa = mergeDfas(singletonAutomaton, newDfa)
-	fields.singletonMatch = nil
-	fields.singletonTransition = nil
-	m.update(fields)
-	return nextField
+// makeNfaAutomaton is like makeAutomaton, for the pattern types whose automata are kept as NFAs
+func makeNfaAutomaton(val typedVal, valBytes []byte) (*smallTable[*nfaStepList], *fieldMatcher) {
+	switch val.vType {
+	case wildcardType:
+		return makeWildcardAutomaton(valBytes, nil)
+	case regexpType:
+		return makeRegexpAutomaton(val.parsedRegexp, nil)
+	default:
+		panic("unknown value type")
+	}
+}
+
+// makeMonocaseAutomaton builds a DFA which matches val without regard to case. Each rune in val may be matched
+// by any member of its Unicode simple case-folding orbit, for example k, K, and the Kelvin sign U+212A. Those
+// runes' UTF-8 forms can differ in length and in their leading bytes, so the variants for each rune are arranged
+// in a little trie whose leaves all lead to the step for the following rune. The automaton is built back to
+// front so that each rune's trie can point at its successor.
+func makeMonocaseAutomaton(val []byte, useThisTransition *fieldMatcher) (*smallTable[*dfaStep], *fieldMatcher) {
+	var nextField *fieldMatcher
+	if useThisTransition != nil {
+		nextField = useThisTransition
+	} else {
+		nextField = newFieldMatcher()
+	}
+
+	lastStep := &dfaStep{table: newSmallTable[*dfaStep](), fieldTransitions: []*fieldMatcher{nextField}}
+	step := &dfaStep{table: makeSmallDfaTable(nil, []byte{valueTerminator}, []*dfaStep{lastStep})}
+	runes := []rune(string(val))
+	for i := len(runes) - 1; i >= 0; i-- {
+		var variants [][]byte
+		r := runes[i]
+		for {
+			variants = append(variants, utf8.AppendRune(nil, r))
+			r = unicode.SimpleFold(r)
+			if r == runes[i] {
+				break
+			}
+		}
+		step = &dfaStep{table: makeVariantsTable(variants, 0, step)}
+	}
+	return step.table, nextField
+}
+
+// makeVariantsTable builds the trie that matches any of the variants, starting at the index'th byte of each.
+// Since UTF-8 is self-synchronizing, no variant can be a prefix of another.
+func makeVariantsTable(variants [][]byte, index int, next *dfaStep) *smallTable[*dfaStep] {
+	var u unpackedTable[*dfaStep]
+	var leadBytes []byte
+	tails := make(map[byte][][]byte)
+	for _, variant := range variants {
+		utf8Byte := variant[index]
+		if index == len(variant)-1 {
+			u[utf8Byte] = next
+			continue
+		}
+		if _, ok := tails[utf8Byte]; !ok {
+			leadBytes = append(leadBytes, utf8Byte)
+		}
+		tails[utf8Byte] = append(tails[utf8Byte], variant)
+	}
+	for _, utf8Byte := range leadBytes {
+		u[utf8Byte] = &dfaStep{table: makeVariantsTable(tails[utf8Byte], index+1, next)}
+	}
+	table := newSmallTable[*dfaStep]()
+	table.pack(&u)
+	return table
 }
 
 func makePrefixAutomaton(val []byte, useThisTransition *fieldMatcher) (*smallTable[*dfaStep], *fieldMatcher) {
@@ -204,6 +361,54 @@ func makePrefixAutomaton(val []byte, useThisTransition *fieldMatcher) (*smallTab
 	return onePrefixStep(val, 0, nextField), nextField
 }
 
+// makeSuffixAutomaton builds a DFA which matches string values ending with val, which still has its quotes.
+// The bytes to look for are val without its opening quote, i.e. the suffix plus the closing quote, and the DFA
+// is the one the Knuth-Morris-Pratt algorithm uses to search for them: state i means the last i bytes seen are
+// the first i bytes being looked for. A mismatch falls back to the longest such partial match rather than
+// starting over, which is what makes this deterministic without any help from nfa2Dfa. Since every step
+// contributes its fieldTransitions as soon as it's reached, a match is only signaled on the valueTerminator
+// that follows a complete suffix.
+func makeSuffixAutomaton(val []byte, useThisTransition *fieldMatcher) (*smallTable[*dfaStep], *fieldMatcher) {
+	var nextField *fieldMatcher
+	if useThisTransition != nil {
+		nextField = useThisTransition
+	} else {
+		nextField = newFieldMatcher()
+	}
+
+	// nextState[i][b] is the state reached from state i on byte b
+	target := val[1:]
+	nextState := make([][valueTerminator]int, len(target)+1)
+	nextState[0][target[0]] = 1
+
+	// restart tracks the state we'd be in had the match started one byte later
+	restart := 0
+	for i := 1; i <= len(target); i++ {
+		nextState[i] = nextState[restart]
+		if i < len(target) {
+			nextState[i][target[i]] = i + 1
+			restart = nextState[restart][target[i]]
+		}
+	}
+
+	steps := make([]*dfaStep, len(target)+1)
+	for i := range steps {
+		steps[i] = &dfaStep{table: newSmallTable[*dfaStep]()}
+	}
+	lastStep := &dfaStep{table: newSmallTable[*dfaStep](), fieldTransitions: []*fieldMatcher{nextField}}
+	for i, step := range steps {
+		var u unpackedTable[*dfaStep]
+		for utf8Byte, next := range nextState[i] {
+			u[utf8Byte] = steps[next]
+		}
+		if i == len(target) {
+			u[valueTerminator] = lastStep
+		}
+		step.table.pack(&u)
+	}
+	return steps[0].table, nextField
+}
+
 func onePrefixStep(val []byte, index int, nextField *fieldMatcher) *smallTable[*dfaStep] {
 	var nextStep *dfaStep
 
@@ -100,10 +100,9 @@ func TestAddTransition(t *testing.T) {
 	}
 }
 
-/* - restore this one when we get multi-glob working
 func TestMultiTransitions(t *testing.T) {
-	patX := `{"foo": [ { "shellstyle": "*x*b" } ]}`
-	patY := `{"foo": [ { "shellstyle": "*y*b" } ]}`
+	patX := `{"foo": [ { "wildcard": "*x*b" } ]}`
+	patY := `{"foo": [ { "wildcard": "*y*b" } ]}`
 
 	m := newCoreMatcher()
 	if m.addPattern("X", patX) != nil {
@@ -113,7 +112,7 @@ func TestMultiTransitions(t *testing.T) {
 		t.Error("add patY")
 	}
 	e := `{"foo": "axyb"}`
-	matches, err := m.MatchesForEvent([]byte(e))
+	matches, err := m.matchesForJSONEvent([]byte(e))
 	if err != nil {
 		t.Error("m4: " + err.Error())
 	}
@@ -124,7 +123,7 @@ func TestMultiTransitions(t *testing.T) {
 
 func TestAY(t *testing.T) {
 	m := newCoreMatcher()
-	pat := `{"x": [ { "shellstyle": "*ay*"} ] }`
+	pat := `{"x": [ { "wildcard": "*ay*"} ] }`
 	err := m.addPattern("AY", pat)
 	if err != nil {
 		t.Error("AY: " + err.Error())
@@ -133,7 +132,7 @@ func TestAY(t *testing.T) {
 	e := `{"x": "X"}`
 	for _, sm := range shouldMatch {
 		p := strings.ReplaceAll(e, "X", sm)
-		matches, err := m.MatchesForEvent([]byte(p))
+		matches, err := m.matchesForJSONEvent([]byte(p))
 		if err != nil {
 			t.Error("bad JSON: " + err.Error())
 		}
@@ -142,7 +141,6 @@ func TestAY(t *testing.T) {
 		}
 	}
 }
-*/
 
 func TestOverlappingValues(t *testing.T) {
 	m := newCoreMatcher()
@@ -340,3 +338,183 @@ func contains(list []*fieldMatcher, s *fieldMatcher) bool {
 	}
 	return false
 }
+
+func TestMonocaseAutomaton(t *testing.T) {
+	type monocaseTest struct {
+		pattern string
+		matches []string
+		misses  []string
+	}
+	tests := []monocaseTest{
+		{
+			pattern: `"example.COM"`,
+			matches: []string{`"example.com"`, `"EXAMPLE.COM"`, `"eXaMpLe.CoM"`},
+			misses:  []string{`"example.co"`, `"example.comm"`, `"examplexcom"`, `"xexample.com"`},
+		},
+		{
+			// K has three variants: k, K, and the Kelvin sign, which is 3 bytes long
+			pattern: `"kit"`,
+			matches: []string{`"KIT"`, `"kit"`, "\"\u212aIt\""},
+			misses:  []string{`"kIT "`, `"K"`},
+		},
+		{
+			pattern: `"Ωμέγα"`,
+			matches: []string{`"ωμέγα"`, `"ΩΜΈΓΑ"`, `"ΩμέΓα"`},
+			misses:  []string{`"ωμεγα"`, `"ωμέγ"`},
+		},
+		{
+			pattern: `"Straße 12"`,
+			matches: []string{`"STRAßE 12"`, "\"STRA\u1e9eE 12\""},
+			misses:  []string{`"STRASSE 12"`, `"straße 13"`},
+		},
+		{
+			pattern: `""`,
+			matches: []string{`""`},
+			misses:  []string{`"a"`},
+		},
+	}
+	for _, test := range tests {
+		table, wanted := makeMonocaseAutomaton([]byte(test.pattern), nil)
+		for _, m := range test.matches {
+			trans := transitionDfa(table, []byte(m), nil)
+			if len(trans) != 1 || trans[0] != wanted {
+				t.Errorf("%s should match %s", test.pattern, m)
+			}
+		}
+		for _, m := range test.misses {
+			trans := transitionDfa(table, []byte(m), nil)
+			if len(trans) != 0 {
+				t.Errorf("%s should not match %s", test.pattern, m)
+			}
+		}
+	}
+}
+
+func TestMonocaseWithOtherPatterns(t *testing.T) {
+	q, _ := New()
+	patterns := map[X]string{
+		"ic":     `{"domain": [ {"equals-ignore-case": "Example.com"} ] }`,
+		"exact":  `{"domain": [ "example.com" ] }`,
+		"prefix": `{"domain": [ {"prefix": "ex"} ] }`,
+		"shell":  `{"domain": [ {"shellstyle": "*.COM"} ] }`,
+		"ic2":    `{"domain": [ {"equals-ignore-case": "EXAMPLE.ORG"}, {"equals-ignore-case": "example.net"} ] }`,
+	}
+	for x, p := range patterns {
+		err := q.AddPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"domain": "example.com"}`: {"ic", "exact", "prefix"},
+		`{"domain": "EXAMPLE.COM"}`: {"ic", "shell"},
+		`{"domain": "exAMPLE.COM"}`: {"ic", "prefix", "shell"},
+		`{"domain": "Example.org"}`: {"ic2"},
+		`{"domain": "example.NET"}`: {"ic2", "prefix"},
+		`{"domain": "example.co"}`:  {"prefix"},
+		`{"domain": "xample.COM"}`:  {"shell"},
+	}
+	for event, want := range wanted {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
+
+func TestSuffixAutomaton(t *testing.T) {
+	type suffixTest struct {
+		pattern string
+		matches []string
+		misses  []string
+	}
+	tests := []suffixTest{
+		{
+			pattern: `".gz"`,
+			matches: []string{`"logs.gz"`, `".gz"`, `"a.gz.gz"`, `"..gz"`},
+			misses:  []string{`"logs.gzip"`, `"gz"`, `"logs.g"`, `".gz.tar"`, `"logs.GZ"`},
+		},
+		{
+			// partial matches overlap, which is where the fallback states earn their keep
+			pattern: `"abab"`,
+			matches: []string{`"abab"`, `"ababab"`, `"aabab"`, `"abaabab"`, `"xxababab"`},
+			misses:  []string{`"aba"`, `"ababa"`, `"abba"`, `"abab "`},
+		},
+		{
+			pattern: `"é"`,
+			matches: []string{`"café"`, `"é"`},
+			misses:  []string{`"cafe"`, `"éa"`},
+		},
+		{
+			pattern: `""`,
+			matches: []string{`""`, `"anything"`},
+			misses:  []string{`123`, `true`},
+		},
+	}
+	for _, test := range tests {
+		table, wanted := makeSuffixAutomaton([]byte(test.pattern), nil)
+		for _, m := range test.matches {
+			trans := transitionDfa(table, []byte(m), nil)
+			if len(trans) != 1 || trans[0] != wanted {
+				t.Errorf("%s should match %s", test.pattern, m)
+			}
+		}
+		for _, m := range test.misses {
+			trans := transitionDfa(table, []byte(m), nil)
+			if len(trans) != 0 {
+				t.Errorf("%s should not match %s", test.pattern, m)
+			}
+		}
+	}
+}
+
+func TestSuffixWithOtherPatterns(t *testing.T) {
+	q, _ := New()
+	patterns := map[X]string{
+		"gz":     `{"file": [ {"suffix": ".gz"} ] }`,
+		"tgz":    `{"file": [ {"suffix": ".tar.gz"}, {"suffix": ".tgz"} ] }`,
+		"logs":   `{"file": [ {"prefix": "logs/"} ] }`,
+		"notgz":  `{"file": [ {"anything-but": ["logs/a.gz"]} ] }`,
+		"exact":  `{"file": [ "logs/a.gz" ] }`,
+		"domain": `{"file": [ {"suffix": ".example.com"} ] }`,
+	}
+	for x, p := range patterns {
+		err := q.AddPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"file": "logs/a.gz"}`:          {"gz", "logs", "exact"},
+		`{"file": "logs/b.gz"}`:          {"gz", "logs", "notgz"},
+		`{"file": "b.tar.gz"}`:           {"gz", "tgz", "notgz"},
+		`{"file": "b.tgz"}`:              {"tgz", "notgz"},
+		`{"file": "logs/x"}`:             {"logs", "notgz"},
+		`{"file": "api.example.com"}`:    {"domain", "notgz"},
+		`{"file": "api.example.com.gz"}`: {"gz", "notgz"},
+	}
+	for event, want := range wanted {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package quamina
+
+import (
+	"errors"
+)
+
+// readWildcardSpecial parses a wildcard object in a Pattern. The value is a string in which '*' matches any
+// sequence of characters, including none. A literal '*' is written as `\*` and a literal backslash as `\\`;
+// since the pattern is JSON, those are "\\*" and "\\\\" in the pattern text. As in EventBridge, two '*'
+// characters in a row are not allowed, since they mean nothing more than one.
+func readWildcardSpecial(pb *patternBuild, valsIn []typedVal) (pathVals []typedVal, err error) {
+	t, err := pb.jd.Token()
+	if err != nil {
+		return
+	}
+	pathVals = valsIn
+	wildcardString, ok := t.(string)
+	if !ok {
+		err = errors.New("value for 'wildcard' must be a string")
+		return
+	}
+
+	valBytes := []byte(wildcardString)
+	lastWasStar := false
+	for i := 0; i < len(valBytes); i++ {
+		switch valBytes[i] {
+		case '\\':
+			i++
+			if i == len(valBytes) || (valBytes[i] != '*' && valBytes[i] != '\\') {
+				err = errors.New("in a 'wildcard' pattern, '\\' may only be followed by '*' or '\\'")
+				return
+			}
+			lastWasStar = false
+		case '*':
+			if lastWasStar {
+				err = errors.New("adjacent '*' characters not allowed in a 'wildcard' pattern")
+				return
+			}
+			lastWasStar = true
+		default:
+			lastWasStar = false
+		}
+	}
+
+	pathVals = append(pathVals, typedVal{vType: wildcardType, val: `"` + wildcardString + `"`})
+
+	// has to be } or tokenizer will throw error
+	_, err = pb.jd.Token()
+	return
+}
+
+// makeWildcardAutomaton builds an NFA for a "-delimited wildcard pattern, which has already been checked by
+// readWildcardSpecial. Literal bytes move forward one step at a time. At a '*', the current step loops back to
+// itself on any byte, and has an epsilon transition to the step where the rest of the pattern starts, so there's
+// no need to work out all the ways that the bytes following a '*' might interact with each other; that's left
+// to whoever runs the NFA.
+func makeWildcardAutomaton(val []byte, useThisTransition *fieldMatcher) (start *smallTable[*nfaStepList], nextField *fieldMatcher) {
+	if useThisTransition != nil {
+		nextField = useThisTransition
+	} else {
+		nextField = newFieldMatcher()
+	}
+	lister := newListMaker()
+
+	step := &nfaStep{table: newSmallTable[*nfaStepList]()}
+	start = step.table
+	for i := 0; i < len(val); i++ {
+		ch := val[i]
+		if ch == '*' {
+			step.table.addRangeSteps(0, int(valueTerminator), lister.getList(step))
+			globExit := &nfaStep{table: newSmallTable[*nfaStepList]()}
+			step.epsilon = []*nfaStep{globExit}
+			step = globExit
+			continue
+		}
+		if ch == '\\' {
+			i++
+			ch = val[i]
+		}
+		nextStep := &nfaStep{table: newSmallTable[*nfaStepList]()}
+		step.table.addByteStep(ch, lister.getList(nextStep))
+		step = nextStep
+	}
+
+	lastStep := &nfaStep{table: newSmallTable[*nfaStepList](), fieldTransitions: []*fieldMatcher{nextField}}
+	step.table.addByteStep(valueTerminator, lister.getList(lastStep))
+	return
+}
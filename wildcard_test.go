@@ -0,0 +1,256 @@
+package quamina
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestReadWildcardSpecial(t *testing.T) {
+	goods := map[string]string{
+		`{"x": [ {"wildcard": "a*b"} ] }`:                      `"a*b"`,
+		`{"x": [ {"wildcard": "*a*b*c*"} ] }`:                  `"*a*b*c*"`,
+		`{"x": [ {"wildcard": "a\\*b"} ] }`:                    `"a\*b"`,
+		`{"x": [ {"wildcard": "a\\\\*b"} ] }`:                  `"a\\*b"`,
+		`{"x": [ {"wildcard": "\\**"} ] }`:                     `"\**"`,
+		`{"x": [ {"wildcard": "arn:aws:s3:::*/logs/*.gz"} ] }`: `"arn:aws:s3:::*/logs/*.gz"`,
+	}
+	for good, wanted := range goods {
+		alternatives, err := patternsFromJSON([]byte(good))
+		if err != nil {
+			t.Errorf("parse %s: %s", good, err.Error())
+			continue
+		}
+		fields := alternatives[0]
+		if len(fields) != 1 || fields[0].vals[0].vType != wildcardType || fields[0].vals[0].val != wanted {
+			t.Errorf("%s: wanted %s got %v", good, wanted, fields[0].vals)
+		}
+	}
+	bads := []string{
+		`{"x": [ {"wildcard": 3} ] }`,
+		`{"x": [ {"wildcard": "a**b"} ] }`,
+		`{"x": [ {"wildcard": "a\\b"} ] }`,
+		`{"x": [ {"wildcard": "ab\\"} ] }`,
+		`{"x": [ {"wildcard": "a*b" ] }`,
+	}
+	for _, bad := range bads {
+		_, err := patternsFromJSON([]byte(bad))
+		if err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestWildcardMatching(t *testing.T) {
+	type wildcardTest struct {
+		pattern string
+		matches []string
+		misses  []string
+	}
+	tests := []wildcardTest{
+		{
+			pattern: `arn:aws:s3:::*/logs/*.gz`,
+			matches: []string{"arn:aws:s3:::bucket/logs/x.gz", "arn:aws:s3:::b/c/logs/d/e.gz", "arn:aws:s3:::/logs/.gz"},
+			misses:  []string{"arn:aws:s3:::bucket/logs/x.gzip", "arn:aws:s3:::bucket/x.gz", "arn:aws:s4:::b/logs/x.gz"},
+		},
+		{
+			pattern: `*`,
+			matches: []string{"", "a", "anything at all"},
+		},
+		{
+			pattern: `*ab*ab*`,
+			matches: []string{"abab", "xabyabz", "ababab", "aabaab"},
+			misses:  []string{"ab", "aba", "abba", "a b ab"},
+		},
+		{
+			pattern: `a\*b*`,
+			matches: []string{"a*b", "a*bcd"},
+			misses:  []string{"ab", "axb", "a\\*b"},
+		},
+		{
+			pattern: `a\\*`,
+			matches: []string{"a\\", "a\\bc"},
+			misses:  []string{"a", "abc"},
+		},
+		{
+			pattern: `x*y*z`,
+			matches: []string{"xyz", "xxyyzz", "xzyz", "xyyzz"},
+			misses:  []string{"xyza", "xzy", "yz", "xy"},
+		},
+		{
+			pattern: `*é*`,
+			matches: []string{"café au lait", "é"},
+			misses:  []string{"cafe"},
+		},
+	}
+	for _, test := range tests {
+		q, _ := New()
+		pattern := fmt.Sprintf(`{"x": [ {"wildcard": %q} ] }`, test.pattern)
+		err := q.AddPattern("W", pattern)
+		if err != nil {
+			t.Errorf("add %s: %s", pattern, err.Error())
+			continue
+		}
+
+		// the same NFA, converted to a DFA, should give the same results
+		nfa, wanted := makeWildcardAutomaton([]byte(`"`+test.pattern+`"`), nil)
+		dfa := nfa2Dfa(nfa)
+
+		for _, m := range test.matches {
+			event := fmt.Sprintf(`{"x": %q}`, m)
+			matches, err := q.MatchesForEvent([]byte(event))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 1 {
+				t.Errorf("%s should match %s", test.pattern, m)
+			}
+			trans := transitionDfa(dfa, []byte(`"`+m+`"`), nil)
+			if len(trans) != 1 || trans[0] != wanted {
+				t.Errorf("DFA for %s should match %s", test.pattern, m)
+			}
+		}
+		for _, m := range test.misses {
+			event := fmt.Sprintf(`{"x": %q}`, m)
+			matches, err := q.MatchesForEvent([]byte(event))
+			if err != nil {
+				t.Error("m4E: " + err.Error())
+			}
+			if len(matches) != 0 {
+				t.Errorf("%s should not match %s", test.pattern, m)
+			}
+			trans := transitionDfa(dfa, []byte(`"`+m+`"`), nil)
+			if len(trans) != 0 {
+				t.Errorf("DFA for %s should not match %s", test.pattern, m)
+			}
+		}
+	}
+}
+
+func TestWildcardWithOtherPatterns(t *testing.T) {
+	q, _ := New()
+	patterns := map[X]string{
+		"w1":     `{"x": [ {"wildcard": "a*c*e"} ] }`,
+		"w2":     `{"x": [ {"wildcard": "ab*"}, {"wildcard": "*yz"} ] }`,
+		"w3":     `{"x": [ {"wildcard": "abc*"} ] }`,
+		"exact":  `{"x": [ "abcde" ] }`,
+		"prefix": `{"x": [ {"prefix": "abc"} ] }`,
+		"shell":  `{"x": [ {"shellstyle": "*de"} ] }`,
+	}
+	for x, p := range patterns {
+		err := q.AddPattern(x, p)
+		if err != nil {
+			t.Errorf("add %s: %s", p, err.Error())
+		}
+	}
+	wanted := map[string][]X{
+		`{"x": "abcde"}`: {"w1", "w2", "w3", "exact", "prefix", "shell"},
+		`{"x": "ace"}`:   {"w1"},
+		`{"x": "abyz"}`:  {"w2"},
+		`{"x": "xyz"}`:   {"w2"},
+		`{"x": "abcz"}`:  {"w2", "w3", "prefix"},
+		`{"x": "xxde"}`:  {"shell"},
+		`{"x": "bcde"}`:  {"shell"},
+	}
+	for event, want := range wanted {
+		matches, err := q.MatchesForEvent([]byte(event))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if len(matches) != len(want) {
+			t.Errorf("%s: wanted %v got %v", event, want, matches)
+			continue
+		}
+		for _, w := range want {
+			if !containsX(matches, w) {
+				t.Errorf("%s: missing %v in %v", event, w, matches)
+			}
+		}
+	}
+}
+
+// TestWildcardBuildTime is the counterpart of TestShellStyleBuildTime, except with lots more patterns, each
+// with several stars. Since the wildcards are kept in an NFA, adding them doesn't blow up.
+func TestWildcardBuildTime(t *testing.T) {
+	words := readWWords(t)
+	q, _ := New()
+	start := time.Now()
+	patternCount := 1000
+	starWords := make([]string, 0, patternCount)
+	for i := 0; i < patternCount; i++ {
+		word := words[i]
+		starWord := "*" + string(word[:2]) + "*" + string(word[2:4]) + "*" + string(word[4:]) + "*"
+		//nolint:gosec
+		if rand.Intn(2) == 0 {
+			starWord = starWord[1:]
+		}
+		starWords = append(starWords, starWord)
+		err := q.AddPattern(starWord, fmt.Sprintf(`{"x": [ {"wildcard": "%s"} ] }`, starWord))
+		if err != nil {
+			t.Error("AddP: " + err.Error())
+		}
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("%d wildcard patterns added in %v\n", patternCount, elapsed)
+	if elapsed > 10*time.Second {
+		t.Errorf("took %v to add %d wildcard patterns", elapsed, patternCount)
+	}
+	for i, starWord := range starWords {
+		matches, err := q.MatchesForEvent([]byte(fmt.Sprintf(`{"x": "-%s-"}`, words[i])))
+		if err != nil {
+			t.Error("m4E: " + err.Error())
+		}
+		if starWord[0] == '*' && !containsX(matches, starWord) {
+			t.Errorf("%s didn't match %s", starWord, words[i])
+		}
+		matches, _ = q.MatchesForEvent([]byte(fmt.Sprintf(`{"x": "%s"}`, words[i])))
+		if !containsX(matches, starWord) {
+			t.Errorf("%s didn't match %s", starWord, words[i])
+		}
+	}
+	fmt.Println(matcherStats(q.matcher.(*coreMatcher)))
+}
+
+func TestMergeNfasLeavesInputsAlone(t *testing.T) {
+	nfa1, next1 := makeWildcardAutomaton([]byte(`"ab*cd"`), nil)
+	nfa2, next2 := makeWildcardAutomaton([]byte(`"abc*d"`), nil)
+	merged := mergeNfas(nfa1, nfa2)
+
+	got := transitionNfa(merged, []byte(`"abcd"`), nil)
+	if len(got) != 2 || !contains(got, next1) || !contains(got, next2) {
+		t.Errorf("merged: wanted both got %d", len(got))
+	}
+	got = transitionNfa(merged, []byte(`"abxcd"`), nil)
+	if len(got) != 1 || got[0] != next1 {
+		t.Error("merged: wanted next1")
+	}
+	got = transitionNfa(nfa1, []byte(`"abcxd"`), nil)
+	if len(got) != 0 {
+		t.Error("nfa1 changed by merge")
+	}
+	got = transitionNfa(nfa2, []byte(`"abxcd"`), nil)
+	if len(got) != 0 {
+		t.Error("nfa2 changed by merge")
+	}
+}
+
+func TestTransitionNfaAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool isn't reliable with the race detector on")
+	}
+	nfa1, _ := makeWildcardAutomaton([]byte(`"ab*cd"`), nil)
+	nfa2, _ := makeWildcardAutomaton([]byte(`"a*c*d"`), nil)
+	merged := mergeNfas(nfa1, nfa2)
+	val := []byte(`"abxxcxxcd"`)
+	transitions := make([]*fieldMatcher, 0, 8)
+	if got := transitionNfa(merged, val, transitions); len(got) != 2 {
+		t.Fatalf("wanted 2 got %d", len(got))
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		transitionNfa(merged, val, transitions)
+	})
+	if allocs != 0 {
+		t.Errorf("%.1f allocations per value", allocs)
+	}
+}
@@ -0,0 +1,1218 @@
+package quamina
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// This file reads YAML, for Events of the application/yaml media type and for Patterns written in YAML. It
+// handles a single document made up of block and flow mappings and sequences, plain, quoted, and block scalars,
+// anchors and aliases, merge keys, and the standard tags, which is what configuration files and rule files use.
+// Plain scalars are resolved to JSON types using the YAML 1.2 core schema, so for example 35 is a number, true
+// is a boolean, ~ is null, and everything else is a string. Complex mapping keys and multiple documents aren't
+// supported. There's no dependency on an external YAML library, in keeping with the rest of Quamina.
+
+type yamlKind int
+
+const (
+	yamlScalar yamlKind = iota
+	yamlMapping
+	yamlSequence
+)
+
+type yamlScalarType int
+
+const (
+	yamlStrType yamlScalarType = iota
+	yamlNullType
+	yamlBoolType
+	yamlIntType
+	yamlFloatType
+)
+
+// yamlNode is a node in the tree that parseYAML produces. The val of a scalar is its value as a Field would
+// have it: the text of a number, true, false, or null, or a string with quotes around it but not escaped.
+type yamlNode struct {
+	kind   yamlKind
+	typ    yamlScalarType // for scalars
+	val    []byte         // for scalars
+	keys   [][]byte       // for mappings
+	values []*yamlNode    // for mappings, the values of the keys, and for sequences, the items
+	size   int            // how many nodes the tree rooted here has, counting those reached by aliases each time
+}
+
+// yamlContext says, for a node in block context, whether it's an item in a sequence, which can be a compact
+// collection starting on the same line as the "-", or something else, such as a value in a mapping, which can be
+// a sequence at the same indentation as its key. The names are the ones the YAML specification uses.
+type yamlContext int
+
+const (
+	yamlBlockIn yamlContext = iota
+	yamlBlockOut
+)
+
+// maxYAMLDepth is how deeply YAML collections may be nested
+const maxYAMLDepth = 1000
+
+type yamlParser struct {
+	src     []byte
+	index   int
+	indent  int // indentation of the line with the next content, or -1 if the document has ended
+	depth   int
+	maxSize int // the largest size a node can have, which protects against aliases that expand exponentially
+	anchors map[string]*yamlNode
+}
+
+func parseYAML(src []byte) (*yamlNode, error) {
+	// the automaton only works on UTF-8, and YAML has to be in some Unicode encoding anyhow
+	if !utf8.Valid(src) {
+		return nil, errors.New("YAML is not valid UTF-8")
+	}
+	// a byte order mark isn't part of the first line's indentation
+	src = bytes.TrimPrefix(src, []byte("\xef\xbb\xbf"))
+	p := &yamlParser{src: src, maxSize: 1000 + 10*len(src), anchors: make(map[string]*yamlNode)}
+	return p.document()
+}
+
+// yamlToJSON converts YAML to JSON, which is how Patterns written in YAML are read
+func yamlToJSON(src []byte) ([]byte, error) {
+	node, err := parseYAML(src)
+	if err != nil {
+		return nil, err
+	}
+	if node.hasNonFiniteFloat() {
+		// in an Event these are null, but a Pattern that matched null instead would be wrong
+		return nil, errors.New("infinities and NaN can't be used in a Pattern")
+	}
+	return node.appendJSON(nil), nil
+}
+
+// hasNonFiniteFloat says whether any float in the tree rooted here is infinite or NaN, which resolveYAMLScalar
+// and yamlNumber turn into null
+func (n *yamlNode) hasNonFiniteFloat() bool {
+	if n.kind == yamlScalar {
+		return n.typ == yamlFloatType && bytes.Equal(n.val, nullBytes)
+	}
+	for _, value := range n.values {
+		if value.hasNonFiniteFloat() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *yamlParser) document() (*yamlNode, error) {
+	if _, err := p.nextContent(); err != nil {
+		return nil, err
+	}
+	for p.indent == 0 && p.ch() == '%' {
+		// directives, e.g. %YAML 1.2, which don't change anything we do
+		p.skipToLineEnd()
+		p.skipBreak()
+		if _, err := p.nextContent(); err != nil {
+			return nil, err
+		}
+	}
+	var root *yamlNode
+	var err error
+	switch {
+	case p.atMarker("---"):
+		p.index += 3
+		p.skipSpace()
+		root, err = p.blockNode(-1, yamlBlockOut)
+	case p.indent >= 0:
+		root, err = p.blockNode(-1, yamlBlockOut)
+	default:
+		root, err = p.scalar(nil, true, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.indent >= 0 {
+		return nil, p.error("bad indentation")
+	}
+	if p.atMarker("...") {
+		p.index += 3
+		if err = p.endLine(); err != nil {
+			return nil, err
+		}
+		if _, err = p.nextContent(); err != nil {
+			return nil, err
+		}
+	}
+	if p.index < len(p.src) {
+		return nil, p.error("only one YAML document is allowed")
+	}
+	return root, nil
+}
+
+// blockNode reads a node in block context. Its content may start where the parser is, or, if there's nothing but
+// properties and comments there, on a following line, in which case it has to be indented more than its parent.
+// Like the other functions that read nodes in block context, it leaves the parser at the next content.
+func (p *yamlParser) blockNode(parentIndent int, ctx yamlContext) (*yamlNode, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	anchor, tag, err := p.properties(false)
+	if err != nil {
+		return nil, err
+	}
+	var node *yamlNode
+	if p.atLineEnd() {
+		if err = p.endLine(); err != nil {
+			return nil, err
+		}
+		if _, err = p.nextContent(); err != nil {
+			return nil, err
+		}
+		if p.indent > parentIndent || (ctx == yamlBlockOut && p.indent == parentIndent && p.seqEntry()) {
+			node, err = p.blockContent(parentIndent, true, tag)
+		} else {
+			node, err = p.scalar(nil, true, tag)
+		}
+	} else {
+		allowCollection := p.atLineStart() || (ctx == yamlBlockIn && anchor == "" && tag == "")
+		node, err = p.blockContent(parentIndent, allowCollection, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if anchor != "" {
+		p.anchors[anchor] = node
+	}
+	return node, nil
+}
+
+// blockContent reads a node in block context once its properties have been read. Block collections are only
+// allowed where they can start, which is at the start of a line or after the "-" of a sequence item.
+func (p *yamlParser) blockContent(parentIndent int, allowCollection bool, tag string) (*yamlNode, error) {
+	if allowCollection {
+		if p.seqEntry() {
+			return p.blockSequence(p.column())
+		}
+		if p.mappingKeyAhead() {
+			return p.blockMapping(p.column())
+		}
+	}
+
+	var node *yamlNode
+	var err error
+	switch p.ch() {
+	case '|', '>':
+		var text []byte
+		if text, err = p.blockScalar(parentIndent); err != nil {
+			return nil, err
+		}
+		return p.scalar(text, false, tag)
+	case '[':
+		node, err = p.flowSequence()
+	case '{':
+		node, err = p.flowMapping()
+	case '*':
+		node, err = p.alias(false)
+	case '\'', '"':
+		var text []byte
+		if text, err = p.quotedScalar(); err != nil {
+			return nil, err
+		}
+		node, err = p.scalar(text, false, tag)
+	default:
+		var text []byte
+		if text, err = p.plainScalar(parentIndent); err != nil {
+			return nil, err
+		}
+		// plainScalar has already found the next content, since a plain scalar can continue on following lines
+		return p.scalar(text, true, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = p.endLine(); err != nil {
+		return nil, err
+	}
+	if _, err = p.nextContent(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *yamlParser) blockSequence(indent int) (*yamlNode, error) {
+	node := &yamlNode{kind: yamlSequence, size: 1}
+	for {
+		p.index++ // the "-"
+		p.skipSpace()
+		item, err := p.blockNode(indent, yamlBlockIn)
+		if err != nil {
+			return nil, err
+		}
+		if err = p.add(node, nil, item); err != nil {
+			return nil, err
+		}
+		if p.indent != indent || !p.seqEntry() {
+			break
+		}
+	}
+	if p.indent > indent {
+		return nil, p.error("bad indentation of a sequence item")
+	}
+	return node, nil
+}
+
+func (p *yamlParser) blockMapping(indent int) (*yamlNode, error) {
+	node := &yamlNode{kind: yamlMapping, size: 1}
+	present := make(map[string]bool)
+	var merges []*yamlNode
+	for {
+		key, plain, err := p.mappingKey(false)
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.ch() != ':' {
+			return nil, p.error("missing ':' after mapping key")
+		}
+		p.index++
+		p.skipSpace()
+		value, err := p.blockNode(indent, yamlBlockOut)
+		if err != nil {
+			return nil, err
+		}
+		if plain && string(key) == "<<" {
+			merges = append(merges, value)
+		} else if err = p.addMember(node, present, key, value); err != nil {
+			return nil, err
+		}
+		if p.indent != indent {
+			break
+		}
+	}
+	if p.indent > indent {
+		return nil, p.error("bad indentation of a mapping entry")
+	}
+	return node, p.merge(node, present, merges)
+}
+
+// mappingKeyAhead says whether the line, from where the parser is, starts with a mapping key
+func (p *yamlParser) mappingKeyAhead() bool {
+	i := p.index
+	if quote := p.ch(); quote == '\'' || quote == '"' {
+		for i++; i < len(p.src) && !isYAMLBreak(p.src[i]); i++ {
+			if quote == '"' && p.src[i] == '\\' {
+				i++
+			} else if p.src[i] == quote {
+				if quote == '\'' && p.at(i+1) == '\'' {
+					i++
+					continue
+				}
+				break
+			}
+		}
+		if i >= len(p.src) || isYAMLBreak(p.src[i]) {
+			return false
+		}
+		for i++; isYAMLBlank(p.at(i)); i++ {
+		}
+		return p.at(i) == ':' && isYAMLSpaceOrEnd(p.at(i+1))
+	}
+	if !p.plainStart(false) {
+		return false
+	}
+	for ; i < len(p.src) && !isYAMLBreak(p.src[i]); i++ {
+		if p.src[i] == ':' && isYAMLSpaceOrEnd(p.at(i+1)) {
+			return true
+		}
+		if p.src[i] == '#' && isYAMLBlank(p.src[i-1]) {
+			return false
+		}
+	}
+	return false
+}
+
+// mappingKey reads a key, and says whether it was a plain scalar, since only a plain << is a merge key
+func (p *yamlParser) mappingKey(flow bool) ([]byte, bool, error) {
+	if p.ch() == '\'' || p.ch() == '"' {
+		key, err := p.quotedScalar()
+		return key, false, err
+	}
+	if !p.plainStart(flow) {
+		return nil, false, p.unexpected()
+	}
+	return p.plainText(flow), true, nil
+}
+
+// add puts a key and value into a mapping, or an item into a sequence if key is nil
+func (p *yamlParser) add(node *yamlNode, key []byte, value *yamlNode) error {
+	if node.kind == yamlMapping {
+		node.keys = append(node.keys, key)
+	}
+	node.values = append(node.values, value)
+	node.size += value.size
+	if node.size > p.maxSize {
+		return p.error("YAML aliases expand too far")
+	}
+	return nil
+}
+
+// addMember puts a key and value into a mapping whose keys so far are in present, since YAML requires the keys
+// in a mapping to be unique
+func (p *yamlParser) addMember(node *yamlNode, present map[string]bool, key []byte, value *yamlNode) error {
+	if present[string(key)] {
+		return p.error(fmt.Sprintf("duplicate mapping key %q", key))
+	}
+	present[string(key)] = true
+	return p.add(node, key, value)
+}
+
+// merge adds the members of the mappings given as values of merge keys, in the order they were given, to a
+// mapping whose keys are in present, unless it already has their keys
+func (p *yamlParser) merge(node *yamlNode, present map[string]bool, sources []*yamlNode) error {
+	for _, source := range sources {
+		mappings := []*yamlNode{source}
+		if source.kind == yamlSequence {
+			mappings = source.values
+		}
+		for _, mapping := range mappings {
+			if mapping.kind != yamlMapping {
+				return p.error("value of merge key must be a mapping or a sequence of mappings")
+			}
+			for i, key := range mapping.keys {
+				if present[string(key)] {
+					continue
+				}
+				present[string(key)] = true
+				if err := p.add(node, key, mapping.values[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// plainScalar reads a plain scalar in block context, which continues on following lines as long as they're
+// indented more than its parent, with the line breaks folded
+func (p *yamlParser) plainScalar(parentIndent int) ([]byte, error) {
+	if !p.plainStart(false) {
+		return nil, p.unexpected()
+	}
+	text := p.plainText(false)
+	for {
+		if err := p.endLine(); err != nil {
+			return nil, err
+		}
+		emptyLines, err := p.nextContent()
+		if err != nil {
+			return nil, err
+		}
+		if p.indent <= parentIndent {
+			return text, nil
+		}
+		// the full slice expression makes sure we don't write over the event
+		text = text[:len(text):len(text)]
+		if emptyLines == 0 {
+			text = append(text, ' ')
+		}
+		for ; emptyLines > 0; emptyLines-- {
+			text = append(text, '\n')
+		}
+		text = append(text, p.plainText(false)...)
+	}
+}
+
+// plainStart says whether a plain scalar can start where the parser is
+func (p *yamlParser) plainStart(flow bool) bool {
+	c := p.ch()
+	switch c {
+	case 0, ' ', '\t', '\n', '\r', ',', '[', ']', '{', '}', '#', '&', '*', '!', '|', '>', '\'', '"', '%', '@', '`':
+		return false
+	case '-', '?', ':':
+		next := p.at(p.index + 1)
+		return !isYAMLSpaceOrEnd(next) && !(flow && isYAMLFlowIndicator(next))
+	}
+	return true
+}
+
+// plainText reads a plain scalar up to the end of the line or whatever else ends it, and drops trailing blanks
+func (p *yamlParser) plainText(flow bool) []byte {
+	start := p.index
+	end := p.index
+	for p.index < len(p.src) {
+		c := p.src[p.index]
+		if isYAMLBreak(c) || (flow && isYAMLFlowIndicator(c)) {
+			break
+		}
+		if c == ':' {
+			next := p.at(p.index + 1)
+			if isYAMLSpaceOrEnd(next) || (flow && isYAMLFlowIndicator(next)) {
+				break
+			}
+		}
+		if c == '#' && p.index > start && isYAMLBlank(p.src[p.index-1]) {
+			break
+		}
+		p.index++
+		if !isYAMLBlank(c) {
+			end = p.index
+		}
+	}
+	p.index = end
+	return p.src[start:end]
+}
+
+// quotedScalar reads a single- or double-quoted scalar, which may continue over several lines
+func (p *yamlParser) quotedScalar() ([]byte, error) {
+	quote := p.ch()
+	p.index++
+	text := []byte{}
+	for {
+		if p.index >= len(p.src) {
+			return nil, p.error("unterminated quoted scalar")
+		}
+		c := p.src[p.index]
+		switch {
+		case c == quote && quote == '\'' && p.at(p.index+1) == '\'':
+			text = append(text, '\'')
+			p.index += 2
+		case c == quote:
+			p.index++
+			return text, nil
+		case c == '\\' && quote == '"' && isYAMLBreak(p.at(p.index+1)):
+			// an escaped line break, which joins the lines without a space
+			p.index++
+			p.skipBreak()
+			text = p.foldLines(text, false)
+		case c == '\\' && quote == '"':
+			var err error
+			if text, err = p.escape(text); err != nil {
+				return nil, err
+			}
+		case isYAMLBreak(c):
+			text = bytes.TrimRight(text, " \t")
+			p.skipBreak()
+			text = p.foldLines(text, true)
+		default:
+			text = append(text, c)
+			p.index++
+		}
+	}
+}
+
+// foldLines is used after a line break in a quoted scalar. It skips any empty lines and the indentation of the
+// next line, and appends a newline for each empty line or, if there were none and space is set, a space.
+func (p *yamlParser) foldLines(text []byte, space bool) []byte {
+	emptyLines := 0
+	for {
+		p.skipSpace()
+		if !isYAMLBreak(p.ch()) {
+			break
+		}
+		p.skipBreak()
+		emptyLines++
+	}
+	if emptyLines == 0 && space {
+		return append(text, ' ')
+	}
+	for ; emptyLines > 0; emptyLines-- {
+		text = append(text, '\n')
+	}
+	return text
+}
+
+var yamlEscapes = map[byte]rune{
+	'0': 0, 'a': '\a', 'b': '\b', 't': '\t', '\t': '\t', 'n': '\n', 'v': '\v', 'f': '\f', 'r': '\r', 'e': 0x1b,
+	' ': ' ', '"': '"', '/': '/', '\\': '\\', 'N': 0x85, '_': 0xa0, 'L': 0x2028, 'P': 0x2029,
+}
+
+// escape reads an escape sequence in a double-quoted scalar and appends the character it stands for
+func (p *yamlParser) escape(text []byte) ([]byte, error) {
+	c := p.at(p.index + 1)
+	p.index += 2
+	if r, ok := yamlEscapes[c]; ok {
+		return utf8.AppendRune(text, r), nil
+	}
+	digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+	if digits == 0 || p.index+digits > len(p.src) {
+		return nil, p.error("invalid escape in double-quoted scalar")
+	}
+	r, err := strconv.ParseUint(string(p.src[p.index:p.index+digits]), 16, 32)
+	if err != nil {
+		return nil, p.error("invalid escape in double-quoted scalar")
+	}
+	p.index += digits
+	return utf8.AppendRune(text, rune(r)), nil
+}
+
+// blockScalar reads a literal (|) or folded (>) scalar, whose lines are indented more than its parent
+func (p *yamlParser) blockScalar(parentIndent int) ([]byte, error) {
+	literal := p.ch() == '|'
+	p.index++
+	var chomping byte
+	indent := -1
+	for i := 0; i < 2; i++ {
+		c := p.ch()
+		if c == '-' || c == '+' {
+			chomping = c
+		} else if c >= '1' && c <= '9' {
+			indent = int(c - '0')
+			if parentIndent > 0 {
+				indent += parentIndent
+			}
+		} else {
+			break
+		}
+		p.index++
+	}
+	if err := p.endLine(); err != nil {
+		return nil, err
+	}
+
+	// empty lines are nil
+	var lines [][]byte
+	for p.index < len(p.src) {
+		lineStart := p.index
+		for p.ch() == ' ' {
+			p.index++
+		}
+		spaces := p.index - lineStart
+		if p.index == len(p.src) || isYAMLBreak(p.ch()) {
+			lines = append(lines, nil)
+			p.skipBreak()
+			continue
+		}
+		if indent < 0 {
+			if spaces <= parentIndent {
+				p.index = lineStart
+				break
+			}
+			indent = spaces
+		}
+		if spaces < indent || (spaces == 0 && (p.atMarker("---") || p.atMarker("..."))) {
+			p.index = lineStart
+			break
+		}
+		p.skipToLineEnd()
+		lines = append(lines, p.src[lineStart+indent:p.index])
+		p.skipBreak()
+	}
+
+	text := []byte{}
+	emptyLines := 0
+	seenContent := false
+	previousMoreIndented := false
+	for _, line := range lines {
+		if line == nil {
+			emptyLines++
+			continue
+		}
+		moreIndented := line[0] == ' ' || line[0] == '\t'
+		switch {
+		case !seenContent:
+		case literal || moreIndented || previousMoreIndented:
+			text = append(text, '\n')
+		case emptyLines == 0:
+			text = append(text, ' ')
+		}
+		for ; emptyLines > 0; emptyLines-- {
+			text = append(text, '\n')
+		}
+		text = append(text, line...)
+		seenContent = true
+		previousMoreIndented = moreIndented
+	}
+	switch {
+	case chomping == '-' || !seenContent && chomping != '+':
+	case chomping == '+':
+		if seenContent {
+			text = append(text, '\n')
+		}
+		for ; emptyLines > 0; emptyLines-- {
+			text = append(text, '\n')
+		}
+	default:
+		text = append(text, '\n')
+	}
+
+	if _, err := p.nextContent(); err != nil {
+		return nil, err
+	}
+	return text, nil
+}
+
+// flowNode reads a node in flow context, i.e. inside [] or {}, where indentation doesn't matter
+func (p *yamlParser) flowNode() (*yamlNode, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	anchor, tag, err := p.properties(true)
+	if err != nil {
+		return nil, err
+	}
+	var node *yamlNode
+	switch p.ch() {
+	case '[':
+		node, err = p.flowSequence()
+	case '{':
+		node, err = p.flowMapping()
+	case '*':
+		node, err = p.alias(true)
+	case '\'', '"':
+		var text []byte
+		if text, err = p.quotedScalar(); err == nil {
+			node, err = p.scalar(text, false, tag)
+		}
+	case ',', ']', '}':
+		// e.g. [&a , b], where the node is empty
+		node, err = p.scalar(nil, true, tag)
+	default:
+		if !p.plainStart(true) {
+			return nil, p.unexpected()
+		}
+		node, err = p.scalar(p.plainText(true), true, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if anchor != "" {
+		p.anchors[anchor] = node
+	}
+	return node, nil
+}
+
+func (p *yamlParser) flowSequence() (*yamlNode, error) {
+	p.index++ // the "["
+	node := &yamlNode{kind: yamlSequence, size: 1}
+	for {
+		p.skipFlowSpace()
+		if p.ch() == ']' {
+			p.index++
+			return node, nil
+		}
+		item, err := p.flowNode()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.add(node, nil, item); err != nil {
+			return nil, err
+		}
+		p.skipFlowSpace()
+		switch p.ch() {
+		case ',':
+			p.index++
+		case ']':
+		default:
+			return nil, p.error("expected ',' or ']' in flow sequence")
+		}
+	}
+}
+
+func (p *yamlParser) flowMapping() (*yamlNode, error) {
+	p.index++ // the "{"
+	node := &yamlNode{kind: yamlMapping, size: 1}
+	present := make(map[string]bool)
+	var merges []*yamlNode
+	for {
+		p.skipFlowSpace()
+		if p.ch() == '}' {
+			p.index++
+			return node, p.merge(node, present, merges)
+		}
+		key, plain, err := p.mappingKey(true)
+		if err != nil {
+			return nil, err
+		}
+		p.skipFlowSpace()
+
+		// a key without a value, as in {a, b: 1}, has null as its value
+		var value *yamlNode
+		if p.ch() == ':' {
+			p.index++
+			p.skipFlowSpace()
+		}
+		if p.ch() == ',' || p.ch() == '}' {
+			value, err = p.scalar(nil, true, "")
+		} else {
+			value, err = p.flowNode()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if plain && string(key) == "<<" {
+			merges = append(merges, value)
+		} else if err = p.addMember(node, present, key, value); err != nil {
+			return nil, err
+		}
+		p.skipFlowSpace()
+		switch p.ch() {
+		case ',':
+			p.index++
+		case '}':
+		default:
+			return nil, p.error("expected ',' or '}' in flow mapping")
+		}
+	}
+}
+
+// properties reads the anchor and tag, either of which may be missing, that can precede a node
+func (p *yamlParser) properties(flow bool) (anchor string, tag string, err error) {
+	for {
+		switch p.ch() {
+		case '&':
+			p.index++
+			anchor = string(p.name(flow))
+			if anchor == "" {
+				return "", "", p.error("empty anchor name")
+			}
+		case '!':
+			tag = string(p.name(flow))
+			// the verbatim form of the standard tags, e.g. !<tag:yaml.org,2002:str>, is the same as the short one
+			if len(tag) > 2 && tag[1] == '<' && tag[len(tag)-1] == '>' {
+				if full := tag[2 : len(tag)-1]; len(full) > 18 && full[:18] == "tag:yaml.org,2002:" {
+					tag = "!!" + full[18:]
+				}
+			}
+		default:
+			return anchor, tag, nil
+		}
+		if flow {
+			p.skipFlowSpace()
+		} else {
+			p.skipSpace()
+		}
+	}
+}
+
+func (p *yamlParser) alias(flow bool) (*yamlNode, error) {
+	p.index++ // the "*"
+	name := p.name(flow)
+	node, ok := p.anchors[string(name)]
+	if !ok {
+		return nil, p.error(fmt.Sprintf("unknown alias '%s'", name))
+	}
+	return node, nil
+}
+
+// name reads an anchor or tag name
+func (p *yamlParser) name(flow bool) []byte {
+	start := p.index
+	for p.index < len(p.src) && !isYAMLSpaceOrEnd(p.ch()) && !(flow && isYAMLFlowIndicator(p.ch())) {
+		p.index++
+	}
+	return p.src[start:p.index]
+}
+
+// scalar makes a scalar node, resolving the type of plain scalars and applying the standard tags
+func (p *yamlParser) scalar(text []byte, plain bool, tag string) (*yamlNode, error) {
+	switch tag {
+	case "!!null", "!!bool", "!!int", "!!float":
+		plain = true
+	case "!!str", "!":
+		plain = false
+	default:
+		// other tags are application-specific, and don't change how the scalar is matched
+		tag = ""
+	}
+	if !plain {
+		return &yamlNode{kind: yamlScalar, typ: yamlStrType, val: quoted(text), size: 1}, nil
+	}
+	val, typ := resolveYAMLScalar(text)
+	bad := false
+	switch tag {
+	case "!!null":
+		bad = typ != yamlNullType
+	case "!!bool":
+		bad = typ != yamlBoolType
+	case "!!int":
+		bad = typ != yamlIntType
+	case "!!float":
+		bad = typ != yamlIntType && typ != yamlFloatType
+	}
+	if bad {
+		return nil, p.error(fmt.Sprintf("'%s' is not a valid %s", text, tag))
+	}
+	return &yamlNode{kind: yamlScalar, typ: typ, val: val, size: 1}, nil
+}
+
+// resolveYAMLScalar resolves a plain scalar using the YAML 1.2 core schema and returns it as a Field would have it
+func resolveYAMLScalar(text []byte) ([]byte, yamlScalarType) {
+	switch string(text) {
+	case "", "~", "null", "Null", "NULL":
+		return nullBytes, yamlNullType
+	case "true", "True", "TRUE":
+		return trueBytes, yamlBoolType
+	case "false", "False", "FALSE":
+		return falseBytes, yamlBoolType
+	case ".inf", ".Inf", ".INF", "+.inf", "+.Inf", "+.INF", "-.inf", "-.Inf", "-.INF", ".nan", ".NaN", ".NAN":
+		// JSON can't represent these, so they're null, as in the Flatteners for binary formats
+		return nullBytes, yamlFloatType
+	}
+	if number, typ, ok := yamlNumber(text); ok {
+		return number, typ
+	}
+	return quoted(text), yamlStrType
+}
+
+// yamlNumber returns the JSON form of a YAML integer or float, if the text is one
+func yamlNumber(text []byte) ([]byte, yamlScalarType, bool) {
+	if len(text) > 2 && text[0] == '0' && (text[1] == 'o' || text[1] == 'x') {
+		base := 8
+		if text[1] == 'x' {
+			base = 16
+		}
+		u, err := strconv.ParseUint(string(text[2:]), base, 64)
+		if err != nil {
+			return nil, 0, false
+		}
+		return strconv.AppendUint(nil, u, 10), yamlIntType, true
+	}
+
+	// [-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?
+	i := 0
+	if i < len(text) && (text[i] == '-' || text[i] == '+') {
+		i++
+	}
+	integralStart := i
+	for i < len(text) && isDigit(text[i]) {
+		i++
+	}
+	integralDigits := i - integralStart
+	typ := yamlIntType
+	if i < len(text) && text[i] == '.' {
+		typ = yamlFloatType
+		i++
+		fractionStart := i
+		for i < len(text) && isDigit(text[i]) {
+			i++
+		}
+		if integralDigits == 0 && i == fractionStart {
+			return nil, 0, false
+		}
+	}
+	if integralDigits == 0 && typ == yamlIntType {
+		return nil, 0, false
+	}
+	if i < len(text) && (text[i] == 'e' || text[i] == 'E') {
+		typ = yamlFloatType
+		i++
+		if i < len(text) && (text[i] == '-' || text[i] == '+') {
+			i++
+		}
+		exponentStart := i
+		for i < len(text) && isDigit(text[i]) {
+			i++
+		}
+		if i == exponentStart {
+			return nil, 0, false
+		}
+	}
+	if i != len(text) {
+		return nil, 0, false
+	}
+
+	if isJSONNumber(text) {
+		return text, typ, true
+	}
+	if typ == yamlIntType {
+		// e.g. +35 or 007, which may be too big for an int64
+		var number []byte
+		if text[0] == '-' {
+			number = append(number, '-')
+		}
+		digits := bytes.TrimLeft(text[integralStart:], "0")
+		if len(digits) == 0 {
+			digits = []byte{'0'}
+		}
+		return append(number, digits...), typ, true
+	}
+	// the syntax has been checked, so an error means the number is out of range, and f is 0 or infinite
+	f, _ := strconv.ParseFloat(string(text), 64)
+	number, ok := appendFloatText(nil, f, 64)
+	if !ok {
+		return nullBytes, typ, true
+	}
+	return number, typ, true
+}
+
+// isJSONNumber says whether the text is a number as JSON writes them
+func isJSONNumber(text []byte) bool {
+	i := 0
+	if i < len(text) && text[i] == '-' {
+		i++
+	}
+	switch {
+	case i < len(text) && text[i] == '0':
+		i++
+	case i < len(text) && isDigit(text[i]):
+		for i < len(text) && isDigit(text[i]) {
+			i++
+		}
+	default:
+		return false
+	}
+	if i < len(text) && text[i] == '.' {
+		i++
+		if i == len(text) || !isDigit(text[i]) {
+			return false
+		}
+		for i < len(text) && isDigit(text[i]) {
+			i++
+		}
+	}
+	if i < len(text) && (text[i] == 'e' || text[i] == 'E') {
+		i++
+		if i < len(text) && (text[i] == '-' || text[i] == '+') {
+			i++
+		}
+		if i == len(text) || !isDigit(text[i]) {
+			return false
+		}
+		for i < len(text) && isDigit(text[i]) {
+			i++
+		}
+	}
+	return i == len(text)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// appendJSON writes a node as JSON
+func (n *yamlNode) appendJSON(dst []byte) []byte {
+	switch n.kind {
+	case yamlMapping:
+		dst = append(dst, '{')
+		for i, key := range n.keys {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendJSONString(dst, key)
+			dst = append(dst, ':')
+			dst = n.values[i].appendJSON(dst)
+		}
+		return append(dst, '}')
+	case yamlSequence:
+		dst = append(dst, '[')
+		for i, item := range n.values {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = item.appendJSON(dst)
+		}
+		return append(dst, ']')
+	}
+	if n.typ == yamlStrType {
+		return appendJSONString(dst, n.val[1:len(n.val)-1])
+	}
+	return append(dst, n.val...)
+}
+
+func appendJSONString(dst []byte, s []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	dst = append(dst, '"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c == '\n':
+			dst = append(dst, '\\', 'n')
+		case c == '\t':
+			dst = append(dst, '\\', 't')
+		case c < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"')
+}
+
+// nextContent moves from the start of a line to the next content, skipping empty lines and comments, which it
+// counts, and sets indent to the indentation of the line it's on, or to -1 if the document ends first
+func (p *yamlParser) nextContent() (int, error) {
+	emptyLines := 0
+	for {
+		lineStart := p.index
+		for p.ch() == ' ' {
+			p.index++
+		}
+		indentation := p.index - lineStart
+		p.skipSpace()
+		switch {
+		case p.index == len(p.src):
+			p.indent = -1
+			return emptyLines, nil
+		case isYAMLBreak(p.ch()):
+			p.skipBreak()
+			emptyLines++
+			continue
+		case p.ch() == '#':
+			p.skipToLineEnd()
+			p.skipBreak()
+			emptyLines++
+			continue
+		}
+		if p.index > lineStart+indentation {
+			return 0, p.error("tabs can't be used for indentation")
+		}
+		if indentation == 0 && (p.atMarker("---") || p.atMarker("...")) {
+			p.indent = -1
+			return emptyLines, nil
+		}
+		p.indent = indentation
+		return emptyLines, nil
+	}
+}
+
+// endLine skips the rest of a line, which may only hold a comment, and the line break
+func (p *yamlParser) endLine() error {
+	p.skipSpace()
+	if p.ch() == '#' && (p.index == 0 || isYAMLSpaceOrEnd(p.src[p.index-1])) {
+		p.skipToLineEnd()
+	}
+	if p.index == len(p.src) {
+		return nil
+	}
+	if !isYAMLBreak(p.ch()) {
+		return p.unexpected()
+	}
+	p.skipBreak()
+	return nil
+}
+
+// atLineEnd says whether there's nothing but blanks and perhaps a comment before the end of the line
+func (p *yamlParser) atLineEnd() bool {
+	return p.index == len(p.src) || isYAMLBreak(p.ch()) || p.ch() == '#'
+}
+
+// atLineStart says whether there's nothing but indentation before the parser on its line
+func (p *yamlParser) atLineStart() bool {
+	for i := p.index - 1; i >= 0 && !isYAMLBreak(p.src[i]); i-- {
+		if p.src[i] != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *yamlParser) column() int {
+	i := p.index
+	for i > 0 && !isYAMLBreak(p.src[i-1]) {
+		i--
+	}
+	return p.index - i
+}
+
+// atMarker says whether the parser is at a document marker, i.e. --- or ...
+func (p *yamlParser) atMarker(marker string) bool {
+	return p.column() == 0 && bytes.HasPrefix(p.src[p.index:], []byte(marker)) &&
+		isYAMLSpaceOrEnd(p.at(p.index+len(marker)))
+}
+
+// seqEntry says whether the parser is at the "-" of a block sequence item
+func (p *yamlParser) seqEntry() bool {
+	return p.ch() == '-' && isYAMLSpaceOrEnd(p.at(p.index+1))
+}
+
+func (p *yamlParser) skipSpace() {
+	for isYAMLBlank(p.ch()) {
+		p.index++
+	}
+}
+
+// skipFlowSpace skips whitespace, line breaks, and comments, which can be anywhere between flow nodes
+func (p *yamlParser) skipFlowSpace() {
+	for p.index < len(p.src) {
+		c := p.src[p.index]
+		switch {
+		case isYAMLBlank(c) || isYAMLBreak(c):
+			p.index++
+		case c == '#':
+			p.skipToLineEnd()
+		default:
+			return
+		}
+	}
+}
+
+func (p *yamlParser) skipToLineEnd() {
+	for p.index < len(p.src) && !isYAMLBreak(p.src[p.index]) {
+		p.index++
+	}
+}
+
+func (p *yamlParser) skipBreak() {
+	if p.ch() == '\r' {
+		p.index++
+	}
+	if p.ch() == '\n' {
+		p.index++
+	}
+}
+
+func (p *yamlParser) enter() error {
+	p.depth++
+	if p.depth > maxYAMLDepth {
+		return p.error("YAML nested too deeply")
+	}
+	return nil
+}
+
+func (p *yamlParser) leave() {
+	p.depth--
+}
+
+// ch returns the byte the parser is at, or 0 at the end
+func (p *yamlParser) ch() byte {
+	return p.at(p.index)
+}
+
+func (p *yamlParser) at(i int) byte {
+	if i < len(p.src) {
+		return p.src[i]
+	}
+	return 0
+}
+
+func (p *yamlParser) unexpected() error {
+	if p.index == len(p.src) {
+		return p.error("unexpected end of YAML")
+	}
+	return p.error(fmt.Sprintf("unexpected '%c'", p.ch()))
+}
+
+func (p *yamlParser) error(message string) error {
+	// let's be helpful and let them know where the error is
+	lineNum := 1
+	lastLineStart := 0
+	for i := 0; i < p.index && i < len(p.src); i++ {
+		if p.src[i] == '\n' {
+			lineNum++
+			lastLineStart = i
+		}
+	}
+	return fmt.Errorf("at line %d col %d: %s", lineNum, p.index-lastLineStart, message)
+}
+
+func isYAMLBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isYAMLBreak(c byte) bool {
+	return c == '\n' || c == '\r'
+}
+
+// isYAMLSpaceOrEnd says whether c, which is 0 at the end of the input, ends something like a "-" or ":"
+func isYAMLSpaceOrEnd(c byte) bool {
+	return c == 0 || isYAMLBlank(c) || isYAMLBreak(c)
+}
+
+func isYAMLFlowIndicator(c byte) bool {
+	return c == ',' || c == '[' || c == ']' || c == '{' || c == '}'
+}
@@ -0,0 +1,146 @@
+package quamina
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		yaml string
+		json string
+	}{
+		{"a: 1", `{"a":1}`},
+		{"a: 1\nb: two\n", `{"a":1,"b":"two"}`},
+		{"# comment\n\na: 1 # trailing\n\n# another\nb: 2", `{"a":1,"b":2}`},
+		{"---\na: 1\n...\n", `{"a":1}`},
+		{"%YAML 1.2\n---\na: 1", `{"a":1}`},
+		{"--- {a: 1}", `{"a":1}`},
+		{"\xef\xbb\xbfa: 1", `{"a":1}`},
+		{"a:\n  b:\n    c: x\n  d: y\ne: z", `{"a":{"b":{"c":"x"},"d":"y"},"e":"z"}`},
+		{"a:\n- 1\n- 2\nb: 3", `{"a":[1,2],"b":3}`},
+		{"a:\n  - 1\n  - - 2\n    - 3\n  -\n    b: 4", `{"a":[1,[2,3],{"b":4}]}`},
+		{"- a: 1\n  b: 2\n- c: 3", `[{"a":1,"b":2},{"c":3}]`},
+		{"a:\nb: ~\nc: null\nd: Null", `{"a":null,"b":null,"c":null,"d":null}`},
+		{"a: true\nb: False\nc: TRUE\nd: yes\ne: 'true'", `{"a":true,"b":false,"c":true,"d":"yes","e":"true"}`},
+		{"a: 35\nb: -3.5e2\nc: +12\nd: 007\ne: .5\nf: 1.\ng: 0x1F\nh: 0o17\ni: 1_000",
+			`{"a":35,"b":-3.5e2,"c":12,"d":7,"e":0.5,"f":1,"g":31,"h":15,"i":"1_000"}`},
+		{"a: 12345678901234567890123\nb: -00", `{"a":12345678901234567890123,"b":-0}`},
+		{"a: '35'\nb: \"x\"\nc: 'it''s'\nd: \"tab\\there\\u00e9\\x41\\\"\"", `{"a":"35","b":"x","c":"it's","d":"tab\there` + "\u00e9" + `A\""}`},
+		{"a: hello world\nb: http://example.com/x#y\nc: a:b", `{"a":"hello world","b":"http://example.com/x#y","c":"a:b"}`},
+		{"a: multi\n  line\n\n  plain\nb: 1", `{"a":"multi line\nplain","b":1}`},
+		{"a: 'multi\n  line\n\n  single'", `{"a":"multi line\nsingle"}`},
+		{"a: \"esc\\\n  aped\"", `{"a":"escaped"}`},
+		{"a: |\n  line 1\n  line 2\n\nb: 1", `{"a":"line 1\nline 2\n","b":1}`},
+		{"a: |-\n  line 1\n   indented\n", `{"a":"line 1\n indented"}`},
+		{"a: |+\n  kept\n\n\nb: 1", `{"a":"kept\n\n\n","b":1}`},
+		{"a: >\n  folded\n  text\n\n  para\n", `{"a":"folded text\npara\n"}`},
+		{"a: >\n  folded\n    more\n  back\n", `{"a":"folded\n  more\nback\n"}`},
+		{"a: |2\n   three\n", `{"a":" three\n"}`},
+		{"- |\n  in seq\n- x", `["in seq\n","x"]`},
+		{"a: [1, two, \"three\", [4], {five: 5}]", `{"a":[1,"two","three",[4],{"five":5}]}`},
+		{"a: {b: 1, c: [x, y], d}", `{"a":{"b":1,"c":["x","y"],"d":null}}`},
+		{"a: [\n  1, # one\n  2,\n]", `{"a":[1,2]}`},
+		{`{"a": {"b": [1, "x", null, true]}, "c":2}`, `{"a":{"b":[1,"x",null,true]},"c":2}`},
+		{"a: {b:1}", `{"a":{"b:1":null}}`},
+		{"a: &x\n  b: 1\nc: *x\nd: &y 5\ne: *y", `{"a":{"b":1},"c":{"b":1},"d":5,"e":5}`},
+		{"base: &base\n  a: 1\n  b: 2\nderived:\n  <<: *base\n  b: 3", `{"base":{"a":1,"b":2},"derived":{"b":3,"a":1}}`},
+		{"x: &x {a: 1}\ny: &y {a: 2, b: 2}\nz:\n  <<: [*x, *y]", `{"x":{"a":1},"y":{"a":2,"b":2},"z":{"a":1,"b":2}}`},
+		{"a: !!str 35\nb: !!int '35'\nc: !custom 35\nd: ! 35\ne: !<tag:yaml.org,2002:str> true", `{"a":"35","b":35,"c":35,"d":"35","e":"true"}`},
+		{"\"quoted key\": 1\n'single': 2\n3: three", `{"quoted key":1,"single":2,"3":"three"}`},
+		{"a: \"x\" # comment", `{"a":"x"}`},
+		{"a:\r\n  b: 1\r\n", `{"a":{"b":1}}`},
+		{"a: 'x\"y\\z'", `{"a":"x\"y\\z"}`},
+		{"", `null`},
+		{"- a\n- b", `["a","b"]`},
+	}
+	for _, test := range tests {
+		converted, err := yamlToJSON([]byte(test.yaml))
+		if err != nil {
+			t.Errorf("%q: %s", test.yaml, err.Error())
+			continue
+		}
+		if string(converted) != test.json {
+			t.Errorf("%q: wanted %s got %s", test.yaml, test.json, converted)
+		}
+	}
+}
+
+func TestYAMLErrors(t *testing.T) {
+	bads := []string{
+		"a: 1\n b: 2",
+		"a:\n  b: 1\n c: 2",
+		"a: b: c",
+		"a: 'unterminated",
+		"a: \"bad \\q escape\"",
+		"a: [1, 2",
+		"a: {b: 1",
+		"a: *nope",
+		"a: !!int x",
+		"a: !!bool 1",
+		"a: !!null x",
+		"a: 1\n---\nb: 2",
+		"a: 1\n...\nb: 2",
+		"- a\nb: 1",
+		"a: 1\n- b",
+		"a:\n\t- b",
+		"a: @x",
+		"key without colon\nb: 1",
+		"x: &x {a: 1}\ny:\n  <<: 5",
+		"a: " + strings.Repeat("[", maxYAMLDepth+1),
+		"a: \xff\n",
+		"a: .inf",
+		"a: [1, -.Inf]",
+		"a:\n  b: .NaN",
+		"a: 1\nb: 2\na: 3",
+		"a: {b: 1, b: 2}",
+	}
+	for _, bad := range bads {
+		if _, err := yamlToJSON([]byte(bad)); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+
+	// aliases that refer to aliases can expand exponentially
+	laughs := "a: &a [x, x, x, x, x, x, x, x, x, x]\n"
+	for i := 'b'; i <= 'j'; i++ {
+		prev := string(i - 1)
+		laughs += string(i) + ": &" + string(i) + " [*" + prev + strings.Repeat(", *"+prev, 9) + "]\n"
+	}
+	_, err := yamlToJSON([]byte(laughs))
+	if err == nil || !strings.Contains(err.Error(), "expand") {
+		t.Errorf("billion laughs: %v", err)
+	}
+}
+
+func TestYAMLPatterns(t *testing.T) {
+	pairs := []struct {
+		yaml string
+		json string
+	}{
+		{"a: [1, x]", `{"a": [1, "x"]}`},
+		{"a:\n  b: [ {exists: true} ]\nc: [ {prefix: pre} ]", `{"a": {"b": [ {"exists": true} ]}, "c": [ {"prefix": "pre"} ]}`},
+		{"x:\n  - numeric: ['<', 100, '>=', 0]", `{"x": [ {"numeric": ["<", 100, ">=", 0]} ]}`},
+		{"x: [ {anything-but: [1, 2]} ]\ny: [ {shellstyle: '*.jpg'} ]", `{"x": [ {"anything-but": [1, 2]} ], "y": [ {"shellstyle": "*.jpg"} ]}`},
+		{"x: [ {regexp: \"a\\\\.b\"} ]", `{"x": [ {"regexp": "a\\.b"} ]}`},
+		{"x: [null, true, \"35\"]", `{"x": [null, true, "35"]}`},
+	}
+	for _, pair := range pairs {
+		converted, err := yamlToJSON([]byte(pair.yaml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromYAML, err := patternsFromJSON(converted)
+		if err != nil {
+			t.Fatalf("%q: %s", pair.yaml, err.Error())
+		}
+		fromJSON, err := patternsFromJSON([]byte(pair.json))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fromYAML, fromJSON) {
+			t.Errorf("%q: %v != %v", pair.yaml, fromYAML, fromJSON)
+		}
+	}
+}